@@ -0,0 +1,123 @@
+package filter
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy"
+)
+
+// Buffers which grew larger than this are not returned to the pool to prevent
+// single huge responses from pinning memory forever.
+const maximumPooledBufferCapacity = 1024 * 1024
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+func acquireBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+func releaseBuffer(buffer *bytes.Buffer) {
+	if buffer == nil || buffer.Cap() > maximumPooledBufferCapacity {
+		return
+	}
+	buffer.Reset()
+	bufferPool.Put(buffer)
+}
+
+type bufferBudgetPolicy string
+
+const (
+	bufferBudgetPolicyBypass = bufferBudgetPolicy("bypass")
+	bufferBudgetPolicyWait   = bufferBudgetPolicy("wait")
+	bufferBudgetPolicyReject = bufferBudgetPolicy("reject")
+)
+
+var possibleBufferBudgetPolicies = []bufferBudgetPolicy{
+	bufferBudgetPolicyBypass,
+	bufferBudgetPolicyWait,
+	bufferBudgetPolicyReject,
+}
+
+// bufferBudgetStorageKey addresses the budget of the current caddy instance which limits the
+// memory of all filtered responses of all sites. A restart of caddy creates a new instance
+// and therefore a new budget.
+const bufferBudgetStorageKey = storageKey("filter.bufferBudget")
+
+func bufferBudgetOf(controller *caddy.Controller) *bufferBudget {
+	if result, ok := controller.Get(bufferBudgetStorageKey).(*bufferBudget); ok {
+		return result
+	}
+	result := newBufferBudget()
+	controller.Set(bufferBudgetStorageKey, result)
+	return result
+}
+
+type bufferBudget struct {
+	mutex   sync.Mutex
+	limit   int64
+	used    int64
+	changed chan struct{}
+}
+
+func newBufferBudget() *bufferBudget {
+	return &bufferBudget{
+		changed: make(chan struct{}),
+	}
+}
+
+// acquire reserves the given amount of bytes. If not enough bytes are available it waits up
+// to the given duration for other responses to release their bytes before it gives up.
+func (instance *bufferBudget) acquire(n int, wait time.Duration) bool {
+	deadline := time.Now().Add(wait)
+	for {
+		instance.mutex.Lock()
+		if instance.limit <= 0 || instance.used+int64(n) <= instance.limit {
+			instance.used += int64(n)
+			instance.mutex.Unlock()
+			return true
+		}
+		changed := instance.changed
+		instance.mutex.Unlock()
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return false
+		}
+		timer := time.NewTimer(remaining)
+		select {
+		case <-changed:
+			timer.Stop()
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+func (instance *bufferBudget) release(n int) {
+	if n <= 0 {
+		return
+	}
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	instance.used -= int64(n)
+	close(instance.changed)
+	instance.changed = make(chan struct{})
+}
+
+func (instance *bufferBudget) setLimit(limit int64) {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	instance.limit = limit
+}
+
+func (instance *bufferBudget) usage() (used int64, limit int64) {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	return instance.used, instance.limit
+}
@@ -0,0 +1,59 @@
+package filter
+
+import (
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+type buffersTest struct{}
+
+func init() {
+	Suite(&buffersTest{})
+}
+
+func (s *buffersTest) Test_acquireAndReleaseBuffer(c *C) {
+	buffer := acquireBuffer()
+	c.Assert(buffer, NotNil)
+	buffer.WriteString("foo")
+	releaseBuffer(buffer)
+	c.Assert(buffer.Len(), Equals, 0)
+	releaseBuffer(nil)
+}
+
+func (s *buffersTest) Test_bufferBudget(c *C) {
+	budget := newBufferBudget()
+	c.Assert(budget.acquire(1000, 0), Equals, true)
+	used, limit := budget.usage()
+	c.Assert(used, Equals, int64(1000))
+	c.Assert(limit, Equals, int64(0))
+
+	budget.setLimit(1500)
+	c.Assert(budget.acquire(400, 0), Equals, true)
+	c.Assert(budget.acquire(200, 0), Equals, false)
+	used, limit = budget.usage()
+	c.Assert(used, Equals, int64(1400))
+	c.Assert(limit, Equals, int64(1500))
+
+	budget.release(1000)
+	c.Assert(budget.acquire(200, 0), Equals, true)
+	used, _ = budget.usage()
+	c.Assert(used, Equals, int64(600))
+}
+
+func (s *buffersTest) Test_bufferBudget_wait(c *C) {
+	budget := newBufferBudget()
+	budget.setLimit(100)
+	c.Assert(budget.acquire(100, 0), Equals, true)
+
+	started := time.Now()
+	c.Assert(budget.acquire(50, 20*time.Millisecond), Equals, false)
+	c.Assert(time.Since(started) >= 20*time.Millisecond, Equals, true)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		budget.release(100)
+	}()
+	c.Assert(budget.acquire(50, 5*time.Second), Equals, true)
+	used, _ := budget.usage()
+	c.Assert(used, Equals, int64(50))
+}
@@ -0,0 +1,97 @@
+package filter
+
+import (
+	"bytes"
+	"mime"
+	"regexp"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+)
+
+const charsetMetaScanLimit = 1024
+
+var metaCharsetPattern = regexp.MustCompile("(?i)<meta[^>]+charset\\s*=\\s*[\"']?\\s*([a-zA-Z0-9_\\-.:]+)")
+var xmlEncodingPattern = regexp.MustCompile("^\\s*<\\?xml\\s[^>]*?encoding\\s*=\\s*[\"']([a-zA-Z0-9_\\-.:]+)[\"']")
+
+type outputCharset string
+
+const (
+	outputCharsetOriginal = outputCharset("original")
+	outputCharsetUtf8     = outputCharset("utf-8")
+)
+
+var possibleOutputCharsets = []outputCharset{
+	outputCharsetOriginal,
+	outputCharsetUtf8,
+}
+
+// detectCharsetOf returns the encoding of the given content by looking at (in this order) a present
+// byte order mark, the charset parameter of the given content type, a <meta> tag in HTML documents
+// and the encoding of the declaration of XML documents.
+// If the content is already UTF-8 encoded or the charset is unknown nil is returned.
+func detectCharsetOf(contentType string, content []byte) (encoding.Encoding, string) {
+	if bytes.HasPrefix(content, []byte{0xEF, 0xBB, 0xBF}) {
+		return nil, "utf-8"
+	}
+	if bytes.HasPrefix(content, []byte{0xFF, 0xFE}) {
+		return unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM), "utf-16le"
+	}
+	if bytes.HasPrefix(content, []byte{0xFE, 0xFF}) {
+		return unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM), "utf-16be"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err == nil {
+		if label, ok := params["charset"]; ok {
+			return charsetByLabel(label)
+		}
+	}
+	scope := content
+	if len(scope) > charsetMetaScanLimit {
+		scope = scope[:charsetMetaScanLimit]
+	}
+	if err == nil && isHtmlMediaType(mediaType) {
+		if groups := metaCharsetPattern.FindSubmatch(scope); groups != nil {
+			return charsetByLabel(string(groups[1]))
+		}
+	}
+	if err == nil && isXmlMediaType(mediaType) {
+		if groups := xmlEncodingPattern.FindSubmatch(scope); groups != nil {
+			return charsetByLabel(string(groups[1]))
+		}
+	}
+	return nil, ""
+}
+
+func charsetByLabel(label string) (encoding.Encoding, string) {
+	result, err := htmlindex.Get(label)
+	if err != nil {
+		return nil, ""
+	}
+	name, err := htmlindex.Name(result)
+	if err != nil || name == "utf-8" {
+		return nil, name
+	}
+	return result, name
+}
+
+func isHtmlMediaType(mediaType string) bool {
+	mediaType = strings.ToLower(mediaType)
+	return mediaType == "text/html" || mediaType == "application/xhtml+xml"
+}
+
+func isXmlMediaType(mediaType string) bool {
+	mediaType = strings.ToLower(mediaType)
+	return mediaType == "text/xml" || mediaType == "application/xml" || strings.HasSuffix(mediaType, "+xml")
+}
+
+func contentTypeWithCharset(contentType string, charset string) string {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+	params["charset"] = charset
+	return mime.FormatMediaType(mediaType, params)
+}
@@ -0,0 +1,71 @@
+package filter
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type charsetTest struct{}
+
+func init() {
+	Suite(&charsetTest{})
+}
+
+func (s *charsetTest) Test_detectCharsetOf(c *C) {
+	charset, name := detectCharsetOf("text/plain; charset=ISO-8859-1", []byte("foo"))
+	c.Assert(charset, NotNil)
+	c.Assert(name, Equals, "windows-1252")
+
+	charset, name = detectCharsetOf("text/html; charset=Shift_JIS", []byte("foo"))
+	c.Assert(charset, NotNil)
+	c.Assert(name, Equals, "shift_jis")
+
+	charset, name = detectCharsetOf("text/html", []byte("<html><head><meta charset=\"iso-8859-15\"></head></html>"))
+	c.Assert(charset, NotNil)
+	c.Assert(name, Equals, "iso-8859-15")
+
+	charset, name = detectCharsetOf("text/html", []byte("<meta http-equiv=\"Content-Type\" content=\"text/html; charset=windows-1251\">"))
+	c.Assert(charset, NotNil)
+	c.Assert(name, Equals, "windows-1251")
+
+	charset, name = detectCharsetOf("text/plain", []byte("<meta charset=\"iso-8859-15\">"))
+	c.Assert(charset, IsNil)
+	c.Assert(name, Equals, "")
+
+	charset, name = detectCharsetOf("application/rss+xml", []byte("<?xml version=\"1.0\" encoding='ISO-8859-15'?><rss/>"))
+	c.Assert(charset, NotNil)
+	c.Assert(name, Equals, "iso-8859-15")
+
+	charset, name = detectCharsetOf("text/plain", []byte("<?xml version=\"1.0\" encoding=\"ISO-8859-15\"?>"))
+	c.Assert(charset, IsNil)
+	c.Assert(name, Equals, "")
+
+	charset, name = detectCharsetOf("text/html; charset=ISO-8859-1", []byte{0xFF, 0xFE, 'a', 0})
+	c.Assert(charset, NotNil)
+	c.Assert(name, Equals, "utf-16le")
+
+	charset, name = detectCharsetOf("", []byte{0xFE, 0xFF, 0, 'a'})
+	c.Assert(charset, NotNil)
+	c.Assert(name, Equals, "utf-16be")
+
+	charset, name = detectCharsetOf("text/html; charset=ISO-8859-1", []byte{0xEF, 0xBB, 0xBF, 'a'})
+	c.Assert(charset, IsNil)
+	c.Assert(name, Equals, "utf-8")
+
+	charset, name = detectCharsetOf("text/html; charset=utf-8", []byte("foo"))
+	c.Assert(charset, IsNil)
+	c.Assert(name, Equals, "utf-8")
+
+	charset, name = detectCharsetOf("text/html; charset=foo", []byte("foo"))
+	c.Assert(charset, IsNil)
+	c.Assert(name, Equals, "")
+
+	charset, name = detectCharsetOf("", []byte("foo"))
+	c.Assert(charset, IsNil)
+	c.Assert(name, Equals, "")
+}
+
+func (s *charsetTest) Test_contentTypeWithCharset(c *C) {
+	c.Assert(contentTypeWithCharset("text/html; charset=ISO-8859-1", "utf-8"), Equals, "text/html; charset=utf-8")
+	c.Assert(contentTypeWithCharset("text/plain", "utf-8"), Equals, "text/plain; charset=utf-8")
+	c.Assert(contentTypeWithCharset("", "utf-8"), Equals, "")
+}
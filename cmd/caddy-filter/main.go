@@ -0,0 +1,182 @@
+// Command caddy-filter applies the rules of a filter configuration to a file without
+// running Caddy. It uses the same parser like the filter directive of the Caddyfile.
+//
+//	caddy-filter -config rules.caddy -path /index.html index.html
+//	caddy-filter -config rules.yaml -expect expected.html index.html
+//
+// Exit codes: 0 on success, 1 if -diff or -expect found differences and 2 on errors.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/echocat/caddy-filter/filtertest"
+	"github.com/echocat/caddy-filter/internal/diff"
+)
+
+const (
+	exitOk          = 0
+	exitDifferences = 1
+	exitError       = 2
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("caddy-filter", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: caddy-filter -config <file> [options] [<input file>|-]\n\nOptions:\n")
+		flags.PrintDefaults()
+	}
+	config := flags.String("config", "", "File with 'filter' directives of a Caddyfile or a rule file (.yaml, .json, or Caddyfile syntax). (required)")
+	method := flags.String("method", "GET", "Method of the simulated request.")
+	path := flags.String("path", "", "Path of the simulated request. (Default: '/' followed by the name of the input file)")
+	contentType := flags.String("content_type", "", "Content type of the simulated response. (Default: derived from extension or content of the input file)")
+	status := flags.Int("status", http.StatusOK, "Status of the simulated response.")
+	requestHeader := headerFlag{}
+	flags.Var(requestHeader, "header", "Header of the simulated request like 'Name: value'. Could be repeated.")
+	responseHeader := headerFlag{}
+	flags.Var(responseHeader, "response_header", "Header of the simulated response like 'Name: value'. Could be repeated.")
+	diff := flags.Bool("diff", false, "Print an unified diff between input and output instead of the output.")
+	expect := flags.String("expect", "", "File with the expected output. If the output differs an unified diff is printed.")
+	verbose := flags.Bool("v", false, "Print the decisions of the filter to stderr.")
+	if err := flags.Parse(args); err != nil {
+		return exitError
+	}
+	if *config == "" || flags.NArg() > 1 {
+		flags.Usage()
+		return exitError
+	}
+	inputName := "-"
+	if flags.NArg() == 1 {
+		inputName = flags.Arg(0)
+	}
+
+	instance, err := filtertest.ParseFilter(*config)
+	if err != nil {
+		fmt.Fprintf(stderr, "Could not load filter configuration '%v'. Got: %v\n", *config, err)
+		return exitError
+	}
+	input, err := readInput(inputName, stdin)
+	if err != nil {
+		fmt.Fprintf(stderr, "Could not read input '%v'. Got: %v\n", inputName, err)
+		return exitError
+	}
+
+	simulation := filtertest.Simulation{
+		Method:         *method,
+		Path:           *path,
+		RequestHeader:  http.Header(requestHeader),
+		Status:         *status,
+		ResponseHeader: http.Header(responseHeader),
+		Body:           input,
+	}
+	if simulation.Path == "" && inputName != "-" {
+		simulation.Path = "/" + filepath.Base(inputName)
+	}
+	if *contentType != "" {
+		simulation.ResponseHeader.Set("Content-Type", *contentType)
+	} else if simulation.ResponseHeader.Get("Content-Type") == "" {
+		simulation.ResponseHeader.Set("Content-Type", contentTypeOf(inputName, input))
+	}
+
+	result, err := instance.Apply(simulation)
+	if err != nil {
+		fmt.Fprintf(stderr, "Could not apply filter. Got: %v\n", err)
+		return exitError
+	}
+	if *verbose {
+		printDecisions(stderr, result)
+	}
+
+	if *expect != "" {
+		expected, err := ioutil.ReadFile(*expect)
+		if err != nil {
+			fmt.Fprintf(stderr, "Could not read expected output '%v'. Got: %v\n", *expect, err)
+			return exitError
+		}
+		return printDiff(stdout, *expect, "output", expected, result.Body)
+	}
+	if *diff {
+		return printDiff(stdout, inputName, "output", input, result.Body)
+	}
+	if _, err := stdout.Write(result.Body); err != nil {
+		fmt.Fprintf(stderr, "Could not write output. Got: %v\n", err)
+		return exitError
+	}
+	return exitOk
+}
+
+func readInput(name string, stdin io.Reader) ([]byte, error) {
+	if name == "-" {
+		return ioutil.ReadAll(stdin)
+	}
+	return ioutil.ReadFile(name)
+}
+
+func contentTypeOf(name string, content []byte) string {
+	if name != "-" {
+		if result := mime.TypeByExtension(filepath.Ext(name)); result != "" {
+			return result
+		}
+	}
+	return http.DetectContentType(content)
+}
+
+func printDecisions(w io.Writer, result *filtertest.SimulationResult) {
+	fmt.Fprintf(w, "Status:        %d\n", result.Status)
+	if len(result.MatchedRules) > 0 {
+		fmt.Fprintf(w, "Matched rules: %v\n", strings.Join(result.MatchedRules, ", "))
+	} else {
+		fmt.Fprintf(w, "Matched rules: <none>\n")
+	}
+	fmt.Fprintf(w, "Replacements:  %d\n", result.Replacements)
+	if result.SkippedReason != "" {
+		fmt.Fprintf(w, "Skipped:       %v\n", result.SkippedReason)
+	}
+	if result.DecodeFailure != "" {
+		fmt.Fprintf(w, "Decode failed: %v\n", result.DecodeFailure)
+	}
+}
+
+func printDiff(w io.Writer, nameA string, nameB string, a []byte, b []byte) int {
+	if bytes.Equal(a, b) {
+		return exitOk
+	}
+	fmt.Fprint(w, diff.Unified(nameA, nameB, a, b))
+	return exitDifferences
+}
+
+// headerFlag collects repeated header flags like 'Name: value'.
+type headerFlag http.Header
+
+func (instance headerFlag) String() string {
+	var result []string
+	for key, values := range instance {
+		for _, value := range values {
+			result = append(result, key+": "+value)
+		}
+	}
+	return strings.Join(result, ", ")
+}
+
+func (instance headerFlag) Set(plain string) error {
+	parts := strings.SplitN(plain, ":", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return fmt.Errorf("illegal header '%v', expected 'Name: value'", plain)
+	}
+	http.Header(instance).Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	return nil
+}
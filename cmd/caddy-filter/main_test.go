@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	. "gopkg.in/check.v1"
+	"strings"
+)
+
+type mainTest struct{}
+
+func init() {
+	Suite(&mainTest{})
+}
+
+const (
+	testRules    = "../../resources/test/cli/rules.caddy"
+	testInput    = "../../resources/test/cli/input.html"
+	testExpected = "../../resources/test/cli/expected.html"
+)
+
+func (s *mainTest) run(stdin string, args ...string) (int, string, string) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	code := run(args, strings.NewReader(stdin), stdout, stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func (s *mainTest) Test_output(c *C) {
+	code, stdout, stderr := s.run("", "-config", testRules, "-header", "X-Name: Tom", "-v", testInput)
+	c.Assert(code, Equals, exitOk)
+	c.Assert(stdout, Equals, "<html>\n<body>\nBye Tom\n</body>\n</html>\n")
+	c.Assert(stderr, Equals, "Status:        200\nMatched rules: greeting\nReplacements:  1\n")
+}
+
+func (s *mainTest) Test_outputOfStdin(c *C) {
+	code, stdout, _ := s.run("Hello", "-config", testRules, "-path", "/index.html", "-content_type", "text/html")
+	c.Assert(code, Equals, exitOk)
+	c.Assert(stdout, Equals, "Bye ")
+
+	code, stdout, _ = s.run("Hello", "-config", testRules, "-path", "/index.txt")
+	c.Assert(code, Equals, exitOk)
+	c.Assert(stdout, Equals, "Hello")
+}
+
+func (s *mainTest) Test_diff(c *C) {
+	code, stdout, _ := s.run("", "-config", testRules, "-diff", testInput)
+	c.Assert(code, Equals, exitDifferences)
+	c.Assert(stdout, Equals, "--- "+testInput+"\n+++ output\n@@ -1,5 +1,5 @@\n <html>\n <body>\n-Hello\n+Bye \n </body>\n </html>\n")
+
+	code, stdout, _ = s.run("", "-config", testRules, "-diff", "-path", "/input.txt", testInput)
+	c.Assert(code, Equals, exitOk)
+	c.Assert(stdout, Equals, "")
+}
+
+func (s *mainTest) Test_expect(c *C) {
+	code, stdout, _ := s.run("", "-config", testRules, "-header", "X-Name: Tom", "-expect", testExpected, testInput)
+	c.Assert(code, Equals, exitOk)
+	c.Assert(stdout, Equals, "")
+
+	code, stdout, _ = s.run("", "-config", testRules, "-header", "X-Name: Tim", "-expect", testExpected, testInput)
+	c.Assert(code, Equals, exitDifferences)
+	c.Assert(stdout, Equals, "--- "+testExpected+"\n+++ output\n@@ -1,5 +1,5 @@\n <html>\n <body>\n-Bye Tom\n+Bye Tim\n </body>\n </html>\n")
+}
+
+func (s *mainTest) Test_errors(c *C) {
+	code, _, stderr := s.run("")
+	c.Assert(code, Equals, exitError)
+	c.Assert(stderr, Matches, "(?s)Usage: caddy-filter.*")
+
+	code, _, stderr = s.run("", "-config", "../../resources/test/cli/missing.caddy", testInput)
+	c.Assert(code, Equals, exitError)
+	c.Assert(stderr, Matches, "Could not load filter configuration '../../resources/test/cli/missing.caddy'. Got: .*\n")
+
+	code, _, stderr = s.run("", "-config", testRules, "../../resources/test/cli/missing.html")
+	c.Assert(code, Equals, exitError)
+	c.Assert(stderr, Matches, "Could not read input '../../resources/test/cli/missing.html'. Got: .*\n")
+
+	code, _, stderr = s.run("", "-config", testRules, "-header", "illegal", testInput)
+	c.Assert(code, Equals, exitError)
+	c.Assert(stderr, Matches, "(?s)invalid value \"illegal\" for flag -header: illegal header 'illegal', expected 'Name: value'.*")
+}
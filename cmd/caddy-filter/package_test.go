@@ -0,0 +1,10 @@
+package main
+
+import (
+	. "gopkg.in/check.v1"
+	"testing"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
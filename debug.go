@@ -0,0 +1,38 @@
+package filter
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+const (
+	debugRequestHeader       = "X-Filter-Debug"
+	debugMatchedHeader       = "X-Filter-Matched"
+	debugReplacementsHeader  = "X-Filter-Replacements"
+	debugSkippedReasonHeader = "X-Filter-Skipped-Reason"
+	debugDecodeFailureHeader = "X-Filter-Decode-Failure"
+)
+
+type skipReason string
+
+const (
+	skipReasonWebsocket            = skipReason("websocket")
+	skipReasonNoRuleMatched        = skipReason("no-rule-matched")
+	skipReasonBufferOverflow       = skipReason("buffer-overflow")
+	skipReasonBodyNotAllowed       = skipReason("body-not-allowed")
+	skipReasonNothingToWrite       = skipReason("nothing-recorded")
+	skipReasonUpstreamError        = skipReason("upstream-error")
+	skipReasonTimeout              = skipReason("timeout")
+	skipReasonTotalBufferExhausted = skipReason("total-buffer-exhausted")
+	skipReasonRejected             = skipReason("rejected")
+	skipReasonPipeFailure          = skipReason("pipe-failure")
+)
+
+// isDebugRequested returns true if the request carries the configured debug token.
+func isDebugRequested(request *http.Request, token string) bool {
+	if token == "" || request == nil {
+		return false
+	}
+	provided := request.Header.Get(debugRequestHeader)
+	return subtle.ConstantTimeCompare([]byte(provided), []byte(token)) == 1
+}
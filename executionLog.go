@@ -0,0 +1,193 @@
+package filter
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+const (
+	executionLogOutputCaddy  = "caddy"
+	executionLogOutputStdout = "stdout"
+	executionLogOutputStderr = "stderr"
+)
+
+const (
+	executionLogSampleContext   = 40
+	executionLogSampleMaxLength = 200
+)
+
+// executionLog writes one JSON line per evaluated rule of a filtered response.
+type executionLog struct {
+	mutex      sync.Mutex
+	writer     io.Writer
+	closer     io.Closer
+	sampleRate float64
+	random     func() float64
+}
+
+type executionLogEntry struct {
+	Time         string              `json:"time"`
+	RequestId    string              `json:"request_id,omitempty"`
+	Method       string              `json:"method,omitempty"`
+	Path         string              `json:"path,omitempty"`
+	Rule         string              `json:"rule"`
+	Mode         string              `json:"mode,omitempty"`
+	Matched      bool                `json:"matched"`
+	Replacements int                 `json:"replacements"`
+	SizeBefore   int                 `json:"size_before"`
+	SizeAfter    int                 `json:"size_after"`
+	DurationMs   float64             `json:"duration_ms"`
+	Sample       *executionLogSample `json:"sample,omitempty"`
+}
+
+// executionLogSample is an excerpt of the first change a rule did (or would have done) to a body.
+type executionLogSample struct {
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+func newExecutionLog(output string, sampleRate float64) (*executionLog, error) {
+	result := &executionLog{
+		sampleRate: sampleRate,
+		random:     rand.Float64,
+	}
+	switch output {
+	case executionLogOutputCaddy:
+	case executionLogOutputStdout:
+		result.writer = os.Stdout
+	case executionLogOutputStderr:
+		result.writer = os.Stderr
+	default:
+		f, err := os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		result.writer = f
+		result.closer = f
+	}
+	return result, nil
+}
+
+// sample decides if the rule executions of the current response should be logged.
+func (instance *executionLog) sample() bool {
+	if instance == nil {
+		return false
+	}
+	if instance.sampleRate >= 1 {
+		return true
+	}
+	return instance.random() < instance.sampleRate
+}
+
+func (instance *executionLog) record(request *http.Request, ruleName string, matched bool, replacements int, sizeBefore int, sizeAfter int, duration time.Duration) {
+	instance.write(request, executionLogEntry{
+		Rule:         ruleName,
+		Matched:      matched,
+		Replacements: replacements,
+		SizeBefore:   sizeBefore,
+		SizeAfter:    sizeAfter,
+		DurationMs:   float64(duration) / float64(time.Millisecond),
+	})
+}
+
+// recordShadow records the execution of a rule in shadow mode with the size and an excerpt
+// of the body the rule would have produced.
+func (instance *executionLog) recordShadow(request *http.Request, ruleName string, replacements int, before []byte, after []byte, duration time.Duration) {
+	instance.write(request, executionLogEntry{
+		Rule:         ruleName,
+		Mode:         string(ruleModeShadow),
+		Matched:      true,
+		Replacements: replacements,
+		SizeBefore:   len(before),
+		SizeAfter:    len(after),
+		DurationMs:   float64(duration) / float64(time.Millisecond),
+		Sample:       sampleOfChange(before, after),
+	})
+}
+
+func (instance *executionLog) write(request *http.Request, entry executionLogEntry) {
+	entry.Time = time.Now().Format(time.RFC3339Nano)
+	entry.RequestId = requestIdOf(request)
+	if request != nil {
+		entry.Method = request.Method
+		if request.URL != nil {
+			entry.Path = request.URL.Path
+		}
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("[WARN] Could not serialize execution log entry of rule '%v'. Got: %v", entry.Rule, err)
+		return
+	}
+	if instance.writer == nil {
+		log.Print(string(line))
+		return
+	}
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	if _, err := instance.writer.Write(append(line, '\n')); err != nil {
+		log.Printf("[WARN] Could not write execution log entry of rule '%v'. Got: %v", entry.Rule, err)
+	}
+}
+
+func (instance *executionLog) Close() error {
+	if instance == nil || instance.closer == nil {
+		return nil
+	}
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	return instance.closer.Close()
+}
+
+// sampleOfChange returns an excerpt of before and after around the first difference or nil if
+// both are equal.
+func sampleOfChange(before []byte, after []byte) *executionLogSample {
+	if bytes.Equal(before, after) {
+		return nil
+	}
+	prefix := 0
+	for prefix < len(before) && prefix < len(after) && before[prefix] == after[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(before)-prefix && suffix < len(after)-prefix && before[len(before)-1-suffix] == after[len(after)-1-suffix] {
+		suffix++
+	}
+	start := prefix - executionLogSampleContext
+	if start < 0 {
+		start = 0
+	}
+	return &executionLogSample{
+		Before: excerptOf(before, start, len(before)-suffix+executionLogSampleContext),
+		After:  excerptOf(after, start, len(after)-suffix+executionLogSampleContext),
+	}
+}
+
+func excerptOf(content []byte, start int, end int) string {
+	if end > len(content) {
+		end = len(content)
+	}
+	if end-start > executionLogSampleMaxLength {
+		end = start + executionLogSampleMaxLength
+	}
+	return string(content[start:end])
+}
+
+func requestIdOf(request *http.Request) string {
+	if request == nil {
+		return ""
+	}
+	if id, ok := request.Context().Value(httpserver.RequestIDCtxKey).(string); ok && id != "" {
+		return id
+	}
+	return request.Header.Get("X-Request-Id")
+}
@@ -0,0 +1,99 @@
+package filter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type executionLogTest struct{}
+
+func init() {
+	Suite(&executionLogTest{})
+}
+
+func (s *executionLogTest) Test_record(c *C) {
+	buffer := new(bytes.Buffer)
+	el := &executionLog{writer: buffer, sampleRate: 1}
+	request := &http.Request{Method: "GET", URL: testUrl1, Header: http.Header{}}
+	request = request.WithContext(context.WithValue(request.Context(), httpserver.RequestIDCtxKey, "4711"))
+
+	el.record(request, "myRule", true, 2, 10, 12, 1500*time.Microsecond)
+	el.record(request, "rule#2", false, 0, 12, 12, 0)
+
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	c.Assert(len(lines), Equals, 2)
+	entry := executionLogEntry{}
+	c.Assert(json.Unmarshal([]byte(lines[0]), &entry), IsNil)
+	c.Assert(entry.Time, Not(Equals), "")
+	entry.Time = ""
+	c.Assert(entry, DeepEquals, executionLogEntry{
+		RequestId:    "4711",
+		Method:       "GET",
+		Path:         "/my/path.html",
+		Rule:         "myRule",
+		Matched:      true,
+		Replacements: 2,
+		SizeBefore:   10,
+		SizeAfter:    12,
+		DurationMs:   1.5,
+	})
+	c.Assert(json.Unmarshal([]byte(lines[1]), &entry), IsNil)
+	c.Assert(entry.Rule, Equals, "rule#2")
+	c.Assert(entry.Matched, Equals, false)
+}
+
+func (s *executionLogTest) Test_sampleOfChange(c *C) {
+	c.Assert(sampleOfChange([]byte("foo"), []byte("foo")), IsNil)
+	c.Assert(sampleOfChange([]byte("Hello world!"), []byte("Hello moon!")), DeepEquals, &executionLogSample{Before: "Hello world!", After: "Hello moon!"})
+
+	long := strings.Repeat("a", 100)
+	c.Assert(sampleOfChange([]byte(long+"b"+long), []byte(long+"c"+long)), DeepEquals, &executionLogSample{
+		Before: strings.Repeat("a", 40) + "b" + strings.Repeat("a", 40),
+		After:  strings.Repeat("a", 40) + "c" + strings.Repeat("a", 40),
+	})
+	c.Assert(len(sampleOfChange([]byte(long+long+long), []byte(strings.Repeat("b", 300))).After), Equals, 200)
+}
+
+func (s *executionLogTest) Test_sample(c *C) {
+	var el *executionLog
+	c.Assert(el.sample(), Equals, false)
+
+	el = &executionLog{sampleRate: 1, random: func() float64 { return 0.99 }}
+	c.Assert(el.sample(), Equals, true)
+
+	el.sampleRate = 0.5
+	c.Assert(el.sample(), Equals, false)
+	el.random = func() float64 { return 0.1 }
+	c.Assert(el.sample(), Equals, true)
+
+	el.sampleRate = 0
+	c.Assert(el.sample(), Equals, false)
+}
+
+func (s *executionLogTest) Test_newExecutionLog(c *C) {
+	directory, err := ioutil.TempDir("", "caddy-filter")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(directory)
+	file := filepath.Join(directory, "filter.log")
+
+	el, err := newExecutionLog(file, 1)
+	c.Assert(err, IsNil)
+	el.record(&http.Request{URL: testUrl1, Header: http.Header{"X-Request-Id": {"abc"}}}, "myRule", true, 1, 1, 1, 0)
+	c.Assert(el.Close(), IsNil)
+
+	content, err := ioutil.ReadFile(file)
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Matches, "\\{\"time\":\"[^\"]+\",\"request_id\":\"abc\",\"path\":\"/my/path.html\",\"rule\":\"myRule\",\"matched\":true,\"replacements\":1,\"size_before\":1,\"size_after\":1,\"duration_ms\":0\\}\n")
+
+	_, err = newExecutionLog(filepath.Join(directory, "missing", "filter.log"), 1)
+	c.Assert(err, NotNil)
+}
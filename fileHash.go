@@ -0,0 +1,73 @@
+package filter
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// fileHashCache contains the SHA-256 checksums of the files below root which are used by the
+// placeholder 'file_hash'. A checksum is calculated again if the size or the modification time
+// of its file changed.
+type fileHashCache struct {
+	root    string
+	mutex   sync.Mutex
+	entries map[string]*fileHashEntry
+}
+
+type fileHashEntry struct {
+	size     int64
+	modified time.Time
+	sum      []byte
+}
+
+func newFileHashCache(root string) *fileHashCache {
+	return &fileHashCache{
+		root:    root,
+		entries: map[string]*fileHashEntry{},
+	}
+}
+
+// sumOf returns the checksum of the file with the given path. Like for requests the path could
+// not leave the root.
+func (instance *fileHashCache) sumOf(name string) ([]byte, error) {
+	filename := filepath.Join(instance.root, filepath.FromSlash(path.Clean("/"+name)))
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("'%v' is a directory", name)
+	}
+
+	instance.mutex.Lock()
+	entry, ok := instance.entries[filename]
+	instance.mutex.Unlock()
+	if ok && entry.size == info.Size() && entry.modified.Equal(info.ModTime()) {
+		return entry.sum, nil
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return nil, err
+	}
+	entry = &fileHashEntry{
+		size:     info.Size(),
+		modified: info.ModTime(),
+		sum:      hash.Sum(nil),
+	}
+	instance.mutex.Lock()
+	instance.entries[filename] = entry
+	instance.mutex.Unlock()
+	return entry.sum, nil
+}
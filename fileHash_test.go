@@ -0,0 +1,52 @@
+package filter
+
+import (
+	"encoding/hex"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type fileHashTest struct{}
+
+func init() {
+	Suite(&fileHashTest{})
+}
+
+func (s *fileHashTest) Test_sumOf(c *C) {
+	root := c.MkDir()
+	filename := filepath.Join(root, "app.js")
+	c.Assert(ioutil.WriteFile(filename, []byte("console.log(1)"), 0644), IsNil)
+	cache := newFileHashCache(root)
+
+	sum, err := cache.sumOf("/app.js")
+	c.Assert(err, IsNil)
+	c.Assert(hex.EncodeToString(sum), Equals, "0a286891c11c056e1ab5bfc25bf5d6b2f5b06d38eac10944f678fd8a2e70c393")
+
+	sum, err = cache.sumOf("/../static/../app.js")
+	c.Assert(err, IsNil)
+	c.Assert(hex.EncodeToString(sum), Equals, "0a286891c11c056e1ab5bfc25bf5d6b2f5b06d38eac10944f678fd8a2e70c393")
+
+	c.Assert(ioutil.WriteFile(filename, []byte("console.log(2)"), 0644), IsNil)
+	modified := time.Now().Add(time.Minute)
+	c.Assert(os.Chtimes(filename, modified, modified), IsNil)
+	sum, err = cache.sumOf("app.js")
+	c.Assert(err, IsNil)
+	c.Assert(hex.EncodeToString(sum), Equals, "f2ae6bd066f7a15fb70ce6dfa7f67818e5e01dc415cbf7a3c47f0c80f70fc532")
+	c.Assert(len(cache.entries), Equals, 1)
+}
+
+func (s *fileHashTest) Test_sumOf_failures(c *C) {
+	root := c.MkDir()
+	c.Assert(os.Mkdir(filepath.Join(root, "static"), 0755), IsNil)
+	cache := newFileHashCache(filepath.Join(root, "static"))
+	c.Assert(ioutil.WriteFile(filepath.Join(root, "secret"), []byte("secret"), 0644), IsNil)
+
+	_, err := cache.sumOf("../secret")
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	_, err = cache.sumOf("/")
+	c.Assert(err, ErrorMatches, "'/' is a directory")
+}
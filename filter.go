@@ -1,39 +1,95 @@
 package filter
 
 import (
+	"bytes"
 	"github.com/caddyserver/caddy/caddyhttp/fastcgi"
 	"github.com/caddyserver/caddy/caddyhttp/httpserver"
 	"io"
+	"log"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 const defaultMaxBufferSize = 10 * 1024 * 1024
 
 type filterHandler struct {
-	next              httpserver.Handler
-	rules             []*rule
-	maximumBufferSize int
+	next                       httpserver.Handler
+	rules                      []*rule
+	maximumBufferSize          int
+	outputCharset              outputCharset
+	metrics                    *filterMetrics
+	metricsPath                string
+	debugToken                 string
+	executionLog               *executionLog
+	timeout                    time.Duration
+	timeoutPolicy              timeoutPolicy
+	bufferBudget               *bufferBudget
+	bufferPolicy               bufferBudgetPolicy
+	bufferWait                 time.Duration
+	maximumIncludeVirtualDepth int
+	includeCache               *includeCache
+	scripts                    scriptCache
+	fileHashes                 *fileHashCache
+	// includeChain contains the files currently included while parsing the configuration.
+	includeChain []string
+}
+
+type timeoutPolicy string
+
+const (
+	timeoutPolicyPass = timeoutPolicy("pass")
+	timeoutPolicyFail = timeoutPolicy("fail")
+)
+
+var possibleTimeoutPolicies = []timeoutPolicy{
+	timeoutPolicyPass,
+	timeoutPolicyFail,
 }
 
 func (instance filterHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) (int, error) {
+	if instance.metricsPath != "" && request.URL.Path == instance.metricsPath {
+		return instance.metrics.ServeHTTP(writer, request)
+	}
+
 	// Do not intercept if this is a websocket upgrade request.
 	if request.Method == "GET" && request.Header.Get("Upgrade") == "websocket" {
+		instance.metrics.recordSkipped(skipReasonWebsocket)
 		return instance.next.ServeHTTP(writer, request)
 	}
 
+	request, variantCookies := assignVariants(instance.rules, request)
 	wrapper := newResponseWriterWrapperFor(writer, func(wrapper *responseWriterWrapper) bool {
 		header := wrapper.Header()
 		for _, rule := range instance.rules {
-			if rule.matches(request, &header) {
+			if rule.filtersBody() && rule.matches(request, &header) {
 				return true
 			}
 		}
 		return false
 	})
 	wrapper.maximumBufferSize = instance.maximumBufferSize
+	wrapper.outputCharset = instance.outputCharset
+	wrapper.debug = isDebugRequested(request, instance.debugToken)
+	wrapper.bufferBudget = instance.bufferBudget
+	wrapper.bufferBudgetPolicy = instance.bufferPolicy
+	wrapper.bufferBudgetWait = instance.bufferWait
+	wrapper.variantCookies = variantCookies
+	if instance.rewritesHeaders() {
+		wrapper.headerRewriter = func(header http.Header, body []byte) {
+			for _, rule := range instance.rules {
+				rule.rewriteHeader(request, header, body)
+			}
+		}
+	}
+	defer wrapper.release()
 	result, err := instance.next.ServeHTTP(wrapper, request)
+	if wrapper.rejected {
+		instance.skip(wrapper, skipReasonRejected)
+		return http.StatusServiceUnavailable, nil
+	}
 	if wrapper.skipped {
+		instance.metrics.recordSkipped(wrapper.skipReason)
 		return result, err
 	}
 	var logError error
@@ -44,10 +100,12 @@ func (instance filterHandler) ServeHTTP(writer http.ResponseWriter, request *htt
 		// this is send (by the FastCGI module) as an error. We have to check this and
 		// handle this case of error in a special way.
 		if logError, ok = err.(fastcgi.LogError); !ok {
+			instance.metrics.recordSkipped(skipReasonUpstreamError)
 			return result, err
 		}
 	}
 	if !wrapper.isInterceptingRequired() || !wrapper.isBodyAllowed() {
+		instance.skip(wrapper, instance.skipReasonOf(wrapper))
 		wrapper.writeHeadersToDelegate(result)
 		return result, logError
 	}
@@ -57,24 +115,173 @@ func (instance filterHandler) ServeHTTP(writer http.ResponseWriter, request *htt
 	header := wrapper.Header()
 	var body []byte
 	bodyRetrieved := false
-	for _, rule := range instance.rules {
-		if rule.matches(request, &header) {
-			if !bodyRetrieved {
-				body = wrapper.recordedAndDecodeIfRequired()
-				bodyRetrieved = true
+	logExecutions := instance.executionLog.sample()
+	var original []byte
+	// Rules are executed alternating from one of these buffers into the other one.
+	var buffers [2]*bytes.Buffer
+	next := 0
+	execution := &ruleExecution{
+		request:        request,
+		responseHeader: &header,
+		includer:       instance.include,
+		status:         wrapper.selectStatus(result),
+		fileHashes:     instance.fileHashes,
+		reserve:        wrapper.reserveBudgetForAllocation,
+	}
+	if instance.timeout > 0 {
+		execution.deadline = time.Now().Add(instance.timeout)
+	}
+	// status and response of the rules with 'set_status' or 'respond' which matched.
+	var status int
+	var response *ruleResponse
+	// The first rule with 'minify' which matched.
+	var minifyRule *rule
+	var minifyRuleName string
+	// aborted is true if the rules are not completely executed and the original body is delivered.
+	aborted := false
+	exhausted := false
+	for index, rule := range instance.rules {
+		if !rule.filtersBody() {
+			continue
+		}
+		name := rule.nameAt(index)
+		if !rule.matches(request, &header) {
+			if logExecutions {
+				instance.executionLog.record(request, name, false, 0, len(body), len(body), 0)
+			}
+			continue
+		}
+		if !bodyRetrieved {
+			body = wrapper.recordedAndDecodeIfRequired()
+			original = body
+			bodyRetrieved = true
+			buffers[0], buffers[1] = acquireBuffer(), acquireBuffer()
+			defer releaseBuffer(buffers[0])
+			defer releaseBuffer(buffers[1])
+			if wrapper.decodeFailure != "" {
+				instance.metrics.recordDecodeFailure(wrapper.decodeFailure)
 			}
-			body = rule.execute(request, &header, body)
 		}
+		// The decoded body and the results of the previous rules are reserved before the next rule is executed.
+		if !wrapper.reserveBudgetForFiltering(buffers[0].Len() + buffers[1].Len()) {
+			exhausted = true
+			break
+		}
+		if rule.minify != nil {
+			// The body is minified after all other rules are executed.
+			if minifyRule == nil {
+				minifyRule, minifyRuleName = rule, name
+			}
+			continue
+		}
+		execution.variant = nil
+		if rule.variants != nil {
+			execution.variant = rule.variants.assignedVariantOf(request)
+		}
+		execution.redactions = nil
+		if rule.redaction != nil {
+			execution.redactions = map[string]int{}
+		}
+		started := time.Now()
+		bytesIn := len(body)
+		if rule.mode == ruleModeShadow {
+			// The result is written to the buffer of the next active rule and is never delivered.
+			shadowed, replacements, executionErr := rule.execute(execution, body, buffers[next])
+			duration := time.Since(started)
+			if executionErr == errExecutionTimeout {
+				log.Printf("[WARN] Filter rule '%v' in shadow mode exceeded its execution time budget for '%v'.", name, request.URL)
+			}
+			instance.metrics.recordRuleShadowExecution(name, replacements, bytesIn, duration)
+			if logExecutions {
+				instance.executionLog.recordShadow(request, name, replacements, body, shadowed, duration)
+			}
+			continue
+		}
+		var replacements int
+		var executionErr error
+		body, replacements, executionErr = rule.execute(execution, body, buffers[next])
+		if replacements > 0 && executionErr == nil && !rule.detectsOnly() {
+			next = 1 - next
+		}
+		duration := time.Since(started)
+		instance.metrics.recordRuleExecution(name, replacements, bytesIn, len(body), duration)
+		instance.metrics.recordRuleRedactions(name, execution.redactions)
+		if logExecutions {
+			instance.executionLog.record(request, name, true, replacements, bytesIn, len(body), duration)
+		}
+		wrapper.matchedRules = append(wrapper.matchedRules, name)
+		wrapper.replacements += replacements
+		if executionErr == errExecutionTimeout {
+			log.Printf("[WARN] Filter rule '%v' exceeded its execution time budget for '%v'; the response is not filtered.", name, request.URL)
+			instance.skip(wrapper, skipReasonTimeout)
+			if instance.timeoutPolicy == timeoutPolicyFail {
+				return http.StatusServiceUnavailable, logError
+			}
+			body, aborted = original, true
+			wrapper.replacements = 0
+			status, response = 0, nil
+			break
+		}
+		if executionErr == errPipeFailure {
+			instance.skip(wrapper, skipReasonPipeFailure)
+			return http.StatusBadGateway, logError
+		}
+		if executionErr == errTotalBufferExhausted {
+			exhausted = true
+			break
+		}
+		if replacements > 0 && (rule.status > 0 || rule.response != nil) {
+			if rule.logOriginalBody {
+				log.Printf("[INFO] Filter rule '%v' changed the response of '%v'. Original body: %s", name, request.URL, original)
+			}
+			if rule.response != nil {
+				status, response = rule.response.status, rule.response
+				break
+			}
+			status = rule.status
+		}
+	}
+	if bodyRetrieved && !aborted && !exhausted && !wrapper.reserveBudgetForFiltering(buffers[0].Len()+buffers[1].Len()) {
+		exhausted = true
+	}
+	if exhausted {
+		log.Printf("[WARN] The total buffer of all filtered responses is exhausted while filtering '%v'; the response is not filtered.", request.URL)
+		if instance.bufferPolicy == bufferBudgetPolicyReject {
+			instance.skip(wrapper, skipReasonRejected)
+			return http.StatusServiceUnavailable, logError
+		}
+		instance.skip(wrapper, skipReasonTotalBufferExhausted)
+		body, aborted = original, true
+		wrapper.replacements = 0
+		status, response = 0, nil
+	}
+	if minifyRule != nil && response == nil && !aborted {
+		body = instance.minify(wrapper, request, minifyRule, minifyRuleName, body, logExecutions)
 	}
 	var n int
 	if bodyRetrieved {
+		if !aborted {
+			instance.metrics.recordFiltered()
+		}
+		if status > 0 {
+			wrapper.overrideStatus(status)
+		}
+		if response != nil {
+			// The body of the response is already in its final encoding.
+			body = response.body
+			response.applyTo(wrapper.Header())
+		} else {
+			body = wrapper.encodeCharsetIfRequired(body)
+		}
 		oldContentLength := wrapper.Header().Get("Content-Length")
 		if len(oldContentLength) > 0 {
 			newContentLength := strconv.Itoa(len(body))
 			wrapper.Header().Set("Content-Length", newContentLength)
 		}
+		wrapper.deliveredBody = body
 		n, err = wrapper.writeToDelegateAndEncodeIfRequired(body, result)
 	} else {
+		instance.skip(wrapper, skipReasonNoRuleMatched)
 		n, err = wrapper.writeRecordedToDelegate(result)
 	}
 	if err != nil {
@@ -85,3 +292,65 @@ func (instance filterHandler) ServeHTTP(writer http.ResponseWriter, request *htt
 	}
 	return result, logError
 }
+
+// minify executes the given rule with 'minify' on the body after all other rules were executed.
+func (instance filterHandler) minify(wrapper *responseWriterWrapper, request *http.Request, rule *rule, name string, body []byte, logExecutions bool) []byte {
+	started := time.Now()
+	minified, err := rule.minify.apply(wrapper.Header().Get("Content-Type"), body)
+	duration := time.Since(started)
+	if err != nil {
+		log.Printf("[WARN] Filter rule '%v' could not minify '%v'. Got: %v", name, request.URL, err)
+		minified = body
+	}
+	replacements := 0
+	if len(minified) != len(body) {
+		replacements = 1
+	}
+	if rule.mode == ruleModeShadow {
+		instance.metrics.recordRuleShadowExecution(name, replacements, len(body), duration)
+		if logExecutions {
+			instance.executionLog.recordShadow(request, name, replacements, body, minified, duration)
+		}
+		return body
+	}
+	instance.metrics.recordRuleExecution(name, replacements, len(body), len(minified), duration)
+	if logExecutions {
+		instance.executionLog.record(request, name, true, replacements, len(body), len(minified), duration)
+	}
+	wrapper.matchedRules = append(wrapper.matchedRules, name)
+	wrapper.replacements += replacements
+	return minified
+}
+
+func (instance filterHandler) rewritesHeaders() bool {
+	for _, rule := range instance.rules {
+		if rule.rewritesHeader() {
+			return true
+		}
+	}
+	return false
+}
+
+func (instance filterHandler) skip(wrapper *responseWriterWrapper, reason skipReason) {
+	wrapper.skipReason = reason
+	instance.metrics.recordSkipped(reason)
+}
+
+func (instance filterHandler) skipReasonOf(wrapper *responseWriterWrapper) skipReason {
+	if !wrapper.isBodyAllowed() {
+		return skipReasonBodyNotAllowed
+	}
+	if wrapper.skipReason != "" {
+		return wrapper.skipReason
+	}
+	return skipReasonNothingToWrite
+}
+
+func (instance filterHandler) ruleNamed(name string) *rule {
+	for _, candidate := range instance.rules {
+		if candidate.name == name {
+			return candidate
+		}
+	}
+	return nil
+}
@@ -1,12 +1,20 @@
 package filter
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/caddyserver/caddy/caddyhttp/fastcgi"
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	. "github.com/echocat/gocheck-addons"
 	. "gopkg.in/check.v1"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"regexp"
+	"strings"
+	"time"
 )
 
 type filterTest struct {
@@ -87,6 +95,548 @@ func (s *filterTest) Test_withErrorInWriter(c *C) {
 	c.Assert(s.writer.buffer.String(), Equals, "")
 }
 
+func (s *filterTest) Test_withCharset(c *C) {
+	s.nextHandler.response = "Gr\xfc\xdfe world!"
+	s.writer.Header().Set("Content-Type", "text/html; charset=ISO-8859-1")
+	s.handler.rules[0].searchPattern = regexp.MustCompile("Grüße (w)orld")
+	s.handler.rules[0].replacement = []byte("Hallo Welt {1} €")
+	status, err := s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, 200)
+	c.Assert(s.writer.buffer.String(), Equals, "Hallo Welt w \x80!")
+	c.Assert(s.writer.Header().Get("Content-Type"), Equals, "text/html; charset=ISO-8859-1")
+}
+
+func (s *filterTest) Test_withCharsetAndUnsupportedCharacter(c *C) {
+	s.nextHandler.response = "Gr\xfc\xdfe world!"
+	s.writer.Header().Set("Content-Type", "text/html; charset=ISO-8859-1")
+	s.handler.rules[0].searchPattern = regexp.MustCompile("Grüße")
+	s.handler.rules[0].replacement = []byte("电视")
+	status, err := s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, 200)
+	c.Assert(s.writer.buffer.String(), Equals, "&#30005;&#35270; world!")
+}
+
+func (s *filterTest) Test_withCharsetAndUtf8Output(c *C) {
+	s.nextHandler.response = "Gr\xfc\xdfe world!"
+	s.writer.Header().Set("Content-Type", "text/html; charset=ISO-8859-1")
+	s.handler.outputCharset = outputCharsetUtf8
+	s.handler.rules[0].searchPattern = regexp.MustCompile("Grüße")
+	s.handler.rules[0].replacement = []byte("电视")
+	status, err := s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, 200)
+	c.Assert(s.writer.buffer.String(), Equals, "电视 world!")
+	c.Assert(s.writer.Header().Get("Content-Type"), Equals, "text/html; charset=utf-8")
+}
+
+func (s *filterTest) Test_withMetrics(c *C) {
+	s.handler.metrics = newFilterMetrics()
+	s.handler.metricsPath = "/metrics"
+	_, err := s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+
+	s.handler.maximumBufferSize = 5
+	_, err = s.handler.ServeHTTP(newMockResponseWriter(), s.request)
+	c.Assert(err, IsNil)
+
+	metricsUrl, _ := url.ParseRequestURI("http://foo.bar/metrics")
+	writer := newMockResponseWriter()
+	status, err := s.handler.ServeHTTP(writer, &http.Request{Method: "GET", URL: metricsUrl})
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, 200)
+	c.Assert(writer.buffer.String(), Contains, "caddy_filter_responses_total{result=\"filtered\"} 1\n")
+	c.Assert(writer.buffer.String(), Contains, "caddy_filter_skipped_total{reason=\"buffer-overflow\"} 1\n")
+	c.Assert(writer.buffer.String(), Contains, "caddy_filter_rule_replacements_total{rule=\"rule#1\"} 1\n")
+	c.Assert(writer.buffer.String(), Contains, "caddy_filter_rule_bytes_in_total{rule=\"rule#1\"} 12\n")
+	c.Assert(writer.buffer.String(), Contains, "caddy_filter_rule_bytes_out_total{rule=\"rule#1\"} 17\n")
+}
+
+func (s *filterTest) Test_withDebug(c *C) {
+	s.handler.debugToken = "secret"
+	s.request.Header = http.Header{}
+	s.request.Header.Set("X-Filter-Debug", "secret")
+	status, err := s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, 200)
+	c.Assert(s.writer.buffer.String(), Equals, "Hello 2nd is 'o'!")
+	c.Assert(s.writer.Header().Get("X-Filter-Matched"), Equals, "rule#1")
+	c.Assert(s.writer.Header().Get("X-Filter-Replacements"), Equals, "1")
+	c.Assert(s.writer.Header().Get("X-Filter-Skipped-Reason"), Equals, "")
+
+	s.writer = newMockResponseWriter()
+	s.request.URL = testUrl2
+	_, err = s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(s.writer.Header().Get("X-Filter-Matched"), Equals, "")
+	c.Assert(s.writer.Header().Get("X-Filter-Skipped-Reason"), Equals, "no-rule-matched")
+
+	s.writer = newMockResponseWriter()
+	s.request.URL = testUrl1
+	s.handler.maximumBufferSize = 5
+	_, err = s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(s.writer.buffer.String(), Equals, "Hello world!")
+	c.Assert(s.writer.Header().Get("X-Filter-Skipped-Reason"), Equals, "buffer-overflow")
+}
+
+func (s *filterTest) Test_withDebugAndWrongToken(c *C) {
+	s.handler.debugToken = "secret"
+	s.request.Header = http.Header{}
+	s.request.Header.Set("X-Filter-Debug", "wrong")
+	_, err := s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(s.writer.buffer.String(), Equals, "Hello 2nd is 'o'!")
+	c.Assert(s.writer.Header().Get("X-Filter-Matched"), Equals, "")
+	c.Assert(s.writer.Header().Get("X-Filter-Replacements"), Equals, "")
+}
+
+func (s *filterTest) Test_withExecutionLog(c *C) {
+	buffer := new(bytes.Buffer)
+	s.handler.executionLog = &executionLog{writer: buffer, sampleRate: 1}
+	s.handler.rules[0].name = "myRule"
+	s.handler.rules = append(s.handler.rules, &rule{
+		path:          regexp.MustCompile(".*\\.txt"),
+		searchPattern: regexp.MustCompile("Hello"),
+	})
+	_, err := s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(s.writer.buffer.String(), Equals, "Hello 2nd is 'o'!")
+
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	c.Assert(len(lines), Equals, 2)
+	c.Assert(lines[0], Matches, ".*\"rule\":\"myRule\",\"matched\":true,\"replacements\":1,\"size_before\":12,\"size_after\":17,.*")
+	c.Assert(lines[1], Matches, ".*\"rule\":\"rule#2\",\"matched\":false,\"replacements\":0,\"size_before\":17,\"size_after\":17,.*")
+}
+
+func (s *filterTest) Test_withShadowRule(c *C) {
+	buffer := new(bytes.Buffer)
+	s.handler.executionLog = &executionLog{writer: buffer, sampleRate: 1}
+	s.handler.metrics = newFilterMetrics()
+	s.handler.rules[0].name = "myRule"
+	s.handler.rules[0].mode = ruleModeShadow
+	s.handler.rules = append(s.handler.rules, &rule{
+		path:          regexp.MustCompile(".*\\.html"),
+		searchPattern: regexp.MustCompile("world"),
+		replacement:   []byte("moon"),
+		mode:          ruleModeActive,
+	})
+	_, err := s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(s.writer.buffer.String(), Equals, "Hello moon!")
+
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	c.Assert(len(lines), Equals, 2)
+	c.Assert(lines[0], Matches, ".*\"rule\":\"myRule\",\"mode\":\"shadow\",\"matched\":true,\"replacements\":1,\"size_before\":12,\"size_after\":17,.*\"sample\":\\{\"before\":\"Hello world!\",\"after\":\"Hello 2nd is 'o'!\"\\}\\}")
+	c.Assert(lines[1], Matches, ".*\"rule\":\"rule#2\",\"matched\":true,\"replacements\":1,\"size_before\":12,\"size_after\":11,.*")
+
+	output := new(bytes.Buffer)
+	c.Assert(s.handler.metrics.writeTo(output), IsNil)
+	c.Assert(output.String(), Contains, "caddy_filter_rule_shadow_replacements_total{rule=\"myRule\"} 1\n")
+	c.Assert(output.String(), Not(Contains), "caddy_filter_rule_replacements_total{rule=\"myRule\"}")
+}
+
+func (s *filterTest) Test_withVariants(c *C) {
+	variants := newRuleVariants()
+	variants.cookieName = "ab"
+	variants.cookieMaxAge = time.Hour
+	variants.variants = []*ruleVariant{
+		{name: "a", weight: 1},
+		{name: "b", weight: 1, replacement: []byte("B")},
+	}
+	variants.random = func(int) int { return 0 }
+	s.handler.rules[0].variants = variants
+	s.handler.rules[0].replacement = []byte("{variant}")
+	_, err := s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(s.writer.buffer.String(), Equals, "Hello a!")
+	c.Assert(s.writer.Header().Get("Set-Cookie"), Equals, "ab=a; Path=/; Max-Age=3600; HttpOnly")
+
+	s.SetUpTest(c)
+	s.handler.rules[0].variants = variants
+	s.request.Header = http.Header{"Cookie": {"ab=b"}}
+	_, err = s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(s.writer.buffer.String(), Equals, "Hello B!")
+	c.Assert(s.writer.Header().Get("Set-Cookie"), Equals, "")
+}
+
+func (s *filterTest) Test_withVariantsVisibleToNextHandler(c *C) {
+	variants := newRuleVariants()
+	variants.cookieName = "ab"
+	variants.variants = []*ruleVariant{{name: "a", weight: 1}, {name: "b", weight: 1}}
+	variants.random = func(int) int { return 1 }
+	s.handler.rules[0].variants = variants
+	s.handler.rules[0].contentType = regexp.MustCompile("text/html")
+	s.handler.rules[0].pathAndContentTypeCombination = pathAndContentTypeOrCombination
+	var placeholder, cookie string
+	contentType := "text/html"
+	s.handler.next = httpserver.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) (int, error) {
+		placeholder = httpserver.NewReplacer(request, nil, "").Replace("{variant}")
+		cookie = writer.Header().Get("Set-Cookie")
+		writer.Header().Set("X-Variant", variants.assignedVariantOf(request).name)
+		writer.Header().Set("Content-Type", contentType)
+		return s.nextHandler.ServeHTTP(writer, request)
+	})
+	s.request.URL = testUrl2
+	s.request.Header = http.Header{}
+	s.request = s.request.WithContext(context.WithValue(s.request.Context(), httpserver.ReplacerCtxKey, httpserver.NewReplacer(s.request, nil, "")))
+	_, err := s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(placeholder, Equals, "b")
+	c.Assert(cookie, Equals, "")
+	c.Assert(s.writer.Header().Get("X-Variant"), Equals, "b")
+	c.Assert(s.writer.Header()["Set-Cookie"], DeepEquals, []string{"ab=b; Path=/; Max-Age=2592000; HttpOnly"})
+
+	// Responses the rule does not match do not get the cookie.
+	s.writer = newMockResponseWriter()
+	contentType = "image/png"
+	_, err = s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(s.writer.Header().Get("X-Variant"), Equals, "b")
+	c.Assert(s.writer.Header()["Set-Cookie"], IsNil)
+}
+
+func (s *filterTest) Test_withSetStatus(c *C) {
+	s.handler.rules[0].status = 503
+	s.handler.rules[0].replacement = nil
+	status, err := s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, 200)
+	c.Assert(s.writer.status, Equals, 503)
+	c.Assert(s.writer.buffer.String(), Equals, "Hello world!")
+
+	s.SetUpTest(c)
+	s.handler.rules[0].status = 503
+	s.handler.rules[0].searchPattern = regexp.MustCompile("Fatal error:")
+	_, err = s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(s.writer.status, Equals, 200)
+	c.Assert(s.writer.buffer.String(), Equals, "Hello world!")
+}
+
+func (s *filterTest) Test_withRespond(c *C) {
+	s.nextHandler.response = "<p>Fatal error: foo</p>"
+	s.handler.next = httpserver.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) (int, error) {
+		writer.Header().Set("ETag", "\"abc\"")
+		return s.nextHandler.ServeHTTP(writer, request)
+	})
+	s.handler.rules = []*rule{{
+		path:          regexp.MustCompile(".*\\.html"),
+		searchPattern: regexp.MustCompile("Fatal error:"),
+		response:      newRuleResponse(503, []byte("<p>Sorry!</p>"), "<p>Sorry!</p>"),
+	}, {
+		path:          regexp.MustCompile(".*\\.html"),
+		searchPattern: regexp.MustCompile("Sorry"),
+		replacement:   []byte("Oops"),
+	}}
+	_, err := s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(s.writer.status, Equals, 503)
+	c.Assert(s.writer.buffer.String(), Equals, "<p>Sorry!</p>")
+	c.Assert(s.writer.Header().Get("Content-Type"), Equals, "text/html; charset=utf-8")
+	c.Assert(s.writer.Header().Get("ETag"), Equals, "")
+}
+
+func (s *filterTest) Test_withRedaction(c *C) {
+	s.handler.metrics = newFilterMetrics()
+	s.nextHandler.response = "Mail me: foo@example.org"
+	redaction := newRuleRedaction()
+	redaction.detectors = []*redactionDetector{builtInRedactionDetectorNamed("email")}
+	c.Assert(redaction.compile(), IsNil)
+	s.handler.rules[0] = &rule{
+		name:          "myRule",
+		path:          regexp.MustCompile(".*\\.html"),
+		searchPattern: redaction.searchPattern,
+		redaction:     redaction,
+	}
+	_, err := s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(s.writer.buffer.String(), Equals, "Mail me: ***@*******.***")
+
+	output := new(bytes.Buffer)
+	c.Assert(s.handler.metrics.writeTo(output), IsNil)
+	c.Assert(output.String(), Contains, "caddy_filter_rule_redactions_total{rule=\"myRule\",detector=\"email\"} 1\n")
+}
+
+func (s *filterTest) Test_withMinify(c *C) {
+	s.nextHandler.response = "<p>  Hello   world!  </p>"
+	s.handler.next = httpserver.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) (int, error) {
+		writer.Header().Set("Content-Type", "text/html")
+		return s.nextHandler.ServeHTTP(writer, request)
+	})
+	minify := &ruleMinify{}
+	minify.compile()
+	s.handler.rules = []*rule{{
+		path:   regexp.MustCompile(".*\\.html"),
+		minify: minify,
+	}, {
+		path:          regexp.MustCompile(".*\\.html"),
+		searchPattern: regexp.MustCompile("world"),
+		replacement:   []byte("   moon"),
+	}}
+	_, err := s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(s.writer.buffer.String(), Equals, "<p>Hello moon!")
+}
+
+func (s *filterTest) Test_withXml(c *C) {
+	s.nextHandler.response = "<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?>\n<feed><title>Caf\xe9</title><entry><id>1</id></entry></feed>"
+	s.handler.next = httpserver.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) (int, error) {
+		writer.Header().Set("Content-Type", "application/atom+xml")
+		return s.nextHandler.ServeHTTP(writer, request)
+	})
+	set, err := newXmlAction(xmlActionSet, "/feed/title")
+	c.Assert(err, IsNil)
+	set.value = []byte("{0} & Bar")
+	remove, err := newXmlAction(xmlActionDelete, "//entry")
+	c.Assert(err, IsNil)
+	s.handler.rules = []*rule{{
+		path: regexp.MustCompile(".*\\.html"),
+		xml:  &ruleXml{actions: []*xmlAction{set, remove}},
+	}}
+	_, err = s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(s.writer.buffer.String(), Equals, "<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?>\n<feed><title>Caf\xe9 &amp; Bar</title></feed>")
+}
+
+func (s *filterTest) Test_withScript(c *C) {
+	proto, err := compileScriptSource("test.lua", []byte(`set_response_header("X-Length", #body) return body:upper()`))
+	c.Assert(err, IsNil)
+	s.handler.rules = []*rule{{
+		path:   regexp.MustCompile(".*\\.html"),
+		script: &ruleScript{name: "test.lua", proto: proto, maximumMemory: defaultScriptMaximumMemory},
+	}}
+	_, err = s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(s.writer.buffer.String(), Equals, "HELLO WORLD!")
+	c.Assert(s.writer.Header().Get("X-Length"), Equals, "12")
+}
+
+func (s *filterTest) Test_withPipe(c *C) {
+	s.handler.rules = []*rule{{
+		path: regexp.MustCompile(".*\\.html"),
+		pipe: newRulePipe([]string{"cat"}),
+	}}
+	defer s.handler.rules[0].pipe.Close()
+	status, err := s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, 200)
+	c.Assert(s.writer.buffer.String(), Equals, "Hello world!")
+}
+
+func (s *filterTest) Test_withPipeAndFailPolicy(c *C) {
+	pipe := newRulePipe([]string{"true"})
+	pipe.onFailure = pipeFailureFail
+	s.handler.rules = []*rule{{
+		path: regexp.MustCompile(".*\\.html"),
+		pipe: pipe,
+	}}
+	defer pipe.Close()
+	status, err := s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, 502)
+	c.Assert(s.writer.status, Equals, 0)
+	c.Assert(s.writer.buffer.String(), Equals, "")
+}
+
+func (s *filterTest) Test_withWasm(c *C) {
+	source, err := ioutil.ReadFile("resources/test/wasm/filter.wasm")
+	c.Assert(err, IsNil)
+	module := &ruleWasm{name: "filter.wasm", source: source, function: defaultWasmFunction, workers: 1, maximumMemory: defaultWasmMaximumMemory}
+	c.Assert(module.load(), IsNil)
+	s.handler.rules = []*rule{{
+		path: regexp.MustCompile(".*\\.html"),
+		wasm: module,
+	}}
+	_, err = s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(s.writer.buffer.String(), Equals, "HELLO WORLD!")
+	c.Assert(s.writer.Header().Get("X-Path"), Equals, s.request.URL.Path)
+}
+
+func (s *filterTest) Test_withBodyPlaceholders(c *C) {
+	s.handler.rules = []*rule{{
+		path:          regexp.MustCompile(".*\\.html"),
+		searchPattern: regexp.MustCompile("!"),
+		replacement:   []byte("! {response_status} {response_body_length} {response_body_sha256}"),
+	}}
+	_, err := s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(s.writer.buffer.String(), Equals, "Hello world! 200 12 c0535e4be2b79ffd93291305436bf889314e4a3faec05ecffcbb7df31ad9e51a")
+}
+
+func (s *filterTest) Test_withBodyPlaceholdersBeforeBodyChangingRule(c *C) {
+	s.handler.next = httpserver.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) (int, error) {
+		writer.Header().Set("Location", "/next")
+		writer.WriteHeader(200)
+		return writer.Write([]byte("Hello world!"))
+	})
+	s.handler.rules = []*rule{{
+		path:          regexp.MustCompile(".*\\.html"),
+		searchPattern: regexp.MustCompile("^Hello"),
+		replacement:   []byte("{response_body_length}"),
+		locationRewrites: []*headerRewrite{{
+			pattern:     regexp.MustCompile("$"),
+			replacement: []byte("?length={response_body_length}&sha256={response_body_sha256}"),
+		}},
+	}, {
+		path:          regexp.MustCompile(".*\\.html"),
+		searchPattern: regexp.MustCompile("world"),
+		replacement:   []byte("everybody"),
+	}}
+	_, err := s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	// The first rule sees the body before the second rule changed it...
+	c.Assert(s.writer.buffer.String(), Equals, "12 everybody!")
+	// ...but the header rewrite sees the delivered body.
+	c.Assert(s.writer.Header().Get("Location"), Equals, "/next?length=13&sha256=d88f6a0851d80f1e2bcf5d414fbe6396460cd89ebdda442442ee195d75694ff4")
+}
+
+func (s *filterTest) Test_withTimeout(c *C) {
+	s.handler.timeout = time.Nanosecond
+	s.handler.timeoutPolicy = timeoutPolicyPass
+	status, err := s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, 200)
+	c.Assert(s.writer.buffer.String(), Equals, "Hello world!")
+}
+
+func (s *filterTest) Test_withTimeoutAndFailPolicy(c *C) {
+	s.handler.rules[0].timeout = time.Nanosecond
+	s.handler.timeoutPolicy = timeoutPolicyFail
+	status, err := s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, 503)
+	c.Assert(s.writer.status, Equals, 0)
+	c.Assert(s.writer.buffer.String(), Equals, "")
+}
+
+func (s *filterTest) Test_withExhaustedBufferBudget(c *C) {
+	s.handler.bufferBudget = newBufferBudget()
+	s.handler.bufferBudget.setLimit(8)
+	s.handler.bufferPolicy = bufferBudgetPolicyBypass
+	status, err := s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, 200)
+	c.Assert(s.writer.buffer.String(), Equals, "Hello world!")
+
+	s.handler.bufferPolicy = bufferBudgetPolicyReject
+	s.writer = newMockResponseWriter()
+	status, err = s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, 503)
+	c.Assert(s.writer.status, Equals, 0)
+	c.Assert(s.writer.buffer.String(), Equals, "")
+
+	s.handler.bufferBudget.setLimit(100)
+	s.writer = newMockResponseWriter()
+	status, err = s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, 200)
+	c.Assert(s.writer.buffer.String(), Equals, "Hello 2nd is 'o'!")
+	used, _ := s.handler.bufferBudget.usage()
+	c.Assert(used, Equals, int64(0))
+}
+
+func (s *filterTest) Test_withBufferBudgetExhaustedByRules(c *C) {
+	// The recorded body fits into the budget but not together with the result of the rule.
+	s.handler.bufferBudget = newBufferBudget()
+	s.handler.bufferBudget.setLimit(20)
+	s.handler.bufferPolicy = bufferBudgetPolicyBypass
+	status, err := s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, 200)
+	c.Assert(s.writer.buffer.String(), Equals, "Hello world!")
+	used, _ := s.handler.bufferBudget.usage()
+	c.Assert(used, Equals, int64(0))
+
+	s.handler.bufferPolicy = bufferBudgetPolicyReject
+	s.writer = newMockResponseWriter()
+	status, err = s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, 503)
+	c.Assert(s.writer.buffer.String(), Equals, "")
+
+	s.handler.bufferBudget.setLimit(29)
+	s.writer = newMockResponseWriter()
+	status, err = s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, 200)
+	c.Assert(s.writer.buffer.String(), Equals, "Hello 2nd is 'o'!")
+}
+
+func (s *filterTest) Test_withBufferBudgetExhaustedByPipe(c *C) {
+	pipe := newRulePipe([]string{"cat"})
+	defer pipe.Close()
+	s.handler.rules = []*rule{{
+		path: regexp.MustCompile(".*\\.html"),
+		pipe: pipe,
+	}}
+	s.handler.bufferBudget = newBufferBudget()
+	s.handler.bufferBudget.setLimit(20)
+	s.handler.bufferPolicy = bufferBudgetPolicyReject
+	status, err := s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, 503)
+	c.Assert(s.writer.buffer.String(), Equals, "")
+
+	s.handler.bufferPolicy = bufferBudgetPolicyBypass
+	s.writer = newMockResponseWriter()
+	status, err = s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, 200)
+	c.Assert(s.writer.buffer.String(), Equals, "Hello world!")
+
+	s.handler.bufferBudget.setLimit(24)
+	s.writer = newMockResponseWriter()
+	status, err = s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, 200)
+	c.Assert(s.writer.buffer.String(), Equals, "Hello world!")
+	used, _ := s.handler.bufferBudget.usage()
+	c.Assert(used, Equals, int64(0))
+}
+
+func (s *filterTest) Test_withBufferBudgetExhaustedByDecoding(c *C) {
+	s.nextHandler.response = "Hello w\xf6rld!"
+	s.writer.Header().Set("Content-Type", "text/html; charset=ISO-8859-1")
+	s.handler.rules[0].searchPattern = regexp.MustCompile("nothing")
+	s.handler.bufferBudget = newBufferBudget()
+	s.handler.bufferBudget.setLimit(20)
+	s.handler.bufferPolicy = bufferBudgetPolicyReject
+	status, err := s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, 503)
+	used, _ := s.handler.bufferBudget.usage()
+	c.Assert(used, Equals, int64(0))
+}
+
+func (s *filterTest) Benchmark_ServeHTTP_withTypicalHtml(c *C) {
+	s.nextHandler.response = benchmarkHtml
+	s.handler.rules = []*rule{
+		{
+			path:          regexp.MustCompile(".*\\.html"),
+			searchPattern: regexp.MustCompile("</title>"),
+			replacement:   []byte("</title><script src=\"/tracking.js?host={request_host}\"></script>"),
+		},
+		{
+			path:          regexp.MustCompile(".*\\.html"),
+			searchPattern: regexp.MustCompile("href=\"http://backend:8080(/[^\"]*)\""),
+			replacement:   []byte("href=\"https://example.org{1}\""),
+		},
+	}
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		s.writer.buffer.Reset()
+		_, err := s.handler.ServeHTTP(s.writer, s.request)
+		if err != nil {
+			c.Fatal(err)
+		}
+	}
+}
+
 ///////////////////////////////////////////////////////////////////////////////////////////
 // MOCKS
 ///////////////////////////////////////////////////////////////////////////////////////////
@@ -129,3 +679,7 @@ func (instance mockHandler) ServeHTTP(writer http.ResponseWriter, request *http.
 	}
 	return instance.status, instance.error
 }
+
+var benchmarkHtml = "<html><head><title>Benchmark</title></head><body>" +
+	strings.Repeat("<p>Lorem ipsum dolor sit amet, <a href=\"http://backend:8080/some/path\">consetetur</a> sadipscing elitr.</p>\n", 500) +
+	"</body></html>"
@@ -0,0 +1,240 @@
+// Package filtertest executes golden-file test cases against filter rules in go test
+// without starting Caddy or any listener.
+//
+// Every subdirectory of a cases directory is one case and contains:
+//
+//	request.yaml   (optional) the simulated request and the response of the upstream
+//	upstream.*     the body delivered by the upstream, for example upstream.html
+//	expected.*     the body expected after the filter was applied, for example expected.html
+//
+// The request.yaml supports these keys:
+//
+//	method: GET
+//	path: /index.html
+//	headers:
+//	  Accept-Language: de
+//	status: 200
+//	response_headers:
+//	  Content-Type: text/html
+//	expected_status: 200
+//
+// Usage:
+//
+//	func TestRules(t *testing.T) {
+//		filtertest.Run(t, "rules.yaml", "testdata/rules")
+//	}
+//
+// Run the tests with -filtertest.update to write the actual bodies to the expected files.
+package filtertest
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/echocat/caddy-filter/internal/diff"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	requestFilename  = "request.yaml"
+	upstreamPrefix   = "upstream"
+	expectedPrefix   = "expected"
+	defaultExtension = ".html"
+)
+
+var update = flag.Bool("filtertest.update", false, "Write the actual bodies of filtertest cases to their expected files.")
+
+// Request is the content of the request.yaml of a case.
+type Request struct {
+	Method          string            `yaml:"method"`
+	Path            string            `yaml:"path"`
+	Headers         map[string]string `yaml:"headers"`
+	Status          int               `yaml:"status"`
+	ResponseHeaders map[string]string `yaml:"response_headers"`
+	ExpectedStatus  int               `yaml:"expected_status"`
+}
+
+// Case is one golden-file test case.
+type Case struct {
+	Name         string
+	Request      Request
+	Upstream     []byte
+	Expected     []byte
+	UpstreamFile string
+	ExpectedFile string
+}
+
+// LoadCases loads all cases of the subdirectories of the given directory ordered by their names.
+func LoadCases(directory string) ([]Case, error) {
+	infos, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+	var result []Case
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		candidate, err := LoadCase(filepath.Join(directory, info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, candidate)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+// LoadCase loads the case of the given directory. A missing expected file is not an error
+// to be able to create it with -filtertest.update.
+func LoadCase(directory string) (Case, error) {
+	result := Case{Name: filepath.Base(directory)}
+	content, err := ioutil.ReadFile(filepath.Join(directory, requestFilename))
+	if err != nil && !os.IsNotExist(err) {
+		return Case{}, err
+	}
+	if err := yaml.UnmarshalStrict(content, &result.Request); err != nil {
+		return Case{}, fmt.Errorf("could not parse '%v': %v", filepath.Join(directory, requestFilename), err)
+	}
+	if result.UpstreamFile, err = fileWithPrefix(directory, upstreamPrefix); err != nil {
+		return Case{}, err
+	}
+	if result.UpstreamFile == "" {
+		return Case{}, fmt.Errorf("there is no '%v.*' file in '%v'", upstreamPrefix, directory)
+	}
+	if result.Upstream, err = ioutil.ReadFile(result.UpstreamFile); err != nil {
+		return Case{}, err
+	}
+	if result.ExpectedFile, err = fileWithPrefix(directory, expectedPrefix); err != nil {
+		return Case{}, err
+	}
+	if result.ExpectedFile == "" {
+		result.ExpectedFile = filepath.Join(directory, expectedPrefix+filepath.Ext(result.UpstreamFile))
+	} else if result.Expected, err = ioutil.ReadFile(result.ExpectedFile); err != nil {
+		return Case{}, err
+	}
+	return result, nil
+}
+
+func fileWithPrefix(directory string, prefix string) (string, error) {
+	matches, err := filepath.Glob(filepath.Join(directory, prefix+".*"))
+	if err != nil {
+		return "", err
+	}
+	if len(matches) > 1 {
+		return "", fmt.Errorf("there is more than one '%v.*' file in '%v'", prefix, directory)
+	}
+	if len(matches) == 0 {
+		return "", nil
+	}
+	return matches[0], nil
+}
+
+// Simulation returns the request and upstream response of this case. If neither the
+// response headers nor the content type are provided the content type is derived from
+// the extension of the upstream file.
+func (instance Case) Simulation() Simulation {
+	result := Simulation{
+		Method:         instance.Request.Method,
+		Path:           instance.Request.Path,
+		RequestHeader:  http.Header{},
+		Status:         instance.Request.Status,
+		ResponseHeader: http.Header{},
+		Body:           instance.Upstream,
+	}
+	for key, value := range instance.Request.Headers {
+		result.RequestHeader.Set(key, value)
+	}
+	for key, value := range instance.Request.ResponseHeaders {
+		result.ResponseHeader.Set(key, value)
+	}
+	if result.ResponseHeader.Get("Content-Type") == "" {
+		extension := filepath.Ext(instance.UpstreamFile)
+		if extension == "" {
+			extension = defaultExtension
+		}
+		result.ResponseHeader.Set("Content-Type", mime.TypeByExtension(extension))
+	}
+	if result.Path == "" {
+		result.Path = "/index" + filepath.Ext(instance.UpstreamFile)
+	}
+	return result
+}
+
+// Execute applies the given filter to this case and returns the result. The returned
+// error describes every difference to the expectations of this case.
+func (instance Case) Execute(target *Filter) (*SimulationResult, error) {
+	result, err := target.Apply(instance.Simulation())
+	if err != nil {
+		return nil, err
+	}
+	var problems []string
+	expectedStatus := instance.Request.ExpectedStatus
+	if expectedStatus == 0 {
+		expectedStatus = instance.Request.Status
+	}
+	if expectedStatus == 0 {
+		expectedStatus = http.StatusOK
+	}
+	if result.Status != expectedStatus {
+		problems = append(problems, fmt.Sprintf("expected status %d but got %d", expectedStatus, result.Status))
+	}
+	if instance.Expected == nil {
+		problems = append(problems, fmt.Sprintf("there is no expected file '%v' (run with -filtertest.update to create it)", instance.ExpectedFile))
+	} else if delta := diff.Unified(instance.ExpectedFile, "actual", instance.Expected, result.Body); delta != "" {
+		problems = append(problems, "unexpected body (matched rules: "+matchedRulesOf(result)+"):\n"+delta)
+	}
+	if len(problems) > 0 {
+		return result, fmt.Errorf("case '%v': %v", instance.Name, strings.Join(problems, "\n"))
+	}
+	return result, nil
+}
+
+func matchedRulesOf(result *SimulationResult) string {
+	if len(result.MatchedRules) <= 0 {
+		return "<none>"
+	}
+	return strings.Join(result.MatchedRules, ", ")
+}
+
+// Run executes every case of the given directory as a subtest against the filter
+// configuration of the given file. The configuration file is read like by the command
+// line tool cmd/caddy-filter: 'filter' directives of a Caddyfile or a rule file.
+func Run(t *testing.T, config string, directory string) {
+	target, err := ParseFilter(config)
+	if err != nil {
+		t.Fatalf("could not load filter configuration '%v': %v", config, err)
+	}
+	cases, err := LoadCases(directory)
+	if err != nil {
+		t.Fatalf("could not load cases of '%v': %v", directory, err)
+	}
+	if len(cases) <= 0 {
+		t.Fatalf("there are no cases in '%v'", directory)
+	}
+	for _, candidate := range cases {
+		candidate := candidate
+		t.Run(candidate.Name, func(t *testing.T) {
+			result, err := candidate.Execute(target)
+			if *update && result != nil {
+				if writeErr := ioutil.WriteFile(candidate.ExpectedFile, result.Body, 0644); writeErr != nil {
+					t.Fatalf("could not update '%v': %v", candidate.ExpectedFile, writeErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package filtertest_test
+
+import (
+	"github.com/echocat/caddy-filter/filtertest"
+	. "gopkg.in/check.v1"
+)
+
+type filtertestTest struct{}
+
+func init() {
+	Suite(&filtertestTest{})
+}
+
+const testDirectory = "../resources/test/golden"
+
+func (s *filtertestTest) Test_LoadCases(c *C) {
+	cases, err := filtertest.LoadCases(testDirectory + "/cases")
+	c.Assert(err, IsNil)
+	c.Assert(len(cases), Equals, 2)
+
+	c.Assert(cases[0].Name, Equals, "html-with-header")
+	c.Assert(cases[0].Request, DeepEquals, filtertest.Request{Path: "/de/index.html", Headers: map[string]string{"X-Name": "Tom"}})
+	c.Assert(string(cases[0].Upstream), Equals, "<p>Hello</p>\n")
+	c.Assert(string(cases[0].Expected), Equals, "<p>Hello Tom</p>\n")
+
+	c.Assert(cases[1].Name, Equals, "text-without-request")
+	c.Assert(cases[1].Request, DeepEquals, filtertest.Request{})
+	c.Assert(cases[1].Simulation().Path, Equals, "/index.txt")
+	c.Assert(cases[1].Simulation().ResponseHeader.Get("Content-Type"), Equals, "text/plain; charset=utf-8")
+}
+
+func (s *filtertestTest) Test_LoadCase_withoutExpected(c *C) {
+	candidate, err := filtertest.LoadCase(testDirectory + "/failing/missing-expected")
+	c.Assert(err, IsNil)
+	c.Assert(candidate.Expected, IsNil)
+	c.Assert(candidate.ExpectedFile, Equals, testDirectory+"/failing/missing-expected/expected.txt")
+}
+
+func (s *filtertestTest) Test_LoadCase_withoutUpstream(c *C) {
+	_, err := filtertest.LoadCase(testDirectory + "/cases")
+	c.Assert(err, ErrorMatches, "there is no 'upstream.\\*' file in '.*/cases'")
+}
+
+func (s *filtertestTest) Test_Execute(c *C) {
+	target, err := filtertest.ParseFilter(testDirectory + "/rules.caddy")
+	c.Assert(err, IsNil)
+	cases, err := filtertest.LoadCases(testDirectory + "/cases")
+	c.Assert(err, IsNil)
+
+	result, err := cases[0].Execute(target)
+	c.Assert(err, IsNil)
+	c.Assert(result.MatchedRules, DeepEquals, []string{"greeting"})
+}
+
+func (s *filtertestTest) Test_Execute_withFailures(c *C) {
+	target, err := filtertest.ParseFilter(testDirectory + "/rules.caddy")
+	c.Assert(err, IsNil)
+	cases, err := filtertest.LoadCases(testDirectory + "/failing")
+	c.Assert(err, IsNil)
+
+	_, err = cases[0].Execute(target)
+	c.Assert(err, ErrorMatches, "case 'missing-expected': there is no expected file '.*/expected.txt' \\(run with -filtertest.update to create it\\)")
+
+	_, err = cases[1].Execute(target)
+	c.Assert(err.Error(), Equals, "case 'wrong-body': unexpected body (matched rules: greeting):\n"+
+		"--- "+testDirectory+"/failing/wrong-body/expected.html\n"+
+		"+++ actual\n"+
+		"@@ -1,1 +1,1 @@\n"+
+		"-<p>Hello</p>\n"+
+		"+<p>Hello </p>\n")
+}
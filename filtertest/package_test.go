@@ -0,0 +1,16 @@
+package filtertest_test
+
+import (
+	"github.com/echocat/caddy-filter/filtertest"
+	. "gopkg.in/check.v1"
+	"testing"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+// TestRun demonstrates the usage of this package by users.
+func TestRun(t *testing.T) {
+	filtertest.Run(t, "../resources/test/golden/rules.caddy", "../resources/test/golden/cases")
+}
@@ -0,0 +1,166 @@
+package filtertest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/caddyfile"
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	_ "github.com/echocat/caddy-filter"
+)
+
+const (
+	// debugToken is added as 'debug' directive to every parsed configuration to report
+	// the decisions of the filter back to the simulation.
+	debugToken = "filtertest"
+
+	debugRequestHeader       = "X-Filter-Debug"
+	debugMatchedHeader       = "X-Filter-Matched"
+	debugReplacementsHeader  = "X-Filter-Replacements"
+	debugSkippedReasonHeader = "X-Filter-Skipped-Reason"
+	debugDecodeFailureHeader = "X-Filter-Decode-Failure"
+)
+
+type simulationKey struct{}
+
+// Filter is a parsed filter configuration which could be applied to responses
+// without running Caddy. It is used by Run and the command line tool cmd/caddy-filter.
+type Filter struct {
+	handler httpserver.Handler
+}
+
+// Simulation describes a request and the response of the upstream handler to filter.
+type Simulation struct {
+	Method         string
+	Path           string
+	RequestHeader  http.Header
+	Status         int
+	ResponseHeader http.Header
+	Body           []byte
+}
+
+// SimulationResult is the response delivered by the filter for a Simulation.
+type SimulationResult struct {
+	Status        int
+	Header        http.Header
+	Body          []byte
+	MatchedRules  []string
+	Replacements  int
+	SkippedReason string
+	DecodeFailure string
+}
+
+// ParseFilter parses the filter configuration of the given file with the setup of the
+// 'filter' directive used by Caddy. The file either contains 'filter' directives of a
+// Caddyfile or is a rule file like accepted by the 'include' directive.
+func ParseFilter(filename string) (*Filter, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	setup, err := caddy.DirectiveAction("http", "filter")
+	if err != nil {
+		return nil, err
+	}
+	controller := caddy.NewTestController("http", "")
+	if containsFilterDirectives(filename, content) {
+		content = append(append([]byte{}, content...), "\nfilter debug "+debugToken+"\n"...)
+		controller.Dispenser = caddyfile.NewDispenser(filename, bytes.NewReader(content))
+	} else {
+		controller.Dispenser = caddyfile.NewDispenserTokens(filename, []caddyfile.Token{
+			{File: filename, Line: 1, Text: "filter"},
+			{File: filename, Line: 1, Text: "include"},
+			{File: filename, Line: 1, Text: filepath.Base(filename)},
+			{File: filename, Line: 2, Text: "filter"},
+			{File: filename, Line: 2, Text: "debug"},
+			{File: filename, Line: 2, Text: debugToken},
+		})
+	}
+	if err := setup(controller); err != nil {
+		return nil, err
+	}
+	middlewares := httpserver.GetConfig(controller).Middleware()
+	if len(middlewares) <= 0 {
+		return nil, fmt.Errorf("there is no rule block in '%v'", filename)
+	}
+	var handler httpserver.Handler = httpserver.HandlerFunc(serveSimulation)
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return &Filter{handler: handler}, nil
+}
+
+func containsFilterDirectives(filename string, content []byte) bool {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml", ".json":
+		return false
+	}
+	dispenser := caddyfile.NewDispenser(filename, bytes.NewReader(content))
+	return dispenser.Next() && dispenser.Val() == "filter"
+}
+
+// serveSimulation delivers the upstream response of the simulation of the given request.
+func serveSimulation(writer http.ResponseWriter, request *http.Request) (int, error) {
+	simulation := request.Context().Value(simulationKey{}).(Simulation)
+	for key, values := range simulation.ResponseHeader {
+		writer.Header()[key] = values
+	}
+	writer.WriteHeader(simulation.Status)
+	if _, err := writer.Write(simulation.Body); err != nil {
+		return 0, err
+	}
+	return simulation.Status, nil
+}
+
+// Apply executes the filter for the given simulated request and response.
+func (instance *Filter) Apply(simulation Simulation) (*SimulationResult, error) {
+	if simulation.Method == "" {
+		simulation.Method = "GET"
+	}
+	if simulation.Path == "" {
+		simulation.Path = "/"
+	}
+	if simulation.Status == 0 {
+		simulation.Status = http.StatusOK
+	}
+	request := httptest.NewRequest(simulation.Method, simulation.Path, nil)
+	request = request.WithContext(context.WithValue(request.Context(), simulationKey{}, simulation))
+	for key, values := range simulation.RequestHeader {
+		request.Header[key] = values
+	}
+	request.Header.Set(debugRequestHeader, debugToken)
+
+	recorder := httptest.NewRecorder()
+	result, err := instance.handler.ServeHTTP(recorder, request)
+	if err != nil {
+		return nil, err
+	}
+	if result == 0 {
+		result = recorder.Code
+	}
+	header := recorder.Header()
+	replacements, _ := strconv.Atoi(header.Get(debugReplacementsHeader))
+	response := &SimulationResult{
+		Status:        result,
+		Header:        header,
+		Body:          recorder.Body.Bytes(),
+		Replacements:  replacements,
+		SkippedReason: header.Get(debugSkippedReasonHeader),
+		DecodeFailure: header.Get(debugDecodeFailureHeader),
+	}
+	if matched := header.Get(debugMatchedHeader); matched != "" {
+		response.MatchedRules = strings.Split(matched, ",")
+	}
+	for _, name := range []string{debugMatchedHeader, debugReplacementsHeader, debugSkippedReasonHeader, debugDecodeFailureHeader} {
+		header.Del(name)
+	}
+	return response, nil
+}
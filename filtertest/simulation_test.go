@@ -0,0 +1,61 @@
+package filtertest_test
+
+import (
+	"net/http"
+
+	"github.com/echocat/caddy-filter/filtertest"
+
+	. "gopkg.in/check.v1"
+)
+
+type simulationTest struct{}
+
+func init() {
+	Suite(&simulationTest{})
+}
+
+func (s *simulationTest) Test_ParseFilterAndApply(c *C) {
+	instance, err := filtertest.ParseFilter("../resources/test/cli/rules.caddy")
+	c.Assert(err, IsNil)
+
+	result, err := instance.Apply(filtertest.Simulation{
+		Path:           "/index.html",
+		RequestHeader:  http.Header{"X-Name": {"Tom"}},
+		ResponseHeader: http.Header{"Content-Type": {"text/html"}},
+		Body:           []byte("Hello! Hello!"),
+	})
+	c.Assert(err, IsNil)
+	c.Assert(result.Status, Equals, 200)
+	c.Assert(string(result.Body), Equals, "Bye Tom! Bye Tom!")
+	c.Assert(result.MatchedRules, DeepEquals, []string{"greeting"})
+	c.Assert(result.Replacements, Equals, 2)
+	c.Assert(result.Header.Get("X-Filter-Matched"), Equals, "")
+
+	result, err = instance.Apply(filtertest.Simulation{
+		Path:   "/index.txt",
+		Status: 404,
+		Body:   []byte("Hello!"),
+	})
+	c.Assert(err, IsNil)
+	c.Assert(result.Status, Equals, 404)
+	c.Assert(string(result.Body), Equals, "Hello!")
+	c.Assert(result.MatchedRules, IsNil)
+}
+
+func (s *simulationTest) Test_ParseFilterOfRuleFile(c *C) {
+	instance, err := filtertest.ParseFilter("../resources/test/rules/common.yaml")
+	c.Assert(err, IsNil)
+	c.Assert(instance, NotNil)
+
+	instance, err = filtertest.ParseFilter("../resources/test/rules/common.caddy")
+	c.Assert(err, IsNil)
+	c.Assert(instance, NotNil)
+}
+
+func (s *simulationTest) Test_ParseFilterWithErrors(c *C) {
+	_, err := filtertest.ParseFilter("../resources/test/cli/missing.caddy")
+	c.Assert(err, NotNil)
+
+	_, err = filtertest.ParseFilter("../resources/test/rules/cyclic.caddy")
+	c.Assert(err, ErrorMatches, ".*Cyclic include of filter file '../resources/test/rules/cyclic.caddy'.")
+}
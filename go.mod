@@ -4,7 +4,13 @@ go 1.12
 
 require (
 	github.com/NYTimes/gziphandler v1.1.1
+	github.com/antchfx/xpath v1.1.10
 	github.com/caddyserver/caddy v1.0.1
 	github.com/echocat/gocheck-addons v0.0.0-20170127185256-3597b4964e95
+	github.com/go-interpreter/wagon v0.6.0
+	github.com/tdewolff/minify/v2 v2.7.0
+	github.com/yuin/gopher-lua v0.0.0-20190514113301-1cd887cd7036
+	golang.org/x/text v0.3.0
 	gopkg.in/check.v1 v0.0.0-20161208181325-20d25e280405
+	gopkg.in/yaml.v2 v2.2.2
 )
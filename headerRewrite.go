@@ -0,0 +1,130 @@
+package filter
+
+import (
+	"bytes"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// headerRewrite replaces every match of pattern in a header value. The replacement could
+// contain the same placeholders like the replacement of a rule.
+type headerRewrite struct {
+	pattern     *regexp.Regexp
+	replacement []byte
+}
+
+func (instance *headerRewrite) rewrite(action *ruleReplaceAction, value string) string {
+	action.replacement = instance.replacement
+	action.placeholders = nil
+	return replaceAllString(instance.pattern, value, action.writeReplacement)
+}
+
+// cookieRewrite modifies the attributes of every cookie set by a response whose name matches.
+type cookieRewrite struct {
+	// name of the cookies to rewrite; nil means all cookies.
+	name   *regexp.Regexp
+	domain *headerRewrite
+	path   *headerRewrite
+	// add contains attributes like "Secure" or "SameSite=Lax" which replace existing ones with the same name.
+	add []string
+	// remove contains the lower case names of attributes to remove.
+	remove []string
+}
+
+func (instance *cookieRewrite) rewrite(action *ruleReplaceAction, value string) string {
+	parts := strings.Split(value, ";")
+	if instance.name != nil && !instance.name.MatchString(cookieAttributeNameOf(parts[0])) {
+		return value
+	}
+	result := parts[:1]
+	for _, part := range parts[1:] {
+		name := strings.ToLower(cookieAttributeNameOf(part))
+		if instance.isRemoved(name) {
+			continue
+		}
+		if attribute := instance.rewriteOf(name); attribute != nil {
+			rewritten := attribute.rewrite(action, cookieAttributeValueOf(part))
+			if rewritten == "" {
+				continue
+			}
+			part = " " + strings.TrimSpace(part[:strings.Index(part, "=")]) + "=" + rewritten
+		}
+		result = append(result, part)
+	}
+	for _, attribute := range instance.add {
+		result = append(result, " "+attribute)
+	}
+	return strings.Join(result, ";")
+}
+
+func (instance *cookieRewrite) rewriteOf(attributeName string) *headerRewrite {
+	switch attributeName {
+	case "domain":
+		return instance.domain
+	case "path":
+		return instance.path
+	}
+	return nil
+}
+
+// isRemoved returns true if the attribute is removed or replaced by an added one.
+func (instance *cookieRewrite) isRemoved(attributeName string) bool {
+	for _, candidate := range instance.remove {
+		if candidate == attributeName {
+			return true
+		}
+	}
+	for _, candidate := range instance.add {
+		if strings.ToLower(cookieAttributeNameOf(candidate)) == attributeName {
+			return true
+		}
+	}
+	return false
+}
+
+func cookieAttributeNameOf(attribute string) string {
+	if i := strings.Index(attribute, "="); i >= 0 {
+		attribute = attribute[:i]
+	}
+	return strings.TrimSpace(attribute)
+}
+
+func cookieAttributeValueOf(attribute string) string {
+	if i := strings.Index(attribute, "="); i >= 0 {
+		return strings.TrimSpace(attribute[i+1:])
+	}
+	return ""
+}
+
+// replaceAllString replaces every match of the given pattern in value with the output of write.
+func replaceAllString(pattern *regexp.Regexp, value string, write func(output *bytes.Buffer, input []byte, match []int)) string {
+	input := []byte(value)
+	matches := pattern.FindAllSubmatchIndex(input, -1)
+	if len(matches) <= 0 {
+		return value
+	}
+	output := new(bytes.Buffer)
+	last := 0
+	for _, match := range matches {
+		output.Write(input[last:match[0]])
+		write(output, input, match)
+		last = match[1]
+	}
+	output.Write(input[last:])
+	return output.String()
+}
+
+// rewriteResponseHeader applies all location and cookie rewrites to the given response header.
+func rewriteResponseHeader(action *ruleReplaceAction, header http.Header, locationRewrites []*headerRewrite, cookieRewrites []*cookieRewrite) {
+	for _, rewrite := range locationRewrites {
+		for i, value := range header["Location"] {
+			header["Location"][i] = rewrite.rewrite(action, value)
+		}
+	}
+	for _, rewrite := range cookieRewrites {
+		for i, value := range header["Set-Cookie"] {
+			header["Set-Cookie"][i] = rewrite.rewrite(action, value)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package filter
+
+import (
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	. "gopkg.in/check.v1"
+	"net/http"
+	"regexp"
+)
+
+type headerRewriteTest struct{}
+
+func init() {
+	Suite(&headerRewriteTest{})
+}
+
+func (s *headerRewriteTest) newAction() *ruleReplaceAction {
+	request := &http.Request{URL: testUrl1, Host: "example.org"}
+	return &ruleReplaceAction{request: request, responseHeader: &http.Header{}}
+}
+
+func (s *headerRewriteTest) Test_headerRewrite(c *C) {
+	rewrite := &headerRewrite{
+		pattern:     regexp.MustCompile("^http://backend:8080(/.*)?$"),
+		replacement: []byte("https://{request_host}{1}"),
+	}
+	c.Assert(rewrite.rewrite(s.newAction(), "http://backend:8080/login?foo"), Equals, "https://example.org/login?foo")
+	c.Assert(rewrite.rewrite(s.newAction(), "http://other/login"), Equals, "http://other/login")
+}
+
+func (s *headerRewriteTest) Test_cookieRewrite(c *C) {
+	rewrite := &cookieRewrite{
+		name:   regexp.MustCompile("^session$"),
+		domain: &headerRewrite{pattern: regexp.MustCompile("^backend$"), replacement: []byte("{request_host}")},
+		path:   &headerRewrite{pattern: regexp.MustCompile("^/app"), replacement: []byte("")},
+		add:    []string{"Secure", "SameSite=Lax"},
+		remove: []string{"expires"},
+	}
+	c.Assert(rewrite.rewrite(s.newAction(), "session=abc; Domain=backend; Path=/app/foo; Expires=Wed, 21 Oct 2015 07:28:00 GMT; samesite=None"),
+		Equals, "session=abc; Domain=example.org; Path=/foo; Secure; SameSite=Lax")
+	c.Assert(rewrite.rewrite(s.newAction(), "session=abc; Path=/app"),
+		Equals, "session=abc; Secure; SameSite=Lax")
+	c.Assert(rewrite.rewrite(s.newAction(), "other=abc; Path=/app"),
+		Equals, "other=abc; Path=/app")
+}
+
+func (s *headerRewriteTest) Test_rewriteResponseHeader(c *C) {
+	header := http.Header{
+		"Location":   {"http://backend:8080/login"},
+		"Set-Cookie": {"a=1; Secure", "b=2"},
+	}
+	rewriteResponseHeader(s.newAction(), header, []*headerRewrite{
+		{pattern: regexp.MustCompile("^http://backend:8080"), replacement: []byte("https://{request_host}")},
+		{pattern: regexp.MustCompile("/login$"), replacement: []byte("/signin")},
+	}, []*cookieRewrite{
+		{remove: []string{"secure"}},
+	})
+	c.Assert(header, DeepEquals, http.Header{
+		"Location":   {"https://example.org/signin"},
+		"Set-Cookie": {"a=1", "b=2"},
+	})
+}
+
+func (s *headerRewriteTest) Test_ServeHTTP_withRedirect(c *C) {
+	handler := &filterHandler{
+		next: httpserver.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) (int, error) {
+			writer.Header().Set("Location", "http://backend:8080/login")
+			writer.Header().Add("Set-Cookie", "session=abc; Path=/")
+			writer.WriteHeader(http.StatusMovedPermanently)
+			return http.StatusMovedPermanently, nil
+		}),
+		rules: []*rule{{
+			path: regexp.MustCompile(".*"),
+			locationRewrites: []*headerRewrite{
+				{pattern: regexp.MustCompile("^http://backend:8080"), replacement: []byte("https://{request_host}")},
+			},
+			cookieRewrites: []*cookieRewrite{
+				{add: []string{"Secure"}},
+			},
+		}},
+		maximumBufferSize: defaultMaxBufferSize,
+	}
+	writer := newMockResponseWriter()
+	_, err := handler.ServeHTTP(writer, &http.Request{URL: testUrl1, Host: "example.org"})
+	c.Assert(err, IsNil)
+	c.Assert(writer.status, Equals, http.StatusMovedPermanently)
+	c.Assert(writer.Header().Get("Location"), Equals, "https://example.org/login")
+	c.Assert(writer.Header().Get("Set-Cookie"), Equals, "session=abc; Path=/; Secure")
+}
+
+func (s *headerRewriteTest) Test_ServeHTTP_withoutBodyFiltering(c *C) {
+	handler := &filterHandler{
+		next: newMockHandler("Hello world!", 200),
+		rules: []*rule{{
+			path:           regexp.MustCompile(".*"),
+			cookieRewrites: []*cookieRewrite{{add: []string{"Secure"}}},
+		}},
+		maximumBufferSize: defaultMaxBufferSize,
+	}
+	writer := newMockResponseWriter()
+	_, err := handler.ServeHTTP(writer, &http.Request{URL: testUrl1})
+	c.Assert(err, IsNil)
+	c.Assert(writer.buffer.String(), Equals, "Hello world!")
+}
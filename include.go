@@ -0,0 +1,258 @@
+package filter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+const (
+	defaultMaximumIncludeVirtualDepth = 3
+	maximumIncludeCacheEntries        = 1000
+)
+
+// includeDepthCtxKey holds the number of sub-requests the current request is nested in.
+const includeDepthCtxKey = caddy.CtxKey("filter_include_depth")
+
+var (
+	errIncludeDepthExceeded = errors.New("maximum include depth exceeded")
+	errIncludeTooLarge      = errors.New("body of sub-request exceeds max_buffer_size")
+)
+
+// ruleInclude replaces every match of a rule with the body of an internal sub-request.
+type ruleInclude struct {
+	// path of the sub-request which could contain the same placeholders like replacements.
+	path     []byte
+	cacheTtl time.Duration
+	// filtered sends the sub-request through the filter again instead of only the following handlers.
+	filtered bool
+}
+
+// includer fetches the body of the given path by an internal sub-request of the given request.
+// The recorded body is reserved by the given function; could be nil.
+type includer func(request *http.Request, path string, include *ruleInclude, reserve func(n int) bool) ([]byte, error)
+
+// include is the includer of the handler. Sub-requests are always GET requests with a copy of
+// the headers and the context of the original request. Their bodies are limited like the
+// recorded responses by max_buffer_size.
+func (instance filterHandler) include(parent *http.Request, path string, include *ruleInclude, reserve func(n int) bool) ([]byte, error) {
+	depth, _ := parent.Context().Value(includeDepthCtxKey).(int)
+	if depth >= instance.maximumIncludeVirtualDepth {
+		return nil, errIncludeDepthExceeded
+	}
+	reference, err := url.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	if reference.IsAbs() || reference.Host != "" {
+		return nil, fmt.Errorf("only paths of the same site could be included")
+	}
+	target := parent.URL.ResolveReference(reference)
+	// Responses for requests with credentials or cookies could be personalized and are never shared by the cache.
+	cached := include.cacheTtl > 0 && parent.Header.Get("Authorization") == "" && parent.Header.Get("Cookie") == ""
+	cacheKey := parent.Host + target.RequestURI()
+	if include.filtered {
+		cacheKey += "#filtered"
+	}
+	header := includeHeaderOf(parent.Header)
+	if cached {
+		if body, ok := instance.includeCache.get(cacheKey, header); ok {
+			return body, nil
+		}
+	}
+
+	request := parent.WithContext(context.WithValue(parent.Context(), includeDepthCtxKey, depth+1))
+	request.Method = "GET"
+	request.URL = target
+	request.RequestURI = target.RequestURI()
+	request.Header = includeHeaderOf(parent.Header)
+	request.Body = http.NoBody
+	request.ContentLength = 0
+	request.GetBody = nil
+
+	var handler httpserver.Handler = instance.next
+	if include.filtered {
+		handler = instance
+	}
+	recorder := newIncludeRecorder()
+	recorder.maximumSize = instance.maximumBufferSize
+	recorder.reserve = reserve
+	status, err := handler.ServeHTTP(recorder, request)
+	if recorder.err != nil {
+		return nil, recorder.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if recorder.status != 0 {
+		status = recorder.status
+	}
+	if status < 200 || status >= 300 {
+		return nil, fmt.Errorf("sub-request responded with status %d", status)
+	}
+	if encoding := recorder.header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return nil, fmt.Errorf("sub-request responded with unsupported encoding '%v'", encoding)
+	}
+	body := recorder.body.Bytes()
+	if cached && isIncludeCacheable(recorder.header) {
+		instance.includeCache.put(cacheKey, header, recorder.header, body, time.Now().Add(include.cacheTtl))
+	}
+	return body, nil
+}
+
+// isIncludeCacheable returns false for responses which are specific to the client like
+// responses which set cookies or are marked as private.
+func isIncludeCacheable(header http.Header) bool {
+	if len(header["Set-Cookie"]) > 0 || header.Get("Vary") == "*" {
+		return false
+	}
+	for _, value := range header["Cache-Control"] {
+		for _, directive := range strings.Split(value, ",") {
+			name := strings.ToLower(strings.TrimSpace(directive))
+			if i := strings.IndexByte(name, '='); i >= 0 {
+				name = strings.TrimSpace(name[:i])
+			}
+			if name == "private" || name == "no-store" {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// includeHeaderOf copies the headers of the original request without the ones which could
+// prevent a complete and plain body.
+func includeHeaderOf(header http.Header) http.Header {
+	result := make(http.Header, len(header))
+	for key, values := range header {
+		if key == "Accept-Encoding" || key == "Range" || strings.HasPrefix(key, "If-") {
+			continue
+		}
+		result[key] = append([]string(nil), values...)
+	}
+	return result
+}
+
+type includeRecorder struct {
+	header http.Header
+	status int
+	body   *bytes.Buffer
+	// maximumSize of the body; negative means unlimited.
+	maximumSize int
+	// reserve reserves the body from the buffer budget; could be nil.
+	reserve func(n int) bool
+	// err is the reason why the body was not completely recorded.
+	err error
+}
+
+func newIncludeRecorder() *includeRecorder {
+	return &includeRecorder{
+		header: http.Header{},
+		body:   new(bytes.Buffer),
+	}
+}
+
+func (instance *includeRecorder) Header() http.Header {
+	return instance.header
+}
+
+func (instance *includeRecorder) WriteHeader(status int) {
+	if instance.status == 0 {
+		instance.status = status
+	}
+}
+
+func (instance *includeRecorder) Write(content []byte) (int, error) {
+	instance.WriteHeader(http.StatusOK)
+	if instance.err != nil {
+		return 0, instance.err
+	}
+	if instance.maximumSize >= 0 && instance.body.Len()+len(content) > instance.maximumSize {
+		instance.err = errIncludeTooLarge
+		return 0, instance.err
+	}
+	if instance.reserve != nil && !instance.reserve(len(content)) {
+		instance.err = errTotalBufferExhausted
+		return 0, instance.err
+	}
+	return instance.body.Write(content)
+}
+
+// includeCache holds the bodies of sub-requests until they expire. Bodies are cached by host,
+// path and query of the sub-request. If the response varies by request headers (see 'Vary')
+// the body is only used for sub-requests with the same values of these headers.
+type includeCache struct {
+	mutex   sync.Mutex
+	entries map[string]includeCacheEntry
+}
+
+type includeCacheEntry struct {
+	body    []byte
+	expires time.Time
+	// vary contains the request headers the body varies by with the values it was requested with.
+	vary http.Header
+}
+
+func newIncludeCache() *includeCache {
+	return &includeCache{
+		entries: map[string]includeCacheEntry{},
+	}
+}
+
+func (instance *includeCache) get(key string, requestHeader http.Header) ([]byte, bool) {
+	if instance == nil {
+		return nil, false
+	}
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	entry, ok := instance.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	for name, values := range entry.vary {
+		if strings.Join(requestHeader[name], ",") != strings.Join(values, ",") {
+			return nil, false
+		}
+	}
+	return entry.body, true
+}
+
+// put stores the given body. If the cache is full the expired entries are removed and if
+// this is not enough the body is not cached.
+func (instance *includeCache) put(key string, requestHeader http.Header, responseHeader http.Header, body []byte, expires time.Time) {
+	if instance == nil {
+		return
+	}
+	vary := http.Header{}
+	for _, value := range responseHeader["Vary"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				name = http.CanonicalHeaderKey(name)
+				vary[name] = requestHeader[name]
+			}
+		}
+	}
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	if len(instance.entries) >= maximumIncludeCacheEntries {
+		now := time.Now()
+		for candidate, entry := range instance.entries {
+			if now.After(entry.expires) {
+				delete(instance.entries, candidate)
+			}
+		}
+		if len(instance.entries) >= maximumIncludeCacheEntries {
+			return
+		}
+	}
+	instance.entries[key] = includeCacheEntry{body: body, expires: expires, vary: vary}
+}
@@ -0,0 +1,272 @@
+package filter
+
+import (
+	"fmt"
+	. "gopkg.in/check.v1"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type includeTest struct {
+	next    *pathHandler
+	handler *filterHandler
+	request *http.Request
+	writer  *mockResponseWriter
+}
+
+func init() {
+	Suite(&includeTest{})
+}
+
+func (s *includeTest) SetUpTest(c *C) {
+	s.next = &pathHandler{
+		responses: map[string]string{
+			"/index.html":          "<body><!--#include virtual=\"nav.html\"--></body>",
+			"/nav.html":            "<nav>{request_header_X-Name}</nav>",
+			"/recursive.html":      "[<!--#include virtual=\"/recursive.html\"-->]",
+			"/fragments/foo.html":  "foo",
+			"/fragments/deep.html": "<!--#include virtual=\"foo.html\"-->",
+		},
+		requests: map[string]*http.Request{},
+	}
+	s.handler = &filterHandler{
+		next: s.next,
+		rules: []*rule{{
+			contentType:   regexp.MustCompile("text/html"),
+			searchPattern: regexp.MustCompile("<!--#include virtual=\"([^\"]+)\"-->"),
+			include:       &ruleInclude{path: []byte("{1}")},
+		}},
+		maximumBufferSize:          defaultMaxBufferSize,
+		maximumIncludeVirtualDepth: defaultMaximumIncludeVirtualDepth,
+		includeCache:               newIncludeCache(),
+	}
+	s.request = &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/index.html"},
+		Header: http.Header{"X-Name": {"Tom"}, "Accept-Encoding": {"gzip"}, "If-None-Match": {"abc"}},
+	}
+	s.writer = newMockResponseWriter()
+}
+
+func (s *includeTest) Test_include(c *C) {
+	_, err := s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(s.writer.buffer.String(), Equals, "<body><nav>{request_header_X-Name}</nav></body>")
+
+	sub := s.next.requests["/nav.html"]
+	c.Assert(sub.Method, Equals, "GET")
+	c.Assert(sub.Header.Get("X-Name"), Equals, "Tom")
+	c.Assert(sub.Header.Get("Accept-Encoding"), Equals, "")
+	c.Assert(sub.Header.Get("If-None-Match"), Equals, "")
+	c.Assert(sub.Context().Value(includeDepthCtxKey), Equals, 1)
+	c.Assert(s.request.Header.Get("Accept-Encoding"), Equals, "gzip")
+}
+
+func (s *includeTest) Test_include_filteredWithDepthLimit(c *C) {
+	s.handler.rules[0].include.filtered = true
+	s.handler.maximumIncludeVirtualDepth = 2
+	s.request.URL.Path = "/recursive.html"
+	_, err := s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(s.writer.buffer.String(), Equals, "[[[<!--#include virtual=\"/recursive.html\"-->]]]")
+}
+
+func (s *includeTest) Test_include_filteredRelativeToSubRequest(c *C) {
+	s.handler.rules[0].include.filtered = true
+	s.next.responses["/index.html"] = "<!--#include virtual=\"/fragments/deep.html\"-->"
+	_, err := s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(s.writer.buffer.String(), Equals, "foo")
+}
+
+func (s *includeTest) Test_include_withCache(c *C) {
+	s.handler.rules[0].include.cacheTtl = time.Minute
+	for i := 0; i < 3; i++ {
+		_, err := s.handler.ServeHTTP(newMockResponseWriter(), s.request)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(s.next.calls["/nav.html"], Equals, 1)
+	c.Assert(s.next.calls["/index.html"], Equals, 3)
+}
+
+func (s *includeTest) Test_include_withFailures(c *C) {
+	s.next.responses["/index.html"] = "<!--#include virtual=\"missing.html\"-->|<!--#include virtual=\"http://example.org/\"-->"
+	_, err := s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(s.writer.buffer.String(), Equals, "<!--#include virtual=\"missing.html\"-->|<!--#include virtual=\"http://example.org/\"-->")
+}
+
+func (s *includeTest) Test_include_withCacheByHost(c *C) {
+	s.handler.rules[0].include.cacheTtl = time.Minute
+	for _, host := range []string{"a.example.org", "b.example.org", "a.example.org"} {
+		s.request.Host = host
+		_, err := s.handler.ServeHTTP(newMockResponseWriter(), s.request)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(s.next.calls["/nav.html"], Equals, 2)
+}
+
+func (s *includeTest) Test_include_withCacheAndVary(c *C) {
+	s.handler.rules[0].include.cacheTtl = time.Minute
+	s.next.headers = map[string]http.Header{"/nav.html": {"Vary": {"Accept-Language, X-Name"}}}
+	for _, name := range []string{"Tom", "Tom", "Anna"} {
+		s.request.Header.Set("X-Name", name)
+		_, err := s.handler.ServeHTTP(newMockResponseWriter(), s.request)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(s.next.calls["/nav.html"], Equals, 2)
+
+	s.next.headers["/nav.html"].Set("Vary", "*")
+	s.next.calls = nil
+	s.handler.includeCache = newIncludeCache()
+	for i := 0; i < 2; i++ {
+		_, err := s.handler.ServeHTTP(newMockResponseWriter(), s.request)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(s.next.calls["/nav.html"], Equals, 2)
+}
+
+func (s *includeTest) Test_include_withCacheOfPrivateResponses(c *C) {
+	s.handler.rules[0].include.cacheTtl = time.Minute
+	for _, header := range []http.Header{
+		{"Set-Cookie": {"session=abc"}},
+		{"Cache-Control": {"max-age=60, private"}},
+		{"Cache-Control": {"no-store"}},
+		{"Cache-Control": {"private=\"Set-Cookie\""}},
+	} {
+		s.next.headers = map[string]http.Header{"/nav.html": header}
+		s.next.calls = nil
+		s.handler.includeCache = newIncludeCache()
+		for i := 0; i < 2; i++ {
+			_, err := s.handler.ServeHTTP(newMockResponseWriter(), s.request)
+			c.Assert(err, IsNil)
+		}
+		c.Assert(s.next.calls["/nav.html"], Equals, 2, Commentf("%v", header))
+	}
+
+	s.next.headers = nil
+	for _, header := range []http.Header{
+		{"Authorization": {"Basic YTpi"}},
+		{"Cookie": {"session=abc"}},
+	} {
+		s.next.calls = nil
+		s.request.Header = header
+		for i := 0; i < 2; i++ {
+			_, err := s.handler.ServeHTTP(newMockResponseWriter(), s.request)
+			c.Assert(err, IsNil)
+		}
+		c.Assert(s.next.calls["/nav.html"], Equals, 2, Commentf("%v", header))
+	}
+}
+
+func (s *includeTest) Test_include_withMaximumBufferSize(c *C) {
+	s.next.responses["/nav.html"] = strings.Repeat("x", 100)
+	s.handler.maximumBufferSize = 60
+	_, err := s.handler.ServeHTTP(s.writer, s.request)
+	c.Assert(err, IsNil)
+	c.Assert(s.writer.buffer.String(), Equals, "<body><!--#include virtual=\"nav.html\"--></body>")
+}
+
+func (s *includeTest) Test_includeRecorder(c *C) {
+	recorder := newIncludeRecorder()
+	recorder.maximumSize = 5
+	var reserved []int
+	recorder.reserve = func(n int) bool {
+		reserved = append(reserved, n)
+		return len(reserved) < 2
+	}
+	n, err := recorder.Write([]byte("abc"))
+	c.Assert(n, Equals, 3)
+	c.Assert(err, IsNil)
+	_, err = recorder.Write([]byte("def"))
+	c.Assert(err, Equals, errIncludeTooLarge)
+
+	recorder = newIncludeRecorder()
+	recorder.maximumSize = -1
+	recorder.reserve = func(n int) bool {
+		reserved = append(reserved, n)
+		return false
+	}
+	_, err = recorder.Write([]byte("abc"))
+	c.Assert(err, Equals, errTotalBufferExhausted)
+	_, err = recorder.Write([]byte("abc"))
+	c.Assert(err, Equals, errTotalBufferExhausted)
+	c.Assert(reserved, DeepEquals, []int{3, 3})
+}
+
+func (s *includeTest) Test_isIncludeCacheable(c *C) {
+	c.Assert(isIncludeCacheable(http.Header{}), Equals, true)
+	c.Assert(isIncludeCacheable(http.Header{"Cache-Control": {"public, max-age=60"}, "Vary": {"Accept-Language"}}), Equals, true)
+	c.Assert(isIncludeCacheable(http.Header{"Set-Cookie": {"a=b"}}), Equals, false)
+	c.Assert(isIncludeCacheable(http.Header{"Cache-Control": {"Private"}}), Equals, false)
+	c.Assert(isIncludeCacheable(http.Header{"Cache-Control": {"max-age=60", "no-store"}}), Equals, false)
+	c.Assert(isIncludeCacheable(http.Header{"Vary": {"*"}}), Equals, false)
+}
+
+func (s *includeTest) Test_includeCache(c *C) {
+	cache := newIncludeCache()
+	cache.put("a", http.Header{}, http.Header{}, []byte("A"), time.Now().Add(time.Minute))
+	cache.put("b", http.Header{}, http.Header{}, []byte("B"), time.Now().Add(-time.Minute))
+	body, ok := cache.get("a", http.Header{})
+	c.Assert(ok, Equals, true)
+	c.Assert(string(body), Equals, "A")
+	_, ok = cache.get("b", http.Header{})
+	c.Assert(ok, Equals, false)
+	_, ok = cache.get("c", http.Header{})
+	c.Assert(ok, Equals, false)
+
+	for i := 0; i < maximumIncludeCacheEntries; i++ {
+		cache.put(fmt.Sprint(i), http.Header{}, http.Header{}, []byte("x"), time.Now().Add(time.Minute))
+	}
+	_, ok = cache.get("b", http.Header{})
+	c.Assert(ok, Equals, false)
+	c.Assert(len(cache.entries), Equals, maximumIncludeCacheEntries)
+
+	var nilCache *includeCache
+	nilCache.put("a", http.Header{}, http.Header{}, []byte("A"), time.Now().Add(time.Minute))
+	_, ok = nilCache.get("a", http.Header{})
+	c.Assert(ok, Equals, false)
+}
+
+func (s *includeTest) Test_includeCache_withVary(c *C) {
+	cache := newIncludeCache()
+	cache.put("a", http.Header{"Accept-Language": {"de"}}, http.Header{"Vary": {"accept-language"}}, []byte("A"), time.Now().Add(time.Minute))
+	body, ok := cache.get("a", http.Header{"Accept-Language": {"de"}, "X-Other": {"x"}})
+	c.Assert(ok, Equals, true)
+	c.Assert(string(body), Equals, "A")
+	_, ok = cache.get("a", http.Header{"Accept-Language": {"en"}})
+	c.Assert(ok, Equals, false)
+	_, ok = cache.get("a", http.Header{})
+	c.Assert(ok, Equals, false)
+}
+
+// pathHandler serves the response configured for the requested path as HTML.
+type pathHandler struct {
+	responses map[string]string
+	requests  map[string]*http.Request
+	calls     map[string]int
+	// headers contains additional response headers by path.
+	headers map[string]http.Header
+}
+
+func (instance *pathHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) (int, error) {
+	if instance.calls == nil {
+		instance.calls = map[string]int{}
+	}
+	instance.requests[request.URL.Path] = request
+	instance.calls[request.URL.Path]++
+	response, ok := instance.responses[request.URL.Path]
+	if !ok {
+		return http.StatusNotFound, nil
+	}
+	writer.Header().Set("Content-Type", "text/html")
+	for key, values := range instance.headers[request.URL.Path] {
+		writer.Header()[key] = values
+	}
+	writer.WriteHeader(http.StatusOK)
+	_, err := writer.Write([]byte(response))
+	return http.StatusOK, err
+}
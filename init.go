@@ -1,12 +1,16 @@
 package filter
 
 import (
+	"fmt"
 	"github.com/caddyserver/caddy"
 	"github.com/caddyserver/caddy/caddyhttp/httpserver"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
 )
 
 func init() {
@@ -22,6 +26,11 @@ func setup(controller *caddy.Controller) error {
 		return err
 	}
 
+	if len(handler.rules) <= 0 {
+		// This directive only defines rulesets to be used by other sites.
+		return nil
+	}
+
 	config := httpserver.GetConfig(controller)
 	config.AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
 		handler.next = next
@@ -35,15 +44,34 @@ func parseConfiguration(controller *caddy.Controller) (*filterHandler, error) {
 	handler := new(filterHandler)
 	handler.rules = []*rule{}
 	handler.maximumBufferSize = defaultMaxBufferSize
+	handler.outputCharset = outputCharsetOriginal
+	handler.metrics = newFilterMetrics()
+	handler.timeoutPolicy = timeoutPolicyPass
+	handler.bufferBudget = bufferBudgetOf(controller)
+	handler.bufferPolicy = bufferBudgetPolicyBypass
+	handler.metrics.bufferBudget = handler.bufferBudget
+	handler.maximumIncludeVirtualDepth = defaultMaximumIncludeVirtualDepth
+	handler.includeCache = newIncludeCache()
+	handler.scripts = scriptCache{}
+	handler.fileHashes = newFileHashCache(httpserver.GetConfig(controller).Root)
 
+	numberOfRulesets := len(rulesetsOf(controller))
 	for controller.Next() {
 		err := evalFilterBlock(controller, handler)
 		if err != nil {
 			return nil, err
 		}
 	}
+	if handler.executionLog != nil {
+		controller.OnShutdown(handler.executionLog.Close)
+	}
+	for _, rule := range handler.rules {
+		if rule.pipe != nil {
+			controller.OnShutdown(rule.pipe.Close)
+		}
+	}
 
-	if len(handler.rules) <= 0 {
+	if len(handler.rules) <= 0 && len(rulesetsOf(controller)) <= numberOfRulesets {
 		return nil, controller.Err("No rule block provided.")
 	}
 	return handler, nil
@@ -74,8 +102,30 @@ func evalNamedBlock(controller *caddy.Controller, args []string, target *filterH
 	switch args[0] {
 	case "rule":
 		return evalRule(controller, args[1:], target)
+	case "ruleset":
+		return evalRuleset(controller, args[1:], target)
+	case "use":
+		return evalUse(controller, args[1:], target)
+	case "include":
+		return evalInclude(controller, args[1:], target)
 	case "max_buffer_size":
 		return evalMaximumBufferSize(controller, args[1:], target)
+	case "output_charset":
+		return evalOutputCharset(controller, args[1:], target)
+	case "metrics_path":
+		return evalMetricsPath(controller, args[1:], target)
+	case "debug":
+		return evalDebug(controller, args[1:], target)
+	case "log":
+		return evalExecutionLog(controller, args[1:], target)
+	case "timeout":
+		return evalTimeout(controller, args[1:], target)
+	case "on_timeout":
+		return evalTimeoutPolicy(controller, args[1:], target)
+	case "max_total_buffer":
+		return evalMaximumTotalBuffer(controller, args[1:], target)
+	case "max_include_virtual_depth":
+		return evalMaximumIncludeVirtualDepth(controller, args[1:], target)
 	}
 	return controller.Errf("Unknown directive: %v", args[0])
 }
@@ -86,9 +136,13 @@ func evalRule(controller *caddy.Controller, args []string, target *filterHandler
 	}
 	targetRule := new(rule)
 	targetRule.pathAndContentTypeCombination = pathAndContentTypeAndCombination
+	targetRule.mode = ruleModeActive
+	targetRule.scope = ruleScopeWhole
 	for controller.NextBlock() {
 		optionName := controller.Val()
 		switch optionName {
+		case "name":
+			err = evalName(controller, targetRule, target)
 		case "path":
 			err = evalPath(controller, targetRule)
 		case "content_type":
@@ -97,8 +151,74 @@ func evalRule(controller *caddy.Controller, args []string, target *filterHandler
 			err = evalPathAndContentTypeCombination(controller, targetRule)
 		case "search_pattern":
 			err = evalSearchPattern(controller, targetRule)
+		case "search_flags":
+			err = evalSearchFlags(controller, targetRule)
+		case "scope":
+			err = evalRuleScope(controller, targetRule)
 		case "replacement":
 			err = evalReplacement(controller, targetRule)
+		case "timeout":
+			err = evalRuleTimeout(controller, targetRule)
+		case "mode":
+			err = evalRuleMode(controller, targetRule)
+		case "variant":
+			err = evalVariant(controller, targetRule)
+		case "variant_key":
+			err = evalVariantKey(controller, targetRule)
+		case "variant_cookie":
+			err = evalVariantCookie(controller, targetRule)
+		case "include_virtual":
+			err = evalIncludeVirtual(controller, targetRule)
+		case "include_cache":
+			err = evalIncludeCache(controller, targetRule)
+		case "include_filtered":
+			err = evalIncludeFiltered(controller, targetRule)
+		case "rewrite_upstream_urls":
+			err = evalRewriteUpstreamUrls(controller, targetRule)
+		case "location_rewrite":
+			err = evalLocationRewrite(controller, targetRule)
+		case "cookie_rewrite":
+			err = evalCookieRewrite(controller, targetRule)
+		case "set_status":
+			err = evalSetStatus(controller, targetRule)
+		case "respond":
+			err = evalRespond(controller, targetRule)
+		case "log_original_body":
+			err = evalLogOriginalBody(controller, targetRule)
+		case "redact":
+			err = evalRedact(controller, targetRule)
+		case "redact_pattern":
+			err = evalRedactPattern(controller, targetRule)
+		case "redact_mask":
+			err = evalRedactMask(controller, targetRule)
+		case "minify":
+			err = evalMinify(controller, targetRule)
+		case "minify_keep":
+			err = evalMinifyKeep(controller, targetRule)
+		case "xml_set":
+			err = evalXmlSet(controller, targetRule)
+		case "xml_delete":
+			err = evalXmlDelete(controller, targetRule)
+		case "xml_insert":
+			err = evalXmlInsert(controller, targetRule)
+		case "script":
+			err = evalScript(controller, targetRule, target)
+		case "script_max_memory":
+			err = evalScriptMaximumMemory(controller, targetRule)
+		case "pipe":
+			err = evalPipe(controller, targetRule)
+		case "pipe_workers":
+			err = evalPipeWorkers(controller, targetRule)
+		case "pipe_timeout":
+			err = evalPipeTimeout(controller, targetRule)
+		case "pipe_on_failure":
+			err = evalPipeOnFailure(controller, targetRule)
+		case "wasm":
+			err = evalWasm(controller, targetRule)
+		case "wasm_workers":
+			err = evalWasmWorkers(controller, targetRule)
+		case "wasm_max_memory":
+			err = evalWasmMaximumMemory(controller, targetRule)
 		default:
 			err = controller.Errf("Unknown option: %v", optionName)
 		}
@@ -109,13 +229,59 @@ func evalRule(controller *caddy.Controller, args []string, target *filterHandler
 	if targetRule.path == nil && targetRule.contentType == nil {
 		return controller.Errf("Neither 'path' nor 'content_type' definition was provided for filter rule block.")
 	}
-	if targetRule.searchPattern == nil {
+	if err := completeSearchFlags(controller, targetRule); err != nil {
+		return err
+	}
+	if err := completeUpstreamUrls(controller, targetRule); err != nil {
+		return err
+	}
+	if err := completeRedaction(controller, targetRule); err != nil {
+		return err
+	}
+	if err := completeResponse(controller, targetRule); err != nil {
+		return err
+	}
+	if err := completeMinify(controller, targetRule); err != nil {
+		return err
+	}
+	if err := completeXml(controller, targetRule); err != nil {
+		return err
+	}
+	if err := completeScript(controller, targetRule); err != nil {
+		return err
+	}
+	if err := completePipe(controller, targetRule); err != nil {
+		return err
+	}
+	if err := completeWasm(controller, targetRule); err != nil {
+		return err
+	}
+	if targetRule.searchPattern == nil && targetRule.minify == nil && targetRule.xml == nil && targetRule.script == nil && targetRule.pipe == nil && targetRule.wasm == nil && !targetRule.rewritesHeader() {
 		return controller.Errf("No 'search_pattern' definition was provided for filter rule block.")
 	}
+	if targetRule.scope == ruleScopeLine && targetRule.searchPattern == nil {
+		return controller.Errf("No 'search_pattern' definition was provided for filter rule block with 'scope line'.")
+	}
+	if err := completeVariants(controller, targetRule); err != nil {
+		return err
+	}
+	if err := completeInclude(controller, targetRule); err != nil {
+		return err
+	}
 	target.rules = append(target.rules, targetRule)
 	return nil
 }
 
+func evalName(controller *caddy.Controller, target *rule, handler *filterHandler) error {
+	return evalSimpleOption(controller, func(value string) error {
+		if handler.ruleNamed(value) != nil {
+			return controller.Errf("There is already a filter rule named '%v'.", value)
+		}
+		target.name = value
+		return nil
+	})
+}
+
 func evalPath(controller *caddy.Controller, target *rule) error {
 	return evalRegexpOption(controller, func(value *regexp.Regexp) error {
 		target.path = value
@@ -149,50 +315,1109 @@ func evalSearchPattern(controller *caddy.Controller, target *rule) error {
 	})
 }
 
+func evalSearchFlags(controller *caddy.Controller, target *rule) error {
+	return evalSimpleOption(controller, func(plainValue string) error {
+		for _, flag := range plainValue {
+			if !strings.ContainsRune(possibleSearchFlags, flag) {
+				return controller.Errf("Illegal flag for 'search_flags': %c", flag)
+			}
+		}
+		target.searchFlags = plainValue
+		return nil
+	})
+}
+
+// completeSearchFlags applies the flags of 'search_flags' to the 'search_pattern' which allows
+// to define both in any order.
+func completeSearchFlags(controller *caddy.Controller, target *rule) error {
+	if target.searchFlags == "" {
+		return nil
+	}
+	if target.searchPattern == nil {
+		return controller.Errf("No 'search_pattern' definition was provided for filter rule block with 'search_flags'.")
+	}
+	value, err := regexp.Compile("(?" + target.searchFlags + ")" + target.searchPattern.String())
+	if err != nil {
+		return controller.Errf("There is no valid value for 'search_flags' provided. Got: %v", err)
+	}
+	target.searchPattern = value
+	return nil
+}
+
 func evalReplacement(controller *caddy.Controller, target *rule) error {
+	return evalReplacementOption(controller, func(value []byte) {
+		target.replacement = value
+	})
+}
+
+func evalReplacementOption(controller *caddy.Controller, setter func([]byte)) error {
 	return evalSimpleOption(controller, func(value string) error {
-		target.replacement = []byte(value)
-		if len(target.replacement) > 1 && target.replacement[0] == '@' {
-			targetFilename := string(target.replacement[1:])
-			content, err := ioutil.ReadFile(targetFilename)
+		replacement, err := contentOf(controller, "replacement", value)
+		if err != nil {
+			return err
+		}
+		if err := checkPlaceholderSections(replacement); err != nil {
+			return controller.Errf("There is no valid 'replacement' provided. Got: %v", err)
+		}
+		setter(replacement)
+		return nil
+	})
+}
+
+// contentOf returns the content of the file if the value has the form '@<file>' and the file
+// exists - otherwise the value itself.
+func contentOf(controller *caddy.Controller, optionName string, value string) ([]byte, error) {
+	result := []byte(value)
+	if len(result) > 1 && result[0] == '@' {
+		targetFilename := string(result[1:])
+		content, err := ioutil.ReadFile(targetFilename)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return nil, controller.Errf("Could not read file provided in '%v' definition. Got: %v", optionName, err)
+			}
+		} else {
+			result = content
+		}
+	}
+	return result, nil
+}
+
+func evalRuleTimeout(controller *caddy.Controller, target *rule) error {
+	return evalSimpleOption(controller, func(plainValue string) error {
+		value, err := time.ParseDuration(plainValue)
+		if err != nil || value <= 0 {
+			return controller.Errf("There is no valid value for 'timeout' provided. Got: %v", plainValue)
+		}
+		target.timeout = value
+		return nil
+	})
+}
+
+func evalRuleMode(controller *caddy.Controller, target *rule) error {
+	return evalSimpleOption(controller, func(plainValue string) error {
+		for _, candidate := range possibleRuleModes {
+			if string(candidate) == plainValue {
+				target.mode = candidate
+				return nil
+			}
+		}
+		return controller.Errf("Illegal value for 'mode': %v", plainValue)
+	})
+}
+
+func evalRuleScope(controller *caddy.Controller, target *rule) error {
+	return evalSimpleOption(controller, func(plainValue string) error {
+		for _, candidate := range possibleRuleScopes {
+			if string(candidate) == plainValue {
+				target.scope = candidate
+				return nil
+			}
+		}
+		return controller.Errf("Illegal value for 'scope': %v", plainValue)
+	})
+}
+
+func variantsOf(target *rule) *ruleVariants {
+	if target.variants == nil {
+		target.variants = newRuleVariants()
+	}
+	return target.variants
+}
+
+func evalVariant(controller *caddy.Controller, target *rule) error {
+	args := controller.RemainingArgs()
+	if len(args) < 1 || len(args) > 2 {
+		return controller.Errf("There are one or two arguments for filter rule option 'variant' expected.")
+	}
+	variants := variantsOf(target)
+	variant := &ruleVariant{name: args[0], weight: 1}
+	if !variantCookieNamePattern.MatchString(variant.name) {
+		return controller.Errf("Illegal name for 'variant': %v", variant.name)
+	}
+	if variants.variantNamed(variant.name) != nil {
+		return controller.Errf("There is already a variant named '%v'.", variant.name)
+	}
+	if len(args) > 1 {
+		if err := parseVariantWeight(controller, args[1], variant); err != nil {
+			return err
+		}
+	}
+	if controller.NextArg() {
+		// The variant block is nested in the rule block, so it is walked manually.
+		closed := false
+		for !closed && controller.Next() {
+			var err error
+			switch controller.Val() {
+			case "}":
+				closed = true
+			case "weight":
+				err = evalSimpleOption(controller, func(plainValue string) error {
+					return parseVariantWeight(controller, plainValue, variant)
+				})
+			case "replacement":
+				err = evalReplacementOption(controller, func(value []byte) {
+					variant.replacement = value
+				})
+			default:
+				err = controller.Errf("Unknown option of variant '%v': %v", variant.name, controller.Val())
+			}
 			if err != nil {
-				if !os.IsNotExist(err) {
-					return controller.Errf("Could not read file provided in 'replacement' definition. Got: %v", err)
+				return err
+			}
+		}
+		if !closed {
+			return controller.EOFErr()
+		}
+	}
+	variants.variants = append(variants.variants, variant)
+	return nil
+}
+
+func parseVariantWeight(controller *caddy.Controller, plainValue string, target *ruleVariant) error {
+	value, err := strconv.Atoi(plainValue)
+	if err != nil || value < 0 {
+		return controller.Errf("There is no valid value for 'weight' of variant '%v' provided. Got: %v", target.name, plainValue)
+	}
+	target.weight = value
+	return nil
+}
+
+func evalVariantKey(controller *caddy.Controller, target *rule) error {
+	args := controller.RemainingArgs()
+	if len(args) < 1 {
+		return controller.ArgErr()
+	}
+	variants := variantsOf(target)
+	for _, candidate := range possibleVariantKeys {
+		if string(candidate) == args[0] {
+			variants.key = candidate
+			if candidate == variantKeyHeader {
+				if len(args) != 2 {
+					return controller.Errf("The 'variant_key' header requires exact one header name.")
 				}
-			} else {
-				target.replacement = content
+				variants.keyHeader = args[1]
+			} else if len(args) != 1 {
+				return controller.ArgErr()
 			}
+			return nil
+		}
+	}
+	return controller.Errf("Illegal value for 'variant_key': %v", args[0])
+}
+
+func evalVariantCookie(controller *caddy.Controller, target *rule) error {
+	args := controller.RemainingArgs()
+	if len(args) < 1 || len(args) > 2 {
+		return controller.ArgErr()
+	}
+	variants := variantsOf(target)
+	if !variantCookieNamePattern.MatchString(args[0]) {
+		return controller.Errf("Illegal cookie name for 'variant_cookie': %v", args[0])
+	}
+	variants.cookieName = args[0]
+	if len(args) > 1 {
+		value, err := time.ParseDuration(args[1])
+		if err != nil || value <= 0 {
+			return controller.Errf("There is no valid max age for 'variant_cookie' provided. Got: %v", args[1])
+		}
+		variants.cookieMaxAge = value
+	}
+	return nil
+}
+
+func completeVariants(controller *caddy.Controller, target *rule) error {
+	variants := target.variants
+	if variants == nil {
+		return nil
+	}
+	if len(variants.variants) <= 0 {
+		return controller.Errf("No 'variant' definition was provided for filter rule block with 'variant_key' or 'variant_cookie'.")
+	}
+	if variants.totalWeight() <= 0 {
+		return controller.Errf("At least one 'variant' of a filter rule block requires a weight greater than 0.")
+	}
+	if variants.cookieName == "" {
+		if target.name == "" {
+			return controller.Errf("Filter rule blocks with variants require a 'name' or 'variant_cookie' definition.")
+		}
+		variants.cookieName = defaultVariantCookiePrefix + target.name
+		if !variantCookieNamePattern.MatchString(variants.cookieName) {
+			return controller.Errf("The name '%v' of the filter rule block could not be used as cookie name - please provide a 'variant_cookie' definition.", target.name)
 		}
+	}
+	if target.name != "" {
+		variants.placeholder = variantPlaceholder + "_" + target.name
+	} else {
+		variants.placeholder = variantPlaceholder + "_" + variants.cookieName
+	}
+	return nil
+}
+
+func includeOf(target *rule) *ruleInclude {
+	if target.include == nil {
+		target.include = new(ruleInclude)
+	}
+	return target.include
+}
+
+func evalIncludeVirtual(controller *caddy.Controller, target *rule) error {
+	return evalSimpleOption(controller, func(value string) error {
+		includeOf(target).path = []byte(value)
 		return nil
 	})
 }
 
-func evalSimpleOption(controller *caddy.Controller, setter func(string) error) error {
+func evalIncludeCache(controller *caddy.Controller, target *rule) error {
+	return evalSimpleOption(controller, func(plainValue string) error {
+		value, err := time.ParseDuration(plainValue)
+		if err != nil || value < 0 {
+			return controller.Errf("There is no valid value for 'include_cache' provided. Got: %v", plainValue)
+		}
+		includeOf(target).cacheTtl = value
+		return nil
+	})
+}
+
+func evalIncludeFiltered(controller *caddy.Controller, target *rule) error {
+	return evalSimpleOption(controller, func(plainValue string) error {
+		value, err := strconv.ParseBool(plainValue)
+		if err != nil {
+			return controller.Errf("There is no valid value for 'include_filtered' provided. Got: %v", plainValue)
+		}
+		includeOf(target).filtered = value
+		return nil
+	})
+}
+
+func completeInclude(controller *caddy.Controller, target *rule) error {
+	include := target.include
+	if include == nil {
+		return nil
+	}
+	if len(include.path) <= 0 {
+		return controller.Errf("No 'include_virtual' definition was provided for filter rule block with 'include_cache' or 'include_filtered'.")
+	}
+	if target.replacement != nil {
+		return controller.Errf("Filter rule blocks could not have a 'replacement' and an 'include_virtual' definition.")
+	}
+	if target.variants != nil {
+		for _, variant := range target.variants.variants {
+			if variant.replacement != nil {
+				return controller.Errf("Variants of filter rule blocks with 'include_virtual' could not have a 'replacement' definition.")
+			}
+		}
+	}
+	return nil
+}
+
+func evalRewriteUpstreamUrls(controller *caddy.Controller, target *rule) error {
 	args := controller.RemainingArgs()
-	if len(args) != 1 {
+	if len(args) != 2 {
 		return controller.ArgErr()
 	}
-	return setter(args[0])
+	value, err := newUpstreamUrlRewrite(args[0], args[1])
+	if err != nil {
+		return controller.Errf("There is no valid value for 'rewrite_upstream_urls' provided. Got: %v", err)
+	}
+	target.upstreamUrls = value
+	return nil
 }
 
-func evalRegexpOption(controller *caddy.Controller, setter func(*regexp.Regexp) error) error {
-	return evalSimpleOption(controller, func(plainValue string) error {
-		value, err := regexp.Compile(plainValue)
+// completeUpstreamUrls uses the search pattern of 'rewrite_upstream_urls' for the rule which
+// replaces every found URL itself.
+func completeUpstreamUrls(controller *caddy.Controller, target *rule) error {
+	if target.upstreamUrls == nil {
+		return nil
+	}
+	if target.searchPattern != nil || target.replacement != nil || target.include != nil {
+		return controller.Errf("Filter rule blocks with 'rewrite_upstream_urls' could not have a 'search_pattern', 'replacement' or 'include_virtual' definition.")
+	}
+	if target.variants != nil {
+		for _, variant := range target.variants.variants {
+			if variant.replacement != nil {
+				return controller.Errf("Variants of filter rule blocks with 'rewrite_upstream_urls' could not have a 'replacement' definition.")
+			}
+		}
+	}
+	target.searchPattern = target.upstreamUrls.searchPattern
+	return nil
+}
+
+func evalLocationRewrite(controller *caddy.Controller, target *rule) error {
+	return evalHeaderRewriteOption(controller, "location_rewrite", func(value *headerRewrite) {
+		target.locationRewrites = append(target.locationRewrites, value)
+	})
+}
+
+func evalHeaderRewriteOption(controller *caddy.Controller, optionName string, setter func(*headerRewrite)) error {
+	args := controller.RemainingArgs()
+	if len(args) != 2 {
+		return controller.Errf("There are exact two arguments for '%v' expected.", optionName)
+	}
+	pattern, err := regexp.Compile(args[0])
+	if err != nil {
+		return controller.Errf("There is no valid regular expression for '%v' provided. Got: %v", optionName, err)
+	}
+	setter(&headerRewrite{pattern: pattern, replacement: []byte(args[1])})
+	return nil
+}
+
+func evalCookieRewrite(controller *caddy.Controller, target *rule) error {
+	args := controller.RemainingArgs()
+	if len(args) > 1 {
+		return controller.Errf("There is at most one argument for filter rule option 'cookie_rewrite' expected.")
+	}
+	rewrite := new(cookieRewrite)
+	if len(args) > 0 {
+		name, err := regexp.Compile(args[0])
+		if err != nil {
+			return controller.Errf("There is no valid regular expression for 'cookie_rewrite' provided. Got: %v", err)
+		}
+		rewrite.name = name
+	}
+	if !controller.NextArg() || controller.Val() != "{" {
+		return controller.Errf("There is a block for filter rule option 'cookie_rewrite' expected.")
+	}
+	// The cookie_rewrite block is nested in the rule block, so it is walked manually.
+	closed := false
+	for !closed && controller.Next() {
+		var err error
+		switch controller.Val() {
+		case "}":
+			closed = true
+		case "domain":
+			err = evalHeaderRewriteOption(controller, "domain", func(value *headerRewrite) {
+				rewrite.domain = value
+			})
+		case "path":
+			err = evalHeaderRewriteOption(controller, "path", func(value *headerRewrite) {
+				rewrite.path = value
+			})
+		case "add":
+			values := controller.RemainingArgs()
+			if len(values) <= 0 {
+				return controller.ArgErr()
+			}
+			rewrite.add = append(rewrite.add, values...)
+		case "remove":
+			values := controller.RemainingArgs()
+			if len(values) <= 0 {
+				return controller.ArgErr()
+			}
+			for _, value := range values {
+				rewrite.remove = append(rewrite.remove, strings.ToLower(value))
+			}
+		default:
+			err = controller.Errf("Unknown option of 'cookie_rewrite': %v", controller.Val())
+		}
 		if err != nil {
 			return err
 		}
-		return setter(value)
+	}
+	if !closed {
+		return controller.EOFErr()
+	}
+	target.cookieRewrites = append(target.cookieRewrites, rewrite)
+	return nil
+}
+
+func evalSetStatus(controller *caddy.Controller, target *rule) error {
+	return evalSimpleOption(controller, func(plainValue string) error {
+		value, err := parseStatus(plainValue)
+		if err != nil {
+			return controller.Errf("There is no valid value for 'set_status' provided. Got: %v", plainValue)
+		}
+		target.status = value
+		return nil
 	})
 }
 
-func evalMaximumBufferSize(controller *caddy.Controller, args []string, target *filterHandler) (err error) {
-	if len(args) != 1 {
-		return controller.Errf("There are exact one argument for filter directive 'max_buffer_size' expected.")
+func evalRespond(controller *caddy.Controller, target *rule) error {
+	args := controller.RemainingArgs()
+	if len(args) != 2 {
+		return controller.Errf("There are exact two arguments for 'respond' expected.")
 	}
-	value, err := strconv.Atoi(args[0])
+	status, err := parseStatus(args[0])
 	if err != nil {
-		return controller.Errf("There is no valid value for filter directive 'max_buffer_size' provided. Got: %v", err)
+		return controller.Errf("There is no valid status for 'respond' provided. Got: %v", args[0])
 	}
-	target.maximumBufferSize = value
+	body, err := contentOf(controller, "respond", args[1])
+	if err != nil {
+		return err
+	}
+	target.response = newRuleResponse(status, body, args[1])
+	return nil
+}
+
+func evalLogOriginalBody(controller *caddy.Controller, target *rule) error {
+	return evalSimpleOption(controller, func(plainValue string) error {
+		value, err := strconv.ParseBool(plainValue)
+		if err != nil {
+			return controller.Errf("There is no valid value for 'log_original_body' provided. Got: %v", plainValue)
+		}
+		target.logOriginalBody = value
+		return nil
+	})
+}
+
+func completeResponse(controller *caddy.Controller, target *rule) error {
+	if target.status <= 0 && target.response == nil {
+		if target.logOriginalBody {
+			return controller.Errf("No 'set_status' or 'respond' definition was provided for filter rule block with 'log_original_body'.")
+		}
+		return nil
+	}
+	if target.searchPattern == nil {
+		return controller.Errf("No 'search_pattern' definition was provided for filter rule block with 'set_status' or 'respond'.")
+	}
+	if target.status > 0 && target.response != nil {
+		return controller.Errf("Filter rule blocks could not have a 'set_status' and a 'respond' definition.")
+	}
+	if target.response != nil && (target.replacement != nil || target.include != nil || target.upstreamUrls != nil) {
+		return controller.Errf("Filter rule blocks with 'respond' could not have a 'replacement', 'include_virtual' or 'rewrite_upstream_urls' definition.")
+	}
+	return nil
+}
+
+func parseStatus(plainValue string) (int, error) {
+	value, err := strconv.Atoi(plainValue)
+	if err != nil {
+		return 0, err
+	}
+	if value < 100 || value > 599 {
+		return 0, fmt.Errorf("illegal status: %d", value)
+	}
+	return value, nil
+}
+
+func redactionOf(target *rule) *ruleRedaction {
+	if target.redaction == nil {
+		target.redaction = newRuleRedaction()
+	}
+	return target.redaction
+}
+
+func addRedactionDetector(controller *caddy.Controller, target *rule, detector *redactionDetector) error {
+	redaction := redactionOf(target)
+	if redaction.detectorNamed(detector.name) != nil {
+		return controller.Errf("There is already a redaction detector named '%v'.", detector.name)
+	}
+	redaction.detectors = append(redaction.detectors, detector)
 	return nil
 }
+
+func evalRedact(controller *caddy.Controller, target *rule) error {
+	args := controller.RemainingArgs()
+	if len(args) <= 0 {
+		return controller.ArgErr()
+	}
+	for _, name := range args {
+		detector := builtInRedactionDetectorNamed(name)
+		if detector == nil {
+			return controller.Errf("Unknown redaction detector: %v", name)
+		}
+		if err := addRedactionDetector(controller, target, detector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func evalRedactPattern(controller *caddy.Controller, target *rule) error {
+	args := controller.RemainingArgs()
+	if len(args) != 2 {
+		return controller.Errf("There are exact two arguments for 'redact_pattern' expected.")
+	}
+	if _, err := regexp.Compile(args[1]); err != nil {
+		return controller.Errf("There is no valid regular expression for 'redact_pattern' provided. Got: %v", err)
+	}
+	return addRedactionDetector(controller, target, &redactionDetector{name: args[0], pattern: args[1]})
+}
+
+func evalRedactMask(controller *caddy.Controller, target *rule) error {
+	args := controller.RemainingArgs()
+	if len(args) < 1 || len(args) > 2 {
+		return controller.Errf("There are one or two arguments for 'redact_mask' expected.")
+	}
+	redaction := redactionOf(target)
+	for _, candidate := range possibleRedactionMasks {
+		if string(candidate) == args[0] {
+			redaction.mask = candidate
+		}
+	}
+	if string(redaction.mask) != args[0] {
+		return controller.Errf("Illegal value for 'redact_mask': %v", args[0])
+	}
+	if len(args) > 1 {
+		if redaction.mask != redactionMaskHash {
+			return controller.Errf("Only 'redact_mask hash' supports a key.")
+		}
+		redaction.hashKey = []byte(args[1])
+	}
+	return nil
+}
+
+// completeRedaction uses the combined patterns of all detectors as search pattern of the rule.
+func completeRedaction(controller *caddy.Controller, target *rule) error {
+	redaction := target.redaction
+	if redaction == nil {
+		return nil
+	}
+	if len(redaction.detectors) <= 0 {
+		return controller.Errf("No 'redact' or 'redact_pattern' definition was provided for filter rule block with 'redact_mask'.")
+	}
+	if target.searchPattern != nil || target.replacement != nil || target.include != nil || target.response != nil {
+		return controller.Errf("Filter rule blocks with 'redact' could not have a 'search_pattern', 'replacement', 'include_virtual', 'rewrite_upstream_urls' or 'respond' definition.")
+	}
+	if err := redaction.compile(); err != nil {
+		return controller.Errf("Could not combine the redaction detectors. Got: %v", err)
+	}
+	target.searchPattern = redaction.searchPattern
+	return nil
+}
+
+func minifyOf(target *rule) *ruleMinify {
+	if target.minify == nil {
+		target.minify = new(ruleMinify)
+	}
+	return target.minify
+}
+
+func evalMinify(controller *caddy.Controller, target *rule) error {
+	minify := minifyOf(target)
+	for _, plainValue := range controller.RemainingArgs() {
+		found := false
+		for _, candidate := range possibleMinifyTypes {
+			if string(candidate) == plainValue {
+				minify.types = append(minify.types, candidate)
+				found = true
+			}
+		}
+		if !found {
+			return controller.Errf("Illegal value for 'minify': %v", plainValue)
+		}
+	}
+	return nil
+}
+
+func evalMinifyKeep(controller *caddy.Controller, target *rule) error {
+	args := controller.RemainingArgs()
+	if len(args) <= 0 {
+		return controller.ArgErr()
+	}
+	minify := minifyOf(target)
+	for _, plainValue := range args {
+		found := false
+		for _, candidate := range possibleMinifyKeeps {
+			if string(candidate) == plainValue {
+				minify.keep = append(minify.keep, candidate)
+				found = true
+			}
+		}
+		if !found {
+			return controller.Errf("Illegal value for 'minify_keep': %v", plainValue)
+		}
+	}
+	return nil
+}
+
+func completeMinify(controller *caddy.Controller, target *rule) error {
+	minify := target.minify
+	if minify == nil {
+		return nil
+	}
+	if target.searchPattern != nil || target.replacement != nil || target.include != nil || target.status > 0 || target.response != nil {
+		return controller.Errf("Filter rule blocks with 'minify' could not have a 'search_pattern', 'replacement', 'include_virtual', 'rewrite_upstream_urls', 'redact', 'set_status' or 'respond' definition.")
+	}
+	minify.compile()
+	return nil
+}
+
+func addXmlAction(controller *caddy.Controller, target *rule, kind xmlActionKind, path string) (*xmlAction, error) {
+	action, err := newXmlAction(kind, path)
+	if err != nil {
+		return nil, controller.Errf("There is no valid XPath expression for '%v' provided. Got: %v", kind, err)
+	}
+	if target.xml == nil {
+		target.xml = new(ruleXml)
+	}
+	target.xml.actions = append(target.xml.actions, action)
+	return action, nil
+}
+
+func evalXmlSet(controller *caddy.Controller, target *rule) error {
+	args := controller.RemainingArgs()
+	if len(args) != 2 && len(args) != 3 {
+		return controller.Errf("There are two or three arguments for 'xml_set' expected.")
+	}
+	action, err := addXmlAction(controller, target, xmlActionSet, args[0])
+	if err != nil {
+		return err
+	}
+	if len(args) == 3 {
+		if action.pattern, err = regexp.Compile(args[1]); err != nil {
+			return controller.Errf("There is no valid regular expression for 'xml_set' provided. Got: %v", err)
+		}
+	}
+	action.value = []byte(args[len(args)-1])
+	return nil
+}
+
+func evalXmlDelete(controller *caddy.Controller, target *rule) error {
+	return evalSimpleOption(controller, func(plainValue string) error {
+		_, err := addXmlAction(controller, target, xmlActionDelete, plainValue)
+		return err
+	})
+}
+
+func evalXmlInsert(controller *caddy.Controller, target *rule) error {
+	args := controller.RemainingArgs()
+	if len(args) != 2 && len(args) != 3 {
+		return controller.Errf("There are two or three arguments for 'xml_insert' expected.")
+	}
+	action, err := addXmlAction(controller, target, xmlActionInsert, args[0])
+	if err != nil {
+		return err
+	}
+	action.position = xmlInsertAppend
+	if len(args) == 3 {
+		action.position = ""
+		for _, candidate := range possibleXmlInsertPositions {
+			if string(candidate) == args[1] {
+				action.position = candidate
+			}
+		}
+		if action.position == "" {
+			return controller.Errf("Illegal position for 'xml_insert': %v", args[1])
+		}
+	}
+	if action.value, err = contentOf(controller, "xml_insert", args[len(args)-1]); err != nil {
+		return err
+	}
+	if _, err := parseXmlFragment(action.value); err != nil {
+		return controller.Errf("There is no valid XML fragment for 'xml_insert' provided. Got: %v", err)
+	}
+	return nil
+}
+
+func completeXml(controller *caddy.Controller, target *rule) error {
+	if target.xml == nil {
+		return nil
+	}
+	if target.searchPattern != nil || target.replacement != nil || target.include != nil || target.minify != nil {
+		return controller.Errf("Filter rule blocks with 'xml_set', 'xml_delete' or 'xml_insert' could not have a 'search_pattern', 'replacement', 'include_virtual', 'rewrite_upstream_urls', 'redact' or 'minify' definition.")
+	}
+	if target.variants != nil {
+		for _, variant := range target.variants.variants {
+			if variant.replacement != nil {
+				return controller.Errf("Variants of filter rule blocks with 'xml_set', 'xml_delete' or 'xml_insert' could not have a 'replacement' definition.")
+			}
+		}
+	}
+	return nil
+}
+
+func scriptOf(target *rule) *ruleScript {
+	if target.script == nil {
+		target.script = &ruleScript{maximumMemory: defaultScriptMaximumMemory}
+	}
+	return target.script
+}
+
+func evalScript(controller *caddy.Controller, target *rule, handler *filterHandler) error {
+	return evalSimpleOption(controller, func(plainValue string) error {
+		source, err := contentOf(controller, "script", plainValue)
+		if err != nil {
+			return err
+		}
+		name := "script"
+		if len(plainValue) > 1 && plainValue[0] == '@' {
+			name = plainValue[1:]
+		}
+		proto, err := handler.compileScript(name, source)
+		if err != nil {
+			return controller.Errf("There is no valid 'script' provided. Got: %v", strings.TrimSpace(err.Error()))
+		}
+		script := scriptOf(target)
+		script.name = name
+		script.proto = proto
+		return nil
+	})
+}
+
+func evalScriptMaximumMemory(controller *caddy.Controller, target *rule) error {
+	return evalSimpleOption(controller, func(plainValue string) error {
+		value, err := parseByteSize(plainValue)
+		if err != nil || value <= 0 {
+			return controller.Errf("There is no valid value for 'script_max_memory' provided. Got: %v", plainValue)
+		}
+		scriptOf(target).maximumMemory = value
+		return nil
+	})
+}
+
+func completeScript(controller *caddy.Controller, target *rule) error {
+	script := target.script
+	if script == nil {
+		return nil
+	}
+	if script.proto == nil {
+		return controller.Errf("No 'script' definition was provided for filter rule block with 'script_max_memory'.")
+	}
+	if target.searchPattern != nil || target.replacement != nil || target.include != nil || target.minify != nil || target.xml != nil {
+		return controller.Errf("Filter rule blocks with 'script' could not have a 'search_pattern', 'replacement', 'include_virtual', 'rewrite_upstream_urls', 'redact', 'minify' or 'xml_*' definition.")
+	}
+	if target.variants != nil {
+		for _, variant := range target.variants.variants {
+			if variant.replacement != nil {
+				return controller.Errf("Variants of filter rule blocks with 'script' could not have a 'replacement' definition.")
+			}
+		}
+	}
+	return nil
+}
+
+func pipeOf(target *rule) *rulePipe {
+	if target.pipe == nil {
+		target.pipe = newRulePipe(nil)
+	}
+	return target.pipe
+}
+
+func evalPipe(controller *caddy.Controller, target *rule) error {
+	args := controller.RemainingArgs()
+	if len(args) <= 0 {
+		return controller.ArgErr()
+	}
+	pipe := newRulePipe(args)
+	if target.pipe != nil {
+		pipe.workers, pipe.timeout, pipe.onFailure = target.pipe.workers, target.pipe.timeout, target.pipe.onFailure
+	}
+	if pipe.socket == "" {
+		if _, err := exec.LookPath(pipe.command[0]); err != nil {
+			return controller.Errf("There is no valid command for 'pipe' provided. Got: %v", err)
+		}
+	}
+	target.pipe = pipe
+	return nil
+}
+
+func evalPipeWorkers(controller *caddy.Controller, target *rule) error {
+	return evalSimpleOption(controller, func(plainValue string) error {
+		value, err := strconv.Atoi(plainValue)
+		if err != nil || value <= 0 {
+			return controller.Errf("There is no valid value for 'pipe_workers' provided. Got: %v", plainValue)
+		}
+		pipeOf(target).workers = value
+		return nil
+	})
+}
+
+func evalPipeTimeout(controller *caddy.Controller, target *rule) error {
+	return evalSimpleOption(controller, func(plainValue string) error {
+		value, err := time.ParseDuration(plainValue)
+		if err != nil || value <= 0 {
+			return controller.Errf("There is no valid value for 'pipe_timeout' provided. Got: %v", plainValue)
+		}
+		pipeOf(target).timeout = value
+		return nil
+	})
+}
+
+func evalPipeOnFailure(controller *caddy.Controller, target *rule) error {
+	return evalSimpleOption(controller, func(plainValue string) error {
+		for _, candidate := range possiblePipeFailurePolicies {
+			if string(candidate) == plainValue {
+				pipeOf(target).onFailure = candidate
+				return nil
+			}
+		}
+		return controller.Errf("Illegal value for 'pipe_on_failure': %v", plainValue)
+	})
+}
+
+func completePipe(controller *caddy.Controller, target *rule) error {
+	pipe := target.pipe
+	if pipe == nil {
+		return nil
+	}
+	if len(pipe.command) <= 0 && pipe.socket == "" {
+		return controller.Errf("No 'pipe' definition was provided for filter rule block with 'pipe_workers', 'pipe_timeout' or 'pipe_on_failure'.")
+	}
+	if target.searchPattern != nil || target.replacement != nil || target.include != nil || target.minify != nil || target.xml != nil || target.script != nil {
+		return controller.Errf("Filter rule blocks with 'pipe' could not have a 'search_pattern', 'replacement', 'include_virtual', 'rewrite_upstream_urls', 'redact', 'minify', 'xml_*' or 'script' definition.")
+	}
+	if target.variants != nil {
+		for _, variant := range target.variants.variants {
+			if variant.replacement != nil {
+				return controller.Errf("Variants of filter rule blocks with 'pipe' could not have a 'replacement' definition.")
+			}
+		}
+	}
+	return nil
+}
+
+func wasmOf(target *rule) *ruleWasm {
+	if target.wasm == nil {
+		target.wasm = &ruleWasm{
+			function:      defaultWasmFunction,
+			workers:       defaultWasmWorkers,
+			maximumMemory: defaultWasmMaximumMemory,
+		}
+	}
+	return target.wasm
+}
+
+func evalWasm(controller *caddy.Controller, target *rule) error {
+	args := controller.RemainingArgs()
+	if len(args) < 1 || len(args) > 2 {
+		return controller.ArgErr()
+	}
+	source, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return controller.Errf("Could not read file provided in 'wasm' definition. Got: %v", err)
+	}
+	module := wasmOf(target)
+	module.name = args[0]
+	module.source = source
+	if len(args) > 1 {
+		module.function = args[1]
+	}
+	return nil
+}
+
+func evalWasmWorkers(controller *caddy.Controller, target *rule) error {
+	return evalSimpleOption(controller, func(plainValue string) error {
+		value, err := strconv.Atoi(plainValue)
+		if err != nil || value <= 0 {
+			return controller.Errf("There is no valid value for 'wasm_workers' provided. Got: %v", plainValue)
+		}
+		wasmOf(target).workers = value
+		return nil
+	})
+}
+
+func evalWasmMaximumMemory(controller *caddy.Controller, target *rule) error {
+	return evalSimpleOption(controller, func(plainValue string) error {
+		value, err := parseByteSize(plainValue)
+		if err != nil || value <= 0 {
+			return controller.Errf("There is no valid value for 'wasm_max_memory' provided. Got: %v", plainValue)
+		}
+		wasmOf(target).maximumMemory = value
+		return nil
+	})
+}
+
+// completeWasm loads the module after all options are known because the memory limit applies
+// to its instantiation.
+func completeWasm(controller *caddy.Controller, target *rule) error {
+	module := target.wasm
+	if module == nil {
+		return nil
+	}
+	if module.source == nil {
+		return controller.Errf("No 'wasm' definition was provided for filter rule block with 'wasm_workers' or 'wasm_max_memory'.")
+	}
+	if target.searchPattern != nil || target.replacement != nil || target.include != nil || target.minify != nil || target.xml != nil || target.script != nil || target.pipe != nil {
+		return controller.Errf("Filter rule blocks with 'wasm' could not have a 'search_pattern', 'replacement', 'include_virtual', 'rewrite_upstream_urls', 'redact', 'minify', 'xml_*', 'script' or 'pipe' definition.")
+	}
+	if target.variants != nil {
+		for _, variant := range target.variants.variants {
+			if variant.replacement != nil {
+				return controller.Errf("Variants of filter rule blocks with 'wasm' could not have a 'replacement' definition.")
+			}
+		}
+	}
+	if err := module.load(); err != nil {
+		return controller.Errf("There is no valid 'wasm' module provided. Got: %v", err)
+	}
+	return nil
+}
+
+func evalSimpleOption(controller *caddy.Controller, setter func(string) error) error {
+	args := controller.RemainingArgs()
+	if len(args) != 1 {
+		return controller.ArgErr()
+	}
+	return setter(args[0])
+}
+
+func evalRegexpOption(controller *caddy.Controller, setter func(*regexp.Regexp) error) error {
+	return evalSimpleOption(controller, func(plainValue string) error {
+		value, err := regexp.Compile(plainValue)
+		if err != nil {
+			return err
+		}
+		return setter(value)
+	})
+}
+
+func evalMaximumBufferSize(controller *caddy.Controller, args []string, target *filterHandler) (err error) {
+	if len(args) != 1 {
+		return controller.Errf("There are exact one argument for filter directive 'max_buffer_size' expected.")
+	}
+	value, err := strconv.Atoi(args[0])
+	if err != nil {
+		return controller.Errf("There is no valid value for filter directive 'max_buffer_size' provided. Got: %v", err)
+	}
+	target.maximumBufferSize = value
+	return nil
+}
+
+func evalMaximumIncludeVirtualDepth(controller *caddy.Controller, args []string, target *filterHandler) (err error) {
+	if len(args) != 1 {
+		return controller.Errf("There are exact one argument for filter directive 'max_include_virtual_depth' expected.")
+	}
+	value, err := strconv.Atoi(args[0])
+	if err != nil || value < 1 {
+		return controller.Errf("There is no valid value for filter directive 'max_include_virtual_depth' provided. Got: %v", args[0])
+	}
+	target.maximumIncludeVirtualDepth = value
+	return nil
+}
+
+func evalOutputCharset(controller *caddy.Controller, args []string, target *filterHandler) (err error) {
+	if len(args) != 1 {
+		return controller.Errf("There are exact one argument for filter directive 'output_charset' expected.")
+	}
+	for _, candidate := range possibleOutputCharsets {
+		if string(candidate) == args[0] {
+			target.outputCharset = candidate
+			return nil
+		}
+	}
+	return controller.Errf("Illegal value for filter directive 'output_charset': %v", args[0])
+}
+
+func evalMetricsPath(controller *caddy.Controller, args []string, target *filterHandler) (err error) {
+	if len(args) != 1 {
+		return controller.Errf("There are exact one argument for filter directive 'metrics_path' expected.")
+	}
+	if !strings.HasPrefix(args[0], "/") {
+		return controller.Errf("The value of filter directive 'metrics_path' has to start with '/'. Got: %v", args[0])
+	}
+	target.metricsPath = args[0]
+	return nil
+}
+
+func evalDebug(controller *caddy.Controller, args []string, target *filterHandler) (err error) {
+	if len(args) != 1 {
+		return controller.Errf("There are exact one argument for filter directive 'debug' expected.")
+	}
+	if len(args[0]) <= 0 {
+		return controller.Errf("The value of filter directive 'debug' could not be empty.")
+	}
+	target.debugToken = args[0]
+	return nil
+}
+
+func evalExecutionLog(controller *caddy.Controller, args []string, target *filterHandler) (err error) {
+	if len(args) < 1 || len(args) > 2 {
+		return controller.Errf("There are one or two arguments for filter directive 'log' expected.")
+	}
+	sampleRate := 1.0
+	if len(args) > 1 {
+		sampleRate, err = strconv.ParseFloat(args[1], 64)
+		if err != nil || sampleRate < 0 || sampleRate > 1 {
+			return controller.Errf("There is no valid sample rate between 0 and 1 for filter directive 'log' provided. Got: %v", args[1])
+		}
+	}
+	if target.executionLog != nil {
+		return controller.Errf("There is already a filter directive 'log' defined.")
+	}
+	target.executionLog, err = newExecutionLog(args[0], sampleRate)
+	if err != nil {
+		return controller.Errf("Could not open output of filter directive 'log'. Got: %v", err)
+	}
+	return nil
+}
+
+func evalTimeout(controller *caddy.Controller, args []string, target *filterHandler) (err error) {
+	if len(args) != 1 {
+		return controller.Errf("There are exact one argument for filter directive 'timeout' expected.")
+	}
+	value, err := time.ParseDuration(args[0])
+	if err != nil || value <= 0 {
+		return controller.Errf("There is no valid value for filter directive 'timeout' provided. Got: %v", args[0])
+	}
+	target.timeout = value
+	return nil
+}
+
+func evalTimeoutPolicy(controller *caddy.Controller, args []string, target *filterHandler) (err error) {
+	if len(args) != 1 {
+		return controller.Errf("There are exact one argument for filter directive 'on_timeout' expected.")
+	}
+	for _, candidate := range possibleTimeoutPolicies {
+		if string(candidate) == args[0] {
+			target.timeoutPolicy = candidate
+			return nil
+		}
+	}
+	return controller.Errf("Illegal value for filter directive 'on_timeout': %v", args[0])
+}
+
+func evalMaximumTotalBuffer(controller *caddy.Controller, args []string, target *filterHandler) (err error) {
+	if len(args) < 1 || len(args) > 3 {
+		return controller.Errf("There are one to three arguments for filter directive 'max_total_buffer' expected.")
+	}
+	value, err := parseByteSize(args[0])
+	if err != nil || value <= 0 {
+		return controller.Errf("There is no valid value for filter directive 'max_total_buffer' provided. Got: %v", args[0])
+	}
+	policy := bufferBudgetPolicyBypass
+	if len(args) > 1 {
+		policy = ""
+		for _, candidate := range possibleBufferBudgetPolicies {
+			if string(candidate) == args[1] {
+				policy = candidate
+			}
+		}
+		if policy == "" {
+			return controller.Errf("Illegal policy for filter directive 'max_total_buffer': %v", args[1])
+		}
+	}
+	var wait time.Duration
+	if policy == bufferBudgetPolicyWait {
+		if len(args) != 3 {
+			return controller.Errf("The policy 'wait' of filter directive 'max_total_buffer' requires a duration.")
+		}
+		wait, err = time.ParseDuration(args[2])
+		if err != nil || wait <= 0 {
+			return controller.Errf("There is no valid duration for policy 'wait' of filter directive 'max_total_buffer' provided. Got: %v", args[2])
+		}
+	} else if len(args) > 2 {
+		return controller.Errf("Only the policy 'wait' of filter directive 'max_total_buffer' accepts a duration.")
+	}
+	if target.bufferBudget == nil {
+		target.bufferBudget = bufferBudgetOf(controller)
+	}
+	if _, limit := target.bufferBudget.usage(); limit > 0 && limit != value {
+		return controller.Errf("The filter directive 'max_total_buffer' is shared by all sites and already defined with %d bytes. Got: %v", limit, args[0])
+	}
+	target.bufferBudget.setLimit(value)
+	target.bufferPolicy = policy
+	target.bufferWait = wait
+	return nil
+}
+
+// parseByteSize parses values like 1024, 512KB, 10MB or 1GB.
+func parseByteSize(plain string) (int64, error) {
+	multiplier := int64(1)
+	upper := strings.ToUpper(plain)
+	for _, unit := range []struct {
+		suffix     string
+		multiplier int64
+	}{{"GB", 1024 * 1024 * 1024}, {"MB", 1024 * 1024}, {"KB", 1024}, {"B", 1}} {
+		if strings.HasSuffix(upper, unit.suffix) {
+			multiplier = unit.multiplier
+			upper = strings.TrimSpace(upper[:len(upper)-len(unit.suffix)])
+			break
+		}
+	}
+	value, err := strconv.ParseInt(upper, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return value * multiplier, nil
+}
@@ -5,8 +5,10 @@ import (
 	"github.com/caddyserver/caddy"
 	"github.com/caddyserver/caddy/caddyhttp/httpserver"
 	. "gopkg.in/check.v1"
+	"os"
 	"regexp"
 	"regexp/syntax"
+	"time"
 )
 
 type initTest struct{}
@@ -179,6 +181,393 @@ func (s *initTest) Test_evalRule(c *C) {
 
 	err = evalRule(s.newControllerFor(""), []string{"foo"}, handler)
 	c.Assert(err, DeepEquals, errors.New("Testfile:1 - Error during parsing: No more arguments for filter block 'rule' supported."))
+
+	err = evalRule(s.newControllerFor("{\npath myPath\nsearch_pattern foo\nreplacement \"{?request_header_X-Debug}debug\"\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:4 - Error during parsing: There is no valid 'replacement' provided. Got: 1 '{?...}' without a following '{/}'"))
+}
+
+func (s *initTest) Test_evalRule_withSearchFlagsAndScope(c *C) {
+	handler := new(filterHandler)
+	err := evalRule(s.newControllerFor("{\npath myPath\nsearch_flags is\nsearch_pattern a.b\nscope line\n}\n"), []string{}, handler)
+	c.Assert(err, IsNil)
+	c.Assert(handler.rules[0].searchPattern.String(), Equals, "(?is)a.b")
+	c.Assert(handler.rules[0].searchPattern.MatchString("A\nB"), Equals, true)
+	c.Assert(handler.rules[0].scope, Equals, ruleScopeLine)
+
+	err = evalRule(s.newControllerFor("{\npath myPath\nsearch_pattern a\n}\n"), []string{}, handler)
+	c.Assert(err, IsNil)
+	c.Assert(handler.rules[1].searchPattern.String(), Equals, "a")
+	c.Assert(handler.rules[1].scope, Equals, ruleScopeWhole)
+
+	err = evalRule(s.newControllerFor("{\npath myPath\nsearch_flags x\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:3 - Error during parsing: Illegal flag for 'search_flags': x"))
+
+	err = evalRule(s.newControllerFor("{\npath myPath\nsearch_flags i\nlocation_rewrite a b\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:5 - Error during parsing: No 'search_pattern' definition was provided for filter rule block with 'search_flags'."))
+
+	err = evalRule(s.newControllerFor("{\npath myPath\nscope foo\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:3 - Error during parsing: Illegal value for 'scope': foo"))
+
+	err = evalRule(s.newControllerFor("{\npath myPath\nscope line\nlocation_rewrite a b\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:5 - Error during parsing: No 'search_pattern' definition was provided for filter rule block with 'scope line'."))
+}
+
+func (s *initTest) Test_evalRule_withVariants(c *C) {
+	handler := new(filterHandler)
+	err := evalRule(s.newControllerFor("{\nname banner\npath myPath\nsearch_pattern mySearchPattern\nreplacement \"<div class='{variant}'>\"\n"+
+		"variant a 10\nvariant b {\nweight 90\nreplacement myReplacement\n}\nvariant_key header X-User\n}\n"), []string{}, handler)
+	c.Assert(err, IsNil)
+	c.Assert(len(handler.rules), Equals, 1)
+	variants := handler.rules[0].variants
+	c.Assert(variants.variants, DeepEquals, []*ruleVariant{
+		{name: "a", weight: 10},
+		{name: "b", weight: 90, replacement: []byte("myReplacement")},
+	})
+	c.Assert(variants.key, Equals, variantKeyHeader)
+	c.Assert(variants.keyHeader, Equals, "X-User")
+	c.Assert(variants.cookieName, Equals, "filter_variant_banner")
+	c.Assert(variants.placeholder, Equals, "variant_banner")
+	c.Assert(variants.cookieMaxAge, Equals, defaultVariantCookieMaxAge)
+
+	err = evalRule(s.newControllerFor("{\npath myPath\nsearch_pattern mySearchPattern\nvariant a\nvariant_cookie ab 1h\n}\n"), []string{}, handler)
+	c.Assert(err, IsNil)
+	c.Assert(handler.rules[1].variants.cookieName, Equals, "ab")
+	c.Assert(handler.rules[1].variants.placeholder, Equals, "variant_ab")
+	c.Assert(handler.rules[1].variants.cookieMaxAge, Equals, time.Hour)
+	c.Assert(handler.rules[1].variants.key, Equals, variantKeyRandom)
+
+	err = evalRule(s.newControllerFor("{\npath myPath\nsearch_pattern mySearchPattern\nvariant a\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:5 - Error during parsing: Filter rule blocks with variants require a 'name' or 'variant_cookie' definition."))
+
+	err = evalRule(s.newControllerFor("{\nname x\npath myPath\nsearch_pattern mySearchPattern\nvariant a 0\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:6 - Error during parsing: At least one 'variant' of a filter rule block requires a weight greater than 0."))
+
+	err = evalRule(s.newControllerFor("{\nname y\npath myPath\nsearch_pattern mySearchPattern\nvariant_key remote_address\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:6 - Error during parsing: No 'variant' definition was provided for filter rule block with 'variant_key' or 'variant_cookie'."))
+
+	err = evalRule(s.newControllerFor("{\npath myPath\nvariant a\nvariant a\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:4 - Error during parsing: There is already a variant named 'a'."))
+
+	err = evalRule(s.newControllerFor("{\npath myPath\nvariant a {\nfoo\n}\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:4 - Error during parsing: Unknown option of variant 'a': foo"))
+
+	err = evalRule(s.newControllerFor("{\npath myPath\nvariant a -1\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:3 - Error during parsing: There is no valid value for 'weight' of variant 'a' provided. Got: -1"))
+
+	err = evalRule(s.newControllerFor("{\npath myPath\nvariant a;b\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:3 - Error during parsing: Illegal name for 'variant': a;b"))
+
+	err = evalRule(s.newControllerFor("{\npath myPath\nvariant_key foo\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:3 - Error during parsing: Illegal value for 'variant_key': foo"))
+
+	err = evalRule(s.newControllerFor("{\npath myPath\nvariant_key header\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:3 - Error during parsing: The 'variant_key' header requires exact one header name."))
+}
+
+func (s *initTest) Test_evalRule_withInclude(c *C) {
+	handler := new(filterHandler)
+	err := evalRule(s.newControllerFor("{\npath myPath\nsearch_pattern mySearchPattern\ninclude_virtual /fragments/{1}\ninclude_cache 1m\ninclude_filtered true\n}\n"), []string{}, handler)
+	c.Assert(err, IsNil)
+	c.Assert(handler.rules[0].include, DeepEquals, &ruleInclude{path: []byte("/fragments/{1}"), cacheTtl: time.Minute, filtered: true})
+
+	err = evalRule(s.newControllerFor("{\npath myPath\nsearch_pattern mySearchPattern\ninclude_cache 1m\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:5 - Error during parsing: No 'include_virtual' definition was provided for filter rule block with 'include_cache' or 'include_filtered'."))
+
+	err = evalRule(s.newControllerFor("{\npath myPath\nsearch_pattern mySearchPattern\ninclude_virtual /foo\nreplacement bar\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:6 - Error during parsing: Filter rule blocks could not have a 'replacement' and an 'include_virtual' definition."))
+
+	err = evalRule(s.newControllerFor("{\npath myPath\ninclude_cache foo\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:3 - Error during parsing: There is no valid value for 'include_cache' provided. Got: foo"))
+
+	err = evalRule(s.newControllerFor("{\npath myPath\ninclude_filtered foo\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:3 - Error during parsing: There is no valid value for 'include_filtered' provided. Got: foo"))
+}
+
+func (s *initTest) Test_evalRule_withRewriteUpstreamUrls(c *C) {
+	handler := new(filterHandler)
+	err := evalRule(s.newControllerFor("{\npath .*\nrewrite_upstream_urls http://backend:8080 https://example.org\n}\n"), []string{}, handler)
+	c.Assert(err, IsNil)
+	c.Assert(handler.rules[0].upstreamUrls.to, Equals, "https://example.org")
+	c.Assert(handler.rules[0].searchPattern, Equals, handler.rules[0].upstreamUrls.searchPattern)
+
+	err = evalRule(s.newControllerFor("{\npath .*\nrewrite_upstream_urls http://backend:8080 https://example.org\nsearch_pattern foo\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:5 - Error during parsing: Filter rule blocks with 'rewrite_upstream_urls' could not have a 'search_pattern', 'replacement' or 'include_virtual' definition."))
+
+	err = evalRule(s.newControllerFor("{\npath .*\nrewrite_upstream_urls http://backend:8080\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:3 - Error during parsing: Wrong argument count or unexpected line ending after 'http://backend:8080'"))
+
+	err = evalRule(s.newControllerFor("{\npath .*\nrewrite_upstream_urls /app https://example.org\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:3 - Error during parsing: There is no valid value for 'rewrite_upstream_urls' provided. Got: '/app' is not an absolute URL"))
+}
+
+func (s *initTest) Test_evalRule_withHeaderRewrites(c *C) {
+	handler := new(filterHandler)
+	err := evalRule(s.newControllerFor("{\npath .*\nlocation_rewrite ^http://backend(.*) https://example.org{1}\ncookie_rewrite ^session$ {\ndomain ^backend$ example.org\npath ^/app /\nadd Secure SameSite=Lax\nremove Expires\n}\ncookie_rewrite {\nremove Domain\n}\n}\n"), []string{}, handler)
+	c.Assert(err, IsNil)
+	r := handler.rules[0]
+	c.Assert(r.searchPattern, IsNil)
+	c.Assert(r.locationRewrites, DeepEquals, []*headerRewrite{
+		{pattern: regexp.MustCompile("^http://backend(.*)"), replacement: []byte("https://example.org{1}")},
+	})
+	c.Assert(r.cookieRewrites, DeepEquals, []*cookieRewrite{{
+		name:   regexp.MustCompile("^session$"),
+		domain: &headerRewrite{pattern: regexp.MustCompile("^backend$"), replacement: []byte("example.org")},
+		path:   &headerRewrite{pattern: regexp.MustCompile("^/app"), replacement: []byte("/")},
+		add:    []string{"Secure", "SameSite=Lax"},
+		remove: []string{"expires"},
+	}, {
+		remove: []string{"domain"},
+	}})
+
+	err = evalRule(s.newControllerFor("{\npath .*\nlocation_rewrite foo\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:3 - Error during parsing: There are exact two arguments for 'location_rewrite' expected."))
+
+	err = evalRule(s.newControllerFor("{\npath .*\nlocation_rewrite ( bar\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:3 - Error during parsing: There is no valid regular expression for 'location_rewrite' provided. Got: error parsing regexp: missing closing ): `(`"))
+
+	err = evalRule(s.newControllerFor("{\npath .*\ncookie_rewrite\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:3 - Error during parsing: There is a block for filter rule option 'cookie_rewrite' expected."))
+
+	err = evalRule(s.newControllerFor("{\npath .*\ncookie_rewrite {\nfoo bar\n}\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:4 - Error during parsing: Unknown option of 'cookie_rewrite': foo"))
+}
+
+func (s *initTest) Test_evalRule_withResponseActions(c *C) {
+	handler := new(filterHandler)
+	err := evalRule(s.newControllerFor("{\npath .*\nsearch_pattern Fatal\nset_status 500\nlog_original_body true\n}\n"), []string{}, handler)
+	c.Assert(err, IsNil)
+	c.Assert(handler.rules[0].status, Equals, 500)
+	c.Assert(handler.rules[0].logOriginalBody, Equals, true)
+	c.Assert(handler.rules[0].detectsOnly(), Equals, true)
+
+	err = evalRule(s.newControllerFor("{\npath .*\nsearch_pattern Fatal\nrespond 503 @resources/test/cli/expected.html\n}\n"), []string{}, handler)
+	c.Assert(err, IsNil)
+	c.Assert(handler.rules[1].response.status, Equals, 503)
+	c.Assert(handler.rules[1].response.contentType, Equals, "text/html; charset=utf-8")
+
+	err = evalRule(s.newControllerFor("{\npath .*\nsearch_pattern Fatal\nset_status 99\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:4 - Error during parsing: There is no valid value for 'set_status' provided. Got: 99"))
+
+	err = evalRule(s.newControllerFor("{\npath .*\nsearch_pattern Fatal\nrespond 503\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:4 - Error during parsing: There are exact two arguments for 'respond' expected."))
+
+	err = evalRule(s.newControllerFor("{\npath .*\nsearch_pattern Fatal\nrespond 503 Sorry\nset_status 500\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:6 - Error during parsing: Filter rule blocks could not have a 'set_status' and a 'respond' definition."))
+
+	err = evalRule(s.newControllerFor("{\npath .*\nsearch_pattern Fatal\nrespond 503 Sorry\nreplacement foo\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:6 - Error during parsing: Filter rule blocks with 'respond' could not have a 'replacement', 'include_virtual' or 'rewrite_upstream_urls' definition."))
+
+	err = evalRule(s.newControllerFor("{\npath .*\nsearch_pattern Fatal\nlog_original_body true\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:5 - Error during parsing: No 'set_status' or 'respond' definition was provided for filter rule block with 'log_original_body'."))
+}
+
+func (s *initTest) Test_evalRule_withRedaction(c *C) {
+	handler := new(filterHandler)
+	err := evalRule(s.newControllerFor("{\npath .*\nredact credit_card email\nredact_pattern employee EMP-[0-9]+\nredact_mask hash mySecret\n}\n"), []string{}, handler)
+	c.Assert(err, IsNil)
+	redaction := handler.rules[0].redaction
+	c.Assert(len(redaction.detectors), Equals, 3)
+	c.Assert(redaction.detectors[2], DeepEquals, &redactionDetector{name: "employee", pattern: "EMP-[0-9]+"})
+	c.Assert(redaction.mask, Equals, redactionMaskHash)
+	c.Assert(string(redaction.hashKey), Equals, "mySecret")
+	c.Assert(handler.rules[0].searchPattern, Equals, redaction.searchPattern)
+
+	err = evalRule(s.newControllerFor("{\npath .*\nredact foo\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:3 - Error during parsing: Unknown redaction detector: foo"))
+
+	err = evalRule(s.newControllerFor("{\npath .*\nredact email email\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:3 - Error during parsing: There is already a redaction detector named 'email'."))
+
+	err = evalRule(s.newControllerFor("{\npath .*\nredact email\nredact_mask foo\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:4 - Error during parsing: Illegal value for 'redact_mask': foo"))
+
+	err = evalRule(s.newControllerFor("{\npath .*\nredact email\nredact_mask full key\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:4 - Error during parsing: Only 'redact_mask hash' supports a key."))
+
+	err = evalRule(s.newControllerFor("{\npath .*\nredact_mask partial\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:4 - Error during parsing: No 'redact' or 'redact_pattern' definition was provided for filter rule block with 'redact_mask'."))
+
+	err = evalRule(s.newControllerFor("{\npath .*\nredact email\nreplacement foo\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:5 - Error during parsing: Filter rule blocks with 'redact' could not have a 'search_pattern', 'replacement', 'include_virtual', 'rewrite_upstream_urls' or 'respond' definition."))
+}
+
+func (s *initTest) Test_evalRule_withMinify(c *C) {
+	handler := new(filterHandler)
+	err := evalRule(s.newControllerFor("{\ncontent_type text/.*\nminify html css\nminify_keep conditional_comments whitespace\n}\n"), []string{}, handler)
+	c.Assert(err, IsNil)
+	c.Assert(handler.rules[0].minify.types, DeepEquals, []minifyType{minifyTypeHtml, minifyTypeCss})
+	c.Assert(handler.rules[0].minify.keep, DeepEquals, []minifyKeep{minifyKeepConditionalComments, minifyKeepWhitespace})
+	c.Assert(handler.rules[0].minify.minifier, NotNil)
+
+	err = evalRule(s.newControllerFor("{\ncontent_type text/.*\nminify\n}\n"), []string{}, handler)
+	c.Assert(err, IsNil)
+	c.Assert(handler.rules[1].minify.types, IsNil)
+
+	err = evalRule(s.newControllerFor("{\ncontent_type text/.*\nminify foo\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:3 - Error during parsing: Illegal value for 'minify': foo"))
+
+	err = evalRule(s.newControllerFor("{\ncontent_type text/.*\nminify_keep foo\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:3 - Error during parsing: Illegal value for 'minify_keep': foo"))
+
+	err = evalRule(s.newControllerFor("{\ncontent_type text/.*\nminify\nsearch_pattern foo\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:5 - Error during parsing: Filter rule blocks with 'minify' could not have a 'search_pattern', 'replacement', 'include_virtual', 'rewrite_upstream_urls', 'redact', 'set_status' or 'respond' definition."))
+}
+
+func (s *initTest) Test_evalRule_withXml(c *C) {
+	handler := new(filterHandler)
+	err := evalRule(s.newControllerFor("{\ncontent_type .*xml.*\nxml_set //item/link ^http://backend https://{request_host}\nxml_set /rss/@xmlns:media http://search.yahoo.com/mrss/\nxml_delete //item[@private]\nxml_insert //channel before \"<ttl>60</ttl>\"\nxml_insert //channel <generator/>\n}\n"), []string{}, handler)
+	c.Assert(err, IsNil)
+	actions := handler.rules[0].xml.actions
+	c.Assert(actions, HasLen, 5)
+	c.Assert(actions[0].kind, Equals, xmlActionSet)
+	c.Assert(actions[0].pattern.String(), Equals, "^http://backend")
+	c.Assert(string(actions[0].value), Equals, "https://{request_host}")
+	c.Assert(actions[0].elementPath, IsNil)
+	c.Assert(actions[1].pattern, IsNil)
+	c.Assert(actions[1].elementPath, NotNil)
+	c.Assert(actions[1].attribute, Equals, xmlNameOf("xmlns:media"))
+	c.Assert(actions[2].kind, Equals, xmlActionDelete)
+	c.Assert(actions[3].kind, Equals, xmlActionInsert)
+	c.Assert(actions[3].position, Equals, xmlInsertBefore)
+	c.Assert(string(actions[3].value), Equals, "<ttl>60</ttl>")
+	c.Assert(actions[4].position, Equals, xmlInsertAppend)
+	c.Assert(handler.rules[0].filtersBody(), Equals, true)
+
+	err = evalRule(s.newControllerFor("{\ncontent_type .*xml.*\nxml_delete //[\n}\n"), []string{}, handler)
+	c.Assert(err, ErrorMatches, "Testfile:3 - Error during parsing: There is no valid XPath expression for 'xml_delete' provided. Got: .*")
+
+	err = evalRule(s.newControllerFor("{\ncontent_type .*xml.*\nxml_set //a\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:3 - Error during parsing: There are two or three arguments for 'xml_set' expected."))
+
+	err = evalRule(s.newControllerFor("{\ncontent_type .*xml.*\nxml_insert //a middle <b/>\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:3 - Error during parsing: Illegal position for 'xml_insert': middle"))
+
+	err = evalRule(s.newControllerFor("{\ncontent_type .*xml.*\nxml_insert //a <b>\n}\n"), []string{}, handler)
+	c.Assert(err, ErrorMatches, "Testfile:3 - Error during parsing: There is no valid XML fragment for 'xml_insert' provided. Got: .*")
+
+	err = evalRule(s.newControllerFor("{\ncontent_type .*xml.*\nxml_delete //a\nsearch_pattern foo\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:5 - Error during parsing: Filter rule blocks with 'xml_set', 'xml_delete' or 'xml_insert' could not have a 'search_pattern', 'replacement', 'include_virtual', 'rewrite_upstream_urls', 'redact' or 'minify' definition."))
+}
+
+func (s *initTest) Test_evalRule_withScript(c *C) {
+	handler := new(filterHandler)
+	err := evalRule(s.newControllerFor("{\npath .*\nscript \"return body:upper()\"\nscript_max_memory 1MB\n}\n"), []string{}, handler)
+	c.Assert(err, IsNil)
+	c.Assert(handler.rules[0].script.name, Equals, "script")
+	c.Assert(handler.rules[0].script.proto, NotNil)
+	c.Assert(handler.rules[0].script.maximumMemory, Equals, int64(1024*1024))
+	c.Assert(handler.rules[0].filtersBody(), Equals, true)
+
+	err = evalRule(s.newControllerFor("{\npath .*\nscript \"return body:upper()\"\n}\n"), []string{}, handler)
+	c.Assert(err, IsNil)
+	c.Assert(handler.rules[1].script.proto, Equals, handler.rules[0].script.proto)
+	c.Assert(handler.rules[1].script.maximumMemory, Equals, int64(defaultScriptMaximumMemory))
+
+	err = evalRule(s.newControllerFor("{\npath .*\nscript \"return (\"\n}\n"), []string{}, handler)
+	c.Assert(err, ErrorMatches, "Testfile:3 - Error during parsing: There is no valid 'script' provided. Got: .*")
+
+	err = evalRule(s.newControllerFor("{\npath .*\nscript_max_memory 1MB\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:4 - Error during parsing: No 'script' definition was provided for filter rule block with 'script_max_memory'."))
+
+	err = evalRule(s.newControllerFor("{\npath .*\nscript_max_memory foo\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:3 - Error during parsing: There is no valid value for 'script_max_memory' provided. Got: foo"))
+
+	err = evalRule(s.newControllerFor("{\npath .*\nscript \"return body\"\nsearch_pattern foo\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:5 - Error during parsing: Filter rule blocks with 'script' could not have a 'search_pattern', 'replacement', 'include_virtual', 'rewrite_upstream_urls', 'redact', 'minify' or 'xml_*' definition."))
+}
+
+func (s *initTest) Test_evalRule_withPipe(c *C) {
+	handler := new(filterHandler)
+	err := evalRule(s.newControllerFor("{\npath .*\npipe cat -u\npipe_workers 4\npipe_timeout 2s\npipe_on_failure fail\n}\n"), []string{}, handler)
+	c.Assert(err, IsNil)
+	c.Assert(handler.rules[0].pipe.command, DeepEquals, []string{"cat", "-u"})
+	c.Assert(handler.rules[0].pipe.workers, Equals, 4)
+	c.Assert(handler.rules[0].pipe.timeout, Equals, 2*time.Second)
+	c.Assert(handler.rules[0].pipe.onFailure, Equals, pipeFailureFail)
+	c.Assert(handler.rules[0].filtersBody(), Equals, true)
+
+	err = evalRule(s.newControllerFor("{\npath .*\npipe_workers 2\npipe unix:/run/filter.sock\n}\n"), []string{}, handler)
+	c.Assert(err, IsNil)
+	c.Assert(handler.rules[1].pipe.socket, Equals, "/run/filter.sock")
+	c.Assert(handler.rules[1].pipe.workers, Equals, 2)
+	c.Assert(handler.rules[1].pipe.timeout, Equals, defaultPipeTimeout)
+	c.Assert(handler.rules[1].pipe.onFailure, Equals, pipeFailurePass)
+
+	err = evalRule(s.newControllerFor("{\npath .*\npipe\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:3 - Error during parsing: Wrong argument count or unexpected line ending after 'pipe'"))
+
+	err = evalRule(s.newControllerFor("{\npath .*\npipe doesNotExist4711\n}\n"), []string{}, handler)
+	c.Assert(err, ErrorMatches, "Testfile:3 - Error during parsing: There is no valid command for 'pipe' provided. Got: .*")
+
+	err = evalRule(s.newControllerFor("{\npath .*\npipe_timeout 1s\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:4 - Error during parsing: No 'pipe' definition was provided for filter rule block with 'pipe_workers', 'pipe_timeout' or 'pipe_on_failure'."))
+
+	err = evalRule(s.newControllerFor("{\npath .*\npipe_workers 0\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:3 - Error during parsing: There is no valid value for 'pipe_workers' provided. Got: 0"))
+
+	err = evalRule(s.newControllerFor("{\npath .*\npipe_timeout foo\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:3 - Error during parsing: There is no valid value for 'pipe_timeout' provided. Got: foo"))
+
+	err = evalRule(s.newControllerFor("{\npath .*\npipe_on_failure foo\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:3 - Error during parsing: Illegal value for 'pipe_on_failure': foo"))
+
+	err = evalRule(s.newControllerFor("{\npath .*\npipe cat\nsearch_pattern foo\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:5 - Error during parsing: Filter rule blocks with 'pipe' could not have a 'search_pattern', 'replacement', 'include_virtual', 'rewrite_upstream_urls', 'redact', 'minify', 'xml_*' or 'script' definition."))
+}
+
+func (s *initTest) Test_evalRule_withWasm(c *C) {
+	handler := new(filterHandler)
+	err := evalRule(s.newControllerFor("{\npath .*\nwasm resources/test/wasm/filter.wasm\nwasm_workers 3\nwasm_max_memory 1MB\n}\n"), []string{}, handler)
+	c.Assert(err, IsNil)
+	c.Assert(handler.rules[0].wasm.name, Equals, "resources/test/wasm/filter.wasm")
+	c.Assert(handler.rules[0].wasm.function, Equals, defaultWasmFunction)
+	c.Assert(handler.rules[0].wasm.workers, Equals, 3)
+	c.Assert(handler.rules[0].wasm.maximumMemory, Equals, int64(1024*1024))
+	c.Assert(cap(handler.rules[0].wasm.pool), Equals, 3)
+	c.Assert(handler.rules[0].filtersBody(), Equals, true)
+
+	err = evalRule(s.newControllerFor("{\npath .*\nwasm resources/test/wasm/filter.wasm fail\n}\n"), []string{}, handler)
+	c.Assert(err, IsNil)
+	c.Assert(handler.rules[1].wasm.function, Equals, "fail")
+	c.Assert(handler.rules[1].wasm.workers, Equals, defaultWasmWorkers)
+	c.Assert(handler.rules[1].wasm.maximumMemory, Equals, int64(defaultWasmMaximumMemory))
+
+	err = evalRule(s.newControllerFor("{\npath .*\nwasm resources/test/wasm/filter.wasm missing\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:4 - Error during parsing: There is no valid 'wasm' module provided. Got: there is no exported function 'missing'"))
+
+	err = evalRule(s.newControllerFor("{\npath .*\nwasm resources/test/wasm/filter.wasm\nwasm_max_memory 1KB\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:5 - Error during parsing: There is no valid 'wasm' module provided. Got: initial memory exceeds the limit of 1024 bytes"))
+
+	err = evalRule(s.newControllerFor("{\npath .*\nwasm resources/test/wasm/missing.wasm\n}\n"), []string{}, handler)
+	c.Assert(err, ErrorMatches, "Testfile:3 - Error during parsing: Could not read file provided in 'wasm' definition. Got: .*")
+
+	err = evalRule(s.newControllerFor("{\npath .*\nwasm\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:3 - Error during parsing: Wrong argument count or unexpected line ending after 'wasm'"))
+
+	err = evalRule(s.newControllerFor("{\npath .*\nwasm_workers 2\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:4 - Error during parsing: No 'wasm' definition was provided for filter rule block with 'wasm_workers' or 'wasm_max_memory'."))
+
+	err = evalRule(s.newControllerFor("{\npath .*\nwasm_workers 0\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:3 - Error during parsing: There is no valid value for 'wasm_workers' provided. Got: 0"))
+
+	err = evalRule(s.newControllerFor("{\npath .*\nwasm_max_memory foo\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:3 - Error during parsing: There is no valid value for 'wasm_max_memory' provided. Got: foo"))
+
+	err = evalRule(s.newControllerFor("{\npath .*\nwasm resources/test/wasm/filter.wasm\nsearch_pattern foo\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:5 - Error during parsing: Filter rule blocks with 'wasm' could not have a 'search_pattern', 'replacement', 'include_virtual', 'rewrite_upstream_urls', 'redact', 'minify', 'xml_*', 'script' or 'pipe' definition."))
+}
+
+func (s *initTest) Test_evalMaximumIncludeVirtualDepth(c *C) {
+	handler := new(filterHandler)
+	err := evalMaximumIncludeVirtualDepth(s.newControllerFor(""), []string{"5"}, handler)
+	c.Assert(err, IsNil)
+	c.Assert(handler.maximumIncludeVirtualDepth, Equals, 5)
+
+	err = evalMaximumIncludeVirtualDepth(s.newControllerFor(""), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:1 - Error during parsing: There are exact one argument for filter directive 'max_include_virtual_depth' expected."))
+
+	err = evalMaximumIncludeVirtualDepth(s.newControllerFor(""), []string{"0"}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:1 - Error during parsing: There is no valid value for filter directive 'max_include_virtual_depth' provided. Got: 0"))
 }
 
 func (s *initTest) Test_evalMaximumBufferSize(c *C) {
@@ -194,6 +583,212 @@ func (s *initTest) Test_evalMaximumBufferSize(c *C) {
 	c.Assert(err, ErrorMatches, "Testfile:1 - Error during parsing: There is no valid value for filter directive 'max_buffer_size' provided. Got: strconv.(ParseInt|Atoi): parsing \"abc\": invalid syntax")
 }
 
+func (s *initTest) Test_evalOutputCharset(c *C) {
+	handler := new(filterHandler)
+	err := evalOutputCharset(s.newControllerFor(""), []string{"utf-8"}, handler)
+	c.Assert(err, IsNil)
+	c.Assert(handler.outputCharset, Equals, outputCharsetUtf8)
+
+	err = evalOutputCharset(s.newControllerFor(""), []string{"original"}, handler)
+	c.Assert(err, IsNil)
+	c.Assert(handler.outputCharset, Equals, outputCharsetOriginal)
+
+	err = evalOutputCharset(s.newControllerFor(""), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:1 - Error during parsing: There are exact one argument for filter directive 'output_charset' expected."))
+
+	err = evalOutputCharset(s.newControllerFor(""), []string{"latin1"}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:1 - Error during parsing: Illegal value for filter directive 'output_charset': latin1"))
+}
+
+func (s *initTest) Test_evalMetricsPath(c *C) {
+	handler := new(filterHandler)
+	err := evalMetricsPath(s.newControllerFor(""), []string{"/filter-metrics"}, handler)
+	c.Assert(err, IsNil)
+	c.Assert(handler.metricsPath, Equals, "/filter-metrics")
+
+	err = evalMetricsPath(s.newControllerFor(""), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:1 - Error during parsing: There are exact one argument for filter directive 'metrics_path' expected."))
+
+	err = evalMetricsPath(s.newControllerFor(""), []string{"metrics"}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:1 - Error during parsing: The value of filter directive 'metrics_path' has to start with '/'. Got: metrics"))
+}
+
+func (s *initTest) Test_evalDebug(c *C) {
+	handler := new(filterHandler)
+	err := evalDebug(s.newControllerFor(""), []string{"secret"}, handler)
+	c.Assert(err, IsNil)
+	c.Assert(handler.debugToken, Equals, "secret")
+
+	err = evalDebug(s.newControllerFor(""), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:1 - Error during parsing: There are exact one argument for filter directive 'debug' expected."))
+
+	err = evalDebug(s.newControllerFor(""), []string{""}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:1 - Error during parsing: The value of filter directive 'debug' could not be empty."))
+}
+
+func (s *initTest) Test_evalRule_withName(c *C) {
+	handler := new(filterHandler)
+	err := evalRule(s.newControllerFor("{\nname myRule\npath myPath\nsearch_pattern mySearchPattern\n}\n"), []string{}, handler)
+	c.Assert(err, IsNil)
+	c.Assert(len(handler.rules), Equals, 1)
+	c.Assert(handler.rules[0].name, Equals, "myRule")
+	c.Assert(handler.rules[0].nameAt(0), Equals, "myRule")
+
+	err = evalRule(s.newControllerFor("{\npath myPath\nsearch_pattern mySearchPattern\n}\n"), []string{}, handler)
+	c.Assert(err, IsNil)
+	c.Assert(handler.rules[1].nameAt(1), Equals, "rule#2")
+
+	err = evalRule(s.newControllerFor("{\nname myRule\npath myPath\nsearch_pattern mySearchPattern\n}\n"), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:2 - Error during parsing: There is already a filter rule named 'myRule'."))
+}
+
+func (s *initTest) Test_evalExecutionLog(c *C) {
+	handler := new(filterHandler)
+	err := evalExecutionLog(s.newControllerFor(""), []string{"caddy", "0.25"}, handler)
+	c.Assert(err, IsNil)
+	c.Assert(handler.executionLog.writer, IsNil)
+	c.Assert(handler.executionLog.sampleRate, Equals, 0.25)
+
+	err = evalExecutionLog(s.newControllerFor(""), []string{"stdout"}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:1 - Error during parsing: There is already a filter directive 'log' defined."))
+
+	handler = new(filterHandler)
+	err = evalExecutionLog(s.newControllerFor(""), []string{"stdout"}, handler)
+	c.Assert(err, IsNil)
+	c.Assert(handler.executionLog.writer, Equals, os.Stdout)
+	c.Assert(handler.executionLog.sampleRate, Equals, 1.0)
+
+	err = evalExecutionLog(s.newControllerFor(""), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:1 - Error during parsing: There are one or two arguments for filter directive 'log' expected."))
+
+	err = evalExecutionLog(s.newControllerFor(""), []string{"stdout", "2"}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:1 - Error during parsing: There is no valid sample rate between 0 and 1 for filter directive 'log' provided. Got: 2"))
+}
+
+func (s *initTest) Test_evalRuleTimeout(c *C) {
+	r := new(rule)
+	err := evalRuleTimeout(s.newControllerFor("150ms"), r)
+	c.Assert(err, IsNil)
+	c.Assert(r.timeout, Equals, 150*time.Millisecond)
+
+	err = evalRuleTimeout(s.newControllerFor("foo"), r)
+	c.Assert(err, DeepEquals, errors.New("Testfile:1 - Error during parsing: There is no valid value for 'timeout' provided. Got: foo"))
+}
+
+func (s *initTest) Test_evalRuleMode(c *C) {
+	r := new(rule)
+	err := evalRuleMode(s.newControllerFor("shadow"), r)
+	c.Assert(err, IsNil)
+	c.Assert(r.mode, Equals, ruleModeShadow)
+
+	err = evalRuleMode(s.newControllerFor("foo"), r)
+	c.Assert(err, DeepEquals, errors.New("Testfile:1 - Error during parsing: Illegal value for 'mode': foo"))
+}
+
+func (s *initTest) Test_evalTimeout(c *C) {
+	handler := new(filterHandler)
+	err := evalTimeout(s.newControllerFor(""), []string{"2s"}, handler)
+	c.Assert(err, IsNil)
+	c.Assert(handler.timeout, Equals, 2*time.Second)
+
+	err = evalTimeout(s.newControllerFor(""), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:1 - Error during parsing: There are exact one argument for filter directive 'timeout' expected."))
+
+	err = evalTimeout(s.newControllerFor(""), []string{"-1s"}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:1 - Error during parsing: There is no valid value for filter directive 'timeout' provided. Got: -1s"))
+}
+
+func (s *initTest) Test_evalTimeoutPolicy(c *C) {
+	handler := new(filterHandler)
+	err := evalTimeoutPolicy(s.newControllerFor(""), []string{"fail"}, handler)
+	c.Assert(err, IsNil)
+	c.Assert(handler.timeoutPolicy, Equals, timeoutPolicyFail)
+
+	err = evalTimeoutPolicy(s.newControllerFor(""), []string{"pass"}, handler)
+	c.Assert(err, IsNil)
+	c.Assert(handler.timeoutPolicy, Equals, timeoutPolicyPass)
+
+	err = evalTimeoutPolicy(s.newControllerFor(""), []string{"foo"}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:1 - Error during parsing: Illegal value for filter directive 'on_timeout': foo"))
+}
+
+func (s *initTest) Test_evalMaximumTotalBuffer(c *C) {
+	handler := &filterHandler{bufferBudget: newBufferBudget()}
+	err := evalMaximumTotalBuffer(s.newControllerFor(""), []string{"512MB"}, handler)
+	c.Assert(err, IsNil)
+	_, limit := handler.bufferBudget.usage()
+	c.Assert(limit, Equals, int64(512*1024*1024))
+	c.Assert(handler.bufferPolicy, Equals, bufferBudgetPolicyBypass)
+
+	handler = &filterHandler{bufferBudget: newBufferBudget()}
+	err = evalMaximumTotalBuffer(s.newControllerFor(""), []string{"1024", "wait", "100ms"}, handler)
+	c.Assert(err, IsNil)
+	_, limit = handler.bufferBudget.usage()
+	c.Assert(limit, Equals, int64(1024))
+	c.Assert(handler.bufferPolicy, Equals, bufferBudgetPolicyWait)
+	c.Assert(handler.bufferWait, Equals, 100*time.Millisecond)
+
+	err = evalMaximumTotalBuffer(s.newControllerFor(""), []string{"1KB", "reject"}, handler)
+	c.Assert(err, IsNil)
+	c.Assert(handler.bufferPolicy, Equals, bufferBudgetPolicyReject)
+
+	err = evalMaximumTotalBuffer(s.newControllerFor(""), []string{"2KB"}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:1 - Error during parsing: The filter directive 'max_total_buffer' is shared by all sites and already defined with 1024 bytes. Got: 2KB"))
+
+	err = evalMaximumTotalBuffer(s.newControllerFor(""), []string{}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:1 - Error during parsing: There are one to three arguments for filter directive 'max_total_buffer' expected."))
+
+	err = evalMaximumTotalBuffer(s.newControllerFor(""), []string{"abc"}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:1 - Error during parsing: There is no valid value for filter directive 'max_total_buffer' provided. Got: abc"))
+
+	err = evalMaximumTotalBuffer(s.newControllerFor(""), []string{"1MB", "foo"}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:1 - Error during parsing: Illegal policy for filter directive 'max_total_buffer': foo"))
+
+	err = evalMaximumTotalBuffer(s.newControllerFor(""), []string{"1MB", "wait"}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:1 - Error during parsing: The policy 'wait' of filter directive 'max_total_buffer' requires a duration."))
+
+	err = evalMaximumTotalBuffer(s.newControllerFor(""), []string{"1MB", "reject", "1s"}, handler)
+	c.Assert(err, DeepEquals, errors.New("Testfile:1 - Error during parsing: Only the policy 'wait' of filter directive 'max_total_buffer' accepts a duration."))
+}
+
+func (s *initTest) Test_parseConfigurationWithMaximumTotalBuffer(c *C) {
+	controller := caddy.NewTestController("http", "filter max_total_buffer 1MB reject\nfilter rule {\npath a\nsearch_pattern a\n}\n")
+	first, err := parseConfiguration(controller)
+	c.Assert(err, IsNil)
+	controller = caddy.NewTestController("http", "filter rule {\npath b\nsearch_pattern b\n}\n")
+	controller.Set(bufferBudgetStorageKey, first.bufferBudget)
+	second, err := parseConfiguration(controller)
+	c.Assert(err, IsNil)
+	c.Assert(second.bufferBudget, Equals, first.bufferBudget)
+	c.Assert(second.bufferPolicy, Equals, bufferBudgetPolicyBypass)
+
+	other, err := parseConfiguration(caddy.NewTestController("http", "filter max_total_buffer 2MB\nfilter rule {\npath a\nsearch_pattern a\n}\n"))
+	c.Assert(err, IsNil)
+	c.Assert(other.bufferBudget == first.bufferBudget, Equals, false)
+	_, limit := other.bufferBudget.usage()
+	c.Assert(limit, Equals, int64(2*1024*1024))
+
+	_, err = parseConfiguration(caddy.NewTestController("http", "filter max_total_buffer 1MB\nfilter max_total_buffer 2MB\nfilter rule {\npath a\nsearch_pattern a\n}\n"))
+	c.Assert(err, DeepEquals, errors.New("Testfile:2 - Error during parsing: The filter directive 'max_total_buffer' is shared by all sites and already defined with 1048576 bytes. Got: 2MB"))
+}
+
+func (s *initTest) Test_parseByteSize(c *C) {
+	for plain, expected := range map[string]int64{
+		"123":   123,
+		"123B":  123,
+		"2KB":   2 * 1024,
+		"10mb":  10 * 1024 * 1024,
+		"1 GB":  1024 * 1024 * 1024,
+		"512MB": 512 * 1024 * 1024,
+	} {
+		value, err := parseByteSize(plain)
+		c.Assert(err, IsNil)
+		c.Assert(value, Equals, expected)
+	}
+	_, err := parseByteSize("MB")
+	c.Assert(err, NotNil)
+}
+
 func (s *initTest) newControllerFor(plainTokens string) *caddy.Controller {
 	controller := caddy.NewTestController("http", "start "+plainTokens)
 	if !controller.Next() {
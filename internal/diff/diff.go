@@ -0,0 +1,257 @@
+// Package diff computes differences between texts.
+package diff
+
+import (
+	"bytes"
+	"fmt"
+)
+
+const contextLines = 3
+
+type operation byte
+
+const (
+	equal  = operation(' ')
+	remove = operation('-')
+	insert = operation('+')
+)
+
+type edit struct {
+	operation operation
+	line      string
+	// lineA and lineB are the zero based positions in a and b before this edit.
+	lineA int
+	lineB int
+}
+
+// Unified returns the differences between the lines of a and b in the unified
+// format with three lines of context. It returns an empty string if both are equal.
+func Unified(nameA string, nameB string, a []byte, b []byte) string {
+	edits := editsOf(splitLines(a), splitLines(b))
+	var changes []int
+	for i, edit := range edits {
+		if edit.operation != equal {
+			changes = append(changes, i)
+		}
+	}
+	if len(changes) <= 0 {
+		return ""
+	}
+	result := new(bytes.Buffer)
+	fmt.Fprintf(result, "--- %s\n+++ %s\n", nameA, nameB)
+	for len(changes) > 0 {
+		last := 0
+		for last+1 < len(changes) && changes[last+1]-changes[last] <= 2*contextLines {
+			last++
+		}
+		from := changes[0] - contextLines
+		if from < 0 {
+			from = 0
+		}
+		to := changes[last] + contextLines + 1
+		if to > len(edits) {
+			to = len(edits)
+		}
+		writeHunk(result, edits[from:to])
+		changes = changes[last+1:]
+	}
+	return result.String()
+}
+
+func writeHunk(w *bytes.Buffer, edits []edit) {
+	startA, startB := edits[0].lineA+1, edits[0].lineB+1
+	countA, countB := 0, 0
+	for _, edit := range edits {
+		if edit.operation != insert {
+			countA++
+		}
+		if edit.operation != remove {
+			countB++
+		}
+	}
+	if countA == 0 {
+		startA--
+	}
+	if countB == 0 {
+		startB--
+	}
+	fmt.Fprintf(w, "@@ -%d,%d +%d,%d @@\n", startA, countA, startB, countB)
+	for _, edit := range edits {
+		w.WriteByte(byte(edit.operation))
+		w.WriteString(edit.line)
+		if len(edit.line) == 0 || edit.line[len(edit.line)-1] != '\n' {
+			w.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+// splitLines splits the given content into lines which still contain their line break.
+func splitLines(content []byte) []string {
+	var result []string
+	for len(content) > 0 {
+		i := bytes.IndexByte(content, '\n')
+		if i < 0 {
+			result = append(result, string(content))
+			break
+		}
+		result = append(result, string(content[:i+1]))
+		content = content[i+1:]
+	}
+	return result
+}
+
+// editsOf computes the shortest edit script from a to b with the linear space variant of the
+// algorithm of Eugene W. Myers: "An O(ND) Difference Algorithm and Its Variations".
+func editsOf(a []string, b []string) []edit {
+	differ := &differ{a: a, b: b}
+	differ.compare(0, len(a), 0, len(b))
+	return groupChanges(differ.result)
+}
+
+// groupChanges reorders every run of changes in the given edits so that all removes come before
+// the inserts - as in every other unified diff.
+func groupChanges(edits []edit) []edit {
+	result := make([]edit, 0, len(edits))
+	for i := 0; i < len(edits); {
+		if edits[i].operation == equal {
+			result = append(result, edits[i])
+			i++
+			continue
+		}
+		end := i
+		for end < len(edits) && edits[end].operation != equal {
+			end++
+		}
+		lineA, lineB := edits[i].lineA, edits[i].lineB
+		for _, e := range edits[i:end] {
+			if e.operation == remove {
+				e.lineB = lineB
+				result = append(result, e)
+				lineA++
+			}
+		}
+		for _, e := range edits[i:end] {
+			if e.operation == insert {
+				e.lineA = lineA
+				result = append(result, e)
+			}
+		}
+		i = end
+	}
+	return result
+}
+
+type differ struct {
+	a      []string
+	b      []string
+	result []edit
+}
+
+// compare appends the edits from a[aLow:aHigh] to b[bLow:bHigh].
+func (instance *differ) compare(aLow, aHigh, bLow, bHigh int) {
+	a, b := instance.a, instance.b
+	for aLow < aHigh && bLow < bHigh && a[aLow] == b[bLow] {
+		instance.result = append(instance.result, edit{operation: equal, line: a[aLow], lineA: aLow, lineB: bLow})
+		aLow++
+		bLow++
+	}
+	aEnd, bEnd := aHigh, bHigh
+	for aEnd > aLow && bEnd > bLow && a[aEnd-1] == b[bEnd-1] {
+		aEnd--
+		bEnd--
+	}
+	if x, y, ok := instance.middleSnake(aLow, aEnd, bLow, bEnd); ok {
+		instance.compare(aLow, x, bLow, y)
+		instance.compare(x, aEnd, y, bEnd)
+	} else {
+		for x := aLow; x < aEnd; x++ {
+			instance.result = append(instance.result, edit{operation: remove, line: a[x], lineA: x, lineB: bLow})
+		}
+		for y := bLow; y < bEnd; y++ {
+			instance.result = append(instance.result, edit{operation: insert, line: b[y], lineA: aEnd, lineB: y})
+		}
+	}
+	for x, y := aEnd, bEnd; x < aHigh; x, y = x+1, y+1 {
+		instance.result = append(instance.result, edit{operation: equal, line: a[x], lineA: x, lineB: y})
+	}
+}
+
+// middleSnake searches the shortest edit script from a[aLow:aHigh] to b[bLow:bHigh] from both
+// ends at once and returns the point where both searches meet. It splits the script into two
+// halves with about the same number of edits. If there is no such point - because one of the
+// ranges is empty or every line is removed and inserted - false is returned.
+func (instance *differ) middleSnake(aLow, aHigh, bLow, bHigh int) (int, int, bool) {
+	a, b := instance.a[aLow:aHigh], instance.b[bLow:bHigh]
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 {
+		return 0, 0, false
+	}
+	maximumD := (n+m+1)/2 + 1
+	offset := maximumD
+	forward := make([]int, 2*maximumD+2)
+	backward := make([]int, 2*maximumD+2)
+	for i := range forward {
+		forward[i], backward[i] = -1, -1
+	}
+	forward[offset+1], backward[offset+1] = 0, 0
+	delta := n - m
+	// If delta is odd the searches meet while searching forward, otherwise while searching backward.
+	odd := delta%2 != 0
+	// The diagonals which left the edit graph are not searched again.
+	forwardStart, forwardEnd, backwardStart, backwardEnd := 0, 0, 0, 0
+	for d := 0; d < maximumD; d++ {
+		for k := -d + forwardStart; k <= d-forwardEnd; k += 2 {
+			var x int
+			if k == -d || (k != d && forward[offset+k-1] < forward[offset+k+1]) {
+				x = forward[offset+k+1]
+			} else {
+				x = forward[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			forward[offset+k] = x
+			if x > n {
+				forwardEnd += 2
+			} else if y > m {
+				forwardStart += 2
+			} else if odd {
+				backwardIndex := offset + delta - k
+				if backwardIndex >= 0 && backwardIndex < len(backward) && backward[backwardIndex] != -1 && x >= n-backward[backwardIndex] {
+					return aLow + x, bLow + y, true
+				}
+			}
+		}
+		for k := -d + backwardStart; k <= d-backwardEnd; k += 2 {
+			var x int
+			if k == -d || (k != d && backward[offset+k-1] < backward[offset+k+1]) {
+				x = backward[offset+k+1]
+			} else {
+				x = backward[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[n-x-1] == b[m-y-1] {
+				x++
+				y++
+			}
+			backward[offset+k] = x
+			if x > n {
+				backwardEnd += 2
+			} else if y > m {
+				backwardStart += 2
+			} else if !odd {
+				forwardIndex := offset + delta - k
+				if forwardIndex >= 0 && forwardIndex < len(forward) && forward[forwardIndex] != -1 {
+					forwardX := forward[forwardIndex]
+					forwardY := forwardX - (forwardIndex - offset)
+					if forwardX >= n-x {
+						return aLow + forwardX, bLow + forwardY, true
+					}
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
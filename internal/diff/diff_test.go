@@ -0,0 +1,98 @@
+package diff
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+type unifiedTest struct{}
+
+func init() {
+	Suite(&unifiedTest{})
+}
+
+func (s *unifiedTest) Test_Unified(c *C) {
+	c.Assert(Unified("a", "b", []byte("1\n2\n"), []byte("1\n2\n")), Equals, "")
+	c.Assert(Unified("a", "b", []byte(""), []byte("1\n")), Equals, "--- a\n+++ b\n@@ -0,0 +1,1 @@\n+1\n")
+	c.Assert(Unified("a", "b", []byte("1\n"), []byte("")), Equals, "--- a\n+++ b\n@@ -1,1 +0,0 @@\n-1\n")
+	c.Assert(Unified("a", "b", []byte("1\n2"), []byte("1\n2\n")), Equals, "--- a\n+++ b\n@@ -1,2 +1,2 @@\n 1\n-2\n\\ No newline at end of file\n+2\n")
+}
+
+func (s *unifiedTest) Test_Unified_withSeparatedHunks(c *C) {
+	a := []byte("1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n")
+	b := []byte("0\n1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n")
+	c.Assert(Unified("a", "b", a, b), Equals, "--- a\n+++ b\n"+
+		"@@ -1,3 +1,4 @@\n+0\n 1\n 2\n 3\n"+
+		"@@ -9,4 +10,3 @@\n 9\n 10\n 11\n-12\n")
+}
+
+func (s *unifiedTest) Test_Unified_withJoinedHunks(c *C) {
+	a := []byte("1\n2\n3\n4\n5\n6\n7\n")
+	b := []byte("x\n2\n3\n4\n5\n6\ny\n")
+	c.Assert(Unified("a", "b", a, b), Equals, "--- a\n+++ b\n"+
+		"@@ -1,7 +1,7 @@\n-1\n+x\n 2\n 3\n 4\n 5\n 6\n-7\n+y\n")
+}
+
+func (s *unifiedTest) Test_Unified_withLargeContent(c *C) {
+	a := bytes.Repeat([]byte("line\n"), 5000)
+	actual := Unified("a", "b", a, []byte("other\n"))
+	c.Assert(strings.HasPrefix(actual, "--- a\n+++ b\n@@ -1,5000 +1,1 @@\n-line\n"), Equals, true)
+	c.Assert(strings.Count(actual, "-line\n"), Equals, 5000)
+	c.Assert(strings.HasSuffix(actual, "+other\n"), Equals, true)
+}
+
+func (s *unifiedTest) Test_editsOf(c *C) {
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		a, b := randomLines(random), randomLines(random)
+		edits := editsOf(a, b)
+		resultA, resultB := []string{}, []string{}
+		changes := 0
+		for _, e := range edits {
+			if e.operation != insert {
+				c.Assert(a[e.lineA], Equals, e.line)
+				resultA = append(resultA, e.line)
+			}
+			if e.operation != remove {
+				c.Assert(b[e.lineB], Equals, e.line)
+				resultB = append(resultB, e.line)
+			}
+			if e.operation != equal {
+				changes++
+			}
+		}
+		c.Assert(resultA, DeepEquals, a)
+		c.Assert(resultB, DeepEquals, b)
+		c.Assert(changes, Equals, len(a)+len(b)-2*longestCommonSubsequenceOf(a, b), Commentf("%v -> %v", a, b))
+	}
+}
+
+func randomLines(random *rand.Rand) []string {
+	result := make([]string, random.Intn(12))
+	for i := range result {
+		result[i] = string(rune('a' + random.Intn(3)))
+	}
+	return result
+}
+
+func longestCommonSubsequenceOf(a []string, b []string) int {
+	lengths := make([][]int, len(a)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			} else if lengths[i+1][j] > lengths[i][j+1] {
+				lengths[i][j] = lengths[i+1][j]
+			} else {
+				lengths[i][j] = lengths[i][j+1]
+			}
+		}
+	}
+	return lengths[0][0]
+}
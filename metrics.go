@@ -0,0 +1,294 @@
+package filter
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const metricsNamespace = "caddy_filter"
+
+var defaultDurationBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// filterMetrics collects the activity of one filter handler and renders it in the Prometheus text format.
+type filterMetrics struct {
+	mutex                  sync.Mutex
+	responses              *counterVec
+	skipped                *counterVec
+	decodeFailures         *counterVec
+	ruleMatches            *counterVec
+	ruleReplacements       *counterVec
+	ruleBytesIn            *counterVec
+	ruleBytesOut           *counterVec
+	ruleShadowReplacements *counterVec
+	ruleRedactions         *counterVec
+	ruleExecutionTime      *histogramVec
+	bufferBudget           *bufferBudget
+}
+
+func newFilterMetrics() *filterMetrics {
+	return &filterMetrics{
+		responses:              newCounterVec("responses_total", "Number of responses passed through the filter by result.", "result"),
+		skipped:                newCounterVec("skipped_total", "Number of responses which were not filtered by reason.", "reason"),
+		decodeFailures:         newCounterVec("decode_failures_total", "Number of response bodies which could not be decoded by encoding.", "encoding"),
+		ruleMatches:            newCounterVec("rule_matches_total", "Number of responses a rule was executed on.", "rule"),
+		ruleReplacements:       newCounterVec("rule_replacements_total", "Number of replacements done by a rule.", "rule"),
+		ruleBytesIn:            newCounterVec("rule_bytes_in_total", "Number of body bytes passed into a rule.", "rule"),
+		ruleBytesOut:           newCounterVec("rule_bytes_out_total", "Number of body bytes produced by a rule.", "rule"),
+		ruleShadowReplacements: newCounterVec("rule_shadow_replacements_total", "Number of replacements a rule in shadow mode would have done.", "rule"),
+		ruleRedactions:         newCounterVec("rule_redactions_total", "Number of values masked by a rule with 'redact' by detector.", "rule", "detector"),
+		ruleExecutionTime:      newHistogramVec("rule_execution_duration_seconds", "Duration of the execution of a rule on a response body.", defaultDurationBuckets, "rule"),
+	}
+}
+
+func (instance *filterMetrics) recordFiltered() {
+	if instance == nil {
+		return
+	}
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	instance.responses.add(1, "filtered")
+}
+
+func (instance *filterMetrics) recordSkipped(reason skipReason) {
+	if instance == nil {
+		return
+	}
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	instance.responses.add(1, "skipped")
+	instance.skipped.add(1, string(reason))
+}
+
+func (instance *filterMetrics) recordDecodeFailure(encoding string) {
+	if instance == nil {
+		return
+	}
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	instance.decodeFailures.add(1, encoding)
+}
+
+func (instance *filterMetrics) recordRuleExecution(ruleName string, replacements int, bytesIn int, bytesOut int, duration time.Duration) {
+	if instance == nil {
+		return
+	}
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	instance.ruleMatches.add(1, ruleName)
+	instance.ruleReplacements.add(float64(replacements), ruleName)
+	instance.ruleBytesIn.add(float64(bytesIn), ruleName)
+	instance.ruleBytesOut.add(float64(bytesOut), ruleName)
+	instance.ruleExecutionTime.observe(duration.Seconds(), ruleName)
+}
+
+// recordRuleShadowExecution records the execution of a rule in shadow mode. The body is
+// delivered unchanged, so the produced bytes are the same as the passed ones.
+func (instance *filterMetrics) recordRuleShadowExecution(ruleName string, replacements int, bytesIn int, duration time.Duration) {
+	if instance == nil {
+		return
+	}
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	instance.ruleMatches.add(1, ruleName)
+	instance.ruleShadowReplacements.add(float64(replacements), ruleName)
+	instance.ruleBytesIn.add(float64(bytesIn), ruleName)
+	instance.ruleBytesOut.add(float64(bytesIn), ruleName)
+	instance.ruleExecutionTime.observe(duration.Seconds(), ruleName)
+}
+
+// recordRuleRedactions records the number of masked values of a rule by detector.
+func (instance *filterMetrics) recordRuleRedactions(ruleName string, redactions map[string]int) {
+	if instance == nil || len(redactions) <= 0 {
+		return
+	}
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	for detector, count := range redactions {
+		instance.ruleRedactions.add(float64(count), ruleName, detector)
+	}
+}
+
+func (instance *filterMetrics) writeTo(writer io.Writer) error {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	for _, counter := range []*counterVec{
+		instance.responses,
+		instance.skipped,
+		instance.decodeFailures,
+		instance.ruleMatches,
+		instance.ruleReplacements,
+		instance.ruleBytesIn,
+		instance.ruleBytesOut,
+		instance.ruleShadowReplacements,
+		instance.ruleRedactions,
+	} {
+		if err := counter.writeTo(writer); err != nil {
+			return err
+		}
+	}
+	if err := instance.ruleExecutionTime.writeTo(writer); err != nil {
+		return err
+	}
+	if instance.bufferBudget != nil {
+		used, limit := instance.bufferBudget.usage()
+		if _, err := fmt.Fprintf(writer, "# HELP %s_total_buffer_bytes Bytes currently recorded by all filtered responses.\n# TYPE %s_total_buffer_bytes gauge\n%s_total_buffer_bytes %d\n", metricsNamespace, metricsNamespace, metricsNamespace, used); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(writer, "# HELP %s_total_buffer_limit_bytes Maximum bytes all filtered responses could record together.\n# TYPE %s_total_buffer_limit_bytes gauge\n%s_total_buffer_limit_bytes %d\n", metricsNamespace, metricsNamespace, metricsNamespace, limit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (instance *filterMetrics) ServeHTTP(writer http.ResponseWriter, request *http.Request) (int, error) {
+	if request.Method != "GET" && request.Method != "HEAD" {
+		return http.StatusMethodNotAllowed, nil
+	}
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writer.WriteHeader(http.StatusOK)
+	if request.Method == "HEAD" {
+		return http.StatusOK, nil
+	}
+	return http.StatusOK, instance.writeTo(writer)
+}
+
+type counterVec struct {
+	name       string
+	help       string
+	labelNames []string
+	values     map[string]float64
+}
+
+func newCounterVec(name string, help string, labelNames ...string) *counterVec {
+	return &counterVec{
+		name:       metricsNamespace + "_" + name,
+		help:       help,
+		labelNames: labelNames,
+		values:     map[string]float64{},
+	}
+}
+
+func (instance *counterVec) add(value float64, labelValues ...string) {
+	instance.values[formatMetricLabels(instance.labelNames, labelValues)] += value
+}
+
+func (instance *counterVec) writeTo(writer io.Writer) error {
+	if _, err := fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s counter\n", instance.name, instance.help, instance.name); err != nil {
+		return err
+	}
+	allLabels := make([]string, 0, len(instance.values))
+	for candidate := range instance.values {
+		allLabels = append(allLabels, candidate)
+	}
+	sort.Strings(allLabels)
+	for _, labels := range allLabels {
+		if _, err := fmt.Fprintf(writer, "%s%s %s\n", instance.name, labels, formatMetricValue(instance.values[labels])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type histogramVec struct {
+	name       string
+	help       string
+	buckets    []float64
+	labelNames []string
+	values     map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labelValues []string
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labelNames ...string) *histogramVec {
+	return &histogramVec{
+		name:       metricsNamespace + "_" + name,
+		help:       help,
+		buckets:    buckets,
+		labelNames: labelNames,
+		values:     map[string]*histogramValue{},
+	}
+}
+
+func (instance *histogramVec) observe(value float64, labelValues ...string) {
+	key := formatMetricLabels(instance.labelNames, labelValues)
+	target, ok := instance.values[key]
+	if !ok {
+		target = &histogramValue{
+			labelValues: labelValues,
+			counts:      make([]uint64, len(instance.buckets)),
+		}
+		instance.values[key] = target
+	}
+	for i, bound := range instance.buckets {
+		if value <= bound {
+			target.counts[i]++
+		}
+	}
+	target.count++
+	target.sum += value
+}
+
+func (instance *histogramVec) writeTo(writer io.Writer) error {
+	if _, err := fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s histogram\n", instance.name, instance.help, instance.name); err != nil {
+		return err
+	}
+	labelNames := append(append([]string{}, instance.labelNames...), "le")
+	allLabels := make([]string, 0, len(instance.values))
+	for candidate := range instance.values {
+		allLabels = append(allLabels, candidate)
+	}
+	sort.Strings(allLabels)
+	for _, labels := range allLabels {
+		value := instance.values[labels]
+		for i, bound := range instance.buckets {
+			bucketLabels := formatMetricLabels(labelNames, append(append([]string{}, value.labelValues...), formatMetricValue(bound)))
+			if _, err := fmt.Fprintf(writer, "%s_bucket%s %d\n", instance.name, bucketLabels, value.counts[i]); err != nil {
+				return err
+			}
+		}
+		infLabels := formatMetricLabels(labelNames, append(append([]string{}, value.labelValues...), "+Inf"))
+		if _, err := fmt.Fprintf(writer, "%s_bucket%s %d\n%s_sum%s %s\n%s_count%s %d\n",
+			instance.name, infLabels, value.count,
+			instance.name, labels, formatMetricValue(value.sum),
+			instance.name, labels, value.count,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatMetricLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	parts := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		parts[i] = name + "=\"" + metricLabelValueEscaper.Replace(value) + "\""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// metricLabelValueEscaper escapes label values like required by the text format of Prometheus
+// which - unlike Go - only knows the escape sequences \\, \" and \n.
+var metricLabelValueEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
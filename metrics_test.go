@@ -0,0 +1,86 @@
+package filter
+
+import (
+	"bytes"
+	. "github.com/echocat/gocheck-addons"
+	. "gopkg.in/check.v1"
+	"net/http"
+	"time"
+)
+
+type metricsTest struct{}
+
+func init() {
+	Suite(&metricsTest{})
+}
+
+func (s *metricsTest) Test_writeTo(c *C) {
+	metrics := newFilterMetrics()
+	metrics.recordFiltered()
+	metrics.recordSkipped(skipReasonBufferOverflow)
+	metrics.recordSkipped(skipReasonBufferOverflow)
+	metrics.recordDecodeFailure("gzip")
+	metrics.recordRuleExecution("rule#1", 3, 100, 120, 2*time.Millisecond)
+
+	buffer := new(bytes.Buffer)
+	c.Assert(metrics.writeTo(buffer), IsNil)
+	output := buffer.String()
+	c.Assert(output, Contains, "# TYPE caddy_filter_responses_total counter\n")
+	c.Assert(output, Contains, "caddy_filter_responses_total{result=\"filtered\"} 1\n")
+	c.Assert(output, Contains, "caddy_filter_responses_total{result=\"skipped\"} 2\n")
+	c.Assert(output, Contains, "caddy_filter_skipped_total{reason=\"buffer-overflow\"} 2\n")
+	c.Assert(output, Contains, "caddy_filter_decode_failures_total{encoding=\"gzip\"} 1\n")
+	c.Assert(output, Contains, "caddy_filter_rule_matches_total{rule=\"rule#1\"} 1\n")
+	c.Assert(output, Contains, "caddy_filter_rule_replacements_total{rule=\"rule#1\"} 3\n")
+	c.Assert(output, Contains, "caddy_filter_rule_bytes_in_total{rule=\"rule#1\"} 100\n")
+	c.Assert(output, Contains, "caddy_filter_rule_bytes_out_total{rule=\"rule#1\"} 120\n")
+	c.Assert(output, Contains, "# TYPE caddy_filter_rule_execution_duration_seconds histogram\n")
+	c.Assert(output, Contains, "caddy_filter_rule_execution_duration_seconds_bucket{rule=\"rule#1\",le=\"0.001\"} 0\n")
+	c.Assert(output, Contains, "caddy_filter_rule_execution_duration_seconds_bucket{rule=\"rule#1\",le=\"0.005\"} 1\n")
+	c.Assert(output, Contains, "caddy_filter_rule_execution_duration_seconds_bucket{rule=\"rule#1\",le=\"+Inf\"} 1\n")
+	c.Assert(output, Contains, "caddy_filter_rule_execution_duration_seconds_sum{rule=\"rule#1\"} 0.002\n")
+	c.Assert(output, Contains, "caddy_filter_rule_execution_duration_seconds_count{rule=\"rule#1\"} 1\n")
+}
+
+func (s *metricsTest) Test_writeTo_withShadowExecution(c *C) {
+	metrics := newFilterMetrics()
+	metrics.recordRuleShadowExecution("rule#1", 3, 100, time.Millisecond)
+
+	buffer := new(bytes.Buffer)
+	c.Assert(metrics.writeTo(buffer), IsNil)
+	output := buffer.String()
+	c.Assert(output, Contains, "caddy_filter_rule_matches_total{rule=\"rule#1\"} 1\n")
+	c.Assert(output, Contains, "caddy_filter_rule_shadow_replacements_total{rule=\"rule#1\"} 3\n")
+	c.Assert(output, Contains, "caddy_filter_rule_bytes_out_total{rule=\"rule#1\"} 100\n")
+	c.Assert(output, Not(Contains), "caddy_filter_rule_replacements_total{rule=\"rule#1\"}")
+}
+
+func (s *metricsTest) Test_nilIsIgnored(c *C) {
+	var metrics *filterMetrics
+	metrics.recordFiltered()
+	metrics.recordSkipped(skipReasonWebsocket)
+	metrics.recordDecodeFailure("gzip")
+	metrics.recordRuleExecution("rule#1", 1, 1, 1, time.Millisecond)
+}
+
+func (s *metricsTest) Test_formatMetricLabels(c *C) {
+	c.Assert(formatMetricLabels(nil, nil), Equals, "")
+	c.Assert(formatMetricLabels([]string{"rule", "reason"}, []string{"caf\u00e9\x01"}), Equals, "{rule=\"caf\u00e9\x01\",reason=\"\"}")
+	c.Assert(formatMetricLabels([]string{"rule"}, []string{"a\\b\"c\nd"}), Equals, "{rule=\"a\\\\b\\\"c\\nd\"}")
+}
+
+func (s *metricsTest) Test_ServeHTTP(c *C) {
+	metrics := newFilterMetrics()
+	metrics.recordFiltered()
+	writer := newMockResponseWriter()
+
+	status, err := metrics.ServeHTTP(writer, &http.Request{Method: "GET"})
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, 200)
+	c.Assert(writer.Header().Get("Content-Type"), Equals, "text/plain; version=0.0.4; charset=utf-8")
+	c.Assert(writer.buffer.String(), Contains, "caddy_filter_responses_total{result=\"filtered\"} 1\n")
+
+	status, err = metrics.ServeHTTP(newMockResponseWriter(), &http.Request{Method: "POST"})
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, 405)
+}
@@ -0,0 +1,134 @@
+package filter
+
+import (
+	"mime"
+	"regexp"
+
+	"github.com/tdewolff/minify/v2"
+	"github.com/tdewolff/minify/v2/css"
+	"github.com/tdewolff/minify/v2/html"
+	"github.com/tdewolff/minify/v2/js"
+	"github.com/tdewolff/minify/v2/json"
+	"github.com/tdewolff/minify/v2/svg"
+)
+
+type minifyType string
+
+const (
+	minifyTypeHtml = minifyType("html")
+	minifyTypeCss  = minifyType("css")
+	minifyTypeJs   = minifyType("js")
+	minifyTypeSvg  = minifyType("svg")
+	minifyTypeJson = minifyType("json")
+)
+
+var possibleMinifyTypes = []minifyType{
+	minifyTypeHtml,
+	minifyTypeCss,
+	minifyTypeJs,
+	minifyTypeSvg,
+	minifyTypeJson,
+}
+
+// minifyTypePatterns contains the media types every type of minification is selected by.
+var minifyTypePatterns = map[minifyType]*regexp.Regexp{
+	minifyTypeHtml: regexp.MustCompile("^text/html$"),
+	minifyTypeCss:  regexp.MustCompile("^text/css$"),
+	minifyTypeJs:   regexp.MustCompile("^(application|text)/(x-)?(java|ecma)script$"),
+	minifyTypeSvg:  regexp.MustCompile("^image/svg\\+xml$"),
+	minifyTypeJson: regexp.MustCompile("^(application|text)/(.+\\+)?json$"),
+}
+
+type minifyKeep string
+
+const (
+	minifyKeepConditionalComments = minifyKeep("conditional_comments")
+	minifyKeepWhitespace          = minifyKeep("whitespace")
+	minifyKeepEndTags             = minifyKeep("end_tags")
+	minifyKeepQuotes              = minifyKeep("quotes")
+	minifyKeepDocumentTags        = minifyKeep("document_tags")
+	minifyKeepDefaultAttributes   = minifyKeep("default_attributes")
+)
+
+var possibleMinifyKeeps = []minifyKeep{
+	minifyKeepConditionalComments,
+	minifyKeepWhitespace,
+	minifyKeepEndTags,
+	minifyKeepQuotes,
+	minifyKeepDocumentTags,
+	minifyKeepDefaultAttributes,
+}
+
+// ruleMinify minifies the whole body by its content type after all other rules are executed.
+// The content of <pre> and <textarea> elements is always preserved.
+type ruleMinify struct {
+	// types which are minified; empty means all.
+	types    []minifyType
+	keep     []minifyKeep
+	minifier *minify.M
+}
+
+func (instance *ruleMinify) keeps(candidate minifyKeep) bool {
+	for _, keep := range instance.keep {
+		if keep == candidate {
+			return true
+		}
+	}
+	return false
+}
+
+func (instance *ruleMinify) minifies(candidate minifyType) bool {
+	if len(instance.types) <= 0 {
+		return true
+	}
+	for _, t := range instance.types {
+		if t == candidate {
+			return true
+		}
+	}
+	return false
+}
+
+// compile creates the minifier of all selected types. Styles and scripts inside of HTML are
+// only minified if their types are selected, too.
+func (instance *ruleMinify) compile() {
+	minifier := minify.New()
+	for _, candidate := range possibleMinifyTypes {
+		if !instance.minifies(candidate) {
+			continue
+		}
+		pattern := minifyTypePatterns[candidate]
+		switch candidate {
+		case minifyTypeHtml:
+			minifier.AddRegexp(pattern, &html.Minifier{
+				KeepConditionalComments: instance.keeps(minifyKeepConditionalComments),
+				KeepWhitespace:          instance.keeps(minifyKeepWhitespace),
+				KeepEndTags:             instance.keeps(minifyKeepEndTags),
+				KeepQuotes:              instance.keeps(minifyKeepQuotes),
+				KeepDocumentTags:        instance.keeps(minifyKeepDocumentTags),
+				KeepDefaultAttrVals:     instance.keeps(minifyKeepDefaultAttributes),
+			})
+		case minifyTypeCss:
+			minifier.AddFuncRegexp(pattern, css.Minify)
+		case minifyTypeJs:
+			minifier.AddFuncRegexp(pattern, js.Minify)
+		case minifyTypeSvg:
+			minifier.AddFuncRegexp(pattern, svg.Minify)
+		case minifyTypeJson:
+			minifier.AddFuncRegexp(pattern, json.Minify)
+		}
+	}
+	instance.minifier = minifier
+}
+
+// apply returns the minified body or the body itself if its content type is not selected.
+func (instance *ruleMinify) apply(contentType string, body []byte) ([]byte, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return body, nil
+	}
+	if _, _, minifier := instance.minifier.Match(mediaType); minifier == nil {
+		return body, nil
+	}
+	return instance.minifier.Bytes(mediaType, body)
+}
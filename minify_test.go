@@ -0,0 +1,41 @@
+package filter
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type minifyTest struct{}
+
+func init() {
+	Suite(&minifyTest{})
+}
+
+func (s *minifyTest) apply(c *C, minify *ruleMinify, contentType string, input string) string {
+	minify.compile()
+	result, err := minify.apply(contentType, []byte(input))
+	c.Assert(err, IsNil)
+	return string(result)
+}
+
+func (s *minifyTest) Test_apply_html(c *C) {
+	input := "<html> <body>\n <!--[if IE]><p>ie</p><![endif]--> <!-- comment --> <pre>  a  \n  b </pre>  <p>  x   y </p><script> var a = 1 ;  // c\n</script><style> p { color : red ; } </style></body></html>"
+	c.Assert(s.apply(c, &ruleMinify{}, "text/html; charset=utf-8", input), Equals,
+		"<pre>  a  \n  b </pre><p>x y</p><script>var a=1;</script><style>p{color:red}</style>")
+	c.Assert(s.apply(c, &ruleMinify{keep: []minifyKeep{minifyKeepConditionalComments}}, "text/html", input), Equals,
+		"<!--[if IE]><p>ie<![endif]--><pre>  a  \n  b </pre><p>x y</p><script>var a=1;</script><style>p{color:red}</style>")
+	c.Assert(s.apply(c, &ruleMinify{types: []minifyType{minifyTypeHtml}}, "text/html", input), Equals,
+		"<pre>  a  \n  b </pre><p>x y</p><script> var a = 1 ;  // c\n</script><style> p { color : red ; } </style>")
+}
+
+func (s *minifyTest) Test_apply_otherTypes(c *C) {
+	c.Assert(s.apply(c, &ruleMinify{}, "text/css", "p {\n  color : red ;\n}\n"), Equals, "p{color:red}")
+	c.Assert(s.apply(c, &ruleMinify{}, "application/javascript", "var a = 1 ;\n// comment\n"), Equals, "var a=1;")
+	c.Assert(s.apply(c, &ruleMinify{}, "application/ld+json", "{ \"a\" : [ 1, 2 ] }"), Equals, "{\"a\":[1,2]}")
+	c.Assert(s.apply(c, &ruleMinify{}, "image/svg+xml", "<svg xmlns=\"http://www.w3.org/2000/svg\">\n  <!-- c -->\n  <rect width=\"10\" height=\"10\"/>\n</svg>"), Equals, "<svg xmlns=\"http://www.w3.org/2000/svg\"><rect width=\"10\" height=\"10\"/></svg>")
+}
+
+func (s *minifyTest) Test_apply_unselectedType(c *C) {
+	c.Assert(s.apply(c, &ruleMinify{types: []minifyType{minifyTypeCss}}, "application/json", "{ \"a\" : 1 }"), Equals, "{ \"a\" : 1 }")
+	c.Assert(s.apply(c, &ruleMinify{}, "text/plain", "a   b"), Equals, "a   b")
+	c.Assert(s.apply(c, &ruleMinify{}, "", "a   b"), Equals, "a   b")
+}
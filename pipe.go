@@ -0,0 +1,403 @@
+package filter
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPipeWorkers = 1
+	// defaultPipeTimeout is also the delay every response suffers from a worker which hangs: there
+	// is no circuit breaker, every exchange waits until the timeout before the failure policy applies.
+	defaultPipeTimeout = 5 * time.Second
+	// maximumPipeBodySize limits the body a process could return.
+	maximumPipeBodySize  = 64 * 1024 * 1024
+	pipeUnixSocketPrefix = "unix:"
+	pipeRequestHeader    = "X-Filter-Request-"
+)
+
+// pipeExcludedHeaders are neither sent to nor accepted from the processes because they describe
+// the transport of the body and not its content.
+var pipeExcludedHeaders = []string{"Content-Length", "Content-Encoding", "Transfer-Encoding"}
+
+var errPipeFailure = errors.New("external filter process failed")
+
+type pipeFailurePolicy string
+
+const (
+	// pipeFailurePass delivers the body as it was before the failed rule.
+	pipeFailurePass = pipeFailurePolicy("pass")
+	pipeFailureFail = pipeFailurePolicy("fail")
+)
+
+var possiblePipeFailurePolicies = []pipeFailurePolicy{
+	pipeFailurePass,
+	pipeFailureFail,
+}
+
+// rulePipe sends the body to long-running external processes - or the servers of a Unix socket -
+// and replaces it with their answer. Every message in both directions consists of header lines
+// like in HTTP, an empty line and a body with the length of the Content-Length header:
+//
+//	Content-Type: text/html
+//	X-Filter-Request-Url: /index.html
+//	Content-Length: 5
+//
+//	Hello
+//
+// The headers of the answer are set on the response; an empty value removes the header. If the
+// answer has no Content-Length the body stays unchanged.
+type rulePipe struct {
+	// command is the executable with its arguments which is started for every worker.
+	command []string
+	// socket is the path of a Unix socket which is connected for every worker.
+	socket    string
+	workers   int
+	timeout   time.Duration
+	onFailure pipeFailurePolicy
+
+	mutex sync.Mutex
+	// pool contains one entry per worker which is nil if the worker is not started yet.
+	pool   chan *pipeWorker
+	closed bool
+}
+
+func newRulePipe(args []string) *rulePipe {
+	result := &rulePipe{
+		workers:   defaultPipeWorkers,
+		timeout:   defaultPipeTimeout,
+		onFailure: pipeFailurePass,
+	}
+	if len(args) == 1 && strings.HasPrefix(args[0], pipeUnixSocketPrefix) {
+		result.socket = args[0][len(pipeUnixSocketPrefix):]
+	} else {
+		result.command = args
+	}
+	return result
+}
+
+func (instance *rulePipe) String() string {
+	if instance.socket != "" {
+		return pipeUnixSocketPrefix + instance.socket
+	}
+	return strings.Join(instance.command, " ")
+}
+
+// exchange sends the given header and body to a worker and returns its answer. A body of nil
+// means that the worker keeps the body unchanged. Workers which fail are stopped and started
+// again on their next use.
+func (instance *rulePipe) exchange(header http.Header, body []byte, deadline time.Time, reserve func(n int) bool) (http.Header, []byte, error) {
+	pool, err := instance.poolOf()
+	if err != nil {
+		return nil, nil, err
+	}
+	var worker *pipeWorker
+	timer := time.NewTimer(time.Until(deadline))
+	select {
+	case worker = <-pool:
+		timer.Stop()
+	case <-timer.C:
+		return nil, nil, errors.New("no worker available in time")
+	}
+	if worker == nil {
+		if worker, err = instance.startWorker(); err != nil {
+			pool <- nil
+			return nil, nil, err
+		}
+	}
+	resultHeader, resultBody, err := worker.exchange(header, body, deadline, reserve)
+	if err != nil {
+		worker.close()
+		worker = nil
+	}
+	instance.release(worker)
+	return resultHeader, resultBody, err
+}
+
+func (instance *rulePipe) poolOf() (chan *pipeWorker, error) {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	if instance.closed {
+		return nil, errors.New("pipe is closed")
+	}
+	if instance.pool == nil {
+		instance.pool = make(chan *pipeWorker, instance.workers)
+		for i := 0; i < instance.workers; i++ {
+			instance.pool <- nil
+		}
+	}
+	return instance.pool, nil
+}
+
+func (instance *rulePipe) release(worker *pipeWorker) {
+	instance.mutex.Lock()
+	closed := instance.closed
+	instance.mutex.Unlock()
+	if closed && worker != nil {
+		worker.close()
+		worker = nil
+	}
+	instance.pool <- worker
+}
+
+func (instance *rulePipe) startWorker() (*pipeWorker, error) {
+	if instance.socket != "" {
+		connection, err := net.Dial("unix", instance.socket)
+		if err != nil {
+			return nil, err
+		}
+		return newPipeWorker(connection, nil), nil
+	}
+	stdinReader, stdinWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdoutReader, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		stdinReader.Close()
+		stdinWriter.Close()
+		return nil, err
+	}
+	process := exec.Command(instance.command[0], instance.command[1:]...)
+	process.Stdin = stdinReader
+	process.Stdout = stdoutWriter
+	process.Stderr = os.Stderr
+	err = process.Start()
+	// The process holds its own copies of these ends.
+	stdinReader.Close()
+	stdoutWriter.Close()
+	if err != nil {
+		stdinWriter.Close()
+		stdoutReader.Close()
+		return nil, err
+	}
+	return newPipeWorker(&pipeProcessConnection{stdin: stdinWriter, stdout: stdoutReader}, process), nil
+}
+
+// Close stops all workers which are currently idle and every other worker as soon as it is released.
+func (instance *rulePipe) Close() error {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	if instance.closed {
+		return nil
+	}
+	instance.closed = true
+	if instance.pool == nil {
+		return nil
+	}
+	var idle []*pipeWorker
+	for i := 0; i < instance.workers; i++ {
+		select {
+		case worker := <-instance.pool:
+			idle = append(idle, worker)
+		default:
+		}
+	}
+	for _, worker := range idle {
+		if worker != nil {
+			worker.close()
+		}
+		instance.pool <- nil
+	}
+	return nil
+}
+
+// pipeConnection is the connection to one worker.
+type pipeConnection interface {
+	io.ReadWriteCloser
+	SetDeadline(t time.Time) error
+}
+
+// pipeProcessConnection connects to the stdin and stdout of a process.
+type pipeProcessConnection struct {
+	stdin  *os.File
+	stdout *os.File
+}
+
+func (instance *pipeProcessConnection) Read(p []byte) (int, error) {
+	return instance.stdout.Read(p)
+}
+
+func (instance *pipeProcessConnection) Write(p []byte) (int, error) {
+	return instance.stdin.Write(p)
+}
+
+func (instance *pipeProcessConnection) SetDeadline(t time.Time) error {
+	if err := instance.stdin.SetDeadline(t); err != nil {
+		return err
+	}
+	return instance.stdout.SetDeadline(t)
+}
+
+func (instance *pipeProcessConnection) Close() error {
+	err := instance.stdin.Close()
+	if closeErr := instance.stdout.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+type pipeWorker struct {
+	connection pipeConnection
+	reader     *textproto.Reader
+	writer     *bufio.Writer
+	// process is nil for workers connected to a Unix socket.
+	process *exec.Cmd
+}
+
+func newPipeWorker(connection pipeConnection, process *exec.Cmd) *pipeWorker {
+	return &pipeWorker{
+		connection: connection,
+		reader:     textproto.NewReader(bufio.NewReader(connection)),
+		writer:     bufio.NewWriter(connection),
+		process:    process,
+	}
+}
+
+// exchange reserves the size of the answer by the given function - which could be nil - before
+// the answer is read. The message is written while the answer is read, so workers which answer
+// while they still read - like 'cat' - do not block on a full pipe. A worker is unusable after
+// an error.
+func (instance *pipeWorker) exchange(header http.Header, body []byte, deadline time.Time, reserve func(n int) bool) (http.Header, []byte, error) {
+	if err := instance.connection.SetDeadline(deadline); err != nil {
+		return nil, nil, err
+	}
+	written := make(chan error, 1)
+	go func() {
+		written <- writePipeMessage(instance.writer, header, body)
+	}()
+	fail := func(err error) (http.Header, []byte, error) {
+		// Closing the connection stops the writing, so the body is not accessed after the return.
+		instance.connection.Close()
+		<-written
+		return nil, nil, err
+	}
+	resultHeader, err := instance.reader.ReadMIMEHeader()
+	if err != nil {
+		return fail(err)
+	}
+	var resultBody []byte
+	if plainLength := resultHeader.Get("Content-Length"); plainLength != "" {
+		length, err := strconv.Atoi(plainLength)
+		if err != nil || length < 0 || length > maximumPipeBodySize {
+			return fail(fmt.Errorf("illegal Content-Length: %v", plainLength))
+		}
+		if reserve != nil && !reserve(length) {
+			return fail(errTotalBufferExhausted)
+		}
+		resultBody = make([]byte, length)
+		if _, err := io.ReadFull(instance.reader.R, resultBody); err != nil {
+			return fail(err)
+		}
+	}
+	if err := <-written; err != nil {
+		return nil, nil, err
+	}
+	return http.Header(resultHeader), resultBody, nil
+}
+
+func (instance *pipeWorker) close() {
+	instance.connection.Close()
+	if process := instance.process; process != nil {
+		process.Process.Kill()
+		process.Wait()
+	}
+}
+
+func writePipeMessage(writer *bufio.Writer, header http.Header, body []byte) error {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range header[name] {
+			value = strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+			if _, err := writer.WriteString(name + ": " + value + "\r\n"); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := writer.WriteString("Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n"); err != nil {
+		return err
+	}
+	if _, err := writer.Write(body); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// pipeHeaderOf returns the headers of the message sent to the workers: the response headers
+// together with the method, URL, host and remote address of the request.
+func pipeHeaderOf(request *http.Request, responseHeader http.Header) http.Header {
+	result := cloneHeader(responseHeader)
+	for _, name := range pipeExcludedHeaders {
+		result.Del(name)
+	}
+	result.Set(pipeRequestHeader+"Method", request.Method)
+	result.Set(pipeRequestHeader+"Url", request.URL.String())
+	result.Set(pipeRequestHeader+"Host", request.Host)
+	result.Set(pipeRequestHeader+"Remote-Address", request.RemoteAddr)
+	return result
+}
+
+// applyPipeHeader sets the headers of the answer of a worker on the given response header. The
+// headers describing the request are ignored, so even a worker which echoes its input is valid.
+func applyPipeHeader(source http.Header, target http.Header) {
+	for name, values := range source {
+		excluded := strings.HasPrefix(name, pipeRequestHeader)
+		for _, candidate := range pipeExcludedHeaders {
+			excluded = excluded || candidate == name
+		}
+		if excluded {
+			continue
+		}
+		if len(values) == 1 && values[0] == "" {
+			target.Del(name)
+		} else {
+			target[name] = values
+		}
+	}
+}
+
+// run sends the given body through the pipe and returns the new body. The memory of the answer
+// is reserved by the given function; could be nil. Failures are logged and reported as
+// errPipeFailure if the rule should fail in this case.
+func (instance *rulePipe) run(action *ruleReplaceAction, deadline time.Time, body []byte, reserve func(n int) bool) ([]byte, error) {
+	pipeDeadline := time.Now().Add(instance.timeout)
+	if !deadline.IsZero() && deadline.Before(pipeDeadline) {
+		pipeDeadline = deadline
+	}
+	header, result, err := instance.exchange(pipeHeaderOf(action.request, *action.responseHeader), body, pipeDeadline, reserve)
+	if err == errTotalBufferExhausted {
+		return body, err
+	}
+	if err != nil {
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return body, errExecutionTimeout
+		}
+		log.Printf("[WARN] Filter pipe '%v' failed for '%v'. Got: %v", instance, action.request.URL, err)
+		if instance.onFailure == pipeFailureFail {
+			return body, errPipeFailure
+		}
+		return body, nil
+	}
+	applyPipeHeader(header, *action.responseHeader)
+	if result == nil {
+		return body, nil
+	}
+	return result, nil
+}
@@ -0,0 +1,239 @@
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	. "gopkg.in/check.v1"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type pipeTest struct {
+	listeners []net.Listener
+}
+
+func init() {
+	Suite(&pipeTest{})
+}
+
+func (s *pipeTest) TearDownTest(c *C) {
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	s.listeners = nil
+}
+
+// serve starts a Unix socket server which answers every message with the given function.
+func (s *pipeTest) serve(c *C, answer func(header textproto.MIMEHeader, body []byte) (http.Header, []byte)) string {
+	path := filepath.Join(c.MkDir(), "filter.sock")
+	listener, err := net.Listen("unix", path)
+	c.Assert(err, IsNil)
+	s.listeners = append(s.listeners, listener)
+	go func() {
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(connection, answer)
+		}
+	}()
+	return path
+}
+
+func (s *pipeTest) handle(connection net.Conn, answer func(header textproto.MIMEHeader, body []byte) (http.Header, []byte)) {
+	defer connection.Close()
+	reader := textproto.NewReader(bufio.NewReader(connection))
+	writer := bufio.NewWriter(connection)
+	for {
+		header, err := reader.ReadMIMEHeader()
+		if err != nil {
+			return
+		}
+		length, _ := strconv.Atoi(header.Get("Content-Length"))
+		body := make([]byte, length)
+		if _, err := io.ReadFull(reader.R, body); err != nil {
+			return
+		}
+		resultHeader, resultBody := answer(header, body)
+		for name, values := range resultHeader {
+			for _, value := range values {
+				writer.WriteString(name + ": " + value + "\r\n")
+			}
+		}
+		if resultBody != nil {
+			writer.WriteString("Content-Length: " + strconv.Itoa(len(resultBody)) + "\r\n")
+		}
+		writer.WriteString("\r\n")
+		writer.Write(resultBody)
+		writer.Flush()
+	}
+}
+
+func (s *pipeTest) execute(c *C, r *rule, header http.Header, input string) (string, int, error) {
+	return s.executeWithReserve(c, r, header, input, nil)
+}
+
+func (s *pipeTest) executeWithReserve(c *C, r *rule, header http.Header, input string, reserve func(n int) bool) (string, int, error) {
+	execution := &ruleExecution{
+		request: &http.Request{
+			Method:     "GET",
+			Host:       "example.org",
+			URL:        &url.URL{Path: "/a"},
+			RemoteAddr: "127.0.0.1:1234",
+		},
+		responseHeader: &header,
+		reserve:        reserve,
+	}
+	result, replacements, err := r.execute(execution, []byte(input), new(bytes.Buffer))
+	return string(result), replacements, err
+}
+
+func (s *pipeTest) Test_run_socket(c *C) {
+	pipe := newRulePipe([]string{"unix:" + s.serve(c, func(header textproto.MIMEHeader, body []byte) (http.Header, []byte) {
+		return http.Header{
+			"X-Seen":   []string{header.Get("X-Filter-Request-Method") + " " + header.Get("X-Filter-Request-Url") + " " + header.Get("Content-Type")},
+			"X-Remove": []string{""},
+		}, bytes.ToUpper(body)
+	})})
+	defer pipe.Close()
+	r := &rule{pipe: pipe}
+	header := http.Header{"Content-Type": []string{"text/html"}, "X-Remove": []string{"foo"}}
+	for i := 0; i < 3; i++ {
+		result, replacements, err := s.execute(c, r, header, "hello")
+		c.Assert(err, IsNil)
+		c.Assert(result, Equals, "HELLO")
+		c.Assert(replacements, Equals, 1)
+	}
+	c.Assert(header.Get("X-Seen"), Equals, "GET /a text/html")
+	c.Assert(header.Get("X-Remove"), Equals, "")
+}
+
+func (s *pipeTest) Test_run_process(c *C) {
+	pipe := newRulePipe([]string{"cat"})
+	pipe.workers = 2
+	defer pipe.Close()
+	r := &rule{pipe: pipe}
+	header := http.Header{"X-Foo": []string{"bar"}}
+	for i := 0; i < 3; i++ {
+		result, replacements, err := s.execute(c, r, header, "hello\r\n\r\nworld")
+		c.Assert(err, IsNil)
+		c.Assert(result, Equals, "hello\r\n\r\nworld")
+		c.Assert(replacements, Equals, 0)
+	}
+	c.Assert(header, DeepEquals, http.Header{"X-Foo": []string{"bar"}})
+}
+
+func (s *pipeTest) Test_run_reservesAnswer(c *C) {
+	pipe := newRulePipe([]string{"unix:" + s.serve(c, func(header textproto.MIMEHeader, body []byte) (http.Header, []byte) {
+		return nil, bytes.Repeat(body, 2)
+	})})
+	pipe.onFailure = pipeFailureFail
+	defer pipe.Close()
+	r := &rule{pipe: pipe}
+	var reserved []int
+	result, _, err := s.executeWithReserve(c, r, http.Header{}, "foo", func(n int) bool {
+		reserved = append(reserved, n)
+		return true
+	})
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, "foofoo")
+	c.Assert(reserved, DeepEquals, []int{6})
+
+	result, replacements, err := s.executeWithReserve(c, r, http.Header{}, "bar", func(n int) bool {
+		return false
+	})
+	c.Assert(err, Equals, errTotalBufferExhausted)
+	c.Assert(result, Equals, "bar")
+	c.Assert(replacements, Equals, 0)
+
+	// The worker with the unread answer was replaced.
+	result, _, err = s.execute(c, r, http.Header{}, "baz")
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, "bazbaz")
+}
+
+func (s *pipeTest) Test_run_processWithLargeBody(c *C) {
+	pipe := newRulePipe([]string{"cat"})
+	pipe.onFailure = pipeFailureFail
+	defer pipe.Close()
+	r := &rule{pipe: pipe}
+	// Much more than the buffer of an OS pipe: cat answers while the message is still written.
+	input := strings.Repeat("0123456789abcdef", 128*1024)
+	for i := 0; i < 2; i++ {
+		result, _, err := s.execute(c, r, http.Header{}, input)
+		c.Assert(err, IsNil)
+		c.Assert(result == input, Equals, true)
+	}
+}
+
+func (s *pipeTest) Test_run_failures(c *C) {
+	for _, command := range [][]string{{"sleep", "10"}, {"true"}, {"unix:" + filepath.Join(c.MkDir(), "missing.sock")}} {
+		pipe := newRulePipe(command)
+		pipe.timeout = 50 * time.Millisecond
+		r := &rule{pipe: pipe}
+		result, replacements, err := s.execute(c, r, http.Header{}, "foo")
+		c.Assert(err, IsNil)
+		c.Assert(result, Equals, "foo")
+		c.Assert(replacements, Equals, 0)
+
+		pipe.onFailure = pipeFailureFail
+		result, replacements, err = s.execute(c, r, http.Header{}, "foo")
+		c.Assert(err, Equals, errPipeFailure, Commentf("%v", command))
+		c.Assert(result, Equals, "foo")
+		c.Assert(replacements, Equals, 0)
+		pipe.Close()
+	}
+}
+
+func (s *pipeTest) Test_run_executionTimeout(c *C) {
+	pipe := newRulePipe([]string{"sleep", "10"})
+	pipe.onFailure = pipeFailureFail
+	defer pipe.Close()
+	r := &rule{pipe: pipe, timeout: 50 * time.Millisecond}
+	result, _, err := s.execute(c, r, http.Header{}, "foo")
+	c.Assert(err, Equals, errExecutionTimeout)
+	c.Assert(result, Equals, "foo")
+}
+
+func (s *pipeTest) Test_run_shadowModeKeepsHeaders(c *C) {
+	pipe := newRulePipe([]string{"unix:" + s.serve(c, func(header textproto.MIMEHeader, body []byte) (http.Header, []byte) {
+		return http.Header{"X-Foo": []string{"bar"}}, []byte("baz")
+	})})
+	defer pipe.Close()
+	r := &rule{pipe: pipe, mode: ruleModeShadow}
+	header := http.Header{}
+	result, replacements, err := s.execute(c, r, header, "foo")
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, "baz")
+	c.Assert(replacements, Equals, 1)
+	c.Assert(header.Get("X-Foo"), Equals, "")
+}
+
+func (s *pipeTest) Test_Close(c *C) {
+	pipe := newRulePipe([]string{"cat"})
+	r := &rule{pipe: pipe}
+	_, _, err := s.execute(c, r, http.Header{}, "foo")
+	c.Assert(err, IsNil)
+	c.Assert(pipe.Close(), IsNil)
+	c.Assert(pipe.Close(), IsNil)
+
+	pipe.onFailure = pipeFailureFail
+	_, _, err = s.execute(c, r, http.Header{}, "foo")
+	c.Assert(err, Equals, errPipeFailure)
+}
+
+func (s *pipeTest) Test_writePipeMessage(c *C) {
+	buffer := new(bytes.Buffer)
+	writer := bufio.NewWriter(buffer)
+	err := writePipeMessage(writer, http.Header{"B": []string{"1\r\n2"}, "A": []string{"x", "y"}}, []byte("body"))
+	c.Assert(err, IsNil)
+	c.Assert(buffer.String(), Equals, strings.Join([]string{"A: x", "A: y", "B: 1  2", "Content-Length: 4", "", "body"}, "\r\n"))
+}
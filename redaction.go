@@ -0,0 +1,232 @@
+package filter
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+const partialRedactionVisibleCharacters = 4
+
+// redactionDetector finds one kind of sensitive data. If the pattern contains a group and it
+// participates in a match only the group is redacted - otherwise the whole match.
+type redactionDetector struct {
+	name    string
+	pattern string
+	// valid rejects matches which only look like the sensitive data; could be nil.
+	valid func(value string) bool
+}
+
+var builtInRedactionDetectors = []*redactionDetector{{
+	name: "credit_card",
+	pattern: `\b(?:\d{13,19}` +
+		`|\d{4} \d{4} \d{4} \d{1,7}|\d{4}-\d{4}-\d{4}-\d{1,7}` +
+		`|\d{4} \d{6} \d{5}|\d{4}-\d{6}-\d{5})\b`,
+	valid: isValidCardNumber,
+}, {
+	name: "api_key",
+	pattern: `\b(?:sk|pk|rk)_(?:live|test)_[0-9A-Za-z]{16,}\b` +
+		`|\bgh[pousr]_[0-9A-Za-z]{36}\b` +
+		`|\bxox[abposr]-[0-9A-Za-z\-]{10,}` +
+		`|\bAIza[0-9A-Za-z_\-]{35}` +
+		`|\beyJ[0-9A-Za-z_\-]+\.eyJ[0-9A-Za-z_\-]+\.[0-9A-Za-z_\-]+`,
+}, {
+	name: "aws_key",
+	pattern: `\b(?:AKIA|ASIA)[0-9A-Z]{16}\b` +
+		`|(?i:aws_?secret_?(?:access_?)?key)["']?\s*[:=]\s*["']?([A-Za-z0-9/+=]{40})`,
+}, {
+	name:    "email",
+	pattern: `[A-Za-z0-9._%+\-]+@[A-Za-z0-9\-]+(?:\.[A-Za-z0-9\-]+)*\.[A-Za-z]{2,}`,
+}, {
+	name:    "private_ip",
+	pattern: `\b(?:10(?:\.\d{1,3}){3}|172\.(?:1[6-9]|2\d|3[01])(?:\.\d{1,3}){2}|192\.168(?:\.\d{1,3}){2})\b`,
+	valid:   isValidIp,
+}}
+
+func builtInRedactionDetectorNamed(name string) *redactionDetector {
+	for _, candidate := range builtInRedactionDetectors {
+		if candidate.name == name {
+			return candidate
+		}
+	}
+	return nil
+}
+
+type redactionMask string
+
+const (
+	// redactionMaskFull replaces every letter and digit with '*'.
+	redactionMaskFull = redactionMask("full")
+	// redactionMaskPartial is like redactionMaskFull but keeps the last letters and digits.
+	redactionMaskPartial = redactionMask("partial")
+	// redactionMaskHash replaces the value with a keyed hash which allows to correlate equal values.
+	redactionMaskHash = redactionMask("hash")
+)
+
+var possibleRedactionMasks = []redactionMask{
+	redactionMaskFull,
+	redactionMaskPartial,
+	redactionMaskHash,
+}
+
+// ruleRedaction masks every value found by one of its detectors.
+type ruleRedaction struct {
+	detectors []*redactionDetector
+	mask      redactionMask
+	hashKey   []byte
+	// groups contains the index of the group of every detector in searchPattern.
+	groups []int
+	// innerGroups contains for every detector if its pattern contains groups itself.
+	innerGroups   []bool
+	searchPattern *regexp.Regexp
+}
+
+func newRuleRedaction() *ruleRedaction {
+	return &ruleRedaction{
+		mask: redactionMaskFull,
+	}
+}
+
+func (instance *ruleRedaction) detectorNamed(name string) *redactionDetector {
+	for _, candidate := range instance.detectors {
+		if candidate.name == name {
+			return candidate
+		}
+	}
+	return nil
+}
+
+// compile combines the patterns of all detectors into searchPattern.
+func (instance *ruleRedaction) compile() error {
+	patterns := make([]string, len(instance.detectors))
+	instance.groups = make([]int, len(instance.detectors))
+	instance.innerGroups = make([]bool, len(instance.detectors))
+	group := 1
+	for i, detector := range instance.detectors {
+		compiled, err := regexp.Compile(detector.pattern)
+		if err != nil {
+			return err
+		}
+		patterns[i] = "(" + detector.pattern + ")"
+		instance.groups[i] = group
+		instance.innerGroups[i] = compiled.NumSubexp() > 0
+		group += 1 + compiled.NumSubexp()
+	}
+	searchPattern, err := regexp.Compile(strings.Join(patterns, "|"))
+	if err != nil {
+		return err
+	}
+	instance.searchPattern = searchPattern
+	if instance.mask == redactionMaskHash && len(instance.hashKey) <= 0 {
+		instance.hashKey = make([]byte, 32)
+		if _, err := rand.Read(instance.hashKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeReplacement writes the masked value of the given match of searchPattern and returns
+// the name of the detector or an empty string if the match was not valid and written unchanged.
+func (instance *ruleRedaction) writeReplacement(output *bytes.Buffer, input []byte, match []int) string {
+	for i, detector := range instance.detectors {
+		group := instance.groups[i]
+		if match[2*group] < 0 {
+			continue
+		}
+		start, end := match[2*group], match[2*group+1]
+		if instance.innerGroups[i] && match[2*group+2] >= 0 {
+			start, end = match[2*group+2], match[2*group+3]
+		}
+		value := string(input[start:end])
+		if detector.valid != nil && !detector.valid(value) {
+			output.Write(input[match[0]:match[1]])
+			return ""
+		}
+		output.Write(input[match[0]:start])
+		output.WriteString(instance.masked(detector, value))
+		output.Write(input[end:match[1]])
+		return detector.name
+	}
+	output.Write(input[match[0]:match[1]])
+	return ""
+}
+
+func (instance *ruleRedaction) masked(detector *redactionDetector, value string) string {
+	switch instance.mask {
+	case redactionMaskHash:
+		mac := hmac.New(sha256.New, instance.hashKey)
+		mac.Write([]byte(value))
+		return "[" + detector.name + ":" + hex.EncodeToString(mac.Sum(nil))[:16] + "]"
+	case redactionMaskPartial:
+		visible := 0
+		if countMaskable(value) >= 2*partialRedactionVisibleCharacters {
+			visible = partialRedactionVisibleCharacters
+		}
+		return maskExceptLast(value, visible)
+	}
+	return maskExceptLast(value, 0)
+}
+
+func isMaskable(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func countMaskable(value string) int {
+	result := 0
+	for _, r := range value {
+		if isMaskable(r) {
+			result++
+		}
+	}
+	return result
+}
+
+// maskExceptLast replaces every letter and digit with '*' except the given number of the last ones.
+func maskExceptLast(value string, visible int) string {
+	masked := countMaskable(value) - visible
+	result := make([]rune, 0, len(value))
+	for _, r := range value {
+		if isMaskable(r) && masked > 0 {
+			r = '*'
+			masked--
+		}
+		result = append(result, r)
+	}
+	return string(result)
+}
+
+// isValidCardNumber checks the length and the Luhn checksum of the digits of the given value.
+func isValidCardNumber(value string) bool {
+	var digits []int
+	for _, r := range value {
+		if r >= '0' && r <= '9' {
+			digits = append(digits, int(r-'0'))
+		}
+	}
+	if len(digits) < 13 || len(digits) > 19 {
+		return false
+	}
+	sum := 0
+	for i := range digits {
+		digit := digits[len(digits)-1-i]
+		if i%2 == 1 {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+	}
+	return sum%10 == 0
+}
+
+func isValidIp(value string) bool {
+	return net.ParseIP(value) != nil
+}
@@ -0,0 +1,52 @@
+;; Test module of the wasm action; filter.wasm is the binary form of this file.
+(module
+  (import "filter" "body_size" (func $body_size (result i32)))
+  (import "filter" "body_read" (func $body_read (param i32 i32 i32) (result i32)))
+  (import "filter" "body_write" (func $body_write (param i32 i32)))
+  (import "filter" "request_header" (func $request_header (param i32 i32 i32 i32) (result i32)))
+  (import "filter" "placeholder" (func $placeholder (param i32 i32 i32 i32) (result i32)))
+  (import "filter" "set_response_header" (func $set_response_header (param i32 i32 i32 i32)))
+  (import "filter" "log" (func $log (param i32 i32)))
+  (memory (export "memory") 1)
+  (data (i32.const 0) "request_pathX-PathX-Tenantboom")
+
+  ;; Sets X-Path to the request path, copies X-Tenant of the request to the response
+  ;; and converts the body to upper case.
+  (func (export "filter") (result i32)
+    (local $size i32) (local $i i32) (local $c i32) (local $n i32)
+    (set_local $n (call $placeholder (i32.const 0) (i32.const 12) (i32.const 512) (i32.const 256)))
+    (call $set_response_header (i32.const 12) (i32.const 6) (i32.const 512) (get_local $n))
+    (if (i32.ge_s (tee_local $n (call $request_header (i32.const 18) (i32.const 8) (i32.const 768) (i32.const 256))) (i32.const 0))
+      (then (call $set_response_header (i32.const 18) (i32.const 8) (i32.const 768) (get_local $n))))
+    (set_local $size (call $body_read (i32.const 1024) (call $body_size) (i32.const 0)))
+    (block
+      (loop
+        (br_if 1 (i32.ge_u (get_local $i) (get_local $size)))
+        (set_local $c (i32.load8_u offset=1024 (get_local $i)))
+        (if (i32.and (i32.ge_u (get_local $c) (i32.const 97)) (i32.le_u (get_local $c) (i32.const 122)))
+          (then (i32.store8 offset=1024 (get_local $i) (i32.sub (get_local $c) (i32.const 32)))))
+        (set_local $i (i32.add (get_local $i) (i32.const 1)))
+        (br 0)))
+    (call $body_write (i32.const 1024) (get_local $size))
+    (i32.const 0))
+
+  ;; Never returns.
+  (func (export "loop") (result i32)
+    (loop (br 0))
+    (i32.const 0))
+
+  ;; Grows the memory by one page per byte of the body and returns the result of grow_memory.
+  (func (export "grow") (result i32)
+    (grow_memory (call $body_size)))
+
+  ;; Logs and reports a failure.
+  (func (export "fail") (result i32)
+    (call $log (i32.const 26) (i32.const 4))
+    (i32.const 1))
+
+  ;; Writes what the previous execution left in the memory and copies the body to the memory.
+  (func (export "leak") (result i32)
+    (call $body_write (i32.const 1024) (i32.const 16))
+    (drop (call $body_read (i32.const 1024) (call $body_size) (i32.const 0)))
+    (i32.const 0))
+)
@@ -0,0 +1,42 @@
+package filter
+
+import (
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// ruleResponse replaces the whole response if the search pattern of its rule matches.
+type ruleResponse struct {
+	status      int
+	body        []byte
+	contentType string
+}
+
+// newRuleResponse creates a response for the given body which was defined by the given value.
+// If the value is a file reference like '@error.html' the content type is derived from the
+// extension of the file - otherwise from the body itself.
+func newRuleResponse(status int, body []byte, definition string) *ruleResponse {
+	contentType := ""
+	if strings.HasPrefix(definition, "@") {
+		contentType = mime.TypeByExtension(filepath.Ext(definition))
+	}
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	return &ruleResponse{
+		status:      status,
+		body:        body,
+		contentType: contentType,
+	}
+}
+
+// applyTo prepares the given header of the original response for this response. Validators
+// of the original response are removed because they do not describe this body.
+func (instance *ruleResponse) applyTo(header http.Header) {
+	header.Set("Content-Type", instance.contentType)
+	header.Del("ETag")
+	header.Del("Last-Modified")
+	header.Del("Content-Range")
+}
@@ -5,14 +5,19 @@ import (
 	"bytes"
 	"compress/gzip"
 	"errors"
-	"io/ioutil"
+	"log"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"golang.org/x/text/encoding"
 )
 
+var errTotalBufferExhausted = errors.New("total buffer of all filtered responses exhausted")
+
 func newResponseWriterWrapperFor(delegate http.ResponseWriter, beforeFirstWrite func(*responseWriterWrapper) bool) *responseWriterWrapper {
 	wrapper := &responseWriterWrapper{
 		skipped:             false,
@@ -21,6 +26,7 @@ func newResponseWriterWrapperFor(delegate http.ResponseWriter, beforeFirstWrite
 		statusSetAtDelegate: 0,
 		bodyAllowed:         true,
 		maximumBufferSize:   -1,
+		outputCharset:       outputCharsetOriginal,
 		header:              http.Header{},
 	}
 	for key, values := range delegate.Header() {
@@ -39,13 +45,37 @@ type responseWriterWrapper struct {
 	skipped             bool
 	delegate            http.ResponseWriter
 	buffer              *bytes.Buffer
+	decoded             *bytes.Buffer
 	beforeFirstWrite    func(*responseWriterWrapper) bool
 	bodyAllowed         bool
 	firstContentWritten bool
 	headerSetAtDelegate bool
 	statusSetAtDelegate int
 	maximumBufferSize   int
+	outputCharset       outputCharset
+	charset             encoding.Encoding
+	charsetName         string
+	skipReason          skipReason
+	decodeFailure       string
+	debug               bool
+	matchedRules        []string
+	replacements        int
+	bufferBudget        *bufferBudget
+	bufferBudgetPolicy  bufferBudgetPolicy
+	bufferBudgetWait    time.Duration
+	reservedBytes       int
+	rejected            bool
 	header              http.Header
+	// headerRewriter is called with the recorded headers and deliveredBody before they are written to the delegate; could be nil.
+	headerRewriter func(header http.Header, body []byte)
+	// deliveredBody is the filtered body before its content encoding; nil if the response is not filtered.
+	deliveredBody []byte
+	// decodedBytes is the size of the copies of the recorded body created while decoding it.
+	decodedBytes int
+	// allocatedBytes is the memory allocated by rules outside of their buffers like answers of 'pipe'.
+	allocatedBytes int
+	// variantCookies adds the cookies of new variant assignments to the header before it is written to the delegate; could be nil.
+	variantCookies func(status int, header http.Header)
 }
 
 func (instance *responseWriterWrapper) Header() http.Header {
@@ -74,34 +104,92 @@ func (instance *responseWriterWrapper) Write(content []byte) (int, error) {
 
 	if !instance.firstContentWritten {
 		if instance.beforeFirstWrite(instance) {
-			instance.buffer = new(bytes.Buffer)
+			instance.buffer = acquireBuffer()
 		} else {
 			instance.skipped = true
+			instance.skipReason = skipReasonNoRuleMatched
 			instance.buffer = nil
 		}
 		instance.firstContentWritten = true
 	}
 
 	if instance.buffer == nil {
-		if err := instance.writeHeadersToDelegate(200); err != nil {
-			return 0, err
-		}
-		return instance.delegate.Write(content)
+		return instance.writeToDelegate(content, 200)
 	}
 
 	if (instance.maximumBufferSize >= 0) &&
 		((instance.buffer.Len() + len(content)) > instance.maximumBufferSize) {
-		_, err := instance.delegate.Write(instance.buffer.Bytes())
-		if err != nil {
-			return 0, err
+		instance.skipReason = skipReasonBufferOverflow
+		return instance.flushRecordedAndBypass(content)
+	}
+
+	if !instance.reserveBudget(len(content)) {
+		if instance.bufferBudgetPolicy == bufferBudgetPolicyReject {
+			instance.rejected = true
+			return 0, errTotalBufferExhausted
 		}
-		instance.buffer = nil
-		return instance.delegate.Write(content)
+		instance.skipReason = skipReasonTotalBufferExhausted
+		return instance.flushRecordedAndBypass(content)
 	}
 
 	return instance.buffer.Write(content)
 }
 
+// flushRecordedAndBypass writes everything recorded until now together with the given content
+// to the delegate. Every following content is directly written to the delegate.
+func (instance *responseWriterWrapper) flushRecordedAndBypass(content []byte) (int, error) {
+	if !instance.headerSetAtDelegate {
+		if err := instance.writeHeadersToDelegate(200); err != nil {
+			return 0, err
+		}
+	}
+	_, err := instance.delegate.Write(instance.buffer.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	instance.release()
+	return instance.delegate.Write(content)
+}
+
+func (instance *responseWriterWrapper) reserveBudget(n int) bool {
+	if instance.bufferBudget == nil {
+		return true
+	}
+	var wait time.Duration
+	if instance.bufferBudgetPolicy == bufferBudgetPolicyWait {
+		wait = instance.bufferBudgetWait
+	}
+	if !instance.bufferBudget.acquire(n, wait) {
+		return false
+	}
+	instance.reservedBytes += n
+	return true
+}
+
+// reserveBudgetForFiltering reserves the decoded body and the given bytes used by the rules
+// in addition to the recorded body. The reservation only grows until the instance is released.
+func (instance *responseWriterWrapper) reserveBudgetForFiltering(ruleBytes int) bool {
+	n := len(instance.recorded()) + instance.decodedBytes + instance.allocatedBytes + ruleBytes - instance.reservedBytes
+	if n <= 0 {
+		return true
+	}
+	return instance.reserveBudget(n)
+}
+
+// reserveBudgetForAllocation reserves the given bytes which a rule allocates outside of its buffers.
+func (instance *responseWriterWrapper) reserveBudgetForAllocation(n int) bool {
+	if !instance.reserveBudget(n) {
+		return false
+	}
+	instance.allocatedBytes += n
+	return true
+}
+
+// overrideStatus replaces the status set by the handler which created the response.
+func (instance *responseWriterWrapper) overrideStatus(status int) {
+	instance.statusSetAtDelegate = status
+}
+
 func (instance *responseWriterWrapper) selectStatus(def int) int {
 	if instance.statusSetAtDelegate > 0 {
 		return instance.statusSetAtDelegate
@@ -149,6 +237,12 @@ func (instance *responseWriterWrapper) writeHeadersToDelegate(defStatus int) err
 		return errors.New("headers already set at response")
 	}
 	instance.headerSetAtDelegate = true
+	if instance.headerRewriter != nil {
+		instance.headerRewriter(instance.header, instance.deliveredBody)
+	}
+	if instance.variantCookies != nil {
+		instance.variantCookies(instance.selectStatus(defStatus), instance.header)
+	}
 	w := instance.delegate
 	for key, values := range instance.header {
 		for i, value := range values {
@@ -159,10 +253,26 @@ func (instance *responseWriterWrapper) writeHeadersToDelegate(defStatus int) err
 			}
 		}
 	}
+	if instance.debug {
+		instance.writeDebugHeadersTo(w.Header())
+	}
 	w.WriteHeader(instance.selectStatus(defStatus))
 	return nil
 }
 
+func (instance *responseWriterWrapper) writeDebugHeadersTo(header http.Header) {
+	if len(instance.matchedRules) > 0 {
+		header.Set(debugMatchedHeader, strings.Join(instance.matchedRules, ","))
+		header.Set(debugReplacementsHeader, strconv.Itoa(instance.replacements))
+	}
+	if instance.skipReason != "" {
+		header.Set(debugSkippedReasonHeader, string(instance.skipReason))
+	}
+	if instance.decodeFailure != "" {
+		header.Set(debugDecodeFailureHeader, instance.decodeFailure)
+	}
+}
+
 func (instance *responseWriterWrapper) isBodyAllowed() bool {
 	return instance.bodyAllowed
 }
@@ -209,19 +319,94 @@ func (instance *responseWriterWrapper) CloseNotify() <-chan bool {
 
 func (instance *responseWriterWrapper) recordedAndDecodeIfRequired() []byte {
 	result := instance.recorded()
-	if !instance.isGzipEncoded() {
-		return result
+	if instance.isGzipEncoded() {
+		var ok bool
+		if result, ok = instance.decodeGzip(result); !ok {
+			return result
+		}
 	}
-	src := bytes.NewBuffer(result)
+	return instance.decodeCharsetIfRequired(result)
+}
+
+func (instance *responseWriterWrapper) decodeGzip(content []byte) ([]byte, bool) {
+	src := bytes.NewReader(content)
 	gzipSrc, err := gzip.NewReader(src)
 	if err != nil {
-		return result
+		instance.decodeFailure = "gzip"
+		return content, false
 	}
-	result, err = ioutil.ReadAll(gzipSrc)
+	if instance.decoded == nil {
+		instance.decoded = acquireBuffer()
+	}
+	instance.decoded.Reset()
+	_, err = instance.decoded.ReadFrom(gzipSrc)
 	if err != nil {
-		return result
+		instance.decodeFailure = "gzip"
+		return instance.decoded.Bytes(), false
 	}
+	instance.decodedBytes += instance.decoded.Len()
 	instance.Header().Del("Content-Encoding")
+	return instance.decoded.Bytes(), true
+}
+
+// release returns all buffers of this instance to the pool. After this call nothing
+// recorded by this instance could be accessed anymore.
+func (instance *responseWriterWrapper) release() {
+	releaseBuffer(instance.buffer)
+	releaseBuffer(instance.decoded)
+	instance.buffer = nil
+	instance.decoded = nil
+	if instance.bufferBudget != nil {
+		instance.bufferBudget.release(instance.reservedBytes)
+	}
+	instance.reservedBytes = 0
+	instance.decodedBytes = 0
+	instance.allocatedBytes = 0
+}
+
+func (instance *responseWriterWrapper) decodeCharsetIfRequired(content []byte) []byte {
+	charset, name := detectCharsetOf(instance.Header().Get("Content-Type"), content)
+	if charset == nil {
+		return content
+	}
+	result, err := charset.NewDecoder().Bytes(content)
+	if err != nil {
+		log.Printf("[WARN] Could not decode response body from charset '%v' - it will be filtered as it is. Got: %v", name, err)
+		instance.decodeFailure = name
+		return content
+	}
+	instance.decodedBytes += len(result)
+	instance.charset = charset
+	instance.charsetName = name
+	return result
+}
+
+func (instance *responseWriterWrapper) encodeCharsetIfRequired(content []byte) []byte {
+	charset := instance.charset
+	if charset == nil {
+		return content
+	}
+	contentType := instance.Header().Get("Content-Type")
+	if instance.outputCharset == outputCharsetUtf8 {
+		if len(contentType) > 0 {
+			instance.Header().Set("Content-Type", contentTypeWithCharset(contentType, "utf-8"))
+		}
+		return bytes.TrimPrefix(content, []byte("\uFEFF"))
+	}
+	encoder := charset.NewEncoder()
+	if strings.Contains(strings.ToLower(contentType), "html") {
+		encoder = encoding.HTMLEscapeUnsupported(encoder)
+	} else {
+		encoder = encoding.ReplaceUnsupported(encoder)
+	}
+	result, err := encoder.Bytes(content)
+	if err != nil {
+		log.Printf("[WARN] Could not encode response body back to charset '%v' - it will be delivered as UTF-8. Got: %v", instance.charsetName, err)
+		if len(contentType) > 0 {
+			instance.Header().Set("Content-Type", contentTypeWithCharset(contentType, "utf-8"))
+		}
+		return content
+	}
 	return result
 }
 
@@ -154,6 +154,49 @@ func (s *responseWriterWrapperTest) Test_WriteWithBufferOverflow(c *C) {
 	c.Assert(original.buffer.Bytes(), DeepEquals, []byte("foobar"))
 }
 
+func (s *responseWriterWrapperTest) Test_WriteWithExhaustedBufferBudget(c *C) {
+	original := newMockResponseWriter()
+	wrapper := newResponseWriterWrapperFor(original, func(*responseWriterWrapper) bool {
+		return true
+	})
+	wrapper.bufferBudget = newBufferBudget()
+	wrapper.bufferBudget.setLimit(5)
+	wrapper.bufferBudgetPolicy = bufferBudgetPolicyBypass
+
+	wrapper.Write([]byte("foo"))
+	c.Assert(wrapper.recorded(), DeepEquals, []byte("foo"))
+	used, _ := wrapper.bufferBudget.usage()
+	c.Assert(used, Equals, int64(3))
+
+	wrapper.Write([]byte("bar"))
+	c.Assert(wrapper.wasSomethingRecorded(), Equals, false)
+	c.Assert(wrapper.skipReason, Equals, skipReasonTotalBufferExhausted)
+	c.Assert(original.buffer.Bytes(), DeepEquals, []byte("foobar"))
+	used, _ = wrapper.bufferBudget.usage()
+	c.Assert(used, Equals, int64(0))
+}
+
+func (s *responseWriterWrapperTest) Test_WriteWithExhaustedBufferBudgetAndRejectPolicy(c *C) {
+	original := newMockResponseWriter()
+	wrapper := newResponseWriterWrapperFor(original, func(*responseWriterWrapper) bool {
+		return true
+	})
+	wrapper.bufferBudget = newBufferBudget()
+	wrapper.bufferBudget.setLimit(5)
+	wrapper.bufferBudgetPolicy = bufferBudgetPolicyReject
+
+	_, err := wrapper.Write([]byte("foo"))
+	c.Assert(err, IsNil)
+	_, err = wrapper.Write([]byte("bar"))
+	c.Assert(err, Equals, errTotalBufferExhausted)
+	c.Assert(wrapper.rejected, Equals, true)
+	c.Assert(original.buffer.Len(), Equals, 0)
+
+	wrapper.release()
+	used, _ := wrapper.bufferBudget.usage()
+	c.Assert(used, Equals, int64(0))
+}
+
 ///////////////////////////////////////////////////////////////////////////////////////////
 // MOCKS
 ///////////////////////////////////////////////////////////////////////////////////////////
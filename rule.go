@@ -1,18 +1,122 @@
 package filter
 
 import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
 	"net/http"
 	"regexp"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
 )
 
+var errExecutionTimeout = errors.New("execution time budget exceeded")
+
 type rule struct {
+	name                          string
 	path                          *regexp.Regexp
 	contentType                   *regexp.Regexp
 	pathAndContentTypeCombination pathAndContentTypeCombination
 	searchPattern                 *regexp.Regexp
 	replacement                   []byte
+	timeout                       time.Duration
+	mode                          ruleMode
+	variants                      *ruleVariants
+	include                       *ruleInclude
+	upstreamUrls                  *upstreamUrlRewrite
+	locationRewrites              []*headerRewrite
+	cookieRewrites                []*cookieRewrite
+	// searchFlags are applied to searchPattern after all options of the rule were evaluated.
+	searchFlags string
+	scope       ruleScope
+	// status replaces the status of the response if the search pattern matches.
+	status int
+	// response replaces the whole response if the search pattern matches.
+	response        *ruleResponse
+	logOriginalBody bool
+	redaction       *ruleRedaction
+	minify          *ruleMinify
+	xml             *ruleXml
+	script          *ruleScript
+	pipe            *rulePipe
+	wasm            *ruleWasm
+}
+
+// ruleExecution contains the state of the response the rules are executed on.
+type ruleExecution struct {
+	request        *http.Request
+	responseHeader *http.Header
+	// deadline of the execution of all rules; zero means no deadline.
+	deadline time.Time
+	// variant assigned to the request for the currently executed rule; could be nil.
+	variant *ruleVariant
+	// includer fetches the bodies of rules with 'include_virtual'; could be nil.
+	includer includer
+	// redactions counts the values masked by the currently executed rule by detector; could be nil.
+	redactions map[string]int
+	// status of the response.
+	status int
+	// fileHashes provides the checksums of the placeholder 'file_hash'; could be nil.
+	fileHashes *fileHashCache
+	// reserve reserves memory which the currently executed rule allocates outside of its output
+	// buffer from the buffer budget of the response; could be nil.
+	reserve func(n int) bool
+}
+
+// replaceActionFor returns an action which resolves the placeholders for a rule executed on
+// the given input.
+func (instance *ruleExecution) replaceActionFor(input []byte) *ruleReplaceAction {
+	if input == nil {
+		input = []byte{}
+	}
+	result := &ruleReplaceAction{
+		request:        instance.request,
+		responseHeader: instance.responseHeader,
+		body:           input,
+		status:         instance.status,
+		fileHashes:     instance.fileHashes,
+	}
+	if variant := instance.variant; variant != nil {
+		result.variant = variant.name
+	}
+	return result
+}
+
+type ruleMode string
+
+const (
+	ruleModeActive = ruleMode("active")
+	// ruleModeShadow executes the rule but delivers the body as it was before. The
+	// replacements the rule would have done are only recorded in metrics and log.
+	ruleModeShadow = ruleMode("shadow")
+)
+
+var possibleRuleModes = []ruleMode{
+	ruleModeActive,
+	ruleModeShadow,
 }
 
+type ruleScope string
+
+const (
+	ruleScopeWhole = ruleScope("whole")
+	// ruleScopeLine applies the search pattern to every line of the body independently.
+	ruleScopeLine = ruleScope("line")
+)
+
+var possibleRuleScopes = []ruleScope{
+	ruleScopeWhole,
+	ruleScopeLine,
+}
+
+// possibleSearchFlags contains the flags of regular expressions which could be set with 'search_flags'.
+const possibleSearchFlags = "imsU"
+
+const linePlaceholder = "line"
+
 type pathAndContentTypeCombination string
 
 const (
@@ -57,17 +161,397 @@ func (instance *rule) matches(request *http.Request, responseHeader *http.Header
 	return instance.evaluatePathAndContentTypeResult(pathMatch, contentTypeMatch)
 }
 
-func (instance *rule) execute(request *http.Request, responseHeader *http.Header, input []byte) []byte {
+// mayMatch returns true if the rule could match the given request - depending on the content type
+// of the response which is not known yet.
+func (instance *rule) mayMatch(request *http.Request) bool {
+	pathMatch := instance.path == nil || instance.path.MatchString(request.URL.Path)
+	return instance.evaluatePathAndContentTypeResult(pathMatch, true)
+}
+
+// nameAt returns the configured name of the rule or - if not configured - a name
+// derived from the given index of the rule. It is used in logs, metrics and headers.
+func (instance *rule) nameAt(index int) string {
+	if instance.name != "" {
+		return instance.name
+	}
+	return "rule#" + strconv.Itoa(index+1)
+}
+
+// execute applies the rule to the given input. If at least one replacement was done the result is
+// written to the given output and its content is returned - otherwise the input itself is returned.
+// If the deadline of the execution or the timeout of the rule is exceeded the processing stops
+// immediately - even while searching for the next match - the input is returned unchanged and
+// errExecutionTimeout is reported.
+func (instance *rule) execute(execution *ruleExecution, input []byte, output *bytes.Buffer) ([]byte, int, error) {
 	pattern := instance.searchPattern
-	if pattern == nil {
-		return input
+	if pattern == nil && instance.xml == nil && instance.script == nil && instance.pipe == nil && instance.wasm == nil {
+		return input, 0, nil
+	}
+	deadline := execution.deadline
+	now := time.Now()
+	if instance.timeout > 0 {
+		ruleDeadline := now.Add(instance.timeout)
+		if deadline.IsZero() || ruleDeadline.Before(deadline) {
+			deadline = ruleDeadline
+		}
+	}
+	if !deadline.IsZero() && !now.Before(deadline) {
+		return input, 0, errExecutionTimeout
+	}
+	if instance.xml != nil {
+		return instance.executeXml(execution, input, output)
+	}
+	if instance.script != nil {
+		return instance.executeScript(execution, deadline, input)
+	}
+	if instance.pipe != nil {
+		return instance.executePipe(execution, deadline, input)
+	}
+	if instance.wasm != nil {
+		return instance.executeWasm(execution, deadline, input)
+	}
+	var matches [][]int
+	var lines []int
+	var err error
+	scan := &matchScanner{pattern: pattern, deadline: deadline}
+	if instance.scope == ruleScopeLine {
+		matches, lines, err = scan.findAllInLines(input)
+	} else {
+		matches, err = scan.findAll(input)
+	}
+	if err != nil {
+		return input, 0, err
+	}
+	if len(matches) <= 0 {
+		return input, 0, nil
+	}
+	if instance.detectsOnly() {
+		return input, len(matches), nil
+	}
+	action := execution.replaceActionFor(input)
+	action.replacement = instance.replacement
+	if variant := execution.variant; variant != nil && variant.replacement != nil {
+		action.replacement = variant.replacement
+	}
+	if instance.include != nil {
+		action.replacement = instance.include.path
+		action.include = instance.include
+		action.includer = execution.includer
+		action.reserve = execution.reserve
+	}
+	if instance.redaction != nil {
+		action.redaction = instance.redaction
+		action.redactions = execution.redactions
+	}
+	if instance.upstreamUrls != nil {
+		if action.upstreamUrls = instance.upstreamUrls.resolve(action); action.upstreamUrls == nil {
+			return input, 0, nil
+		}
+	}
+	output.Reset()
+	output.Grow(len(input))
+	last := 0
+	for i, match := range matches {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return input, i, errExecutionTimeout
+		}
+		if lines != nil {
+			action.line = lines[i]
+		}
+		output.Write(input[last:match[0]])
+		action.writeReplacement(output, input, match)
+		last = match[1]
+	}
+	output.Write(input[last:])
+	return output.Bytes(), len(matches), nil
+}
+
+// matchScanner finds the matches of a pattern like regexp.Regexp.FindAllSubmatchIndex. If a
+// deadline is set the matches are searched one after another and the deadline is checked while
+// the input is read, so even the search for a single match in a large body is cut short.
+type matchScanner struct {
+	pattern  *regexp.Regexp
+	deadline time.Time
+}
+
+// matchScannerCheckInterval is the number of runes read between two checks of the deadline.
+const matchScannerCheckInterval = 4096
+
+// continuationPatterns caches the patterns used to continue a scan after the first match.
+var continuationPatterns sync.Map
+
+// findAll returns the submatch indices of all matches in the given input or errExecutionTimeout
+// if the deadline was exceeded.
+func (instance *matchScanner) findAll(input []byte) ([][]int, error) {
+	if instance.deadline.IsZero() {
+		return instance.pattern.FindAllSubmatchIndex(input, -1), nil
+	}
+	if !time.Now().Before(instance.deadline) {
+		return nil, errExecutionTimeout
+	}
+	var matches [][]int
+	for position, previousEnd := 0, -1; position <= len(input); {
+		match, err := instance.findAt(input, position)
+		if err != nil {
+			return nil, err
+		}
+		if match == nil {
+			break
+		}
+		accept := true
+		if match[1] == position {
+			// Like regexp.Regexp.FindAll empty matches directly after a previous match are ignored.
+			accept = match[0] != previousEnd
+			if position < len(input) {
+				_, width := utf8.DecodeRune(input[position:])
+				position += width
+			} else {
+				position++
+			}
+		} else {
+			position = match[1]
+		}
+		previousEnd = match[1]
+		if accept {
+			matches = append(matches, match)
+		}
+	}
+	return matches, nil
+}
+
+// findAt returns the submatch indices of the first match starting at or after the given
+// position - or nil if there is none.
+func (instance *matchScanner) findAt(input []byte, position int) ([]int, error) {
+	pattern, start, continued := instance.pattern, position, false
+	if position > 0 {
+		// The scan starts with the preceding rune which is consumed by the continuation pattern.
+		// This way assertions like ^ or \b see the same context as if the whole input is scanned.
+		_, width := utf8.DecodeLastRune(input[:position])
+		pattern, start, continued = continuationPatternOf(instance.pattern), position-width, true
+	}
+	reader := &deadlineReader{input: input[start:], deadline: instance.deadline}
+	match := pattern.FindReaderSubmatchIndex(reader)
+	if reader.exceeded {
+		return nil, errExecutionTimeout
+	}
+	if match == nil {
+		return nil, nil
+	}
+	if continued {
+		// The match of the given pattern is the first group of the continuation pattern; the rune
+		// consumed before it could be any rune in front of the match, not only the one before position.
+		match = match[2:]
+	}
+	for i := range match {
+		if match[i] >= 0 {
+			match[i] += start
+		}
+	}
+	return match, nil
+}
+
+// continuationPatternOf returns a pattern which matches one arbitrary rune followed by the given
+// pattern. The match of the given pattern is its first group followed by the submatches of the
+// given pattern.
+func continuationPatternOf(pattern *regexp.Regexp) *regexp.Regexp {
+	if result, ok := continuationPatterns.Load(pattern); ok {
+		return result.(*regexp.Regexp)
+	}
+	result := regexp.MustCompile("(?s:.)(" + pattern.String() + ")")
+	continuationPatterns.Store(pattern, result)
+	return result
+}
+
+// findAllInLines returns the matches in every line of the input and the number of the line -
+// starting with 1 - of every match. Line breaks are never part of a line.
+func (instance *matchScanner) findAllInLines(input []byte) ([][]int, []int, error) {
+	var matches [][]int
+	var lines []int
+	line := 0
+	for start := 0; start < len(input) || line == 0; line++ {
+		end := len(input)
+		next := end
+		if i := bytes.IndexByte(input[start:], '\n'); i >= 0 {
+			end = start + i
+			next = end + 1
+		}
+		content := input[start:end]
+		if len(content) > 0 && content[len(content)-1] == '\r' {
+			content = content[:len(content)-1]
+		}
+		found, err := instance.findAll(content)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, match := range found {
+			for i := range match {
+				if match[i] >= 0 {
+					match[i] += start
+				}
+			}
+			matches = append(matches, match)
+			lines = append(lines, line+1)
+		}
+		start = next
+	}
+	return matches, lines, nil
+}
+
+// deadlineReader provides the input to the regular expression and ends it as soon as the
+// deadline is exceeded.
+type deadlineReader struct {
+	input    []byte
+	offset   int
+	deadline time.Time
+	// untilCheck is the number of runes which could be read before the deadline is checked again.
+	untilCheck int
+	exceeded   bool
+}
+
+func (instance *deadlineReader) ReadRune() (rune, int, error) {
+	if instance.exceeded || instance.offset >= len(instance.input) {
+		return 0, 0, io.EOF
+	}
+	if instance.untilCheck--; instance.untilCheck < 0 {
+		if !time.Now().Before(instance.deadline) {
+			instance.exceeded = true
+			return 0, 0, io.EOF
+		}
+		instance.untilCheck = matchScannerCheckInterval
+	}
+	r, width := utf8.DecodeRune(instance.input[instance.offset:])
+	instance.offset += width
+	return r, width, nil
+}
+
+// executeXml applies the actions of 'xml_set', 'xml_delete' and 'xml_insert' to the given input.
+// If the input could not be parsed it is returned unchanged.
+func (instance *rule) executeXml(execution *ruleExecution, input []byte, output *bytes.Buffer) ([]byte, int, error) {
+	action := execution.replaceActionFor(input)
+	result, modifications, err := instance.xml.apply(action, input, output)
+	if err != nil {
+		log.Printf("[WARN] Could not modify XML document of '%v'. Got: %v", execution.request.URL, err)
+		return input, 0, nil
+	}
+	return result, modifications, nil
+}
+
+// executeScript runs the script of the rule on the given input. Rules in shadow mode could not
+// modify the headers of the response.
+func (instance *rule) executeScript(execution *ruleExecution, deadline time.Time, input []byte) ([]byte, int, error) {
+	action := execution.replaceActionFor(input)
+	if instance.mode == ruleModeShadow && execution.responseHeader != nil {
+		header := cloneHeader(*execution.responseHeader)
+		action.responseHeader = &header
+	}
+	result, err := instance.script.run(action, deadline, input)
+	if err == errExecutionTimeout {
+		return input, 0, err
+	}
+	if err != nil {
+		log.Printf("[WARN] Filter script '%v' failed for '%v'. Got: %v", instance.script.name, execution.request.URL, err)
+		return input, 0, nil
+	}
+	if bytes.Equal(result, input) {
+		return input, 0, nil
+	}
+	return result, 1, nil
+}
+
+// executeWasm executes the WebAssembly module of the rule on the given input. Modules which fail
+// are logged and the input stays unchanged. The written body is reserved by execution.reserve.
+func (instance *rule) executeWasm(execution *ruleExecution, deadline time.Time, input []byte) ([]byte, int, error) {
+	action := execution.replaceActionFor(input)
+	if instance.mode == ruleModeShadow && execution.responseHeader != nil {
+		header := cloneHeader(*execution.responseHeader)
+		action.responseHeader = &header
+	}
+	action.reserve = execution.reserve
+	result, err := instance.wasm.run(action, deadline, input)
+	if err == errExecutionTimeout || err == errTotalBufferExhausted {
+		return input, 0, err
+	}
+	if err != nil {
+		log.Printf("[WARN] Filter wasm '%v' failed for '%v'. Got: %v", instance.wasm.name, execution.request.URL, err)
+		return input, 0, nil
+	}
+	if bytes.Equal(result, input) {
+		return input, 0, nil
+	}
+	return result, 1, nil
+}
+
+// executePipe sends the given input through the pipe of the rule. Rules in shadow mode could
+// not modify the headers of the response.
+func (instance *rule) executePipe(execution *ruleExecution, deadline time.Time, input []byte) ([]byte, int, error) {
+	header := http.Header{}
+	if execution.responseHeader != nil {
+		header = *execution.responseHeader
+	}
+	if instance.mode == ruleModeShadow {
+		header = cloneHeader(header)
+	}
+	action := execution.replaceActionFor(input)
+	action.responseHeader = &header
+	result, err := instance.pipe.run(action, deadline, input, execution.reserve)
+	if err != nil {
+		return input, 0, err
+	}
+	if bytes.Equal(result, input) {
+		return input, 0, nil
+	}
+	return result, 1, nil
+}
+
+// detectsOnly returns true if the rule only reacts on matches with 'set_status' or 'respond'
+// and does not replace them in the body.
+func (instance *rule) detectsOnly() bool {
+	if instance.status <= 0 && instance.response == nil {
+		return false
+	}
+	if instance.replacement != nil || instance.include != nil || instance.upstreamUrls != nil || instance.redaction != nil {
+		return false
+	}
+	if instance.variants != nil {
+		for _, variant := range instance.variants.variants {
+			if variant.replacement != nil {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// filtersBody returns true if the rule replaces something in the body and not only in the headers.
+func (instance *rule) filtersBody() bool {
+	return instance.searchPattern != nil || instance.minify != nil || instance.xml != nil || instance.script != nil || instance.pipe != nil || instance.wasm != nil
+}
+
+// rewritesHeader returns true if the rule has a definition which modifies the response headers.
+func (instance *rule) rewritesHeader() bool {
+	return instance.upstreamUrls != nil || len(instance.locationRewrites) > 0 || len(instance.cookieRewrites) > 0
+}
+
+// rewriteHeader applies 'rewrite_upstream_urls', 'location_rewrite' and 'cookie_rewrite' to the
+// given response header if the rule matches the path of the request. The content type is
+// ignored because responses like redirects often do not have one. The body is the delivered
+// body of a filtered response and nil otherwise.
+func (instance *rule) rewriteHeader(request *http.Request, responseHeader http.Header, body []byte) {
+	if !instance.rewritesHeader() || instance.mode == ruleModeShadow {
+		return
+	}
+	if instance.path != nil && !instance.path.MatchString(request.URL.Path) {
+		return
 	}
 	action := &ruleReplaceAction{
 		request:        request,
-		responseHeader: responseHeader,
-		searchPattern:  instance.searchPattern,
-		replacement:    instance.replacement,
+		responseHeader: &responseHeader,
+		body:           body,
+	}
+	if instance.upstreamUrls != nil {
+		if resolved := instance.upstreamUrls.resolve(action); resolved != nil {
+			resolved.rewriteHeader(responseHeader)
+		}
 	}
-	output := pattern.ReplaceAllFunc(input, action.replacer)
-	return output
+	rewriteResponseHeader(action, responseHeader, instance.locationRewrites, instance.cookieRewrites)
 }
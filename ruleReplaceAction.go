@@ -1,6 +1,10 @@
 package filter
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"net/http"
@@ -11,47 +15,196 @@ import (
 	"time"
 )
 
-var paramReplacementPattern = regexp.MustCompile("\\{[a-zA-Z0-9_\\-.]+}")
+// paramReplacementPattern matches placeholders like {1} or {request_host}, chains of fallbacks
+// like {request_header_X-Forwarded-Host|request_host|'localhost'} and the conditional sections
+// {?request_header_X-Debug}...{/} which are only written if the placeholder is not empty.
+var paramReplacementPattern = regexp.MustCompile("\\{\\??" + placeholderNamePattern + "(?:\\|" + placeholderNamePattern + ")*}|\\{/}")
+
+// placeholderNamePattern matches a name with an optional argument like now:unix or a text in
+// single quotes.
+const placeholderNamePattern = "(?:[a-zA-Z0-9_\\-.]+(?::[^{}|']*)?|'[^'{}|]*')"
+
+const (
+	placeholderSectionStart = '?'
+	placeholderSectionEnd   = "/"
+)
 
 type ruleReplaceAction struct {
 	request        *http.Request
 	responseHeader *http.Header
-	searchPattern  *regexp.Regexp
 	replacement    []byte
+	variant        string
+	include        *ruleInclude
+	includer       includer
+	upstreamUrls   *resolvedUpstreamUrlRewrite
+	redaction      *ruleRedaction
+	redactions     map[string]int
+	placeholders   [][]int
+	groups         [][]byte
+	// line of the current match if the rule has the scope 'line'; otherwise 0.
+	line int
+	// body is the input of the rule or - while rewriting headers - the delivered body; nil if it is not available.
+	body []byte
+	// bodySha256 is calculated on first use.
+	bodySha256 []byte
+	// status of the response; 0 if it is not available.
+	status     int
+	fileHashes *fileHashCache
+	// reserve reserves the bodies of sub-requests and the output of 'wasm' from the buffer budget of the response; could be nil.
+	reserve func(n int) bool
 }
 
-func (instance *ruleReplaceAction) replacer(input []byte) []byte {
-	pattern := instance.searchPattern
-	if pattern == nil {
-		return input
+// writeReplacement writes the replacement for one match to the given output. The match is
+// described by its submatch indices of input (see regexp.Regexp.FindAllSubmatchIndex) which
+// prevents to match the search pattern again for resolving the groups. For rules with
+// 'include_virtual' the replacement is the path whose body is included.
+func (instance *ruleReplaceAction) writeReplacement(output *bytes.Buffer, input []byte, match []int) {
+	if instance.upstreamUrls != nil {
+		instance.upstreamUrls.writeReplacement(output, input, match)
+		return
+	}
+	if instance.redaction != nil {
+		if detector := instance.redaction.writeReplacement(output, input, match); detector != "" && instance.redactions != nil {
+			instance.redactions[detector]++
+		}
+		return
+	}
+	if instance.include == nil {
+		instance.writeResolved(output, input, match)
+		return
 	}
+	path := acquireBuffer()
+	defer releaseBuffer(path)
+	instance.writeResolved(path, input, match)
+	if instance.includer == nil {
+		output.Write(input[match[0]:match[1]])
+		return
+	}
+	body, err := instance.includer(instance.request, path.String(), instance.include, instance.reserve)
+	if err != nil {
+		log.Printf("[WARN] Could not include '%v' into '%v'. Got: %v", path.String(), instance.request.URL, err)
+		output.Write(input[match[0]:match[1]])
+		return
+	}
+	output.Write(body)
+}
+
+// writeResolved writes the replacement with all its placeholders resolved to the given output.
+func (instance *ruleReplaceAction) writeResolved(output *bytes.Buffer, input []byte, match []int) {
 	rawReplacement := instance.replacement
 	if len(rawReplacement) <= 0 {
-		return []byte{}
+		return
+	}
+	if instance.placeholders == nil {
+		instance.placeholders = paramReplacementPattern.FindAllIndex(rawReplacement, -1)
+		if instance.placeholders == nil {
+			instance.placeholders = [][]int{}
+		}
+	}
+	groups := instance.groups[:0]
+	for i := 0; i+1 < len(match); i += 2 {
+		if match[i] < 0 {
+			groups = append(groups, nil)
+		} else {
+			groups = append(groups, input[match[i]:match[i+1]])
+		}
+	}
+	instance.groups = groups
+	last := 0
+	// sections is the number of open conditional sections and skipFrom the number of the
+	// outermost one whose placeholder is empty - or 0 if everything is written.
+	sections, skipFrom := 0, 0
+	for _, placeholder := range instance.placeholders {
+		if skipFrom == 0 {
+			output.Write(rawReplacement[last:placeholder[0]])
+		}
+		last = placeholder[1]
+		raw := rawReplacement[placeholder[0]:placeholder[1]]
+		name := string(raw[1 : len(raw)-1])
+		switch {
+		case name[0] == placeholderSectionStart:
+			sections++
+			if value, _ := instance.placeholderValueBy(name[1:], groups); skipFrom == 0 && len(value) == 0 {
+				skipFrom = sections
+			}
+		case name == placeholderSectionEnd && sections > 0:
+			if skipFrom == sections {
+				skipFrom = 0
+			}
+			sections--
+		case skipFrom == 0:
+			output.Write(instance.paramReplacer(raw, groups))
+		}
+	}
+	if skipFrom == 0 {
+		output.Write(rawReplacement[last:])
 	}
-	groups := pattern.FindSubmatch(input)
-	replacement := paramReplacementPattern.ReplaceAllFunc(rawReplacement, func(input2 []byte) []byte {
-		return instance.paramReplacer(input2, groups)
-	})
-	return replacement
 }
 
 func (instance *ruleReplaceAction) paramReplacer(input []byte, groups [][]byte) []byte {
 	if len(input) < 3 {
 		return input
 	}
-	name := string(input[1 : len(input)-1])
+	if value, ok := instance.placeholderValueBy(string(input[1:len(input)-1]), groups); ok {
+		return value
+	}
+	return input
+}
+
+// placeholderValueBy resolves the given chain of placeholders separated by '|'. The first value
+// which is not empty is returned. ok is false if none of the placeholders is known.
+func (instance *ruleReplaceAction) placeholderValueBy(chain string, groups [][]byte) (value []byte, ok bool) {
+	for chain != "" {
+		name := chain
+		if i := strings.IndexByte(chain, '|'); i >= 0 {
+			name, chain = chain[:i], chain[i+1:]
+		} else {
+			chain = ""
+		}
+		candidate, known := instance.singlePlaceholderValueBy(name, groups)
+		if len(candidate) > 0 {
+			return candidate, true
+		}
+		ok = ok || known
+	}
+	return nil, ok
+}
+
+func (instance *ruleReplaceAction) singlePlaceholderValueBy(name string, groups [][]byte) ([]byte, bool) {
+	if len(name) >= 2 && name[0] == '\'' && name[len(name)-1] == '\'' {
+		return []byte(name[1 : len(name)-1]), true
+	}
 	if index, err := strconv.Atoi(name); err == nil {
 		if index >= 0 && index < len(groups) {
-			return groups[index]
+			return groups[index], true
 		}
-		return input
+		return nil, false
 	}
-
 	if value, ok := instance.contextValueBy(name); ok {
-		return []byte(value)
+		return []byte(value), true
 	}
-	return input
+	return nil, false
+}
+
+// checkPlaceholderSections returns an error if the conditional sections of the given
+// replacement are not balanced.
+func checkPlaceholderSections(replacement []byte) error {
+	sections := 0
+	for _, placeholder := range paramReplacementPattern.FindAll(replacement, -1) {
+		name := string(placeholder[1 : len(placeholder)-1])
+		if name[0] == placeholderSectionStart {
+			sections++
+		} else if name == placeholderSectionEnd {
+			if sections == 0 {
+				return fmt.Errorf("'{%v}' without a preceding '{%c...}'", placeholderSectionEnd, placeholderSectionStart)
+			}
+			sections--
+		}
+	}
+	if sections > 0 {
+		return fmt.Errorf("%d '{%c...}' without a following '{%v}'", sections, placeholderSectionStart, placeholderSectionEnd)
+	}
+	return nil
 }
 
 func (instance *ruleReplaceAction) contextValueBy(name string) (string, bool) {
@@ -64,12 +217,24 @@ func (instance *ruleReplaceAction) contextValueBy(name string) (string, bool) {
 	if strings.HasPrefix(name, "env_") {
 		return instance.contextEnvironmentValueBy(name[4:])
 	}
+	if name == variantPlaceholder {
+		return instance.variant, true
+	}
+	if name == linePlaceholder && instance.line > 0 {
+		return strconv.Itoa(instance.line), true
+	}
 	if name == "now" {
 		return instance.contextNowValueBy("")
 	}
 	if strings.HasPrefix(name, "now:") {
 		return instance.contextNowValueBy(name[4:])
 	}
+	if strings.HasPrefix(name, "file_hash:") {
+		return instance.contextFileHashValueBy(name[10:], hex.EncodeToString)
+	}
+	if strings.HasPrefix(name, "file_hash_base64:") {
+		return instance.contextFileHashValueBy(name[17:], base64.StdEncoding.EncodeToString)
+	}
 	return "", false
 }
 
@@ -105,9 +270,43 @@ func (instance *ruleReplaceAction) contextResponseValueBy(name string) (string,
 	if strings.HasPrefix(name, "header_") {
 		return (*instance.responseHeader).Get(name[7:]), true
 	}
+	switch name {
+	case "status":
+		return strconv.Itoa(instance.status), instance.status > 0
+	case "body_length":
+		return strconv.Itoa(len(instance.body)), instance.body != nil
+	case "body_sha256":
+		if sum := instance.bodySha256Of(); sum != nil {
+			return hex.EncodeToString(sum), true
+		}
+	case "body_sha256_base64":
+		if sum := instance.bodySha256Of(); sum != nil {
+			return base64.StdEncoding.EncodeToString(sum), true
+		}
+	}
 	return "", false
 }
 
+func (instance *ruleReplaceAction) bodySha256Of() []byte {
+	if instance.bodySha256 == nil && instance.body != nil {
+		sum := sha256.Sum256(instance.body)
+		instance.bodySha256 = sum[:]
+	}
+	return instance.bodySha256
+}
+
+func (instance *ruleReplaceAction) contextFileHashValueBy(name string, encode func([]byte) string) (string, bool) {
+	if instance.fileHashes == nil {
+		return "", false
+	}
+	sum, err := instance.fileHashes.sumOf(name)
+	if err != nil {
+		log.Printf("[WARN] Could not calculate the hash of '%v' for '%v'. Got: %v", name, instance.request.URL, err)
+		return "", true
+	}
+	return encode(sum), true
+}
+
 func (instance *ruleReplaceAction) contextEnvironmentValueBy(name string) (string, bool) {
 	return os.Getenv(name), true
 }
@@ -1,11 +1,14 @@
 package filter
 
 import (
+	"bytes"
 	"fmt"
 	. "gopkg.in/check.v1"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
 	"time"
 )
@@ -32,23 +35,93 @@ func (s *ruleReplaceActionTest) TearDownTest(c *C) {
 	os.Unsetenv(testEnvironmentVariableName)
 }
 
-func (s *ruleReplaceActionTest) Test_replacer(c *C) {
+func (s *ruleReplaceActionTest) Test_writeReplacement(c *C) {
+	pattern := regexp.MustCompile("My name is (.*?)\\.")
+	input := []byte("My name is Caddy.")
+	match := pattern.FindSubmatchIndex(input)
+	replace := func(replacement string) string {
+		rra := &ruleReplaceAction{
+			replacement: []byte(replacement),
+			responseHeader: &http.Header{
+				"A": []string{"foobar"},
+			},
+		}
+		output := new(bytes.Buffer)
+		rra.writeReplacement(output, input, match)
+		return output.String()
+	}
+
+	c.Assert(replace(""), Equals, "")
+	c.Assert(replace("Your name is {1}."), Equals, "Your name is Caddy.")
+	c.Assert(replace("Hi {1}! The header A is {response_header_A}."), Equals, "Hi Caddy! The header A is foobar.")
+	c.Assert(replace("{0}|{1}|{2}"), Equals, "My name is Caddy.|Caddy|{2}")
+}
+
+func (s *ruleReplaceActionTest) Test_writeReplacement_withUnmatchedGroup(c *C) {
+	pattern := regexp.MustCompile("(a)|(b)")
+	input := []byte("b")
 	rra := &ruleReplaceAction{
-		replacement:   []byte(""),
-		searchPattern: nil,
-		responseHeader: &http.Header{
-			"A": []string{"foobar"},
-		},
+		replacement: []byte("[{1}][{2}]"),
+	}
+	output := new(bytes.Buffer)
+	rra.writeReplacement(output, input, pattern.FindSubmatchIndex(input))
+	c.Assert(output.String(), Equals, "[][b]")
+}
+
+func (s *ruleReplaceActionTest) Test_writeReplacement_withFallbacks(c *C) {
+	pattern := regexp.MustCompile("(a)|(b)")
+	input := []byte("b")
+	replace := func(replacement string, requestHeader http.Header) string {
+		rra := &ruleReplaceAction{
+			request:        &http.Request{Host: "example.org", URL: testUrl, Header: requestHeader},
+			responseHeader: &http.Header{},
+			replacement:    []byte(replacement),
+		}
+		output := new(bytes.Buffer)
+		rra.writeReplacement(output, input, pattern.FindSubmatchIndex(input))
+		return output.String()
 	}
-	c.Assert(rra.replacer([]byte("My name is Caddy.")), DeepEquals, []byte("My name is Caddy."))
-	rra.searchPattern = regexp.MustCompile("My name is (.*?)\\.")
-	c.Assert(rra.replacer([]byte("My name is Caddy.")), DeepEquals, []byte(""))
 
-	rra.replacement = []byte("Your name is {1}.")
-	c.Assert(rra.replacer([]byte("My name is Caddy.")), DeepEquals, []byte("Your name is Caddy."))
+	c.Assert(replace("{request_header_X-Forwarded-Host|request_host}", http.Header{"X-Forwarded-Host": {"public.org"}}), Equals, "public.org")
+	c.Assert(replace("{request_header_X-Forwarded-Host|request_host}", http.Header{}), Equals, "example.org")
+	c.Assert(replace("{1|2}", nil), Equals, "b")
+	c.Assert(replace("{request_header_X-Lang|'en'}", nil), Equals, "en")
+	c.Assert(replace("[{request_header_X-Lang|response_header_X-Lang}]", nil), Equals, "[]")
+	c.Assert(replace("[{''}]", nil), Equals, "[]")
+	c.Assert(replace("{foo|bar}", nil), Equals, "{foo|bar}")
+	c.Assert(replace("{foo|request_host}", nil), Equals, "example.org")
+}
+
+func (s *ruleReplaceActionTest) Test_writeReplacement_withSections(c *C) {
+	replace := func(replacement string, requestHeader http.Header) string {
+		rra := &ruleReplaceAction{
+			request:        &http.Request{Host: "example.org", URL: testUrl, Header: requestHeader},
+			responseHeader: &http.Header{},
+			replacement:    []byte(replacement),
+		}
+		output := new(bytes.Buffer)
+		rra.writeReplacement(output, []byte("</body>"), []int{0, 7})
+		return output.String()
+	}
+	debug := http.Header{"X-Debug": {"1"}}
+	replacement := "{?request_header_X-Debug}<pre>{request_host}{?request_header_X-Trace}/{request_header_X-Trace}{/}</pre>{/}{0}"
+
+	c.Assert(replace(replacement, nil), Equals, "</body>")
+	c.Assert(replace(replacement, debug), Equals, "<pre>example.org</pre></body>")
+	c.Assert(replace(replacement, http.Header{"X-Debug": {"1"}, "X-Trace": {"abc"}}), Equals, "<pre>example.org/abc</pre></body>")
+	c.Assert(replace("{?request_header_X-Trace}{request_header_X-Debug}{/}{0}", debug), Equals, "</body>")
+	c.Assert(replace("{?request_header_X-Trace|request_header_X-Debug}debug{/}", debug), Equals, "debug")
+	c.Assert(replace("{?foo}a{/}b", debug), Equals, "b")
+	c.Assert(replace("a{/}b", debug), Equals, "a{/}b")
+	c.Assert(replace("a{?request_header_X-Debug}b", debug), Equals, "ab")
+	c.Assert(replace("a{?request_header_X-Trace}b", debug), Equals, "a")
+}
 
-	rra.replacement = []byte("Hi {1}! The header A is {response_header_A}.")
-	c.Assert(rra.replacer([]byte("My name is Caddy.")), DeepEquals, []byte("Hi Caddy! The header A is foobar."))
+func (s *ruleReplaceActionTest) Test_checkPlaceholderSections(c *C) {
+	c.Assert(checkPlaceholderSections([]byte("a{1}{?1}{?2}{2}{/}{/}")), IsNil)
+	c.Assert(checkPlaceholderSections([]byte("{foo}")), IsNil)
+	c.Assert(checkPlaceholderSections([]byte("{?1}{/}{/}")), ErrorMatches, "'\\{/}' without a preceding '\\{\\?...}'")
+	c.Assert(checkPlaceholderSections([]byte("{?1}{?2}{/}")), ErrorMatches, "1 '\\{\\?...}' without a following '\\{/}'")
 }
 
 func (s *ruleReplaceActionTest) Test_paramReplacer(c *C) {
@@ -227,6 +300,50 @@ func (s *ruleReplaceActionTest) Test_contextResponseValueBy(c *C) {
 	c.Assert(r, Equals, "")
 }
 
+func (s *ruleReplaceActionTest) Test_contextResponseValueBy_withBody(c *C) {
+	rra := &ruleReplaceAction{
+		responseHeader: &http.Header{},
+		body:           []byte("hello"),
+		status:         404,
+	}
+	values := map[string]string{}
+	for _, name := range []string{"status", "body_length", "body_sha256", "body_sha256_base64"} {
+		value, ok := rra.contextResponseValueBy(name)
+		c.Assert(ok, Equals, true)
+		values[name] = value
+	}
+	c.Assert(values, DeepEquals, map[string]string{
+		"status":             "404",
+		"body_length":        "5",
+		"body_sha256":        "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		"body_sha256_base64": "LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=",
+	})
+
+	rra = &ruleReplaceAction{responseHeader: &http.Header{}}
+	for _, name := range []string{"status", "body_length", "body_sha256", "body_sha256_base64"} {
+		_, ok := rra.contextResponseValueBy(name)
+		c.Assert(ok, Equals, false)
+	}
+}
+
+func (s *ruleReplaceActionTest) Test_writeReplacement_withFileHash(c *C) {
+	root := c.MkDir()
+	c.Assert(ioutil.WriteFile(filepath.Join(root, "app.js"), []byte("console.log(1)"), 0644), IsNil)
+	rra := &ruleReplaceAction{
+		request:     &http.Request{URL: testUrl},
+		replacement: []byte(`<script src="/app.js?v={file_hash:/app.js}" integrity="sha256-{file_hash_base64:app.js}"></script>{file_hash:/missing.js|'0'}`),
+		fileHashes:  newFileHashCache(root),
+	}
+	output := new(bytes.Buffer)
+	rra.writeReplacement(output, []byte("x"), []int{0, 1})
+	c.Assert(output.String(), Equals, `<script src="/app.js?v=0a286891c11c056e1ab5bfc25bf5d6b2f5b06d38eac10944f678fd8a2e70c393" integrity="sha256-CihokcEcBW4atb/CW/XWsvWwbTjqwQlE9nj9ii5ww5M="></script>0`)
+
+	rra.fileHashes = nil
+	output.Reset()
+	rra.writeReplacement(output, []byte("x"), []int{0, 1})
+	c.Assert(output.String(), Equals, `<script src="/app.js?v={file_hash:/app.js}" integrity="sha256-{file_hash_base64:app.js}"></script>0`)
+}
+
 func (s *ruleReplaceActionTest) Test_formatTimeBy(c *C) {
 	rra := &ruleReplaceAction{}
 	now, err := time.Parse(time.RFC3339Nano, "2017-08-15T14:00:00.123456789+02:00")
@@ -1,10 +1,13 @@
 package filter
 
 import (
+	"bytes"
 	. "gopkg.in/check.v1"
 	"net/http"
 	"net/url"
 	"regexp"
+	"strings"
+	"time"
 )
 
 var (
@@ -106,10 +109,151 @@ func (s *ruleTest) Test_execute(c *C) {
 		replacement:   []byte("Hi {1}! The name of this server is {response_header_Server}."),
 	}
 
-	result := r.execute(req, &header, []byte("Hello I'am a test.\nMy name is Test_execute."))
+	result, replacements, err := r.execute(&ruleExecution{request: req, responseHeader: &header}, []byte("Hello I'am a test.\nMy name is Test_execute."), new(bytes.Buffer))
+	c.Assert(err, IsNil)
 	c.Assert(string(result), Equals, "Hello I'am a test.\nHi Test_execute! The name of this server is Caddy.")
+	c.Assert(replacements, Equals, 1)
 
 	r.searchPattern = nil
-	result = r.execute(req, &header, []byte("foobar"))
+	result, replacements, err = r.execute(&ruleExecution{request: req, responseHeader: &header}, []byte("foobar"), new(bytes.Buffer))
+	c.Assert(err, IsNil)
 	c.Assert(string(result), Equals, "foobar")
+	c.Assert(replacements, Equals, 0)
+}
+
+func (s *ruleTest) Test_execute_withTimeout(c *C) {
+	req := &http.Request{}
+	header := http.Header{}
+	r := &rule{
+		searchPattern: regexp.MustCompile("o"),
+		replacement:   []byte("0"),
+	}
+
+	result, replacements, err := r.execute(&ruleExecution{request: req, responseHeader: &header, deadline: time.Now().Add(-time.Second)}, []byte("foo"), new(bytes.Buffer))
+	c.Assert(err, Equals, errExecutionTimeout)
+	c.Assert(string(result), Equals, "foo")
+	c.Assert(replacements, Equals, 0)
+
+	result, replacements, err = r.execute(&ruleExecution{request: req, responseHeader: &header, deadline: time.Now().Add(time.Minute)}, []byte("foo"), new(bytes.Buffer))
+	c.Assert(err, IsNil)
+	c.Assert(string(result), Equals, "f00")
+	c.Assert(replacements, Equals, 2)
+
+	r.timeout = time.Nanosecond
+	result, _, err = r.execute(&ruleExecution{request: req, responseHeader: &header}, []byte(strings.Repeat("foo", 10000)), new(bytes.Buffer))
+	c.Assert(err, Equals, errExecutionTimeout)
+	c.Assert(string(result), Equals, strings.Repeat("foo", 10000))
+}
+
+func (s *ruleTest) Test_execute_withoutMatchReturnsInput(c *C) {
+	r := &rule{
+		searchPattern: regexp.MustCompile("bar"),
+		replacement:   []byte("foo"),
+	}
+	input := []byte("foo")
+	output := new(bytes.Buffer)
+	result, replacements, err := r.execute(&ruleExecution{request: &http.Request{}, responseHeader: &http.Header{}}, input, output)
+	c.Assert(err, IsNil)
+	c.Assert(replacements, Equals, 0)
+	c.Assert(&result[0], Equals, &input[0])
+	c.Assert(output.Len(), Equals, 0)
+}
+
+func (s *ruleTest) Test_execute_withLineScope(c *C) {
+	r := &rule{
+		searchPattern: regexp.MustCompile("^(\\w+)=.*$"),
+		replacement:   []byte("{1}@{line}"),
+		scope:         ruleScopeLine,
+	}
+	result, replacements, err := r.execute(&ruleExecution{request: &http.Request{}, responseHeader: &http.Header{}}, []byte("a=1\r\n# b=2\n\nc=3{line}"), new(bytes.Buffer))
+	c.Assert(err, IsNil)
+	c.Assert(string(result), Equals, "a@1\r\n# b=2\n\nc@4")
+	c.Assert(replacements, Equals, 2)
+
+	r.scope = ruleScopeWhole
+	result, replacements, err = r.execute(&ruleExecution{request: &http.Request{}, responseHeader: &http.Header{}}, []byte("a=1"), new(bytes.Buffer))
+	c.Assert(err, IsNil)
+	c.Assert(string(result), Equals, "a@{line}")
+	c.Assert(replacements, Equals, 1)
+}
+
+func (s *ruleTest) Test_execute_withTimeoutCutsScanShort(c *C) {
+	// Every byte of the input keeps hundreds of states of this pattern alive which makes a scan
+	// of the whole input take more than a minute.
+	r := &rule{
+		searchPattern: regexp.MustCompile("[a-z]{1,500}[0-9]{1,500}!"),
+		replacement:   []byte("x"),
+		timeout:       20 * time.Millisecond,
+	}
+	input := []byte(strings.Repeat("a", 4*1024*1024))
+	started := time.Now()
+	result, replacements, err := r.execute(&ruleExecution{request: &http.Request{}, responseHeader: &http.Header{}}, input, new(bytes.Buffer))
+	c.Assert(err, Equals, errExecutionTimeout)
+	c.Assert(replacements, Equals, 0)
+	c.Assert(&result[0], Equals, &input[0])
+	c.Assert(time.Since(started) < time.Second, Equals, true)
+}
+
+func (s *ruleTest) Test_matchScanner_findAll(c *C) {
+	for _, pattern := range []string{"o", "b", "^f", "(?m)^b", "\\bo", "\\Bo", "o*", "x*", "(o)(b)?", "(?P<x>b)(é)?", "$", "r$|^", "."} {
+		for _, input := range []string{"", "foo", "foo\nbar boo", "ö\xffoö", "abéb", "aébü😀bob"} {
+			scan := &matchScanner{pattern: regexp.MustCompile(pattern), deadline: time.Now().Add(time.Minute)}
+			matches, err := scan.findAll([]byte(input))
+			c.Assert(err, IsNil)
+			c.Assert(matches, DeepEquals, scan.pattern.FindAllSubmatchIndex([]byte(input), -1), Commentf("%q in %q", pattern, input))
+		}
+	}
+
+	scan := &matchScanner{pattern: regexp.MustCompile("o"), deadline: time.Now().Add(-time.Second)}
+	_, err := scan.findAll([]byte("foo"))
+	c.Assert(err, Equals, errExecutionTimeout)
+}
+
+func (s *ruleTest) Test_execute_withTimeoutAndMultibyteBody(c *C) {
+	r := &rule{
+		searchPattern: regexp.MustCompile("b"),
+		replacement:   []byte("X"),
+		timeout:       time.Hour,
+	}
+	execution := &ruleExecution{request: &http.Request{URL: testUrl1}, responseHeader: &http.Header{}}
+	result, replacements, err := r.execute(execution, []byte("abéb😀b"), new(bytes.Buffer))
+	c.Assert(err, IsNil)
+	c.Assert(replacements, Equals, 3)
+	c.Assert(string(result), Equals, "aXéX😀X")
+}
+
+func (s *ruleTest) Test_matchScanner_findAllInLines(c *C) {
+	scan := &matchScanner{pattern: regexp.MustCompile("^$|b")}
+	matches, lines, err := scan.findAllInLines([]byte("ab\n\nb\n"))
+	c.Assert(err, IsNil)
+	c.Assert(matches, DeepEquals, [][]int{{1, 2}, {3, 3}, {4, 5}})
+	c.Assert(lines, DeepEquals, []int{1, 2, 3})
+
+	matches, lines, err = scan.findAllInLines([]byte(""))
+	c.Assert(err, IsNil)
+	c.Assert(matches, DeepEquals, [][]int{{0, 0}})
+	c.Assert(lines, DeepEquals, []int{1})
+
+	scan.deadline = time.Now().Add(time.Minute)
+	matches, lines, err = scan.findAllInLines([]byte("ab\n\nb\n"))
+	c.Assert(err, IsNil)
+	c.Assert(matches, DeepEquals, [][]int{{1, 2}, {3, 3}, {4, 5}})
+	c.Assert(lines, DeepEquals, []int{1, 2, 3})
+}
+
+func (s *ruleTest) Benchmark_execute(c *C) {
+	r := &rule{
+		searchPattern: regexp.MustCompile("href=\"http://backend:8080(/[^\"]*)\""),
+		replacement:   []byte("href=\"https://example.org{1}\""),
+	}
+	req := &http.Request{}
+	header := http.Header{}
+	input := []byte(benchmarkHtml)
+	output := new(bytes.Buffer)
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		if _, _, err := r.execute(&ruleExecution{request: req, responseHeader: &header}, input, output); err != nil {
+			c.Fatal(err)
+		}
+	}
 }
@@ -0,0 +1,312 @@
+package filter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/caddyfile"
+	"gopkg.in/yaml.v2"
+)
+
+const maximumIncludeDepth = 10
+
+type storageKey string
+
+// rulesetsStorageKey addresses the rulesets of the current caddy instance. Rulesets are shared
+// between all sites and could be used by every filter directive parsed after their definition.
+const rulesetsStorageKey = storageKey("filter.rulesets")
+
+func rulesetsOf(controller *caddy.Controller) map[string][]*rule {
+	if result, ok := controller.Get(rulesetsStorageKey).(map[string][]*rule); ok {
+		return result
+	}
+	result := map[string][]*rule{}
+	controller.Set(rulesetsStorageKey, result)
+	return result
+}
+
+func evalRuleset(controller *caddy.Controller, args []string, target *filterHandler) error {
+	if len(args) != 1 {
+		return controller.Errf("There are exact one argument for filter block 'ruleset' expected.")
+	}
+	name := args[0]
+	rulesets := rulesetsOf(controller)
+	if _, exists := rulesets[name]; exists {
+		return controller.Errf("There is already a filter ruleset named '%v'.", name)
+	}
+	if !controller.NextArg() || controller.Val() != "{" {
+		return controller.Errf("Filter block 'ruleset' requires a block of rules.")
+	}
+	ruleset := new(filterHandler)
+	// The rule blocks itself are nested blocks, so the block of the ruleset is walked manually.
+	for controller.Next() {
+		switch controller.Val() {
+		case "}":
+			if len(ruleset.rules) <= 0 {
+				return controller.Errf("No rule block provided for filter ruleset '%v'.", name)
+			}
+			rulesets[name] = ruleset.rules
+			return nil
+		case "rule":
+			if err := evalRule(controller, controller.RemainingArgs(), ruleset); err != nil {
+				return err
+			}
+		case "use":
+			if err := evalUse(controller, controller.RemainingArgs(), ruleset); err != nil {
+				return err
+			}
+		default:
+			return controller.Errf("Unknown directive in filter ruleset '%v': %v", name, controller.Val())
+		}
+	}
+	return controller.EOFErr()
+}
+
+func evalUse(controller *caddy.Controller, args []string, target *filterHandler) error {
+	if len(args) <= 0 {
+		return controller.Errf("There is at least one argument for filter directive 'use' expected.")
+	}
+	rulesets := rulesetsOf(controller)
+	for _, name := range args {
+		rules, ok := rulesets[name]
+		if !ok {
+			return controller.Errf("There is no filter ruleset named '%v' defined.", name)
+		}
+		for _, candidate := range rules {
+			if candidate.name != "" && target.ruleNamed(candidate.name) != nil {
+				return controller.Errf("There is already a filter rule named '%v'.", candidate.name)
+			}
+			target.rules = append(target.rules, candidate)
+		}
+	}
+	return nil
+}
+
+func evalInclude(controller *caddy.Controller, args []string, target *filterHandler) error {
+	if len(args) != 1 {
+		return controller.Errf("There are exact one argument for filter directive 'include' expected.")
+	}
+	filename := includeFilenameOf(controller, args[0])
+	for _, candidate := range target.includeChain {
+		if candidate == filename {
+			return controller.Errf("Cyclic include of filter file '%v'.", filename)
+		}
+	}
+	if len(target.includeChain) >= maximumIncludeDepth {
+		return controller.Errf("Filter includes are nested deeper than %d levels.", maximumIncludeDepth)
+	}
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return controller.Errf("Could not read filter file '%v'. Got: %v", filename, err)
+	}
+	included := *controller
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		file := ruleFile{}
+		if err := yaml.Unmarshal(content, &file); err != nil {
+			return controller.Errf("Could not parse filter file '%v'. Got: %v", filename, err)
+		}
+		tokens, err := file.tokens(filename)
+		if err != nil {
+			return controller.Errf("Could not parse filter file '%v'. Got: %v", filename, err)
+		}
+		included.Dispenser = caddyfile.NewDispenserTokens(filename, tokens)
+	case ".json":
+		file := ruleFile{}
+		if err := json.Unmarshal(content, &file); err != nil {
+			return controller.Errf("Could not parse filter file '%v'. Got: %v", filename, err)
+		}
+		tokens, err := file.tokens(filename)
+		if err != nil {
+			return controller.Errf("Could not parse filter file '%v'. Got: %v", filename, err)
+		}
+		included.Dispenser = caddyfile.NewDispenserTokens(filename, tokens)
+	default:
+		included.Dispenser = caddyfile.NewDispenser(filename, bytes.NewReader(content))
+	}
+
+	target.includeChain = append(target.includeChain, filename)
+	defer func() {
+		target.includeChain = target.includeChain[:len(target.includeChain)-1]
+	}()
+	for included.Next() {
+		args := []string{included.Val()}
+		args = append(args, included.RemainingArgs()...)
+		if err := evalNamedBlock(&included, args, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// includeFilenameOf resolves the given filename relative to the directory of the file containing
+// the include - the Caddyfile or the including filter file.
+func includeFilenameOf(controller *caddy.Controller, filename string) string {
+	if filepath.IsAbs(filename) {
+		return filename
+	}
+	return filepath.Join(filepath.Dir(controller.File()), filename)
+}
+
+// ruleFile is the structure of filter files in YAML or JSON format. Every rule is
+// a map of the options of a 'rule' block to their values - see ruleFileTokenizer.appendOption.
+type ruleFile struct {
+	Rulesets map[string][]map[string]interface{} `yaml:"rulesets" json:"rulesets"`
+	Use      []string                            `yaml:"use" json:"use"`
+	Rules    []map[string]interface{}            `yaml:"rules" json:"rules"`
+}
+
+// tokens converts the file into the tokens of the equivalent Caddyfile syntax.
+func (instance ruleFile) tokens(filename string) ([]caddyfile.Token, error) {
+	tokenizer := &ruleFileTokenizer{filename: filename, line: 1}
+	names := make([]string, 0, len(instance.Rulesets))
+	for name := range instance.Rulesets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		tokenizer.appendLine("ruleset", name, "{")
+		if err := tokenizer.appendRules(instance.Rulesets[name]); err != nil {
+			return nil, err
+		}
+		tokenizer.appendLine("}")
+	}
+	if len(instance.Use) > 0 {
+		tokenizer.appendLine(append([]string{"use"}, instance.Use...)...)
+	}
+	if err := tokenizer.appendRules(instance.Rules); err != nil {
+		return nil, err
+	}
+	return tokenizer.result, nil
+}
+
+type ruleFileTokenizer struct {
+	filename string
+	line     int
+	result   []caddyfile.Token
+}
+
+func (instance *ruleFileTokenizer) appendLine(texts ...string) {
+	for _, text := range texts {
+		instance.result = append(instance.result, caddyfile.Token{File: instance.filename, Line: instance.line, Text: text})
+	}
+	instance.line++
+	for _, text := range texts {
+		instance.line += strings.Count(text, "\n")
+	}
+}
+
+func (instance *ruleFileTokenizer) appendRules(rules []map[string]interface{}) error {
+	for _, options := range rules {
+		instance.appendLine("rule", "{")
+		if err := instance.appendOptions(options); err != nil {
+			return err
+		}
+		instance.appendLine("}")
+	}
+	return nil
+}
+
+func (instance *ruleFileTokenizer) appendOptions(options map[string]interface{}) error {
+	keys := make([]string, 0, len(options))
+	for key := range options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := instance.appendOption(key, options[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendOption appends the lines of the given option:
+// * A scalar is the only argument of the option; null means no argument.
+// * A map is a block of options like the block of 'variant' or 'cookie_rewrite'.
+// * A list of lists repeats the option once per element - like multiple 'location_rewrite' lines.
+// * Every other list contains the arguments of the option; its last element could be a map for a block.
+func (instance *ruleFileTokenizer) appendOption(name string, value interface{}) error {
+	values, isList := value.([]interface{})
+	if isList && len(values) > 0 && ruleFileListsOnly(values) {
+		for _, candidate := range values {
+			if err := instance.appendOption(name, candidate); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if !isList && value != nil {
+		values = []interface{}{value}
+	}
+	texts := []string{name}
+	for i, candidate := range values {
+		if block, ok := ruleFileMapOf(candidate); ok {
+			if i != len(values)-1 {
+				return fmt.Errorf("The block of option '%v' has to be its last value.", name)
+			}
+			instance.appendLine(append(texts, "{")...)
+			if err := instance.appendOptions(block); err != nil {
+				return err
+			}
+			instance.appendLine("}")
+			return nil
+		}
+		text, ok := ruleFileScalarOf(candidate)
+		if !ok {
+			return fmt.Errorf("Illegal value for option '%v': %v", name, candidate)
+		}
+		texts = append(texts, text)
+	}
+	instance.appendLine(texts...)
+	return nil
+}
+
+func ruleFileListsOnly(values []interface{}) bool {
+	for _, candidate := range values {
+		if _, ok := candidate.([]interface{}); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// ruleFileMapOf converts the maps of both JSON and YAML documents.
+func ruleFileMapOf(value interface{}) (map[string]interface{}, bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return v, true
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, candidate := range v {
+			result[fmt.Sprint(key)] = candidate
+		}
+		return result, true
+	}
+	return nil, false
+}
+
+func ruleFileScalarOf(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case int:
+		return strconv.Itoa(v), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case uint64:
+		return strconv.FormatUint(v, 10), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	}
+	return "", false
+}
@@ -0,0 +1,322 @@
+package filter
+
+import (
+	"errors"
+	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/caddyfile"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type rulesetTest struct{}
+
+func init() {
+	Suite(&rulesetTest{})
+}
+
+func (s *rulesetTest) Test_rulesetAndUse(c *C) {
+	controller := caddy.NewTestController("http", "filter ruleset common {\n"+
+		"  rule {\n    name first\n    path myPath\n    search_pattern mySearchPattern\n  }\n"+
+		"  rule {\n    path myPath2\n    search_pattern mySearchPattern2\n  }\n"+
+		"}\n"+
+		"filter rule {\n  path myPath3\n  search_pattern mySearchPattern3\n}\n"+
+		"filter use common\n")
+	handler, err := parseConfiguration(controller)
+	c.Assert(err, IsNil)
+	c.Assert(len(handler.rules), Equals, 3)
+	c.Assert(handler.rules[0].path.String(), Equals, "myPath3")
+	c.Assert(handler.rules[1].name, Equals, "first")
+	c.Assert(handler.rules[1].path.String(), Equals, "myPath")
+	c.Assert(handler.rules[2].path.String(), Equals, "myPath2")
+	c.Assert(len(rulesetsOf(controller)["common"]), Equals, 2)
+}
+
+func (s *rulesetTest) Test_rulesetOnly(c *C) {
+	controller := caddy.NewTestController("http", "filter ruleset common {\n  rule {\n    path myPath\n    search_pattern mySearchPattern\n  }\n}\n")
+	handler, err := parseConfiguration(controller)
+	c.Assert(err, IsNil)
+	c.Assert(len(handler.rules), Equals, 0)
+	c.Assert(len(rulesetsOf(controller)["common"]), Equals, 1)
+}
+
+func (s *rulesetTest) Test_rulesetErrors(c *C) {
+	_, err := parseConfiguration(caddy.NewTestController("http", "filter use unknown\n"))
+	c.Assert(err, DeepEquals, errors.New("Testfile:1 - Error during parsing: There is no filter ruleset named 'unknown' defined."))
+
+	_, err = parseConfiguration(caddy.NewTestController("http", "filter ruleset a {\n}\n"))
+	c.Assert(err, DeepEquals, errors.New("Testfile:2 - Error during parsing: No rule block provided for filter ruleset 'a'."))
+
+	_, err = parseConfiguration(caddy.NewTestController("http", "filter ruleset a {\n  foo\n}\n"))
+	c.Assert(err, DeepEquals, errors.New("Testfile:2 - Error during parsing: Unknown directive in filter ruleset 'a': foo"))
+
+	_, err = parseConfiguration(caddy.NewTestController("http", "filter ruleset a\n"))
+	c.Assert(err, DeepEquals, errors.New("Testfile:1 - Error during parsing: Filter block 'ruleset' requires a block of rules."))
+
+	_, err = parseConfiguration(caddy.NewTestController("http", "filter ruleset a {\n  rule {\n    path a\n    search_pattern a\n  }\n}\n"+
+		"filter ruleset a {\n  rule {\n    path a\n    search_pattern a\n  }\n}\n"))
+	c.Assert(err, DeepEquals, errors.New("Testfile:7 - Error during parsing: There is already a filter ruleset named 'a'."))
+
+	_, err = parseConfiguration(caddy.NewTestController("http", "filter ruleset a {\n  rule {\n    name x\n    path a\n    search_pattern a\n  }\n}\n"+
+		"filter rule {\n  name x\n  path a\n  search_pattern a\n}\nfilter use a\n"))
+	c.Assert(err, DeepEquals, errors.New("Testfile:13 - Error during parsing: There is already a filter rule named 'x'."))
+}
+
+func (s *rulesetTest) Test_includeCaddyfile(c *C) {
+	controller := caddy.NewTestController("http", "filter include resources/test/rules/common.caddy\nfilter use common\n")
+	handler, err := parseConfiguration(controller)
+	c.Assert(err, IsNil)
+	c.Assert(len(handler.rules), Equals, 2)
+	c.Assert(handler.rules[0].path.String(), Equals, ".*\\.txt")
+	c.Assert(string(handler.rules[0].replacement), Equals, "bar")
+	c.Assert(handler.rules[1].name, Equals, "analytics")
+	c.Assert(string(handler.rules[1].replacement), Equals, "</title><script src=\"/analytics.js\"></script>")
+}
+
+func (s *rulesetTest) Test_includeYaml(c *C) {
+	controller := caddy.NewTestController("http", "filter include resources/test/rules/common.yaml\n")
+	handler, err := parseConfiguration(controller)
+	c.Assert(err, IsNil)
+	c.Assert(len(handler.rules), Equals, 2)
+	c.Assert(handler.rules[0].name, Equals, "footer")
+	c.Assert(handler.rules[0].contentType.String(), Equals, "text/html.*")
+	c.Assert(string(handler.rules[0].replacement), Equals, "<footer>\n  Served by {request_host}\n</footer></body>\n")
+	c.Assert(handler.rules[1].path.String(), Equals, ".*\\.txt")
+	c.Assert(handler.rules[1].timeout, Equals, 100*time.Millisecond)
+}
+
+func (s *rulesetTest) Test_includeJson(c *C) {
+	controller := caddy.NewTestController("http", "filter include resources/test/rules/common.json\nfilter use banner\n")
+	handler, err := parseConfiguration(controller)
+	c.Assert(err, IsNil)
+	c.Assert(len(handler.rules), Equals, 2)
+	c.Assert(handler.rules[0].path.String(), Equals, ".*\\.txt")
+	c.Assert(handler.rules[1].name, Equals, "banner")
+	c.Assert(string(handler.rules[1].replacement), Equals, "<body><div class=\"banner\"></div>")
+}
+
+func (s *rulesetTest) Test_includeNestedRelative(c *C) {
+	controller := caddy.NewTestController("http", "filter include resources/test/rules/nested/main.caddy\n")
+	handler, err := parseConfiguration(controller)
+	c.Assert(err, IsNil)
+	c.Assert(len(handler.rules), Equals, 1)
+	c.Assert(handler.rules[0].name, Equals, "banner")
+
+	controller = caddy.NewTestController("http", "")
+	controller.Dispenser = caddyfile.NewDispenser("resources/test/rules/Caddyfile", strings.NewReader("filter include nested/main.caddy\n"))
+	handler, err = parseConfiguration(controller)
+	c.Assert(err, IsNil)
+	c.Assert(len(handler.rules), Equals, 1)
+	c.Assert(handler.rules[0].name, Equals, "banner")
+}
+
+func (s *rulesetTest) Test_includeErrors(c *C) {
+	_, err := parseConfiguration(caddy.NewTestController("http", "filter include resources/test/rules/cyclic.caddy\n"))
+	c.Assert(err, DeepEquals, errors.New("resources/test/rules/cyclic.caddy:1 - Error during parsing: Cyclic include of filter file 'resources/test/rules/cyclic.caddy'."))
+
+	_, err = parseConfiguration(caddy.NewTestController("http", "filter include resources/test/rules/missing.caddy\n"))
+	c.Assert(err, ErrorMatches, "Testfile:1 - Error during parsing: Could not read filter file 'resources/test/rules/missing.caddy'. Got: .*")
+
+	_, err = parseConfiguration(caddy.NewTestController("http", "filter include\n"))
+	c.Assert(err, DeepEquals, errors.New("Testfile:1 - Error during parsing: There are exact one argument for filter directive 'include' expected."))
+}
+
+func (s *rulesetTest) Test_ruleFile_tokens(c *C) {
+	file := ruleFile{
+		Rulesets: map[string][]map[string]interface{}{
+			"a": {{"path": "p", "search_pattern": "s"}},
+		},
+		Use: []string{"a"},
+		Rules: []map[string]interface{}{{
+			"replacement": "line1\nline2",
+			"path":        "p2",
+			"respond":     []interface{}{503, "body"},
+			"redact":      []interface{}{[]interface{}{"email"}, []interface{}{"credit_card", "api_key"}},
+			"variant":     []interface{}{"new", 10.0, map[interface{}]interface{}{"replacement": "r"}},
+			"minify":      nil,
+		}},
+	}
+	tokens, err := file.tokens("f")
+	c.Assert(err, IsNil)
+	var texts []string
+	var lines []int
+	for _, token := range tokens {
+		texts = append(texts, token.Text)
+		lines = append(lines, token.Line)
+	}
+	c.Assert(texts, DeepEquals, []string{
+		"ruleset", "a", "{",
+		"rule", "{", "path", "p", "search_pattern", "s", "}",
+		"}",
+		"use", "a",
+		"rule", "{",
+		"minify",
+		"path", "p2",
+		"redact", "email",
+		"redact", "credit_card", "api_key",
+		"replacement", "line1\nline2",
+		"respond", "503", "body",
+		"variant", "new", "10", "{", "replacement", "r", "}",
+		"}",
+	})
+	c.Assert(lines, DeepEquals, []int{
+		1, 1, 1,
+		2, 2, 3, 3, 4, 4, 5,
+		6,
+		7, 7,
+		8, 8,
+		9,
+		10, 10,
+		11, 11,
+		12, 12, 12,
+		13, 13,
+		15, 15, 15,
+		16, 16, 16, 16, 17, 17, 18,
+		19,
+	})
+}
+
+func (s *rulesetTest) Test_ruleFile_tokensErrors(c *C) {
+	_, err := ruleFile{Rules: []map[string]interface{}{{
+		"variant": []interface{}{"new", map[string]interface{}{"weight": 1}, "10"},
+	}}}.tokens("f")
+	c.Assert(err, DeepEquals, errors.New("The block of option 'variant' has to be its last value."))
+
+	_, err = ruleFile{Rules: []map[string]interface{}{{
+		"redact": []interface{}{"email", []interface{}{"credit_card"}},
+	}}}.tokens("f")
+	c.Assert(err, DeepEquals, errors.New("Illegal value for option 'redact': [credit_card]"))
+
+	_, err = includeRuleFile(c, "rules.yaml", "rules:\n  - path: p\n    respond: [503, [foo]]\n")
+	c.Assert(err, ErrorMatches, "Testfile:1 - Error during parsing: Could not parse filter file '.*rules.yaml'. Got: Illegal value for option 'respond': \\[foo\\]")
+}
+
+func (s *rulesetTest) Test_includeYaml_respond(c *C) {
+	handler, err := includeRuleFile(c, "rules.yaml", "rules:\n"+
+		"  - path: p\n"+
+		"    search_pattern: maintenance\n"+
+		"    respond: [503, Service unavailable]\n")
+	c.Assert(err, IsNil)
+	c.Assert(handler.rules[0].response.status, Equals, 503)
+	c.Assert(string(handler.rules[0].response.body), Equals, "Service unavailable")
+}
+
+func (s *rulesetTest) Test_includeJson_respond(c *C) {
+	handler, err := includeRuleFile(c, "rules.json", `{"rules": [{"path": "p", "search_pattern": "maintenance", "respond": [503, "Service unavailable"]}]}`)
+	c.Assert(err, IsNil)
+	c.Assert(handler.rules[0].response.status, Equals, 503)
+	c.Assert(string(handler.rules[0].response.body), Equals, "Service unavailable")
+}
+
+func (s *rulesetTest) Test_includeYaml_rewriteUpstreamUrls(c *C) {
+	handler, err := includeRuleFile(c, "rules.yaml", "rules:\n"+
+		"  - path: p\n"+
+		"    rewrite_upstream_urls: [\"http://backend:8080/app\", \"https://{request_host}\"]\n")
+	c.Assert(err, IsNil)
+	c.Assert(handler.rules[0].upstreamUrls.fromHost, Equals, "backend:8080")
+	c.Assert(handler.rules[0].upstreamUrls.fromPath, Equals, "/app")
+	c.Assert(handler.rules[0].upstreamUrls.to, Equals, "https://{request_host}")
+}
+
+func (s *rulesetTest) Test_includeYaml_locationRewrite(c *C) {
+	handler, err := includeRuleFile(c, "rules.yaml", "rules:\n"+
+		"  - path: p\n"+
+		"    location_rewrite:\n"+
+		"      - [\"^http://backend:8080(/.*)?$\", \"https://{request_host}{1}\"]\n"+
+		"      - [\"^/old/\", \"/new/\"]\n")
+	c.Assert(err, IsNil)
+	rewrites := handler.rules[0].locationRewrites
+	c.Assert(len(rewrites), Equals, 2)
+	c.Assert(rewrites[0].pattern.String(), Equals, "^http://backend:8080(/.*)?$")
+	c.Assert(string(rewrites[0].replacement), Equals, "https://{request_host}{1}")
+	c.Assert(rewrites[1].pattern.String(), Equals, "^/old/")
+	c.Assert(string(rewrites[1].replacement), Equals, "/new/")
+}
+
+func (s *rulesetTest) Test_includeYaml_cookieRewrite(c *C) {
+	handler, err := includeRuleFile(c, "rules.yaml", "rules:\n"+
+		"  - path: p\n"+
+		"    cookie_rewrite:\n"+
+		"      - - \"^session$\"\n"+
+		"        - domain: [\"^backend$\", example.org]\n"+
+		"          add: [Secure, SameSite=Lax]\n"+
+		"      - - remove: [domain]\n")
+	c.Assert(err, IsNil)
+	rewrites := handler.rules[0].cookieRewrites
+	c.Assert(len(rewrites), Equals, 2)
+	c.Assert(rewrites[0].name.String(), Equals, "^session$")
+	c.Assert(rewrites[0].domain.pattern.String(), Equals, "^backend$")
+	c.Assert(string(rewrites[0].domain.replacement), Equals, "example.org")
+	c.Assert(rewrites[0].add, DeepEquals, []string{"Secure", "SameSite=Lax"})
+	c.Assert(rewrites[1].name, IsNil)
+	c.Assert(rewrites[1].remove, DeepEquals, []string{"domain"})
+}
+
+func (s *rulesetTest) Test_includeYaml_xmlSet(c *C) {
+	handler, err := includeRuleFile(c, "rules.yaml", "rules:\n"+
+		"  - path: p\n"+
+		"    xml_set:\n"+
+		"      - [//item/link, \"^https?://[^/]+\", \"https://{request_host}\"]\n"+
+		"      - [/rss/@version, \"2.0\"]\n")
+	c.Assert(err, IsNil)
+	actions := handler.rules[0].xml.actions
+	c.Assert(len(actions), Equals, 2)
+	c.Assert(actions[0].pattern.String(), Equals, "^https?://[^/]+")
+	c.Assert(string(actions[0].value), Equals, "https://{request_host}")
+	c.Assert(actions[1].pattern, IsNil)
+	c.Assert(string(actions[1].value), Equals, "2.0")
+}
+
+func (s *rulesetTest) Test_includeYaml_variant(c *C) {
+	handler, err := includeRuleFile(c, "rules.yaml", "rules:\n"+
+		"  - name: title\n"+
+		"    path: p\n"+
+		"    search_pattern: </title>\n"+
+		"    replacement: old\n"+
+		"    variant:\n"+
+		"      - [new, 10, {replacement: new}]\n"+
+		"      - [old, {weight: 90}]\n")
+	c.Assert(err, IsNil)
+	variants := handler.rules[0].variants.variants
+	c.Assert(len(variants), Equals, 2)
+	c.Assert(variants[0].name, Equals, "new")
+	c.Assert(variants[0].weight, Equals, 10)
+	c.Assert(string(variants[0].replacement), Equals, "new")
+	c.Assert(variants[1].name, Equals, "old")
+	c.Assert(variants[1].weight, Equals, 90)
+	c.Assert(variants[1].replacement, IsNil)
+}
+
+func (s *rulesetTest) Test_includeYaml_pipe(c *C) {
+	handler, err := includeRuleFile(c, "rules.yaml", "rules:\n"+
+		"  - path: p\n"+
+		"    pipe: [cat, -u, \"with space\"]\n")
+	c.Assert(err, IsNil)
+	c.Assert(handler.rules[0].pipe.command, DeepEquals, []string{"cat", "-u", "with space"})
+}
+
+func (s *rulesetTest) Test_includeYaml_redact(c *C) {
+	handler, err := includeRuleFile(c, "rules.yaml", "rules:\n"+
+		"  - path: p\n"+
+		"    redact:\n"+
+		"      - [credit_card, email]\n"+
+		"      - [api_key]\n")
+	c.Assert(err, IsNil)
+	var names []string
+	for _, detector := range handler.rules[0].redaction.detectors {
+		names = append(names, detector.name)
+	}
+	c.Assert(names, DeepEquals, []string{"credit_card", "email", "api_key"})
+}
+
+func includeRuleFile(c *C, name string, content string) (*filterHandler, error) {
+	directory, err := ioutil.TempDir("", "caddy-filter")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(directory)
+	file := filepath.Join(directory, name)
+	c.Assert(ioutil.WriteFile(file, []byte(content), 0644), IsNil)
+	return parseConfiguration(caddy.NewTestController("http", "filter include "+file+"\n"))
+}
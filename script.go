@@ -0,0 +1,233 @@
+package filter
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+const (
+	// defaultScriptTimeout limits scripts of rules without 'timeout' and without 'timeout' of the filter.
+	defaultScriptTimeout       = time.Second
+	defaultScriptMaximumMemory = 16 * 1024 * 1024
+	// luaValueSize is the approximated size of one slot of the stack of the interpreter.
+	luaValueSize       = 16
+	luaCallStackSize   = 256
+	luaInitialRegistry = 1024
+)
+
+// scriptGlobalsRemoved contains the functions of the base library which could access the file
+// system, load code at runtime or write to stdout.
+var scriptGlobalsRemoved = []string{"dofile", "loadfile", "load", "loadstring", "require", "module", "collectgarbage", "_printregs"}
+
+var scriptChecksums = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"crc32":  func() hash.Hash { return crc32.NewIEEE() },
+}
+
+// ruleScript transforms the body with a Lua script. Every execution runs in its own interpreter
+// which only provides the base, string, table and math libraries together with the functions
+// of the filter - there is no access to the file system, the network or other processes.
+type ruleScript struct {
+	// name of the script used in error messages; the file name if loaded from a file.
+	name          string
+	proto         *lua.FunctionProto
+	maximumMemory int64
+}
+
+// scriptCache contains the compiled scripts of a handler by their name and source.
+type scriptCache map[string]*lua.FunctionProto
+
+func compileScriptSource(name string, source []byte) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(bytes.NewReader(source), name)
+	if err != nil {
+		return nil, err
+	}
+	return lua.Compile(rewriteScript(chunk), name)
+}
+
+// compileScript returns the compiled form of the given source. Scripts are compiled once while
+// the configuration is parsed and only the compiled form is executed for every response. Equal
+// scripts of different rules are only compiled once.
+func (instance *filterHandler) compileScript(name string, source []byte) (*lua.FunctionProto, error) {
+	key := name + "\x00" + string(source)
+	if proto, ok := instance.scripts[key]; ok {
+		return proto, nil
+	}
+	proto, err := compileScriptSource(name, source)
+	if err != nil {
+		return nil, err
+	}
+	if instance.scripts == nil {
+		instance.scripts = scriptCache{}
+	}
+	instance.scripts[key] = proto
+	return proto, nil
+}
+
+// run executes the script on the given body until the given deadline. The script gets the body
+// as global 'body' and returns the new body - or nil to keep the body unchanged.
+func (instance *ruleScript) run(action *ruleReplaceAction, deadline time.Time, body []byte) ([]byte, error) {
+	if deadline.IsZero() {
+		deadline = time.Now().Add(defaultScriptTimeout)
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	memory := &scriptMemory{limit: instance.maximumMemory, cancel: cancel}
+	state := instance.newState(action, memory)
+	defer state.Close()
+	state.SetContext(ctx)
+	state.SetGlobal("body", lua.LString(body))
+
+	err := state.CallByParam(lua.P{
+		Fn:      state.NewFunctionFromProto(instance.proto),
+		NRet:    1,
+		Protect: true,
+	})
+	if memory.exceeded {
+		return nil, fmt.Errorf("script '%v' exceeded the memory limit of %d bytes", instance.name, instance.maximumMemory)
+	}
+	if ctx.Err() != nil {
+		return nil, errExecutionTimeout
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch result := state.Get(-1).(type) {
+	case lua.LString:
+		if int64(len(result)) > instance.maximumMemory {
+			return nil, fmt.Errorf("script '%v' returned a body larger than %d bytes", instance.name, instance.maximumMemory)
+		}
+		return []byte(result), nil
+	case *lua.LNilType:
+		return body, nil
+	default:
+		return nil, fmt.Errorf("script '%v' returned a %v instead of a string or nil", instance.name, result.Type())
+	}
+}
+
+func (instance *ruleScript) newState(action *ruleReplaceAction, memory *scriptMemory) *lua.LState {
+	state := lua.NewState(lua.Options{
+		SkipOpenLibs:    true,
+		CallStackSize:   luaCallStackSize,
+		RegistrySize:    luaInitialRegistry,
+		RegistryMaxSize: int(instance.maximumMemory / luaValueSize),
+	})
+	for _, library := range []struct {
+		name   string
+		opener lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		state.Push(state.NewFunction(library.opener))
+		state.Push(lua.LString(library.name))
+		state.Call(1, 0)
+	}
+	for _, name := range scriptGlobalsRemoved {
+		state.SetGlobal(name, lua.LNil)
+	}
+	memory.install(state)
+
+	request := action.request
+	requestTable := state.NewTable()
+	requestTable.RawSetString("method", lua.LString(request.Method))
+	requestTable.RawSetString("url", lua.LString(request.URL.String()))
+	requestTable.RawSetString("path", lua.LString(request.URL.Path))
+	requestTable.RawSetString("host", lua.LString(request.Host))
+	requestTable.RawSetString("proto", lua.LString(request.Proto))
+	requestTable.RawSetString("remote_address", lua.LString(request.RemoteAddr))
+	state.SetGlobal("request", requestTable)
+
+	state.SetGlobal("print", state.NewFunction(instance.print))
+	state.SetGlobal("request_header", state.NewFunction(func(state *lua.LState) int {
+		state.Push(lua.LString(request.Header.Get(state.CheckString(1))))
+		return 1
+	}))
+	state.SetGlobal("response_header", state.NewFunction(func(state *lua.LState) int {
+		state.Push(lua.LString(instance.responseHeaderOf(action).Get(state.CheckString(1))))
+		return 1
+	}))
+	state.SetGlobal("set_response_header", state.NewFunction(func(state *lua.LState) int {
+		header := instance.responseHeaderOf(action)
+		name := state.CheckString(1)
+		if value := state.Get(2); value == lua.LNil {
+			header.Del(name)
+		} else {
+			header.Set(name, lua.LVAsString(value))
+		}
+		return 0
+	}))
+	state.SetGlobal("placeholder", state.NewFunction(func(state *lua.LState) int {
+		if value, ok := action.contextValueBy(state.CheckString(1)); ok {
+			state.Push(lua.LString(value))
+		} else {
+			state.Push(lua.LNil)
+		}
+		return 1
+	}))
+	state.SetGlobal("checksum", state.NewFunction(checksumOfScript))
+	return state
+}
+
+func (instance *ruleScript) responseHeaderOf(action *ruleReplaceAction) http.Header {
+	if action.responseHeader == nil {
+		header := http.Header{}
+		action.responseHeader = &header
+	}
+	return *action.responseHeader
+}
+
+func (instance *ruleScript) print(state *lua.LState) int {
+	buffer := new(bytes.Buffer)
+	for i := 1; i <= state.GetTop(); i++ {
+		if i > 1 {
+			buffer.WriteByte('\t')
+		}
+		buffer.WriteString(state.ToStringMeta(state.Get(i)).String())
+	}
+	log.Printf("[INFO] Filter script '%v': %s", instance.name, buffer)
+	return 0
+}
+
+// checksumOfScript implements checksum(<algorithm>, <value>) which returns the hex encoded checksum.
+func checksumOfScript(state *lua.LState) int {
+	algorithm := state.CheckString(1)
+	value := state.CheckString(2)
+	factory, ok := scriptChecksums[algorithm]
+	if !ok {
+		state.ArgError(1, "unknown checksum algorithm: "+algorithm)
+		return 0
+	}
+	h := factory()
+	h.Write([]byte(value))
+	state.Push(lua.LString(hex.EncodeToString(h.Sum(nil))))
+	return 1
+}
+
+func cloneHeader(header http.Header) http.Header {
+	result := make(http.Header, len(header))
+	for key, values := range header {
+		result[key] = append([]string(nil), values...)
+	}
+	return result
+}
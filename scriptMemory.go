@@ -0,0 +1,454 @@
+package filter
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/ast"
+	"github.com/yuin/gopher-lua/pm"
+)
+
+const (
+	// luaSlotSize is the approximated size of one entry of a table.
+	luaSlotSize = 2 * luaValueSize
+	// luaTableSize is the approximated size of an empty table.
+	luaTableSize = 4 * luaValueSize
+	// luaMaximumFormatWidth is the largest width or precision of string.format like in Lua 5.1.
+	luaMaximumFormatWidth = 99
+)
+
+// Names of the functions which count the allocations of the operators of a script. They are no
+// valid identifiers of Lua and could not be referenced or replaced by scripts.
+const (
+	scriptConcatFunction = "filter.concat"
+	scriptSetFunction    = "filter.set"
+	scriptTableFunction  = "filter.table"
+)
+
+// rewriteScript changes the syntax tree of a script in a way that every operation of the
+// interpreter which allocates memory - concatenations, assignments to fields of tables and table
+// constructors - calls a function which counts the allocation (see scriptMemory). The functions
+// are captured as locals before anything of the script is executed.
+func rewriteScript(stmts []ast.Stmt) []ast.Stmt {
+	names := []string{scriptConcatFunction, scriptSetFunction, scriptTableFunction}
+	capture := &ast.LocalAssignStmt{Names: names}
+	for _, name := range names {
+		capture.Exprs = append(capture.Exprs, &ast.IdentExpr{Value: name})
+	}
+	return append([]ast.Stmt{capture}, rewriteScriptStmts(stmts)...)
+}
+
+func rewriteScriptStmts(stmts []ast.Stmt) []ast.Stmt {
+	for i, stmt := range stmts {
+		stmts[i] = rewriteScriptStmt(stmt)
+	}
+	return stmts
+}
+
+func rewriteScriptStmt(stmt ast.Stmt) ast.Stmt {
+	switch s := stmt.(type) {
+	case *ast.AssignStmt:
+		return rewriteScriptAssignment(s)
+	case *ast.LocalAssignStmt:
+		rewriteScriptExprs(s.Exprs)
+	case *ast.FuncCallStmt:
+		s.Expr = rewriteScriptExpr(s.Expr)
+	case *ast.DoBlockStmt:
+		rewriteScriptStmts(s.Stmts)
+	case *ast.WhileStmt:
+		s.Condition = rewriteScriptExpr(s.Condition)
+		rewriteScriptStmts(s.Stmts)
+	case *ast.RepeatStmt:
+		s.Condition = rewriteScriptExpr(s.Condition)
+		rewriteScriptStmts(s.Stmts)
+	case *ast.IfStmt:
+		s.Condition = rewriteScriptExpr(s.Condition)
+		rewriteScriptStmts(s.Then)
+		rewriteScriptStmts(s.Else)
+	case *ast.NumberForStmt:
+		s.Init = rewriteScriptExpr(s.Init)
+		s.Limit = rewriteScriptExpr(s.Limit)
+		s.Step = rewriteScriptExpr(s.Step)
+		rewriteScriptStmts(s.Stmts)
+	case *ast.GenericForStmt:
+		rewriteScriptExprs(s.Exprs)
+		rewriteScriptStmts(s.Stmts)
+	case *ast.FuncDefStmt:
+		rewriteScriptStmts(s.Func.Stmts)
+	case *ast.ReturnStmt:
+		rewriteScriptExprs(s.Exprs)
+	}
+	return stmt
+}
+
+// rewriteScriptAssignment replaces assignments to fields of tables by calls of
+// scriptSetFunction. If there are multiple values they are evaluated into temporary locals first.
+func rewriteScriptAssignment(s *ast.AssignStmt) ast.Stmt {
+	fields := false
+	for _, lhs := range s.Lhs {
+		if field, ok := lhs.(*ast.AttrGetExpr); ok {
+			field.Object = rewriteScriptExpr(field.Object)
+			field.Key = rewriteScriptExpr(field.Key)
+			fields = true
+		}
+	}
+	rewriteScriptExprs(s.Rhs)
+	if !fields {
+		return s
+	}
+	if len(s.Lhs) == 1 && len(s.Rhs) == 1 {
+		field := s.Lhs[0].(*ast.AttrGetExpr)
+		return scriptCallStmtOf(s.Line(), scriptSetFunction, field.Object, field.Key, s.Rhs[0])
+	}
+	values := &ast.LocalAssignStmt{Exprs: s.Rhs}
+	values.SetLine(s.Line())
+	block := &ast.DoBlockStmt{Stmts: []ast.Stmt{values}}
+	block.SetLine(s.Line())
+	for i, lhs := range s.Lhs {
+		name := "filter." + strconv.Itoa(i)
+		values.Names = append(values.Names, name)
+		value := &ast.IdentExpr{Value: name}
+		value.SetLine(s.Line())
+		if field, ok := lhs.(*ast.AttrGetExpr); ok {
+			block.Stmts = append(block.Stmts, scriptCallStmtOf(s.Line(), scriptSetFunction, field.Object, field.Key, value))
+		} else {
+			assignment := &ast.AssignStmt{Lhs: []ast.Expr{lhs}, Rhs: []ast.Expr{value}}
+			assignment.SetLine(s.Line())
+			block.Stmts = append(block.Stmts, assignment)
+		}
+	}
+	return block
+}
+
+func rewriteScriptExprs(exprs []ast.Expr) {
+	for i, expr := range exprs {
+		exprs[i] = rewriteScriptExpr(expr)
+	}
+}
+
+func rewriteScriptExpr(expr ast.Expr) ast.Expr {
+	switch e := expr.(type) {
+	case *ast.StringConcatOpExpr:
+		return scriptCallOf(e.Line(), scriptConcatFunction, rewriteScriptExpr(e.Lhs), rewriteScriptExpr(e.Rhs))
+	case *ast.TableExpr:
+		for _, field := range e.Fields {
+			if field.Key != nil {
+				field.Key = rewriteScriptExpr(field.Key)
+			}
+			field.Value = rewriteScriptExpr(field.Value)
+		}
+		return scriptCallOf(e.Line(), scriptTableFunction, e)
+	case *ast.AttrGetExpr:
+		e.Object = rewriteScriptExpr(e.Object)
+		e.Key = rewriteScriptExpr(e.Key)
+	case *ast.FuncCallExpr:
+		if e.Func != nil {
+			e.Func = rewriteScriptExpr(e.Func)
+		}
+		if e.Receiver != nil {
+			e.Receiver = rewriteScriptExpr(e.Receiver)
+		}
+		rewriteScriptExprs(e.Args)
+	case *ast.LogicalOpExpr:
+		e.Lhs = rewriteScriptExpr(e.Lhs)
+		e.Rhs = rewriteScriptExpr(e.Rhs)
+	case *ast.RelationalOpExpr:
+		e.Lhs = rewriteScriptExpr(e.Lhs)
+		e.Rhs = rewriteScriptExpr(e.Rhs)
+	case *ast.ArithmeticOpExpr:
+		e.Lhs = rewriteScriptExpr(e.Lhs)
+		e.Rhs = rewriteScriptExpr(e.Rhs)
+	case *ast.UnaryMinusOpExpr:
+		e.Expr = rewriteScriptExpr(e.Expr)
+	case *ast.UnaryNotOpExpr:
+		e.Expr = rewriteScriptExpr(e.Expr)
+	case *ast.UnaryLenOpExpr:
+		e.Expr = rewriteScriptExpr(e.Expr)
+	case *ast.FunctionExpr:
+		rewriteScriptStmts(e.Stmts)
+	}
+	return expr
+}
+
+func scriptCallOf(line int, function string, args ...ast.Expr) *ast.FuncCallExpr {
+	name := &ast.IdentExpr{Value: function}
+	name.SetLine(line)
+	result := &ast.FuncCallExpr{Func: name, Args: args}
+	result.SetLine(line)
+	return result
+}
+
+func scriptCallStmtOf(line int, function string, args ...ast.Expr) *ast.FuncCallStmt {
+	result := &ast.FuncCallStmt{Expr: scriptCallOf(line, function, args...)}
+	result.SetLine(line)
+	return result
+}
+
+// scriptMemory counts the memory allocated by one execution of a script: every string it creates
+// and every table and entry of a table it adds. Strings which only refer to a part of another
+// string like the results of string.sub do not allocate memory. If the limit would be exceeded
+// the script is stopped - errors could not be caught by pcall because the context of the script
+// is canceled, too.
+type scriptMemory struct {
+	limit    int64
+	used     int64
+	exceeded bool
+	cancel   context.CancelFunc
+}
+
+func (instance *scriptMemory) allocate(state *lua.LState, size int64) {
+	if instance.exceeded || instance.used+size > instance.limit {
+		instance.exceeded = true
+		instance.cancel()
+		state.RaiseError("memory limit of %d bytes exceeded", instance.limit)
+	}
+	instance.used += size
+}
+
+// install provides the functions used by rewriteScript and replaces all functions of the
+// libraries which allocate memory by functions which count it.
+func (instance *scriptMemory) install(state *lua.LState) {
+	state.SetGlobal(scriptConcatFunction, state.NewFunction(instance.concat))
+	state.SetGlobal(scriptSetFunction, state.NewFunction(instance.set))
+	state.SetGlobal(scriptTableFunction, state.NewFunction(instance.table))
+
+	instance.replace(state, state.G.Global, "tostring", instance.counting)
+	instance.replace(state, state.G.Global, "rawset", instance.rawSet)
+	if library, ok := state.GetGlobal(lua.StringLibName).(*lua.LTable); ok {
+		for _, name := range []string{"char", "lower", "upper", "reverse"} {
+			instance.replace(state, library, name, instance.counting)
+		}
+		instance.replace(state, library, "format", instance.stringFormat)
+		instance.replace(state, library, "gsub", instance.stringGsub)
+		library.RawSetString("rep", state.NewFunction(instance.stringRep))
+	}
+	if library, ok := state.GetGlobal(lua.TabLibName).(*lua.LTable); ok {
+		instance.replace(state, library, "concat", instance.tableConcat)
+		instance.replace(state, library, "insert", instance.tableInsert)
+	}
+}
+
+func (instance *scriptMemory) replace(state *lua.LState, library *lua.LTable, name string, wrapper func(lua.LGFunction) lua.LGFunction) {
+	if function, ok := library.RawGetString(name).(*lua.LFunction); ok && function.IsG {
+		library.RawSetString(name, state.NewFunction(wrapper(function.GFunction)))
+	}
+}
+
+// concat implements the operator '..' - including the metamethod __concat.
+func (instance *scriptMemory) concat(state *lua.LState) int {
+	lhs, rhs := state.Get(1), state.Get(2)
+	if !lua.LVCanConvToString(lhs) || !lua.LVCanConvToString(rhs) {
+		operator := state.GetMetaField(lhs, "__concat")
+		if operator == lua.LNil {
+			operator = state.GetMetaField(rhs, "__concat")
+		}
+		if operator == lua.LNil {
+			// Raises the error of the interpreter.
+			state.Concat(lhs, rhs)
+			return 0
+		}
+		state.Push(operator)
+		state.Push(lhs)
+		state.Push(rhs)
+		state.Call(2, 1)
+		return 1
+	}
+	left, right := lua.LVAsString(lhs), lua.LVAsString(rhs)
+	instance.allocate(state, int64(len(left)+len(right)))
+	state.Push(lua.LString(left + right))
+	return 1
+}
+
+// set implements the assignment to a field of a table.
+func (instance *scriptMemory) set(state *lua.LState) int {
+	object, key, value := state.Get(1), state.Get(2), state.Get(3)
+	if table, ok := object.(*lua.LTable); ok && value != lua.LNil && table.RawGet(key) == lua.LNil {
+		instance.allocate(state, luaSlotSize)
+	}
+	state.SetTable(object, key, value)
+	return 0
+}
+
+// table counts the entries of a table created by a constructor.
+func (instance *scriptMemory) table(state *lua.LState) int {
+	table := state.CheckTable(1)
+	entries := int64(0)
+	table.ForEach(func(lua.LValue, lua.LValue) {
+		entries++
+	})
+	instance.allocate(state, luaTableSize+entries*luaSlotSize)
+	state.Push(table)
+	return 1
+}
+
+// counting counts the strings returned by the given function after it was called. It is used
+// for functions whose results are not larger than their arguments.
+func (instance *scriptMemory) counting(function lua.LGFunction) lua.LGFunction {
+	return func(state *lua.LState) int {
+		results := function(state)
+		top := state.GetTop()
+		for i := top - results + 1; i <= top; i++ {
+			if value, ok := state.Get(i).(lua.LString); ok {
+				instance.allocate(state, int64(len(value)))
+			}
+		}
+		return results
+	}
+}
+
+func (instance *scriptMemory) rawSet(function lua.LGFunction) lua.LGFunction {
+	return func(state *lua.LState) int {
+		table := state.CheckTable(1)
+		if state.Get(3) != lua.LNil && table.RawGet(state.Get(2)) == lua.LNil {
+			instance.allocate(state, luaSlotSize)
+		}
+		return function(state)
+	}
+}
+
+// stringRep implements string.rep and counts the result before it is created.
+func (instance *scriptMemory) stringRep(state *lua.LState) int {
+	value := state.CheckString(1)
+	n := state.CheckInt(2)
+	if n <= 0 {
+		state.Push(lua.LString(""))
+		return 1
+	}
+	instance.allocate(state, int64(len(value))*int64(n))
+	state.Push(lua.LString(bytes.Repeat([]byte(value), n)))
+	return 1
+}
+
+// stringFormat rejects widths and precisions larger than Lua 5.1 supports before the result is
+// created and counts it afterwards.
+func (instance *scriptMemory) stringFormat(function lua.LGFunction) lua.LGFunction {
+	counting := instance.counting(function)
+	return func(state *lua.LState) int {
+		format := state.CheckString(1)
+		for i := 0; i < len(format); i++ {
+			if format[i] != '%' {
+				continue
+			}
+			for i++; i < len(format) && strings.IndexByte("-+ #0", format[i]) >= 0; i++ {
+			}
+			width, precision := 0, 0
+			for ; i < len(format) && format[i] >= '0' && format[i] <= '9' && width <= luaMaximumFormatWidth; i++ {
+				width = width*10 + int(format[i]-'0')
+			}
+			if i < len(format) && format[i] == '.' {
+				for i++; i < len(format) && format[i] >= '0' && format[i] <= '9' && precision <= luaMaximumFormatWidth; i++ {
+					precision = precision*10 + int(format[i]-'0')
+				}
+			}
+			if width > luaMaximumFormatWidth || precision > luaMaximumFormatWidth {
+				state.RaiseError("invalid format (width or precision too long)")
+			}
+		}
+		return counting(state)
+	}
+}
+
+// stringGsub counts the result of string.gsub before it is created. Replacements provided by
+// tables or functions are counted one after another while they are collected.
+func (instance *scriptMemory) stringGsub(function lua.LGFunction) lua.LGFunction {
+	return func(state *lua.LState) int {
+		value := state.CheckString(1)
+		pattern := state.CheckString(2)
+		limit := state.OptInt(4, -1)
+		switch replacement := state.Get(3).(type) {
+		case lua.LString:
+			// Errors of the pattern are raised by the original function.
+			if matches, err := pm.Find(pattern, []byte(value), 0, limit); err == nil {
+				instance.allocate(state, gsubResultSize(value, string(replacement), matches))
+			}
+		case *lua.LTable, *lua.LFunction:
+			instance.allocate(state, int64(len(value)))
+			state.Replace(3, state.NewFunction(func(state *lua.LState) int {
+				var result lua.LValue
+				if table, ok := replacement.(*lua.LTable); ok {
+					result = state.GetTable(table, state.Get(1))
+				} else {
+					arguments := state.GetTop()
+					state.Push(replacement)
+					for i := 1; i <= arguments; i++ {
+						state.Push(state.Get(i))
+					}
+					state.Call(arguments, 1)
+					result = state.Get(-1)
+				}
+				if !lua.LVIsFalse(result) {
+					instance.allocate(state, int64(len(lua.LVAsString(result))))
+				}
+				state.Push(result)
+				return 1
+			}))
+		}
+		return function(state)
+	}
+}
+
+// gsubResultSize returns the maximum size of the result of string.gsub with the given matches
+// and a replacement which could refer to the captures with %0 to %9.
+func gsubResultSize(value string, replacement string, matches []*pm.MatchData) int64 {
+	result := int64(len(value))
+	for _, match := range matches {
+		result -= int64(match.Capture(1) - match.Capture(0))
+		for i := 0; i < len(replacement); i++ {
+			if replacement[i] != '%' || i+1 >= len(replacement) {
+				result++
+				continue
+			}
+			i++
+			if replacement[i] < '0' || replacement[i] > '9' {
+				result += 2
+				continue
+			}
+			capture := 2 * int(replacement[i]-'0')
+			if capture == 2 && match.CaptureLength() == 2 {
+				capture = 0
+			}
+			if capture >= match.CaptureLength() {
+				continue
+			}
+			if match.IsPosCapture(capture) {
+				result += 20
+			} else {
+				result += int64(match.Capture(capture+1) - match.Capture(capture))
+			}
+		}
+	}
+	return result
+}
+
+// tableConcat counts the result of table.concat before it is created.
+func (instance *scriptMemory) tableConcat(function lua.LGFunction) lua.LGFunction {
+	return func(state *lua.LState) int {
+		table := state.CheckTable(1)
+		separator := state.OptString(2, "")
+		last := state.OptInt(4, table.Len())
+		if last > table.Len() {
+			last = table.Len()
+		}
+		size := int64(0)
+		for i := state.OptInt(3, 1); i <= last && size <= instance.limit; i++ {
+			value := table.RawGetInt(i)
+			if !lua.LVCanConvToString(value) {
+				// Raised by the original function.
+				break
+			}
+			size += int64(len(lua.LVAsString(value)) + len(separator))
+		}
+		instance.allocate(state, size)
+		return function(state)
+	}
+}
+
+func (instance *scriptMemory) tableInsert(function lua.LGFunction) lua.LGFunction {
+	return func(state *lua.LState) int {
+		instance.allocate(state, luaSlotSize)
+		return function(state)
+	}
+}
@@ -0,0 +1,144 @@
+package filter
+
+import (
+	"bytes"
+	. "gopkg.in/check.v1"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type scriptTest struct{}
+
+func init() {
+	Suite(&scriptTest{})
+}
+
+func (s *scriptTest) newRule(c *C, source string) *rule {
+	proto, err := compileScriptSource("test.lua", []byte(source))
+	c.Assert(err, IsNil)
+	return &rule{script: &ruleScript{name: "test.lua", proto: proto, maximumMemory: 1024}}
+}
+
+func (s *scriptTest) execute(c *C, r *rule, header http.Header, input string) (string, int, error) {
+	execution := &ruleExecution{
+		request: &http.Request{
+			Method: "GET",
+			Host:   "example.org",
+			URL:    &url.URL{Path: "/a"},
+			Header: http.Header{"X-Tenant": []string{"acme"}, "X-Plan": []string{"gold"}},
+		},
+		responseHeader: &header,
+	}
+	result, replacements, err := r.execute(execution, []byte(input), new(bytes.Buffer))
+	return string(result), replacements, err
+}
+
+func (s *scriptTest) Test_run(c *C) {
+	r := s.newRule(c, `
+		if request_header("X-Tenant") == "acme" and request_header("X-Plan") == "gold" then
+			set_response_header("X-Checksum", checksum("sha256", body))
+			return (body:gsub("</body>", "<p>" .. request.host .. request.path .. " " .. placeholder("response_header_Server") .. "</p></body>"))
+		end
+	`)
+	header := http.Header{"Server": []string{"Caddy"}}
+	result, replacements, err := s.execute(c, r, header, "<body></body>")
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, "<body><p>example.org/a Caddy</p></body>")
+	c.Assert(replacements, Equals, 1)
+	c.Assert(header.Get("X-Checksum"), Equals, "0c62c11e910d7c0d6b6c9800b70e78bfd9220e1f78bd7bb34ae4c3646d05f6e5")
+}
+
+func (s *scriptTest) Test_run_unchanged(c *C) {
+	for _, source := range []string{"return nil", "return body", "local x = 1", "return 42", "error('boom')"} {
+		result, replacements, err := s.execute(c, s.newRule(c, source), http.Header{}, "foo")
+		c.Assert(err, IsNil)
+		c.Assert(result, Equals, "foo")
+		c.Assert(replacements, Equals, 0)
+	}
+}
+
+func (s *scriptTest) Test_run_sandbox(c *C) {
+	result, _, err := s.execute(c, s.newRule(c, `return tostring(io) .. tostring(os) .. tostring(dofile) .. tostring(require) .. tostring(load)`), http.Header{}, "foo")
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, "nilnilnilnilnil")
+}
+
+func (s *scriptTest) Test_run_limits(c *C) {
+	r := s.newRule(c, `return string.rep("x", 2048)`)
+	result, replacements, err := s.execute(c, r, http.Header{}, "foo")
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, "foo")
+	c.Assert(replacements, Equals, 0)
+
+	r = s.newRule(c, `return body .. body`)
+	result, _, err = s.execute(c, r, http.Header{}, string(make([]byte, 600)))
+	c.Assert(err, IsNil)
+	c.Assert(len(result), Equals, 600)
+
+	r = s.newRule(c, `while true do end`)
+	r.timeout = 10 * time.Millisecond
+	result, replacements, err = s.execute(c, r, http.Header{}, "foo")
+	c.Assert(err, Equals, errExecutionTimeout)
+	c.Assert(result, Equals, "foo")
+	c.Assert(replacements, Equals, 0)
+}
+
+func (s *scriptTest) Test_run_memoryLimit(c *C) {
+	for _, source := range []string{
+		`local s = body while true do s = s .. s end`,
+		`local t = {} for i = 1, 20 do t[i] = body end return table.concat(t)`,
+		`local t, i = {}, 0 while true do i = i + 1 t[i] = i end`,
+		`local t = {} while true do table.insert(t, {}) end`,
+		`return (body:gsub(".", body))`,
+		`return (body:gsub(".", function(c) return body end))`,
+		`return string.format("%99999999s", "x")`,
+		`pcall(function() local s = body while true do s = s .. s end end) return "survived"`,
+	} {
+		r := s.newRule(c, source)
+		r.script.maximumMemory = 64 * 1024
+		r.timeout = time.Minute
+		started := time.Now()
+		result, replacements, err := s.execute(c, r, http.Header{}, strings.Repeat("x", 4096))
+		c.Assert(err, IsNil, Commentf(source))
+		c.Assert(result, Equals, strings.Repeat("x", 4096), Commentf(source))
+		c.Assert(replacements, Equals, 0)
+		c.Assert(time.Since(started) < 10*time.Second, Equals, true, Commentf(source))
+	}
+}
+
+func (s *scriptTest) Test_run_memoryAccountingKeepsSemantics(c *C) {
+	r := s.newRule(c, `
+		local t, u = {}, setmetatable({}, {__concat = function(a, b) return "meta" end})
+		t.a, t["b"], t[1] = "1", 2 .. "", body .. "!"
+		local x, y = t.a .. t.b, u .. "x"
+		return x .. y .. t[1] .. #t .. table.concat({"a", "b"}, ",") .. (body:gsub("o", {o = "0"}))
+	`)
+	result, _, err := s.execute(c, r, http.Header{}, "foo")
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, "12metafoo!1a,bf00")
+}
+
+func (s *scriptTest) Test_run_shadowModeKeepsHeaders(c *C) {
+	r := s.newRule(c, `set_response_header("X-Foo", "bar") return "baz"`)
+	r.mode = ruleModeShadow
+	header := http.Header{}
+	result, replacements, err := s.execute(c, r, header, "foo")
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, "baz")
+	c.Assert(replacements, Equals, 1)
+	c.Assert(header.Get("X-Foo"), Equals, "")
+}
+
+func (s *scriptTest) Test_compileScript_isCached(c *C) {
+	handler := new(filterHandler)
+	first, err := handler.compileScript("a.lua", []byte("return body"))
+	c.Assert(err, IsNil)
+	second, err := handler.compileScript("a.lua", []byte("return body"))
+	c.Assert(err, IsNil)
+	c.Assert(second, Equals, first)
+
+	_, err = handler.compileScript("b.lua", []byte("return ("))
+	c.Assert(err, NotNil)
+}
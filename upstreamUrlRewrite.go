@@ -0,0 +1,210 @@
+package filter
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// upstreamUrlRewriteHeaders contains URLs which are rewritten like the body.
+var upstreamUrlRewriteHeaders = []string{"Location", "Content-Location", "Refresh", "Link"}
+
+// upstreamUrlRewrite rewrites absolute URLs of an upstream (from) into their public
+// counterpart (to). It finds the URLs in three notations: plain - also protocol relative
+// like in HTML attributes and CSS - escaped like in JS string literals and JSON (http:\/\/...)
+// and URL encoded like in query parameters (http%3A%2F%2F...).
+type upstreamUrlRewrite struct {
+	fromScheme string
+	fromHost   string
+	fromPath   string
+	// to could contain the same placeholders like replacements which are resolved per request.
+	to            string
+	searchPattern *regexp.Regexp
+}
+
+// The groups of upstreamUrlRewrite.searchPattern.
+const (
+	upstreamUrlPlainSchemeGroup   = 1
+	upstreamUrlPlainBoundaryGroup = 2
+	upstreamUrlEscapedGroup       = 3
+	upstreamUrlEncodedGroup       = 4
+)
+
+func newUpstreamUrlRewrite(from string, to string) (*upstreamUrlRewrite, error) {
+	fromScheme, fromHost, fromPath, err := parseUpstreamUrl(from)
+	if err != nil {
+		return nil, err
+	}
+	if fromHost == "" {
+		return nil, fmt.Errorf("'%v' is not an absolute URL", from)
+	}
+	if _, _, _, err := parseUpstreamUrl(paramReplacementPattern.ReplaceAllString(to, "placeholder")); err != nil {
+		return nil, err
+	}
+	result := &upstreamUrlRewrite{
+		fromScheme: fromScheme,
+		fromHost:   fromHost,
+		fromPath:   fromPath,
+		to:         to,
+	}
+	plain := fromHost + fromPath
+	escaped := fromScheme + ":" + strings.Replace("//"+plain, "/", "\\/", -1)
+	encoded := url.QueryEscape(fromScheme + "://" + plain)
+	result.searchPattern = regexp.MustCompile(
+		"(" + regexp.QuoteMeta(fromScheme) + ":)?//" + regexp.QuoteMeta(plain) + "([/?#\"'\\s)<>;,\\\\]|$)" +
+			"|" + regexp.QuoteMeta(escaped) + "(\\\\/|[?#\"'\\s;,]|$)" +
+			"|(?i:" + regexp.QuoteMeta(encoded) + ")(%2[fF]|%3[fF]|%23|[&\"'\\s#<>]|$)",
+	)
+	return result, nil
+}
+
+// parseUpstreamUrl splits the given URL into scheme, host and path without trailing slash.
+// The URL could also be only a path, then scheme and host are empty.
+func parseUpstreamUrl(plain string) (scheme string, host string, path string, err error) {
+	if strings.HasPrefix(plain, "/") || plain == "" {
+		return "", "", strings.TrimRight(plain, "/"), nil
+	}
+	i := strings.Index(plain, "://")
+	if i <= 0 {
+		return "", "", "", fmt.Errorf("'%v' is neither an absolute URL nor a path", plain)
+	}
+	scheme, host = plain[:i], plain[i+3:]
+	if j := strings.IndexAny(host, "/?#"); j >= 0 {
+		if host[j] != '/' {
+			return "", "", "", fmt.Errorf("'%v' should not contain a query or fragment", plain)
+		}
+		host, path = host[:j], strings.TrimRight(host[j:], "/")
+	}
+	if host == "" {
+		return "", "", "", fmt.Errorf("'%v' does not contain a host", plain)
+	}
+	return scheme, host, path, nil
+}
+
+// resolve returns the rewrite with all placeholders of the target resolved by the given
+// action or nil if the target is not valid for the current request.
+func (instance *upstreamUrlRewrite) resolve(action *ruleReplaceAction) *resolvedUpstreamUrlRewrite {
+	to := paramReplacementPattern.ReplaceAllStringFunc(instance.to, func(placeholder string) string {
+		if value, ok := action.placeholderValueBy(placeholder[1:len(placeholder)-1], nil); ok {
+			return string(value)
+		}
+		return placeholder
+	})
+	toScheme, toHost, toPath, err := parseUpstreamUrl(to)
+	if err != nil {
+		log.Printf("[WARN] Could not rewrite upstream URLs for '%v'. Got: %v", action.request.URL, err)
+		return nil
+	}
+	return &resolvedUpstreamUrlRewrite{
+		upstreamUrlRewrite: instance,
+		toScheme:           toScheme,
+		toHost:             toHost,
+		toPath:             toPath,
+	}
+}
+
+type resolvedUpstreamUrlRewrite struct {
+	*upstreamUrlRewrite
+	toScheme string
+	toHost   string
+	toPath   string
+}
+
+// writeReplacement writes the rewritten URL of the given match of searchPattern in the same
+// notation as found.
+func (instance *resolvedUpstreamUrlRewrite) writeReplacement(output *bytes.Buffer, input []byte, match []int) {
+	groupOf := func(group int) (string, bool) {
+		if match[2*group] < 0 {
+			return "", false
+		}
+		return string(input[match[2*group]:match[2*group+1]]), true
+	}
+	if boundary, ok := groupOf(upstreamUrlPlainBoundaryGroup); ok {
+		if _, absolute := groupOf(upstreamUrlPlainSchemeGroup); absolute || instance.toHost == "" {
+			output.WriteString(instance.target(boundary))
+		} else {
+			output.WriteString("//" + instance.toHost + instance.toPath)
+		}
+		output.WriteString(boundary)
+	} else if boundary, ok := groupOf(upstreamUrlEscapedGroup); ok {
+		output.WriteString(strings.Replace(instance.target(strings.Replace(boundary, "\\/", "/", 1)), "/", "\\/", -1))
+		output.WriteString(boundary)
+	} else if boundary, ok := groupOf(upstreamUrlEncodedGroup); ok {
+		decodedBoundary, _ := url.QueryUnescape(boundary)
+		output.WriteString(url.QueryEscape(instance.target(decodedBoundary)))
+		output.WriteString(boundary)
+	}
+}
+
+// target returns the URL to replace the upstream URL with if it is followed by the given boundary.
+func (instance *resolvedUpstreamUrlRewrite) target(boundary string) string {
+	if instance.toHost != "" {
+		return instance.toScheme + "://" + instance.toHost + instance.toPath
+	}
+	if instance.toPath == "" && !strings.HasPrefix(boundary, "/") {
+		return "/"
+	}
+	return instance.toPath
+}
+
+// rewriteHeader rewrites the URLs of the relevant headers and domain and path of cookies.
+func (instance *resolvedUpstreamUrlRewrite) rewriteHeader(header http.Header) {
+	for _, name := range upstreamUrlRewriteHeaders {
+		for i, value := range header[name] {
+			header[name][i] = replaceAllString(instance.searchPattern, value, instance.writeReplacement)
+		}
+	}
+	for i, value := range header["Set-Cookie"] {
+		header["Set-Cookie"][i] = instance.rewriteCookie(value)
+	}
+}
+
+func (instance *resolvedUpstreamUrlRewrite) rewriteCookie(value string) string {
+	parts := strings.Split(value, ";")
+	result := parts[:1]
+	for _, part := range parts[1:] {
+		attribute := cookieAttributeValueOf(part)
+		switch strings.ToLower(cookieAttributeNameOf(part)) {
+		case "domain":
+			if strings.EqualFold(strings.TrimPrefix(attribute, "."), hostnameOf(instance.fromHost)) {
+				if instance.toHost == "" {
+					// The cookie becomes a host-only cookie of the public host.
+					continue
+				}
+				part = " Domain=" + hostnameOf(instance.toHost)
+			}
+		case "path":
+			if path, ok := instance.rewritePath(attribute); ok {
+				part = " Path=" + path
+			}
+		}
+		result = append(result, part)
+	}
+	return strings.Join(result, ";")
+}
+
+func (instance *resolvedUpstreamUrlRewrite) rewritePath(path string) (string, bool) {
+	if instance.fromPath == instance.toPath {
+		return path, false
+	}
+	if path != instance.fromPath && !strings.HasPrefix(path, instance.fromPath+"/") {
+		return path, false
+	}
+	result := instance.toPath + path[len(instance.fromPath):]
+	if result == "" {
+		return "/", true
+	}
+	return result, true
+}
+
+func hostnameOf(host string) string {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		return hostname
+	}
+	return host
+}
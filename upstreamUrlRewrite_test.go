@@ -0,0 +1,160 @@
+package filter
+
+import (
+	"bytes"
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	. "gopkg.in/check.v1"
+	"net/http"
+	"regexp"
+)
+
+type upstreamUrlRewriteTest struct{}
+
+func init() {
+	Suite(&upstreamUrlRewriteTest{})
+}
+
+func (s *upstreamUrlRewriteTest) rewrite(c *C, from string, to string, input string) string {
+	r := &rule{
+		upstreamUrls: s.newRewrite(c, from, to),
+	}
+	r.searchPattern = r.upstreamUrls.searchPattern
+	header := http.Header{"X-Public-Host": {"example.org"}}
+	result, _, err := r.execute(&ruleExecution{request: &http.Request{URL: testUrl1}, responseHeader: &header}, []byte(input), new(bytes.Buffer))
+	c.Assert(err, IsNil)
+	return string(result)
+}
+
+func (s *upstreamUrlRewriteTest) newRewrite(c *C, from string, to string) *upstreamUrlRewrite {
+	result, err := newUpstreamUrlRewrite(from, to)
+	c.Assert(err, IsNil)
+	return result
+}
+
+func (s *upstreamUrlRewriteTest) Test_execute_html(c *C) {
+	c.Assert(s.rewrite(c, "http://backend:8080/app", "https://example.org/public",
+		`<a href="http://backend:8080/app/foo?bar#baz">a</a><a href='http://backend:8080/app'>b</a><img src="//backend:8080/app/logo.png"><a href="http://backend:8080/application">c</a><a href="http://backend:80801/app">d</a>`),
+		Equals,
+		`<a href="https://example.org/public/foo?bar#baz">a</a><a href='https://example.org/public'>b</a><img src="//example.org/public/logo.png"><a href="http://backend:8080/application">c</a><a href="http://backend:80801/app">d</a>`)
+}
+
+func (s *upstreamUrlRewriteTest) Test_execute_css(c *C) {
+	c.Assert(s.rewrite(c, "http://backend:8080", "https://example.org/",
+		`body { background: url(http://backend:8080/bg.png); } @import url(//backend:8080);`),
+		Equals,
+		`body { background: url(https://example.org/bg.png); } @import url(//example.org);`)
+}
+
+func (s *upstreamUrlRewriteTest) Test_execute_jsAndEncoded(c *C) {
+	c.Assert(s.rewrite(c, "http://backend:8080/app", "https://example.org",
+		`{"url":"http:\/\/backend:8080\/app\/foo","plain":"http://backend:8080/app","next":"/login?next=http%3A%2F%2Fbackend%3A8080%2Fapp%2Ffoo&x=1"}`),
+		Equals,
+		`{"url":"https:\/\/example.org\/foo","plain":"https://example.org","next":"/login?next=https%3A%2F%2Fexample.org%2Ffoo&x=1"}`)
+}
+
+func (s *upstreamUrlRewriteTest) Test_execute_toPath(c *C) {
+	c.Assert(s.rewrite(c, "http://backend:8080", "",
+		`<a href="http://backend:8080">a</a><a href="http://backend:8080/foo">b</a><a href="//backend:8080/foo">c</a>`),
+		Equals,
+		`<a href="/">a</a><a href="/foo">b</a><a href="/foo">c</a>`)
+	c.Assert(s.rewrite(c, "http://backend:8080", "/public/",
+		`<a href="http://backend:8080">a</a><a href="http://backend:8080/foo">b</a>`),
+		Equals,
+		`<a href="/public">a</a><a href="/public/foo">b</a>`)
+}
+
+func (s *upstreamUrlRewriteTest) Test_execute_withPlaceholders(c *C) {
+	c.Assert(s.rewrite(c, "http://backend:8080", "https://{response_header_X-Public-Host}",
+		`<a href="http://backend:8080/foo">a</a>`),
+		Equals,
+		`<a href="https://example.org/foo">a</a>`)
+	c.Assert(s.rewrite(c, "http://backend:8080", "https://{request_header_X-Forwarded-Host|response_header_X-Public-Host}",
+		`<a href="http://backend:8080/foo">a</a>`),
+		Equals,
+		`<a href="https://example.org/foo">a</a>`)
+}
+
+func (s *upstreamUrlRewriteTest) Test_rewriteHeader(c *C) {
+	r := &rule{
+		path:         regexp.MustCompile(".*\\.html"),
+		upstreamUrls: s.newRewrite(c, "http://backend:8080/app", "https://example.org/public"),
+	}
+	header := http.Header{
+		"Location":         {"http://backend:8080/app/login"},
+		"Content-Location": {"http://other/app"},
+		"Refresh":          {"5; url=http://backend:8080/app/"},
+		"Link":             {"<http://backend:8080/app/style.css>; rel=preload"},
+		"Set-Cookie": {
+			"a=1; Domain=backend; Path=/app/foo; HttpOnly",
+			"b=2; path=/other",
+			"c=3; Domain=.Backend; Path=/app",
+		},
+	}
+	r.rewriteHeader(&http.Request{URL: testUrl1}, header, nil)
+	c.Assert(header, DeepEquals, http.Header{
+		"Location":         {"https://example.org/public/login"},
+		"Content-Location": {"http://other/app"},
+		"Refresh":          {"5; url=https://example.org/public/"},
+		"Link":             {"<https://example.org/public/style.css>; rel=preload"},
+		"Set-Cookie": {
+			"a=1; Domain=example.org; Path=/public/foo; HttpOnly",
+			"b=2; path=/other",
+			"c=3; Domain=example.org; Path=/public",
+		},
+	})
+
+	header = http.Header{"Location": {"http://backend:8080/app/login"}}
+	r.rewriteHeader(&http.Request{URL: testUrl2}, header, nil)
+	c.Assert(header.Get("Location"), Equals, "http://backend:8080/app/login")
+
+	r.mode = ruleModeShadow
+	r.rewriteHeader(&http.Request{URL: testUrl1}, header, nil)
+	c.Assert(header.Get("Location"), Equals, "http://backend:8080/app/login")
+}
+
+func (s *upstreamUrlRewriteTest) Test_rewriteHeader_toPath(c *C) {
+	r := &rule{
+		upstreamUrls: s.newRewrite(c, "http://backend:8080/app", "/"),
+	}
+	header := http.Header{
+		"Location":   {"http://backend:8080/app"},
+		"Set-Cookie": {"a=1; Domain=backend; Path=/app"},
+	}
+	r.rewriteHeader(&http.Request{URL: testUrl1}, header, nil)
+	c.Assert(header.Get("Location"), Equals, "/")
+	c.Assert(header.Get("Set-Cookie"), Equals, "a=1; Path=/")
+}
+
+func (s *upstreamUrlRewriteTest) Test_ServeHTTP_withRedirect(c *C) {
+	r := &rule{
+		path:         regexp.MustCompile(".*"),
+		contentType:  regexp.MustCompile("text/html.*"),
+		upstreamUrls: s.newRewrite(c, "http://backend:8080", "https://example.org"),
+	}
+	r.searchPattern = r.upstreamUrls.searchPattern
+	handler := &filterHandler{
+		next: httpserver.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) (int, error) {
+			writer.Header().Set("Location", "http://backend:8080/login")
+			writer.WriteHeader(http.StatusFound)
+			return http.StatusFound, nil
+		}),
+		rules:             []*rule{r},
+		maximumBufferSize: defaultMaxBufferSize,
+	}
+	writer := newMockResponseWriter()
+	_, err := handler.ServeHTTP(writer, &http.Request{URL: testUrl1})
+	c.Assert(err, IsNil)
+	c.Assert(writer.status, Equals, http.StatusFound)
+	c.Assert(writer.Header().Get("Location"), Equals, "https://example.org/login")
+}
+
+func (s *upstreamUrlRewriteTest) Test_newUpstreamUrlRewrite(c *C) {
+	_, err := newUpstreamUrlRewrite("/app", "https://example.org")
+	c.Assert(err, ErrorMatches, "'/app' is not an absolute URL")
+	_, err = newUpstreamUrlRewrite("backend:8080", "https://example.org")
+	c.Assert(err, ErrorMatches, "'backend:8080' is neither an absolute URL nor a path")
+	_, err = newUpstreamUrlRewrite("http://backend:8080?foo", "https://example.org")
+	c.Assert(err, ErrorMatches, "'http://backend:8080\\?foo' should not contain a query or fragment")
+	_, err = newUpstreamUrlRewrite("http://backend:8080", "https:///foo")
+	c.Assert(err, ErrorMatches, "'https:///foo' does not contain a host")
+}
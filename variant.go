@@ -0,0 +1,230 @@
+package filter
+
+import (
+	"context"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+const (
+	defaultVariantCookiePrefix = "filter_variant_"
+	defaultVariantCookieMaxAge = 30 * 24 * time.Hour
+	variantPlaceholder         = "variant"
+)
+
+// variantsCtxKey holds the variants assigned to the request by assignVariants.
+const variantsCtxKey = caddy.CtxKey("filter_variants")
+
+var variantCookieNamePattern = regexp.MustCompile("^[a-zA-Z0-9!#$%&'*+\\-.^_`|~]+$")
+
+type variantKey string
+
+const (
+	// variantKeyRandom assigns new clients randomly by the weights of the variants.
+	variantKeyRandom = variantKey("random")
+	// variantKeyHeader assigns new clients by the hash of a request header.
+	variantKeyHeader = variantKey("header")
+	// variantKeyRemoteAddress assigns new clients by the hash of their remote address.
+	variantKeyRemoteAddress = variantKey("remote_address")
+)
+
+var possibleVariantKeys = []variantKey{
+	variantKeyRandom,
+	variantKeyHeader,
+	variantKeyRemoteAddress,
+}
+
+type ruleVariant struct {
+	name   string
+	weight int
+	// replacement overwrites the replacement of the rule if not nil.
+	replacement []byte
+}
+
+// ruleVariants assigns every client sticky to one of the variants of a rule. An assignment
+// is remembered by a cookie; clients without this cookie are assigned by the key.
+type ruleVariants struct {
+	variants     []*ruleVariant
+	key          variantKey
+	keyHeader    string
+	cookieName   string
+	cookieMaxAge time.Duration
+	random       func(n int) int
+	// placeholder is the name of the Caddy placeholder of the assigned variant.
+	placeholder string
+}
+
+func newRuleVariants() *ruleVariants {
+	return &ruleVariants{
+		key:          variantKeyRandom,
+		cookieMaxAge: defaultVariantCookieMaxAge,
+		random:       rand.Intn,
+	}
+}
+
+func (instance *ruleVariants) variantNamed(name string) *ruleVariant {
+	for _, candidate := range instance.variants {
+		if candidate.name == name {
+			return candidate
+		}
+	}
+	return nil
+}
+
+func (instance *ruleVariants) totalWeight() int {
+	result := 0
+	for _, candidate := range instance.variants {
+		result += candidate.weight
+	}
+	return result
+}
+
+// variantFor returns the variant of the given request and if it was assigned by this call.
+func (instance *ruleVariants) variantFor(request *http.Request) (*ruleVariant, bool) {
+	if cookie, err := request.Cookie(instance.cookieName); err == nil {
+		if result := instance.variantNamed(cookie.Value); result != nil && result.weight > 0 {
+			return result, false
+		}
+	}
+	total := instance.totalWeight()
+	var n int
+	if value := instance.keyValueOf(request); value != "" {
+		hash := fnv.New32a()
+		hash.Write([]byte(instance.cookieName))
+		hash.Write([]byte{0})
+		hash.Write([]byte(value))
+		n = int(hash.Sum32() % uint32(total))
+	} else {
+		n = instance.random(total)
+	}
+	for _, candidate := range instance.variants {
+		if n < candidate.weight {
+			return candidate, true
+		}
+		n -= candidate.weight
+	}
+	return instance.variants[len(instance.variants)-1], true
+}
+
+// keyValueOf returns the value to hash for an assignment or an empty string for a random assignment.
+func (instance *ruleVariants) keyValueOf(request *http.Request) string {
+	switch instance.key {
+	case variantKeyHeader:
+		return request.Header.Get(instance.keyHeader)
+	case variantKeyRemoteAddress:
+		if host, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+			return host
+		}
+		return request.RemoteAddr
+	}
+	return ""
+}
+
+func (instance *ruleVariants) cookieFor(variant *ruleVariant) *http.Cookie {
+	return &http.Cookie{
+		Name:     instance.cookieName,
+		Value:    variant.name,
+		Path:     "/",
+		MaxAge:   int(instance.cookieMaxAge / time.Second),
+		HttpOnly: true,
+	}
+}
+
+// exposeVariants makes the given variants available as {variant_<name of rule>} placeholders - and
+// if the filter has only one rule with variants also as {variant} placeholder - for the following
+// handlers of Caddy like the upstream headers of proxy or the access log.
+func exposeVariants(request *http.Request, assignments map[*ruleVariants]*ruleVariant, numberOfVariants int) {
+	replacer, ok := request.Context().Value(httpserver.ReplacerCtxKey).(httpserver.Replacer)
+	if !ok {
+		return
+	}
+	for variants, variant := range assignments {
+		replacer.Set(variants.placeholder, variant.name)
+		if numberOfVariants == 1 {
+			replacer.Set(variantPlaceholder, variant.name)
+		}
+	}
+}
+
+// variantAssignment is a new assignment of a client to the variant of a rule.
+type variantAssignment struct {
+	rule    *rule
+	variant *ruleVariant
+}
+
+// assignVariants assigns the request to a variant of every active rule which could match it -
+// the content type is not known yet - before it is handled by the following handlers. The
+// assignments are stored in the context of the returned request and exposed as placeholders.
+// Sub-requests of 'include_virtual' keep the assignments of their parent.
+// The returned function adds the cookies of new assignments to the given response header - only
+// for rules which match the response, so other responses like images, redirects or responses
+// without body never carry them. It is nil if there are no new assignments.
+func assignVariants(rules []*rule, request *http.Request) (*http.Request, func(status int, header http.Header)) {
+	parent, _ := request.Context().Value(variantsCtxKey).(map[*ruleVariants]*ruleVariant)
+	var assignments map[*ruleVariants]*ruleVariant
+	var assigned []variantAssignment
+	numberOfVariants := 0
+	for _, rule := range rules {
+		if rule.variants == nil || rule.mode == ruleModeShadow {
+			continue
+		}
+		numberOfVariants++
+		if !rule.mayMatch(request) {
+			continue
+		}
+		if _, ok := parent[rule.variants]; ok {
+			continue
+		}
+		if _, ok := assignments[rule.variants]; ok {
+			continue
+		}
+		variant, isNew := rule.variants.variantFor(request)
+		if isNew {
+			assigned = append(assigned, variantAssignment{rule: rule, variant: variant})
+		}
+		if assignments == nil {
+			assignments = map[*ruleVariants]*ruleVariant{}
+			for variants, variant := range parent {
+				assignments[variants] = variant
+			}
+		}
+		assignments[rule.variants] = variant
+	}
+	if assignments == nil {
+		return request, nil
+	}
+	exposeVariants(request, assignments, numberOfVariants)
+	request = request.WithContext(context.WithValue(request.Context(), variantsCtxKey, assignments))
+	if len(assigned) <= 0 {
+		return request, nil
+	}
+	return request, func(status int, header http.Header) {
+		if !bodyAllowedForStatus(status) || (status >= 300 && status <= 399) {
+			return
+		}
+		for _, assignment := range assigned {
+			if assignment.rule.matches(request, &header) {
+				header.Add("Set-Cookie", assignment.rule.variants.cookieFor(assignment.variant).String())
+			}
+		}
+	}
+}
+
+// assignedVariantOf returns the variant the request was assigned to by assignVariants or - for
+// rules in shadow mode - a new assignment which is never delivered.
+func (instance *ruleVariants) assignedVariantOf(request *http.Request) *ruleVariant {
+	if assignments, ok := request.Context().Value(variantsCtxKey).(map[*ruleVariants]*ruleVariant); ok {
+		if result, ok := assignments[instance]; ok {
+			return result
+		}
+	}
+	result, _ := instance.variantFor(request)
+	return result
+}
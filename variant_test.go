@@ -0,0 +1,141 @@
+package filter
+
+import (
+	"context"
+	"fmt"
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	. "gopkg.in/check.v1"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+type variantTest struct{}
+
+func init() {
+	Suite(&variantTest{})
+}
+
+func (s *variantTest) newVariants() *ruleVariants {
+	result := newRuleVariants()
+	result.cookieName = "ab"
+	result.placeholder = "variant_ab"
+	result.variants = []*ruleVariant{
+		{name: "a", weight: 10},
+		{name: "b", weight: 90},
+	}
+	return result
+}
+
+func (s *variantTest) Test_variantFor_byRandom(c *C) {
+	variants := s.newVariants()
+	var requested int
+	variants.random = func(n int) int {
+		requested = n
+		return 9
+	}
+	variant, assigned := variants.variantFor(&http.Request{Header: http.Header{}})
+	c.Assert(variant.name, Equals, "a")
+	c.Assert(assigned, Equals, true)
+	c.Assert(requested, Equals, 100)
+
+	variants.random = func(int) int { return 10 }
+	variant, assigned = variants.variantFor(&http.Request{Header: http.Header{}})
+	c.Assert(variant.name, Equals, "b")
+	c.Assert(assigned, Equals, true)
+}
+
+func (s *variantTest) Test_variantFor_byCookie(c *C) {
+	variants := s.newVariants()
+	variants.random = func(int) int { return 0 }
+	variant, assigned := variants.variantFor(&http.Request{Header: http.Header{"Cookie": {"ab=b"}}})
+	c.Assert(variant.name, Equals, "b")
+	c.Assert(assigned, Equals, false)
+
+	variant, assigned = variants.variantFor(&http.Request{Header: http.Header{"Cookie": {"ab=unknown"}}})
+	c.Assert(variant.name, Equals, "a")
+	c.Assert(assigned, Equals, true)
+
+	variants.variants[1].weight = 0
+	variant, assigned = variants.variantFor(&http.Request{Header: http.Header{"Cookie": {"ab=b"}}})
+	c.Assert(variant.name, Equals, "a")
+	c.Assert(assigned, Equals, true)
+}
+
+func (s *variantTest) Test_variantFor_byHash(c *C) {
+	variants := s.newVariants()
+	variants.random = func(int) int {
+		c.Fatal("random should not be used")
+		return 0
+	}
+	variants.key = variantKeyRemoteAddress
+	counts := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		first, _ := variants.variantFor(&http.Request{Header: http.Header{}, RemoteAddr: fmt.Sprintf("10.0.%d.%d:1234", i/256, i%256)})
+		second, _ := variants.variantFor(&http.Request{Header: http.Header{}, RemoteAddr: fmt.Sprintf("10.0.%d.%d:5678", i/256, i%256)})
+		c.Assert(first, Equals, second)
+		counts[first.name]++
+	}
+	c.Assert(counts["a"] > 50 && counts["a"] < 150, Equals, true, Commentf("Got: %v", counts))
+
+	variants.key = variantKeyHeader
+	variants.keyHeader = "X-User"
+	first, _ := variants.variantFor(&http.Request{Header: http.Header{"X-User": {"4711"}}})
+	second, _ := variants.variantFor(&http.Request{Header: http.Header{"X-User": {"4711"}}})
+	c.Assert(first, Equals, second)
+}
+
+func (s *variantTest) Test_cookieFor(c *C) {
+	variants := s.newVariants()
+	variants.cookieMaxAge = 2 * time.Hour
+	c.Assert(variants.cookieFor(variants.variants[1]).String(), Equals, "ab=b; Path=/; Max-Age=7200; HttpOnly")
+}
+
+func (s *variantTest) Test_exposeVariants(c *C) {
+	variants := s.newVariants()
+	request := &http.Request{URL: testUrl1, Header: http.Header{}}
+	replacer := httpserver.NewReplacer(request, nil, "")
+	request = request.WithContext(context.WithValue(request.Context(), httpserver.ReplacerCtxKey, replacer))
+	exposeVariants(request, map[*ruleVariants]*ruleVariant{variants: variants.variants[1]}, 1)
+	c.Assert(httpserver.NewReplacer(request, nil, "").Replace("{variant} {variant_ab}"), Equals, "b b")
+
+	request = &http.Request{URL: testUrl1, Header: http.Header{}}
+	request = request.WithContext(context.WithValue(request.Context(), httpserver.ReplacerCtxKey, httpserver.NewReplacer(request, nil, "")))
+	exposeVariants(request, map[*ruleVariants]*ruleVariant{variants: variants.variants[1]}, 2)
+	c.Assert(httpserver.NewReplacer(request, nil, "").Replace("{variant} {variant_ab}"), Equals, " b")
+
+	exposeVariants(&http.Request{}, map[*ruleVariants]*ruleVariant{variants: variants.variants[1]}, 1)
+}
+
+func (s *variantTest) Test_assignVariants(c *C) {
+	variants := s.newVariants()
+	variants.random = func(int) int { return 10 }
+	rules := []*rule{{path: regexp.MustCompile("\\.html$"), contentType: regexp.MustCompile("^text/html"), variants: variants}}
+
+	request, cookies := assignVariants(rules, &http.Request{URL: testUrl1, Header: http.Header{}})
+	c.Assert(variants.assignedVariantOf(request).name, Equals, "b")
+	header := http.Header{"Content-Type": {"text/html"}}
+	cookies(200, header)
+	c.Assert(header["Set-Cookie"], DeepEquals, []string{"ab=b; Path=/; Max-Age=2592000; HttpOnly"})
+
+	// Only responses the rule matches get the cookie.
+	header = http.Header{"Content-Type": {"image/png"}}
+	cookies(200, header)
+	c.Assert(header["Set-Cookie"], IsNil)
+	header = http.Header{"Content-Type": {"text/html"}}
+	cookies(302, header)
+	cookies(304, header)
+	cookies(204, header)
+	c.Assert(header["Set-Cookie"], IsNil)
+
+	// Sub-requests keep the assignment of their parent.
+	variants.random = func(int) int { return 0 }
+	request, cookies = assignVariants(rules, request)
+	c.Assert(variants.assignedVariantOf(request).name, Equals, "b")
+	c.Assert(cookies, IsNil)
+
+	// Rules which could not match are not assigned.
+	request, cookies = assignVariants(rules, &http.Request{URL: testUrl2, Header: http.Header{}})
+	c.Assert(request.Context().Value(variantsCtxKey), IsNil)
+	c.Assert(cookies, IsNil)
+}
@@ -0,0 +1,425 @@
+package filter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"runtime"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-interpreter/wagon/disasm"
+	"github.com/go-interpreter/wagon/exec"
+	"github.com/go-interpreter/wagon/validate"
+	"github.com/go-interpreter/wagon/wasm"
+	"github.com/go-interpreter/wagon/wasm/operators"
+)
+
+const (
+	defaultWasmFunction      = "filter"
+	defaultWasmTimeout       = time.Second
+	defaultWasmMaximumMemory = 16 * 1024 * 1024
+	// maximumWasmBodySize limits the body a module could write.
+	maximumWasmBodySize = 64 * 1024 * 1024
+	// wasmImportModule is the name of the module which provides the functions of the filter.
+	wasmImportModule = "filter"
+	wasmPageSize     = 64 * 1024
+)
+
+var defaultWasmWorkers = runtime.NumCPU()
+
+// ruleWasm transforms the body with a function of a WebAssembly module. The module imports the
+// functions of the filter from the module "filter":
+//
+//	body_size() -> i32
+//	body_read(pointer, length, offset i32) -> i32
+//	body_write(pointer, length i32)
+//	request_header(namePointer, nameLength, valuePointer, valueCapacity i32) -> i32
+//	response_header(namePointer, nameLength, valuePointer, valueCapacity i32) -> i32
+//	placeholder(namePointer, nameLength, valuePointer, valueCapacity i32) -> i32
+//	set_response_header(namePointer, nameLength, valuePointer, valueLength i32)
+//	log(pointer, length i32)
+//
+// The exported function takes no arguments and returns 0 on success. The body is replaced with
+// everything written by body_write - or stays unchanged if body_write was not called. Functions
+// returning values copy them only if they fit into the capacity and return their length or -1 if
+// they do not exist. A negative valueLength of set_response_header removes the header.
+type ruleWasm struct {
+	// name of the module used in error messages; the file name.
+	name          string
+	source        []byte
+	function      string
+	workers       int
+	maximumMemory int64
+
+	// pool contains one entry per worker which is nil if the worker is not instantiated yet.
+	pool chan *wasmWorker
+}
+
+// load instantiates the first worker to verify the module and prepares the pool of the workers.
+func (instance *ruleWasm) load() error {
+	worker, err := instance.newWorker()
+	if err != nil {
+		return err
+	}
+	instance.pool = make(chan *wasmWorker, instance.workers)
+	instance.pool <- worker
+	for i := 1; i < instance.workers; i++ {
+		instance.pool <- nil
+	}
+	return nil
+}
+
+// run executes the function of the module on the given body until the given deadline. Workers
+// which fail are discarded and instantiated again on their next use.
+func (instance *ruleWasm) run(action *ruleReplaceAction, deadline time.Time, body []byte) ([]byte, error) {
+	if deadline.IsZero() {
+		deadline = time.Now().Add(defaultWasmTimeout)
+	}
+	var worker *wasmWorker
+	timer := time.NewTimer(time.Until(deadline))
+	select {
+	case worker = <-instance.pool:
+		timer.Stop()
+	case <-timer.C:
+		return nil, errExecutionTimeout
+	}
+	if worker == nil {
+		var err error
+		if worker, err = instance.newWorker(); err != nil {
+			instance.pool <- nil
+			return nil, err
+		}
+	}
+	result, err := worker.execute(action, deadline, body)
+	if err != nil || !worker.reset() {
+		worker = nil
+	}
+	instance.pool <- worker
+	return result, err
+}
+
+func (instance *ruleWasm) newWorker() (*wasmWorker, error) {
+	worker := &wasmWorker{rule: instance}
+	module, err := wasm.ReadModule(bytes.NewReader(instance.source), worker.resolve)
+	if err != nil {
+		return nil, err
+	}
+	if err := validate.VerifyModule(module); err != nil {
+		return nil, err
+	}
+	if module.Start != nil {
+		return nil, errors.New("modules with a start function are not supported")
+	}
+	if module.Memory != nil && len(module.Memory.Entries) > 0 {
+		limits := &module.Memory.Entries[0].Limits
+		maximumPages := uint32(instance.maximumMemory / wasmPageSize)
+		if limits.Initial > maximumPages {
+			return nil, fmt.Errorf("initial memory exceeds the limit of %d bytes", instance.maximumMemory)
+		}
+		if limits.Flags&1 == 0 || limits.Maximum > maximumPages {
+			limits.Flags, limits.Maximum = limits.Flags|1, maximumPages
+		}
+		if err := limitMemoryGrowth(module, limits.Maximum); err != nil {
+			return nil, err
+		}
+	}
+	var export wasm.ExportEntry
+	if module.Export != nil {
+		export = module.Export.Entries[instance.function]
+	}
+	function := module.GetFunction(int(export.Index))
+	if export.FieldStr != instance.function || export.Kind != wasm.ExternalFunction || function == nil {
+		return nil, fmt.Errorf("there is no exported function '%v'", instance.function)
+	}
+	if len(function.Sig.ParamTypes) != 0 || len(function.Sig.ReturnTypes) != 1 || function.Sig.ReturnTypes[0] != wasm.ValueTypeI32 {
+		return nil, fmt.Errorf("function '%v' has to take no arguments and return an i32", instance.function)
+	}
+	if worker.vm, err = exec.NewVM(module); err != nil {
+		return nil, err
+	}
+	worker.vm.RecoverPanic = true
+	worker.function = int64(export.Index)
+	worker.initialMemory = append([]byte(nil), worker.vm.Memory()...)
+	return worker, nil
+}
+
+// limitMemoryGrowth replaces every grow_memory of the functions of the given module by
+// instructions which return -1 - like grow_memory does if it fails - instead of growing the
+// memory beyond the given number of pages. The interpreter ignores the maximum declared by the
+// module. The requested number of pages is kept in a new local of the function:
+//
+//	tee_local $n
+//	i32.const <maximumPages>
+//	i32.gt_u
+//	get_local $n
+//	current_memory
+//	i32.add
+//	i32.const <maximumPages>
+//	i32.gt_u
+//	i32.or
+//	if (result i32)
+//	  i32.const -1
+//	else
+//	  get_local $n
+//	  grow_memory
+//	end
+func limitMemoryGrowth(module *wasm.Module, maximumPages uint32) error {
+	for _, function := range module.FunctionIndexSpace {
+		if function.Host.IsValid() || function.Body == nil {
+			continue
+		}
+		instructions, err := disasm.Disassemble(function.Body.Code)
+		if err != nil {
+			return err
+		}
+		local := uint32(len(function.Sig.ParamTypes))
+		for _, entry := range function.Body.Locals {
+			local += entry.Count
+		}
+		var result []disasm.Instr
+		for _, instruction := range instructions {
+			if instruction.Op.Code != operators.GrowMemory {
+				result = append(result, instruction)
+				continue
+			}
+			result = append(result,
+				wasmInstructionOf(operators.TeeLocal, local),
+				wasmInstructionOf(operators.I32Const, int32(maximumPages)),
+				wasmInstructionOf(operators.I32GtU),
+				wasmInstructionOf(operators.GetLocal, local),
+				wasmInstructionOf(operators.CurrentMemory, uint8(0)),
+				wasmInstructionOf(operators.I32Add),
+				wasmInstructionOf(operators.I32Const, int32(maximumPages)),
+				wasmInstructionOf(operators.I32GtU),
+				wasmInstructionOf(operators.I32Or),
+				wasmInstructionOf(operators.If, wasm.BlockType(wasm.ValueTypeI32)),
+				wasmInstructionOf(operators.I32Const, int32(-1)),
+				wasmInstructionOf(operators.Else),
+				wasmInstructionOf(operators.GetLocal, local),
+				instruction,
+				wasmInstructionOf(operators.End),
+			)
+		}
+		if len(result) == len(instructions) {
+			continue
+		}
+		if function.Body.Code, err = disasm.Assemble(result); err != nil {
+			return err
+		}
+		function.Body.Locals = append(function.Body.Locals, wasm.LocalEntry{Count: 1, Type: wasm.ValueTypeI32})
+	}
+	return nil
+}
+
+func wasmInstructionOf(code byte, immediates ...interface{}) disasm.Instr {
+	// The codes are all known, so there are no errors.
+	op, _ := operators.New(code)
+	return disasm.Instr{Op: op, Immediates: immediates}
+}
+
+// wasmWorker is one instance of the module which executes one body at a time.
+type wasmWorker struct {
+	rule     *ruleWasm
+	vm       *exec.VM
+	function int64
+	// initialMemory is the content of the memory after the module was instantiated.
+	initialMemory []byte
+
+	// action, input and output describe the current execution.
+	action *ruleReplaceAction
+	input  []byte
+	output *bytes.Buffer
+}
+
+func (instance *wasmWorker) execute(action *ruleReplaceAction, deadline time.Time, body []byte) ([]byte, error) {
+	instance.action, instance.input, instance.output = action, body, nil
+	defer func() {
+		instance.action, instance.input, instance.output = nil, nil, nil
+	}()
+
+	var timedOut int32
+	timer := time.AfterFunc(time.Until(deadline), func() {
+		atomic.StoreInt32(&timedOut, 1)
+		exec.NewProcess(instance.vm).Terminate()
+	})
+	result, err := instance.vm.ExecCode(instance.function)
+	// If the timer could not be stopped the worker could be terminated at any time from now on.
+	if !timer.Stop() || atomic.LoadInt32(&timedOut) != 0 {
+		return nil, errExecutionTimeout
+	}
+	if err != nil {
+		return nil, err
+	}
+	if code, _ := result.(uint32); code != 0 {
+		return nil, fmt.Errorf("function '%v' returned %d", instance.rule.function, int32(code))
+	}
+	if instance.output == nil {
+		return body, nil
+	}
+	return instance.output.Bytes(), nil
+}
+
+// reset restores the memory and the globals of the module to their state after it was
+// instantiated, so nothing of an execution is visible to the next one. It returns false if the
+// memory grew and the worker has to be instantiated again.
+func (instance *wasmWorker) reset() bool {
+	memory := instance.vm.Memory()
+	if len(memory) != len(instance.initialMemory) {
+		return false
+	}
+	copy(memory, instance.initialMemory)
+	instance.vm.Restart()
+	return true
+}
+
+// resolve provides the module with the functions of the filter.
+func (instance *wasmWorker) resolve(name string) (*wasm.Module, error) {
+	if name != wasmImportModule {
+		return nil, fmt.Errorf("unknown import module '%v'", name)
+	}
+	functions := map[string]interface{}{
+		"body_size":           instance.bodySize,
+		"body_read":           instance.bodyRead,
+		"body_write":          instance.bodyWrite,
+		"request_header":      instance.requestHeader,
+		"response_header":     instance.responseHeader,
+		"placeholder":         instance.placeholder,
+		"set_response_header": instance.setResponseHeader,
+		"log":                 instance.log,
+	}
+	names := make([]string, 0, len(functions))
+	for name := range functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := wasm.NewModule()
+	result.Types = &wasm.SectionTypes{Entries: make([]wasm.FunctionSig, len(names))}
+	result.Export = &wasm.SectionExports{Entries: map[string]wasm.ExportEntry{}}
+	for i, name := range names {
+		function := reflect.ValueOf(functions[name])
+		signature := &result.Types.Entries[i]
+		// The first argument is always the *exec.Process.
+		for j := 1; j < function.Type().NumIn(); j++ {
+			signature.ParamTypes = append(signature.ParamTypes, wasm.ValueTypeI32)
+		}
+		// The body is never executed but has to pass the verification of the module.
+		body := &wasm.FunctionBody{}
+		for j := 0; j < function.Type().NumOut(); j++ {
+			signature.ReturnTypes = append(signature.ReturnTypes, wasm.ValueTypeI32)
+			body.Code = []byte{operators.I32Const, 0}
+		}
+		result.FunctionIndexSpace = append(result.FunctionIndexSpace, wasm.Function{
+			Sig:  signature,
+			Host: function,
+			Body: body,
+		})
+		result.Export.Entries[name] = wasm.ExportEntry{
+			FieldStr: name,
+			Kind:     wasm.ExternalFunction,
+			Index:    uint32(i),
+		}
+	}
+	return result, nil
+}
+
+// memory returns the given range of the memory of the module. Ranges outside of the memory trap
+// the execution.
+func (instance *wasmWorker) memory(pointer int32, length int32) []byte {
+	memory := instance.vm.Memory()
+	if pointer < 0 || length < 0 || int64(pointer)+int64(length) > int64(len(memory)) {
+		panic(fmt.Errorf("out of bounds memory access at %d with length %d", pointer, length))
+	}
+	return memory[pointer : pointer+length]
+}
+
+// copyValue copies the given value into the memory if it fits into the given capacity and
+// returns its length.
+func (instance *wasmWorker) copyValue(value string, pointer int32, capacity int32) int32 {
+	if len(value) <= int(capacity) {
+		copy(instance.memory(pointer, int32(len(value))), value)
+	}
+	return int32(len(value))
+}
+
+func (instance *wasmWorker) responseHeaderOf() http.Header {
+	action := instance.action
+	if action.responseHeader == nil {
+		header := http.Header{}
+		action.responseHeader = &header
+	}
+	return *action.responseHeader
+}
+
+func (instance *wasmWorker) bodySize(_ *exec.Process) int32 {
+	return int32(len(instance.input))
+}
+
+func (instance *wasmWorker) bodyRead(_ *exec.Process, pointer int32, length int32, offset int32) int32 {
+	if offset < 0 || int(offset) > len(instance.input) {
+		panic(fmt.Errorf("body offset %d is out of range", offset))
+	}
+	if remaining := int32(len(instance.input) - int(offset)); length > remaining {
+		length = remaining
+	}
+	return int32(copy(instance.memory(pointer, length), instance.input[offset:]))
+}
+
+func (instance *wasmWorker) bodyWrite(_ *exec.Process, pointer int32, length int32) {
+	if instance.output == nil {
+		instance.output = new(bytes.Buffer)
+	}
+	content := instance.memory(pointer, length)
+	if instance.output.Len()+len(content) > maximumWasmBodySize {
+		panic(fmt.Errorf("body exceeds the limit of %d bytes", maximumWasmBodySize))
+	}
+	if reserve := instance.action.reserve; reserve != nil && !reserve(len(content)) {
+		panic(errTotalBufferExhausted)
+	}
+	instance.output.Write(content)
+}
+
+func (instance *wasmWorker) requestHeader(_ *exec.Process, namePointer int32, nameLength int32, valuePointer int32, valueCapacity int32) int32 {
+	name := http.CanonicalHeaderKey(string(instance.memory(namePointer, nameLength)))
+	values, ok := instance.action.request.Header[name]
+	if !ok || len(values) == 0 {
+		return -1
+	}
+	return instance.copyValue(values[0], valuePointer, valueCapacity)
+}
+
+func (instance *wasmWorker) responseHeader(_ *exec.Process, namePointer int32, nameLength int32, valuePointer int32, valueCapacity int32) int32 {
+	name := http.CanonicalHeaderKey(string(instance.memory(namePointer, nameLength)))
+	values, ok := instance.responseHeaderOf()[name]
+	if !ok || len(values) == 0 {
+		return -1
+	}
+	return instance.copyValue(values[0], valuePointer, valueCapacity)
+}
+
+func (instance *wasmWorker) placeholder(_ *exec.Process, namePointer int32, nameLength int32, valuePointer int32, valueCapacity int32) int32 {
+	value, ok := instance.action.contextValueBy(string(instance.memory(namePointer, nameLength)))
+	if !ok {
+		return -1
+	}
+	return instance.copyValue(value, valuePointer, valueCapacity)
+}
+
+func (instance *wasmWorker) setResponseHeader(_ *exec.Process, namePointer int32, nameLength int32, valuePointer int32, valueLength int32) {
+	header := instance.responseHeaderOf()
+	name := string(instance.memory(namePointer, nameLength))
+	if valueLength < 0 {
+		header.Del(name)
+	} else {
+		header.Set(name, string(instance.memory(valuePointer, valueLength)))
+	}
+}
+
+func (instance *wasmWorker) log(_ *exec.Process, pointer int32, length int32) {
+	log.Printf("[INFO] Filter wasm '%v': %s", instance.rule.name, instance.memory(pointer, length))
+}
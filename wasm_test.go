@@ -0,0 +1,152 @@
+package filter
+
+import (
+	"bytes"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type wasmTest struct{}
+
+func init() {
+	Suite(&wasmTest{})
+}
+
+func (s *wasmTest) newRule(c *C, function string) *rule {
+	source, err := ioutil.ReadFile("resources/test/wasm/filter.wasm")
+	c.Assert(err, IsNil)
+	result := &ruleWasm{name: "filter.wasm", source: source, function: function, workers: 2, maximumMemory: defaultWasmMaximumMemory}
+	c.Assert(result.load(), IsNil)
+	return &rule{wasm: result}
+}
+
+func (s *wasmTest) execute(c *C, r *rule, header http.Header, input string) (string, int, error) {
+	execution := &ruleExecution{
+		request: &http.Request{
+			Host:   "example.org",
+			URL:    &url.URL{Path: "/a"},
+			Header: http.Header{"X-Tenant": []string{"acme"}},
+		},
+		responseHeader: &header,
+	}
+	result, replacements, err := r.execute(execution, []byte(input), new(bytes.Buffer))
+	return string(result), replacements, err
+}
+
+func (s *wasmTest) Test_run(c *C) {
+	r := s.newRule(c, defaultWasmFunction)
+	for i := 0; i < 3; i++ {
+		header := http.Header{}
+		result, replacements, err := s.execute(c, r, header, "<p>Hello world!</p>")
+		c.Assert(err, IsNil)
+		c.Assert(result, Equals, "<P>HELLO WORLD!</P>")
+		c.Assert(replacements, Equals, 1)
+		c.Assert(header, DeepEquals, http.Header{"X-Path": []string{"/a"}, "X-Tenant": []string{"acme"}})
+	}
+}
+
+func (s *wasmTest) Test_run_failures(c *C) {
+	for _, function := range []string{"fail", "grow"} {
+		r := s.newRule(c, function)
+		result, replacements, err := s.execute(c, r, http.Header{}, "foo")
+		c.Assert(err, IsNil)
+		c.Assert(result, Equals, "foo")
+		c.Assert(replacements, Equals, 0)
+	}
+}
+
+func (s *wasmTest) Test_run_memoryLimit(c *C) {
+	r := s.newRule(c, "grow")
+	request := &http.Request{URL: &url.URL{Path: "/a"}}
+	started := time.Now()
+	for pages, expected := range map[int]string{
+		255:   "function 'grow' returned 1",
+		256:   "function 'grow' returned -1",
+		65536: "function 'grow' returned -1",
+	} {
+		_, err := r.wasm.run(&ruleReplaceAction{request: request}, time.Time{}, make([]byte, pages))
+		c.Assert(err, ErrorMatches, expected)
+	}
+	c.Assert(time.Since(started) < time.Second, Equals, true)
+}
+
+func (s *wasmTest) Test_run_reservesOutput(c *C) {
+	r := s.newRule(c, defaultWasmFunction)
+	var reserved []int
+	execution := &ruleExecution{
+		request:        &http.Request{URL: &url.URL{Path: "/a"}, Header: http.Header{}},
+		responseHeader: &http.Header{},
+		reserve: func(n int) bool {
+			reserved = append(reserved, n)
+			return len(reserved) <= 1
+		},
+	}
+	result, replacements, err := r.execute(execution, []byte("hello"), new(bytes.Buffer))
+	c.Assert(err, IsNil)
+	c.Assert(string(result), Equals, "HELLO")
+	c.Assert(replacements, Equals, 1)
+	c.Assert(reserved, DeepEquals, []int{5})
+
+	result, replacements, err = r.execute(execution, []byte("hello"), new(bytes.Buffer))
+	c.Assert(err, Equals, errTotalBufferExhausted)
+	c.Assert(string(result), Equals, "hello")
+	c.Assert(replacements, Equals, 0)
+}
+
+func (s *wasmTest) Test_run_memoryIsReset(c *C) {
+	source, err := ioutil.ReadFile("resources/test/wasm/filter.wasm")
+	c.Assert(err, IsNil)
+	r := &rule{wasm: &ruleWasm{name: "filter.wasm", source: source, function: "leak", workers: 1, maximumMemory: defaultWasmMaximumMemory}}
+	c.Assert(r.wasm.load(), IsNil)
+	for i := 0; i < 2; i++ {
+		result, _, err := s.execute(c, r, http.Header{}, "secret-body-1234")
+		c.Assert(err, IsNil)
+		c.Assert(result, Equals, string(make([]byte, 16)))
+	}
+}
+
+func (s *wasmTest) Test_run_timeout(c *C) {
+	r := s.newRule(c, "loop")
+	r.timeout = 10 * time.Millisecond
+	result, replacements, err := s.execute(c, r, http.Header{}, "foo")
+	c.Assert(err, Equals, errExecutionTimeout)
+	c.Assert(result, Equals, "foo")
+	c.Assert(replacements, Equals, 0)
+
+	// The worker which timed out is replaced by a new one.
+	r.wasm.function = defaultWasmFunction
+	result, _, err = s.execute(c, r, http.Header{}, "foo")
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, "FOO")
+}
+
+func (s *wasmTest) Test_run_shadowModeKeepsHeaders(c *C) {
+	r := s.newRule(c, defaultWasmFunction)
+	r.mode = ruleModeShadow
+	header := http.Header{}
+	result, replacements, err := s.execute(c, r, header, "foo")
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, "FOO")
+	c.Assert(replacements, Equals, 1)
+	c.Assert(header, DeepEquals, http.Header{})
+}
+
+func (s *wasmTest) Test_load(c *C) {
+	source, err := ioutil.ReadFile("resources/test/wasm/filter.wasm")
+	c.Assert(err, IsNil)
+
+	r := &ruleWasm{source: source, function: "missing", workers: 1, maximumMemory: defaultWasmMaximumMemory}
+	c.Assert(r.load(), ErrorMatches, "there is no exported function 'missing'")
+
+	r = &ruleWasm{source: source, function: "memory", workers: 1, maximumMemory: defaultWasmMaximumMemory}
+	c.Assert(r.load(), ErrorMatches, "there is no exported function 'memory'")
+
+	r = &ruleWasm{source: source, function: defaultWasmFunction, workers: 1, maximumMemory: 1024}
+	c.Assert(r.load(), ErrorMatches, "initial memory exceeds the limit of 1024 bytes")
+
+	r = &ruleWasm{source: []byte("foo"), function: defaultWasmFunction, workers: 1, maximumMemory: defaultWasmMaximumMemory}
+	c.Assert(r.load(), NotNil)
+}
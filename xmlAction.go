@@ -0,0 +1,222 @@
+package filter
+
+import (
+	"bytes"
+	"encoding/xml"
+	"mime"
+	"regexp"
+	"strings"
+
+	"github.com/antchfx/xpath"
+)
+
+var xmlAttributePathPattern = regexp.MustCompile(`^(.*)/@([a-zA-Z_][a-zA-Z0-9_.\-]*(?::[a-zA-Z_][a-zA-Z0-9_.\-]*)?)$`)
+
+type xmlActionKind string
+
+const (
+	xmlActionSet    = xmlActionKind("xml_set")
+	xmlActionDelete = xmlActionKind("xml_delete")
+	xmlActionInsert = xmlActionKind("xml_insert")
+)
+
+type xmlInsertPosition string
+
+const (
+	xmlInsertBefore  = xmlInsertPosition("before")
+	xmlInsertAfter   = xmlInsertPosition("after")
+	xmlInsertPrepend = xmlInsertPosition("prepend")
+	xmlInsertAppend  = xmlInsertPosition("append")
+)
+
+var possibleXmlInsertPositions = []xmlInsertPosition{
+	xmlInsertBefore,
+	xmlInsertAfter,
+	xmlInsertPrepend,
+	xmlInsertAppend,
+}
+
+// xmlAction modifies all nodes of a document selected by an XPath expression.
+type xmlAction struct {
+	kind xmlActionKind
+	path *xpath.Expr
+	// elementPath selects the elements of the attribute of path if it ends with '/@<name>'
+	// which allows 'xml_set' to create missing attributes like namespace declarations.
+	elementPath *xpath.Expr
+	attribute   xml.Name
+	// pattern restricts 'xml_set' to the matches inside of the current value; could be nil.
+	pattern *regexp.Regexp
+	// value is the replacement of 'xml_set' or the fragment of 'xml_insert'. Both could contain placeholders.
+	value    []byte
+	position xmlInsertPosition
+}
+
+// xmlTarget is one node selected by an action; attribute is nil if the node itself is selected.
+type xmlTarget struct {
+	node      *xmlNode
+	attribute *xml.Name
+}
+
+func newXmlAction(kind xmlActionKind, path string) (*xmlAction, error) {
+	expr, err := xpath.Compile(path)
+	if err != nil {
+		return nil, err
+	}
+	result := &xmlAction{kind: kind, path: expr}
+	if groups := xmlAttributePathPattern.FindStringSubmatch(path); kind == xmlActionSet && groups != nil {
+		elementPath := groups[1]
+		if elementPath == "" {
+			elementPath = "."
+		}
+		if result.elementPath, err = xpath.Compile(elementPath); err != nil {
+			return nil, err
+		}
+		result.attribute = xmlNameOf(groups[2])
+	}
+	return result, nil
+}
+
+func xmlNameOf(qualifiedName string) xml.Name {
+	if i := strings.IndexByte(qualifiedName, ':'); i >= 0 {
+		return xml.Name{Space: qualifiedName[:i], Local: qualifiedName[i+1:]}
+	}
+	return xml.Name{Local: qualifiedName}
+}
+
+func (instance *xmlAction) targetsOf(document *xmlNode) []xmlTarget {
+	var result []xmlTarget
+	if instance.elementPath != nil {
+		iterator := instance.elementPath.Select(newXmlNavigator(document))
+		for iterator.MoveNext() {
+			if current := iterator.Current().(*xmlNavigator); current.attribute < 0 && current.node.kind == xmlElementNode {
+				result = append(result, xmlTarget{node: current.node, attribute: &instance.attribute})
+			}
+		}
+		return result
+	}
+	iterator := instance.path.Select(newXmlNavigator(document))
+	for iterator.MoveNext() {
+		current := iterator.Current().(*xmlNavigator)
+		target := xmlTarget{node: current.node}
+		if current.attribute >= 0 {
+			name := current.node.attributes[current.attribute].Name
+			target.attribute = &name
+		} else if current.node.kind == xmlDocumentNode {
+			continue
+		}
+		result = append(result, target)
+	}
+	return result
+}
+
+// apply executes the action on the given document and returns the number of modified nodes.
+func (instance *xmlAction) apply(action *ruleReplaceAction, document *xmlNode) (int, error) {
+	// All targets are collected before because modifications could confuse the evaluation.
+	targets := instance.targetsOf(document)
+	for _, target := range targets {
+		switch instance.kind {
+		case xmlActionSet:
+			instance.set(action, target)
+		case xmlActionDelete:
+			if target.attribute != nil {
+				target.node.removeAttribute(*target.attribute)
+			} else {
+				target.node.remove()
+			}
+		case xmlActionInsert:
+			if err := instance.insert(action, target); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(targets), nil
+}
+
+func (instance *xmlAction) set(action *ruleReplaceAction, target xmlTarget) {
+	var current string
+	if target.attribute != nil {
+		if i := target.node.attributeIndexOf(*target.attribute); i >= 0 {
+			current = target.node.attributes[i].Value
+		}
+	} else {
+		current = target.node.value()
+	}
+	value := instance.resolve(action, current)
+	if target.attribute != nil {
+		target.node.setAttribute(*target.attribute, value)
+	} else {
+		target.node.setText(value)
+	}
+}
+
+// resolve returns the new value of the given one. Without a pattern the whole value is
+// replaced and is available as group {0}.
+func (instance *xmlAction) resolve(action *ruleReplaceAction, current string) string {
+	action.replacement = instance.value
+	action.placeholders = nil
+	if instance.pattern != nil {
+		return replaceAllString(instance.pattern, current, action.writeResolved)
+	}
+	output := new(bytes.Buffer)
+	action.writeResolved(output, []byte(current), []int{0, len(current)})
+	return output.String()
+}
+
+func (instance *xmlAction) insert(action *ruleReplaceAction, target xmlTarget) error {
+	if target.attribute != nil || (target.node.kind != xmlElementNode && (instance.position == xmlInsertPrepend || instance.position == xmlInsertAppend)) {
+		return nil
+	}
+	nodes, err := parseXmlFragment([]byte(instance.resolve(action, "")))
+	if err != nil {
+		return err
+	}
+	node := target.node
+	switch instance.position {
+	case xmlInsertBefore:
+		node.parent.insert(node.indexInParent(), nodes)
+	case xmlInsertAfter:
+		node.parent.insert(node.indexInParent()+1, nodes)
+	case xmlInsertPrepend:
+		node.insert(0, nodes)
+	default:
+		node.insert(len(node.children), nodes)
+	}
+	return nil
+}
+
+// ruleXml executes the actions 'xml_set', 'xml_delete' and 'xml_insert' in the order of
+// their definition on responses with a XML content type.
+type ruleXml struct {
+	actions []*xmlAction
+}
+
+// apply returns the modified document and the number of modified nodes. If nothing was
+// modified or the content type is not XML the input itself is returned.
+func (instance *ruleXml) apply(action *ruleReplaceAction, input []byte, output *bytes.Buffer) ([]byte, int, error) {
+	if action.responseHeader == nil {
+		return input, 0, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(action.responseHeader.Get("Content-Type"))
+	if err != nil || !isXmlMediaType(mediaType) {
+		return input, 0, nil
+	}
+	document, err := parseXmlDocument(input)
+	if err != nil {
+		return input, 0, err
+	}
+	modifications := 0
+	for _, candidate := range instance.actions {
+		modified, err := candidate.apply(action, document)
+		if err != nil {
+			return input, 0, err
+		}
+		modifications += modified
+	}
+	if modifications <= 0 {
+		return input, 0, nil
+	}
+	output.Reset()
+	output.Grow(len(input))
+	document.writeTo(output)
+	return output.Bytes(), modifications, nil
+}
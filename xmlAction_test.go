@@ -0,0 +1,91 @@
+package filter
+
+import (
+	"bytes"
+	. "gopkg.in/check.v1"
+	"net/http"
+	"net/url"
+	"regexp"
+)
+
+type xmlActionTest struct{}
+
+func init() {
+	Suite(&xmlActionTest{})
+}
+
+func (s *xmlActionTest) newAction(c *C, kind xmlActionKind, path string, value string) *xmlAction {
+	result, err := newXmlAction(kind, path)
+	c.Assert(err, IsNil)
+	result.value = []byte(value)
+	result.position = xmlInsertAppend
+	return result
+}
+
+func (s *xmlActionTest) apply(c *C, contentType string, input string, actions ...*xmlAction) (string, int) {
+	r := &rule{xml: &ruleXml{actions: actions}}
+	execution := &ruleExecution{
+		request:        &http.Request{Host: "example.org", URL: &url.URL{Path: "/feed"}},
+		responseHeader: &http.Header{"Content-Type": []string{contentType}},
+	}
+	result, modifications, err := r.execute(execution, []byte(input), new(bytes.Buffer))
+	c.Assert(err, IsNil)
+	return string(result), modifications
+}
+
+func (s *xmlActionTest) Test_set(c *C) {
+	linkHost := s.newAction(c, xmlActionSet, "//item/link", "https://{request_host}{1}")
+	linkHost.pattern = regexp.MustCompile("^https?://[^/]+(.*)$")
+	result, modifications := s.apply(c, "application/rss+xml",
+		"<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<rss><channel><title>A &amp; B</title>"+
+			"<item><link>http://backend:8080/1</link></item><item><link>http://backend:8080/2</link></item></channel></rss>",
+		linkHost,
+		s.newAction(c, xmlActionSet, "/rss/@xmlns:media", "http://search.yahoo.com/mrss/"),
+		s.newAction(c, xmlActionSet, "//channel/title", "[{0}]"),
+	)
+	c.Assert(result, Equals, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<rss xmlns:media=\"http://search.yahoo.com/mrss/\"><channel><title>[A &amp; B]</title>"+
+		"<item><link>https://example.org/1</link></item><item><link>https://example.org/2</link></item></channel></rss>")
+	c.Assert(modifications, Equals, 4)
+}
+
+func (s *xmlActionTest) Test_delete(c *C) {
+	result, modifications := s.apply(c, "text/xml",
+		"<urlset>\n  <url><loc>/a</loc></url>\n  <url private=\"true\"><loc>/b</loc></url>\n  <url x=\"1\"><loc>/c</loc></url>\n</urlset>",
+		s.newAction(c, xmlActionDelete, "//url[@private='true']", ""),
+		s.newAction(c, xmlActionDelete, "//url/@x", ""),
+	)
+	c.Assert(result, Equals, "<urlset>\n  <url><loc>/a</loc></url>\n  \n  <url><loc>/c</loc></url>\n</urlset>")
+	c.Assert(modifications, Equals, 2)
+}
+
+func (s *xmlActionTest) Test_insert(c *C) {
+	insert := func(path string, position xmlInsertPosition, value string) *xmlAction {
+		result := s.newAction(c, xmlActionInsert, path, value)
+		result.position = position
+		return result
+	}
+	result, modifications := s.apply(c, "application/soap+xml",
+		"<s:Envelope><s:Header/><s:Body><r>1</r></s:Body></s:Envelope>",
+		insert("//s:Header", xmlInsertAppend, "<h>{request_path}</h>"),
+		insert("//r", xmlInsertBefore, "<before/>"),
+		insert("//r", xmlInsertAfter, "<after/>"),
+		insert("//s:Body", xmlInsertPrepend, "<!-- first -->"),
+	)
+	c.Assert(result, Equals, "<s:Envelope><s:Header><h>/feed</h></s:Header><s:Body><!-- first --><before/><r>1</r><after/></s:Body></s:Envelope>")
+	c.Assert(modifications, Equals, 4)
+}
+
+func (s *xmlActionTest) Test_unchanged(c *C) {
+	input := "<a><b/></a>"
+	result, modifications := s.apply(c, "text/html", input, s.newAction(c, xmlActionDelete, "//b", ""))
+	c.Assert(result, Equals, input)
+	c.Assert(modifications, Equals, 0)
+
+	result, modifications = s.apply(c, "application/xml", input, s.newAction(c, xmlActionDelete, "//c", ""))
+	c.Assert(result, Equals, input)
+	c.Assert(modifications, Equals, 0)
+
+	result, modifications = s.apply(c, "application/xml", "<a><b></a>", s.newAction(c, xmlActionDelete, "//b", ""))
+	c.Assert(result, Equals, "<a><b></a>")
+	c.Assert(modifications, Equals, 0)
+}
@@ -0,0 +1,413 @@
+package filter
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+
+	"github.com/antchfx/xpath"
+)
+
+type xmlNodeKind int
+
+const (
+	xmlDocumentNode xmlNodeKind = iota
+	xmlElementNode
+	xmlTextNode
+	xmlCommentNode
+	// xmlOtherNode are processing instructions (like the XML declaration) and directives.
+	xmlOtherNode
+)
+
+// xmlNode is a node of a parsed document which remembers its original bytes. Only modified
+// nodes are serialized again; everything else - like the XML declaration, entities or the
+// formatting of tags - is written as it was.
+type xmlNode struct {
+	kind     xmlNodeKind
+	parent   *xmlNode
+	children []*xmlNode
+	// raw contains the original bytes of the node or the start tag of an element.
+	raw []byte
+	// rawEnd contains the original end tag of an element; it is empty for self-closing elements.
+	rawEnd     []byte
+	name       xml.Name
+	attributes []xml.Attr
+	// text is the decoded content of text and comment nodes.
+	text string
+	// modified nodes are serialized from name, attributes and text instead of raw.
+	modified bool
+}
+
+var utf8ByteOrderMark = []byte{0xEF, 0xBB, 0xBF}
+
+// parseXmlDocument parses the given UTF-8 encoded document. The declared encoding is ignored
+// because the body was already decoded by its detected charset.
+func parseXmlDocument(content []byte) (*xmlNode, error) {
+	document := &xmlNode{kind: xmlDocumentNode}
+	if bytes.HasPrefix(content, utf8ByteOrderMark) {
+		document.raw = utf8ByteOrderMark
+		content = content[len(utf8ByteOrderMark):]
+	}
+	return document, parseXmlNodesInto(document, content)
+}
+
+// parseXmlFragment parses the given content which could contain multiple nodes on top level.
+func parseXmlFragment(content []byte) ([]*xmlNode, error) {
+	wrapper := &xmlNode{kind: xmlDocumentNode}
+	wrapped := append(append([]byte("<fragment>"), content...), []byte("</fragment>")...)
+	if err := parseXmlNodesInto(wrapper, wrapped); err != nil {
+		return nil, err
+	}
+	result := wrapper.children[0].children
+	for _, node := range result {
+		node.parent = nil
+	}
+	return result, nil
+}
+
+func parseXmlNodesInto(document *xmlNode, content []byte) error {
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	decoder.CharsetReader = func(_ string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	current := document
+	start := decoder.InputOffset()
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		end := decoder.InputOffset()
+		raw := content[start:end]
+		start = end
+		switch t := token.(type) {
+		case xml.StartElement:
+			element := &xmlNode{kind: xmlElementNode, raw: raw, name: t.Name, attributes: t.Copy().Attr}
+			current.appendChild(element)
+			current = element
+		case xml.EndElement:
+			if current.kind != xmlElementNode || current.name != t.Name {
+				return &xml.SyntaxError{Msg: "unexpected end element </" + qualifiedXmlNameOf(t.Name) + ">"}
+			}
+			current.rawEnd = raw
+			current = current.parent
+		case xml.CharData:
+			current.appendChild(&xmlNode{kind: xmlTextNode, raw: raw, text: string(t)})
+		case xml.Comment:
+			current.appendChild(&xmlNode{kind: xmlCommentNode, raw: raw, text: string(t)})
+		default:
+			current.appendChild(&xmlNode{kind: xmlOtherNode, raw: raw})
+		}
+	}
+	if current != document {
+		return &xml.SyntaxError{Msg: "unexpected end of document"}
+	}
+	return nil
+}
+
+func (instance *xmlNode) appendChild(child *xmlNode) {
+	child.parent = instance
+	instance.children = append(instance.children, child)
+}
+
+func (instance *xmlNode) indexInParent() int {
+	for i, candidate := range instance.parent.children {
+		if candidate == instance {
+			return i
+		}
+	}
+	return -1
+}
+
+// insert adds the given nodes at the given index of the children.
+func (instance *xmlNode) insert(index int, nodes []*xmlNode) {
+	children := make([]*xmlNode, 0, len(instance.children)+len(nodes))
+	children = append(children, instance.children[:index]...)
+	for _, node := range nodes {
+		node.parent = instance
+		children = append(children, node)
+	}
+	instance.children = append(children, instance.children[index:]...)
+	if instance.kind == xmlElementNode && len(instance.rawEnd) <= 0 {
+		// A self-closing element needs a new start and end tag.
+		instance.modified = true
+	}
+}
+
+func (instance *xmlNode) remove() {
+	if index := instance.indexInParent(); index >= 0 {
+		parent := instance.parent
+		parent.children = append(parent.children[:index], parent.children[index+1:]...)
+	}
+	instance.parent = nil
+}
+
+// setText replaces the content of the node with the given text.
+func (instance *xmlNode) setText(text string) {
+	switch instance.kind {
+	case xmlElementNode:
+		instance.children = nil
+		instance.insert(0, []*xmlNode{{kind: xmlTextNode, text: text, modified: true}})
+	case xmlTextNode, xmlCommentNode:
+		instance.text = text
+		instance.modified = true
+	}
+}
+
+func (instance *xmlNode) attributeIndexOf(name xml.Name) int {
+	for i, attribute := range instance.attributes {
+		if attribute.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (instance *xmlNode) setAttribute(name xml.Name, value string) {
+	if i := instance.attributeIndexOf(name); i >= 0 {
+		instance.attributes[i].Value = value
+	} else {
+		instance.attributes = append(instance.attributes, xml.Attr{Name: name, Value: value})
+	}
+	instance.modified = true
+}
+
+func (instance *xmlNode) removeAttribute(name xml.Name) {
+	if i := instance.attributeIndexOf(name); i >= 0 {
+		instance.attributes = append(instance.attributes[:i], instance.attributes[i+1:]...)
+		instance.modified = true
+	}
+}
+
+// value returns the string value of the node like defined by XPath.
+func (instance *xmlNode) value() string {
+	switch instance.kind {
+	case xmlTextNode, xmlCommentNode:
+		return instance.text
+	case xmlOtherNode:
+		return ""
+	}
+	buffer := new(bytes.Buffer)
+	var collect func(node *xmlNode)
+	collect = func(node *xmlNode) {
+		for _, child := range node.children {
+			if child.kind == xmlTextNode {
+				buffer.WriteString(child.text)
+			} else if child.kind == xmlElementNode {
+				collect(child)
+			}
+		}
+	}
+	collect(instance)
+	return buffer.String()
+}
+
+func (instance *xmlNode) writeTo(output *bytes.Buffer) {
+	switch instance.kind {
+	case xmlDocumentNode:
+		output.Write(instance.raw)
+		instance.writeChildrenTo(output)
+	case xmlElementNode:
+		if !instance.modified {
+			output.Write(instance.raw)
+			instance.writeChildrenTo(output)
+			output.Write(instance.rawEnd)
+			return
+		}
+		output.WriteString("<" + qualifiedXmlNameOf(instance.name))
+		for _, attribute := range instance.attributes {
+			output.WriteString(" " + qualifiedXmlNameOf(attribute.Name) + "=\"")
+			xml.EscapeText(output, []byte(attribute.Value))
+			output.WriteString("\"")
+		}
+		if len(instance.children) <= 0 && len(instance.rawEnd) <= 0 {
+			output.WriteString("/>")
+			return
+		}
+		output.WriteString(">")
+		instance.writeChildrenTo(output)
+		if len(instance.rawEnd) > 0 {
+			output.Write(instance.rawEnd)
+		} else {
+			output.WriteString("</" + qualifiedXmlNameOf(instance.name) + ">")
+		}
+	case xmlTextNode:
+		if instance.modified {
+			xml.EscapeText(output, []byte(instance.text))
+		} else {
+			output.Write(instance.raw)
+		}
+	case xmlCommentNode:
+		if instance.modified {
+			output.WriteString("<!--" + instance.text + "-->")
+		} else {
+			output.Write(instance.raw)
+		}
+	default:
+		output.Write(instance.raw)
+	}
+}
+
+func (instance *xmlNode) writeChildrenTo(output *bytes.Buffer) {
+	for _, child := range instance.children {
+		child.writeTo(output)
+	}
+}
+
+func qualifiedXmlNameOf(name xml.Name) string {
+	if name.Space != "" {
+		return name.Space + ":" + name.Local
+	}
+	return name.Local
+}
+
+// xmlNavigator walks through the nodes of a document for evaluating XPath expressions. Prefixes
+// of names are matched as written in the document - namespace URIs are not resolved.
+type xmlNavigator struct {
+	node *xmlNode
+	// attribute is the index of the current attribute of node or -1 if the node itself is current.
+	attribute int
+}
+
+func newXmlNavigator(node *xmlNode) *xmlNavigator {
+	return &xmlNavigator{node: node, attribute: -1}
+}
+
+func isNavigableXmlNode(node *xmlNode) bool {
+	return node.kind == xmlElementNode || node.kind == xmlTextNode || node.kind == xmlCommentNode
+}
+
+func (instance *xmlNavigator) NodeType() xpath.NodeType {
+	if instance.attribute >= 0 {
+		return xpath.AttributeNode
+	}
+	switch instance.node.kind {
+	case xmlDocumentNode:
+		return xpath.RootNode
+	case xmlTextNode:
+		return xpath.TextNode
+	case xmlCommentNode:
+		return xpath.CommentNode
+	}
+	return xpath.ElementNode
+}
+
+func (instance *xmlNavigator) LocalName() string {
+	if instance.attribute >= 0 {
+		return instance.node.attributes[instance.attribute].Name.Local
+	}
+	return instance.node.name.Local
+}
+
+func (instance *xmlNavigator) Prefix() string {
+	if instance.attribute >= 0 {
+		return instance.node.attributes[instance.attribute].Name.Space
+	}
+	return instance.node.name.Space
+}
+
+func (instance *xmlNavigator) Value() string {
+	if instance.attribute >= 0 {
+		return instance.node.attributes[instance.attribute].Value
+	}
+	return instance.node.value()
+}
+
+func (instance *xmlNavigator) Copy() xpath.NodeNavigator {
+	result := *instance
+	return &result
+}
+
+func (instance *xmlNavigator) MoveToRoot() {
+	for instance.node.parent != nil {
+		instance.node = instance.node.parent
+	}
+	instance.attribute = -1
+}
+
+func (instance *xmlNavigator) MoveToParent() bool {
+	if instance.attribute >= 0 {
+		instance.attribute = -1
+		return true
+	}
+	if instance.node.parent == nil {
+		return false
+	}
+	instance.node = instance.node.parent
+	return true
+}
+
+func (instance *xmlNavigator) MoveToNextAttribute() bool {
+	if instance.attribute+1 >= len(instance.node.attributes) {
+		return false
+	}
+	instance.attribute++
+	return true
+}
+
+func (instance *xmlNavigator) MoveToChild() bool {
+	if instance.attribute >= 0 {
+		return false
+	}
+	for _, child := range instance.node.children {
+		if isNavigableXmlNode(child) {
+			instance.node = child
+			return true
+		}
+	}
+	return false
+}
+
+func (instance *xmlNavigator) MoveToFirst() bool {
+	if instance.attribute >= 0 || instance.node.parent == nil {
+		return false
+	}
+	for _, sibling := range instance.node.parent.children {
+		if isNavigableXmlNode(sibling) {
+			instance.node = sibling
+			return true
+		}
+	}
+	return false
+}
+
+func (instance *xmlNavigator) MoveToNext() bool {
+	return instance.moveToSibling(1)
+}
+
+func (instance *xmlNavigator) MoveToPrevious() bool {
+	return instance.moveToSibling(-1)
+}
+
+func (instance *xmlNavigator) moveToSibling(direction int) bool {
+	if instance.attribute >= 0 || instance.node.parent == nil {
+		return false
+	}
+	siblings := instance.node.parent.children
+	for i := instance.node.indexInParent() + direction; i >= 0 && i < len(siblings); i += direction {
+		if isNavigableXmlNode(siblings[i]) {
+			instance.node = siblings[i]
+			return true
+		}
+	}
+	return false
+}
+
+func (instance *xmlNavigator) MoveTo(other xpath.NodeNavigator) bool {
+	if target, ok := other.(*xmlNavigator); ok && target.root() == instance.root() {
+		*instance = *target
+		return true
+	}
+	return false
+}
+
+func (instance *xmlNavigator) root() *xmlNode {
+	result := instance.node
+	for result.parent != nil {
+		result = result.parent
+	}
+	return result
+}
@@ -0,0 +1,65 @@
+package filter
+
+import (
+	"bytes"
+	"github.com/antchfx/xpath"
+	. "gopkg.in/check.v1"
+)
+
+type xmlDocumentTest struct{}
+
+func init() {
+	Suite(&xmlDocumentTest{})
+}
+
+func (s *xmlDocumentTest) serialize(node *xmlNode) string {
+	buffer := new(bytes.Buffer)
+	node.writeTo(buffer)
+	return buffer.String()
+}
+
+func (s *xmlDocumentTest) Test_parseXmlDocument_preservesOriginal(c *C) {
+	input := "\xEF\xBB\xBF<?xml version='1.0' encoding='ISO-8859-1'?>\n<!DOCTYPE rss>\n<rss  version = \"2.0\">\n  <!-- c --><a x='1' >&amp;&#169;<![CDATA[<b>]]></a><b/></rss>\n"
+	document, err := parseXmlDocument([]byte(input))
+	c.Assert(err, IsNil)
+	c.Assert(s.serialize(document), Equals, input)
+}
+
+func (s *xmlDocumentTest) Test_parseXmlDocument_invalid(c *C) {
+	_, err := parseXmlDocument([]byte("<a><b></a>"))
+	c.Assert(err, NotNil)
+	_, err = parseXmlDocument([]byte("<a>"))
+	c.Assert(err, NotNil)
+}
+
+func (s *xmlDocumentTest) Test_modifications(c *C) {
+	document, err := parseXmlDocument([]byte("<a x='1'><b>foo</b><c/><d>bar</d></a>"))
+	c.Assert(err, IsNil)
+	a := document.children[0]
+	a.setAttribute(xmlNameOf("xmlns:m"), "urn:m&")
+	a.children[0].setText("<new>")
+	fragment, err := parseXmlFragment([]byte("<e>1</e>text"))
+	c.Assert(err, IsNil)
+	a.children[1].insert(0, fragment)
+	a.children[2].remove()
+	c.Assert(s.serialize(document), Equals, "<a x=\"1\" xmlns:m=\"urn:m&amp;\"><b>&lt;new&gt;</b><c><e>1</e>text</c></a>")
+
+	a.removeAttribute(xmlNameOf("x"))
+	a.children[1].children = nil
+	c.Assert(s.serialize(document), Equals, "<a xmlns:m=\"urn:m&amp;\"><b>&lt;new&gt;</b><c/></a>")
+}
+
+func (s *xmlDocumentTest) Test_xmlNavigator(c *C) {
+	document, err := parseXmlDocument([]byte("<?xml version=\"1.0\"?><rss xmlns:atom=\"urn:atom\"><channel><atom:link href=\"a\"/><item><title>1</title></item><!-- c --><item><title>2</title></item></channel></rss>"))
+	c.Assert(err, IsNil)
+	evaluate := func(expression string) interface{} {
+		return xpath.MustCompile(expression).Evaluate(newXmlNavigator(document))
+	}
+	c.Assert(evaluate("count(//item)"), Equals, float64(2))
+	c.Assert(evaluate("string(//item[2]/title)"), Equals, "2")
+	c.Assert(evaluate("string(//atom:link/@href)"), Equals, "a")
+	c.Assert(evaluate("string(/rss/@xmlns:atom)"), Equals, "urn:atom")
+	c.Assert(evaluate("string(//item[1]/following-sibling::item/title)"), Equals, "2")
+	c.Assert(evaluate("string(//item[2]/preceding-sibling::comment())"), Equals, " c ")
+	c.Assert(evaluate("string(/rss)"), Equals, "12")
+}